@@ -17,8 +17,10 @@ type Backend interface {
 	Enable(name string, config *enginetypes.PluginEnableConfig) error
 	List(filters.Args) ([]enginetypes.Plugin, error)
 	Inspect(name string) (*enginetypes.Plugin, error)
+	Logs(name string, follow bool, tail int) (io.ReadCloser, error)
+	Stats(name string) (*enginetypes.PluginStats, error)
 	Remove(name string, config *enginetypes.PluginRmConfig) error
-	Set(name string, args []string) error
+	Set(name string, args []string, config *enginetypes.PluginSetConfig) error
 	Privileges(ctx context.Context, ref reference.Named, metaHeaders http.Header, authConfig *enginetypes.AuthConfig) (enginetypes.PluginPrivileges, error)
 	Pull(ctx context.Context, ref reference.Named, name string, metaHeaders http.Header, authConfig *enginetypes.AuthConfig, privileges enginetypes.PluginPrivileges, outStream io.Writer, opts ...plugin.CreateOpt) error
 	Push(ctx context.Context, name string, metaHeaders http.Header, authConfig *enginetypes.AuthConfig, outStream io.Writer) error
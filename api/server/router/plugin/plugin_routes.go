@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/server/httputils"
@@ -206,7 +207,9 @@ func (pr *pluginRouter) createPlugin(ctx context.Context, w http.ResponseWriter,
 	}
 
 	options := &types.PluginCreateOptions{
-		RepoName: r.FormValue("name")}
+		RepoName:      r.FormValue("name"),
+		RemoteContext: r.FormValue("remote"),
+	}
 
 	if err := pr.backend.CreateFromContext(ctx, r.Body, options); err != nil {
 		return err
@@ -226,7 +229,27 @@ func (pr *pluginRouter) enablePlugin(ctx context.Context, w http.ResponseWriter,
 	if err != nil {
 		return err
 	}
-	config := &types.PluginEnableConfig{Timeout: timeout}
+	config := &types.PluginEnableConfig{
+		Timeout:    timeout,
+		Entrypoint: r.Form["entrypoint"],
+		Args:       r.Form["args"],
+	}
+	config.RestartPolicy.Name = r.Form.Get("restartPolicy")
+	if v := r.Form.Get("restartMaxRetries"); v != "" {
+		if config.RestartPolicy.MaximumRetryCount, err = strconv.Atoi(v); err != nil {
+			return errdefs.InvalidParameter(errors.Wrap(err, "invalid restartMaxRetries"))
+		}
+	}
+	if v := r.Form.Get("memory"); v != "" {
+		if config.Resources.Memory, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return errdefs.InvalidParameter(errors.Wrap(err, "invalid memory"))
+		}
+	}
+	if v := r.Form.Get("nanoCpus"); v != "" {
+		if config.Resources.NanoCPUs, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return errdefs.InvalidParameter(errors.Wrap(err, "invalid nanoCpus"))
+		}
+	}
 
 	return pr.backend.Enable(name, config)
 }
@@ -240,6 +263,13 @@ func (pr *pluginRouter) disablePlugin(ctx context.Context, w http.ResponseWriter
 	config := &types.PluginDisableConfig{
 		ForceDisable: httputils.BoolValue(r, "force"),
 	}
+	if v := r.Form.Get("timeout"); v != "" {
+		timeout, err := strconv.Atoi(v)
+		if err != nil || timeout < 0 {
+			return errdefs.InvalidParameter(errors.Errorf("invalid timeout %q: must be a non-negative number of seconds", v))
+		}
+		config.Timeout = &timeout
+	}
 
 	return pr.backend.Disable(name, config)
 }
@@ -276,6 +306,14 @@ func (pr *pluginRouter) pushPlugin(ctx context.Context, w http.ResponseWriter, r
 }
 
 func (pr *pluginRouter) setPlugin(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+	config := &types.PluginSetConfig{
+		Restart:     httputils.BoolValue(r, "restart"),
+		SkipRestart: httputils.BoolValue(r, "skipRestart"),
+	}
+
 	var args []string
 	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
 		if err == io.EOF {
@@ -283,7 +321,7 @@ func (pr *pluginRouter) setPlugin(ctx context.Context, w http.ResponseWriter, r
 		}
 		return errdefs.InvalidParameter(err)
 	}
-	if err := pr.backend.Set(vars["name"], args); err != nil {
+	if err := pr.backend.Set(vars["name"], args, config); err != nil {
 		return err
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -306,6 +344,73 @@ func (pr *pluginRouter) listPlugins(ctx context.Context, w http.ResponseWriter,
 	return httputils.WriteJSON(w, http.StatusOK, l)
 }
 
+func (pr *pluginRouter) getPluginLogs(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	tail := -1
+	if v := r.Form.Get("tail"); v != "" && v != "all" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errdefs.InvalidParameter(errors.Errorf("invalid tail %q: must be a non-negative integer or \"all\"", v))
+		}
+		tail = n
+	}
+
+	logs, err := pr.backend.Logs(vars["name"], httputils.BoolValue(r, "follow"), tail)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	go func() {
+		<-ctx.Done()
+		logs.Close()
+	}()
+
+	output := ioutils.NewWriteFlusher(w)
+	defer output.Close()
+
+	w.Header().Set("Content-Type", "text/plain")
+	output.Flush()
+	io.Copy(output, logs)
+	return nil
+}
+
+func (pr *pluginRouter) getPluginStats(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	stats, err := pr.backend.Stats(vars["name"])
+	if err != nil {
+		return err
+	}
+	if !httputils.BoolValueOrDefault(r, "stream", true) {
+		return httputils.WriteJSON(w, http.StatusOK, stats)
+	}
+
+	// Like the stats of containers, the stats of the plugin are sent every
+	// second until the client goes away, or the plugin is disabled.
+	output := ioutils.NewWriteFlusher(w)
+	defer output.Close()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(output)
+	for {
+		if err := enc.Encode(stats); err != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+		if stats, err = pr.backend.Stats(vars["name"]); err != nil {
+			return nil
+		}
+	}
+}
+
 func (pr *pluginRouter) inspectPlugin(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	result, err := pr.backend.Inspect(vars["name"])
 	if err != nil {
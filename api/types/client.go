@@ -374,12 +374,17 @@ type PluginRemoveOptions struct {
 
 // PluginEnableOptions holds parameters to enable plugins.
 type PluginEnableOptions struct {
-	Timeout int
+	Timeout       int
+	Entrypoint    []string
+	Args          []string
+	RestartPolicy container.RestartPolicy
+	Resources     PluginResources
 }
 
 // PluginDisableOptions holds parameters to disable plugins.
 type PluginDisableOptions struct {
-	Force bool
+	Force   bool
+	Timeout *int
 }
 
 // PluginInstallOptions holds parameters to install a plugin.
@@ -403,4 +408,7 @@ type SwarmUnlockKeyResponse struct {
 // PluginCreateOptions hold all options to plugin create.
 type PluginCreateOptions struct {
 	RepoName string
+	// RemoteContext is the URL of a git repository or of a tar archive to
+	// create the plugin from, instead of the context sent with the request.
+	RemoteContext string
 }
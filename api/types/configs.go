@@ -49,11 +49,45 @@ type PluginRmConfig struct {
 // PluginEnableConfig holds arguments for plugin enable
 type PluginEnableConfig struct {
 	Timeout int
+	// Entrypoint and Args override the plugin's entrypoint and args until
+	// the plugin is disabled. They are not persisted.
+	Entrypoint []string
+	Args       []string
+	// RestartPolicy decides whether the plugin is restarted when it exits
+	// while enabled: "no", "always", or "on-failure" with an optional
+	// maximum retry count. It defaults to "always".
+	RestartPolicy container.RestartPolicy
+	// Resources are the resource limits of the plugin until it is disabled.
+	// Limits which are not set default to those of the daemon.
+	Resources PluginResources
+}
+
+// PluginResources holds the resource limits of a plugin.
+type PluginResources struct {
+	// Memory is the memory limit in bytes. 0 means no limit.
+	Memory int64
+	// NanoCPUs is the CPU quota in units of 10^-9 CPUs. 0 means no limit.
+	NanoCPUs int64
+}
+
+// PluginSetConfig holds arguments for plugin set.
+type PluginSetConfig struct {
+	// Restart disables an enabled plugin before applying the settings, and
+	// enables it again afterwards so that they take effect.
+	Restart bool
+	// SkipRestart applies the settings to an enabled plugin without
+	// restarting it, for settings that the plugin picks up lazily. They take
+	// effect the next time the plugin is enabled.
+	SkipRestart bool
 }
 
 // PluginDisableConfig holds arguments for plugin disable.
 type PluginDisableConfig struct {
 	ForceDisable bool
+	// Timeout is the number of seconds the plugin is given to exit after it
+	// is sent SIGTERM, before it is killed. It defaults to the stop timeout
+	// of the daemon, which is 10 seconds unless configured otherwise.
+	Timeout *int
 }
 
 // NetworkListConfig stores the options available for listing networks
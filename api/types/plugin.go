@@ -15,6 +15,12 @@ type Plugin struct {
 	// Required: true
 	Enabled bool `json:"Enabled"`
 
+	// True if the plugin was disabled because it kept exiting, or exited and its restart policy did not allow restarting it. It is reset when the plugin is enabled again.
+	Failed bool `json:"Failed,omitempty"`
+
+	// health
+	Health *PluginHealth `json:"Health,omitempty"`
+
 	// Id
 	ID string `json:"Id,omitempty"`
 
@@ -42,6 +48,11 @@ type PluginConfig struct {
 	// Required: true
 	Description string `json:"Description"`
 
+	// The names of the plugins this plugin depends on. The plugin can only
+	// be enabled once these plugins are enabled, and when the daemon
+	// starts, these plugins are restored before this one.
+	Dependencies []string `json:"Dependencies,omitempty"`
+
 	// Docker Version used to create the plugin
 	DockerVersion string `json:"DockerVersion,omitempty"`
 
@@ -57,6 +68,9 @@ type PluginConfig struct {
 	// Required: true
 	Env []PluginEnv `json:"Env"`
 
+	// health check
+	HealthCheck *PluginConfigHealthCheck `json:"HealthCheck,omitempty"`
+
 	// interface
 	// Required: true
 	Interface PluginConfigInterface `json:"Interface"`
@@ -117,6 +131,25 @@ type PluginConfigArgs struct {
 	Value []string `json:"Value"`
 }
 
+// PluginConfigHealthCheck A health check that is polled over the plugin socket while the plugin is enabled.
+// swagger:model PluginConfigHealthCheck
+type PluginConfigHealthCheck struct {
+
+	// The time to wait between checks in nanoseconds. 0 means the default of 30 seconds.
+	Interval int64 `json:"Interval,omitempty"`
+
+	// The HTTP path to request. The plugin is healthy if it responds
+	// with a 2xx status code, and a body other than `unhealthy`.
+	//
+	Path string `json:"Path,omitempty"`
+
+	// The number of consecutive failures needed to consider the plugin unhealthy. 0 means the default of 3.
+	Retries int64 `json:"Retries,omitempty"`
+
+	// The time to wait before considering a check to have hung in nanoseconds. 0 means the default of 10 seconds.
+	Timeout int64 `json:"Timeout,omitempty"`
+}
+
 // PluginConfigInterface The interface between Docker and the plugin
 // swagger:model PluginConfigInterface
 type PluginConfigInterface struct {
@@ -181,6 +214,21 @@ type PluginConfigUser struct {
 	UID uint32 `json:"UID,omitempty"`
 }
 
+// PluginHealth The health of the plugin, if its config declares a health check.
+// swagger:model PluginHealth
+type PluginHealth struct {
+
+	// FailingStreak is the number of consecutive failed health checks.
+	FailingStreak int64 `json:"FailingStreak,omitempty"`
+
+	// LastError is the error of the last failed health check, if the last check failed.
+	LastError string `json:"LastError,omitempty"`
+
+	// Status is one of `starting`, `healthy` or `unhealthy`.
+	//
+	Status string `json:"Status,omitempty"`
+}
+
 // PluginSettings Settings that can be modified by users.
 // swagger:model PluginSettings
 type PluginSettings struct {
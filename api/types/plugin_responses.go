@@ -9,6 +9,14 @@ import (
 // PluginsListResponse contains the response for the Engine API
 type PluginsListResponse []*Plugin
 
+// PluginStats is the resource usage of a plugin.
+type PluginStats struct {
+	Stats
+
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
 // UnmarshalJSON implements json.Unmarshaler for PluginInterfaceType
 func (t *PluginInterfaceType) UnmarshalJSON(p []byte) error {
 	versionIndex := len(p)
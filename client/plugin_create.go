@@ -16,6 +16,9 @@ func (cli *Client) PluginCreate(ctx context.Context, createContext io.Reader, cr
 
 	query := url.Values{}
 	query.Set("name", createOptions.RepoName)
+	if createOptions.RemoteContext != "" {
+		query.Set("remote", createOptions.RemoteContext)
+	}
 
 	resp, err := cli.postRaw(ctx, "/plugins/create", query, createContext, headers)
 	if err != nil {
@@ -3,6 +3,7 @@ package client // import "github.com/docker/docker/client"
 import (
 	"context"
 	"net/url"
+	"strconv"
 
 	"github.com/docker/docker/api/types"
 )
@@ -13,6 +14,9 @@ func (cli *Client) PluginDisable(ctx context.Context, name string, options types
 	if options.Force {
 		query.Set("force", "1")
 	}
+	if options.Timeout != nil {
+		query.Set("timeout", strconv.Itoa(*options.Timeout))
+	}
 	resp, err := cli.post(ctx, "/plugins/"+name+"/disable", query, nil, nil)
 	ensureReaderClosed(resp)
 	return err
@@ -12,6 +12,24 @@ import (
 func (cli *Client) PluginEnable(ctx context.Context, name string, options types.PluginEnableOptions) error {
 	query := url.Values{}
 	query.Set("timeout", strconv.Itoa(options.Timeout))
+	for _, e := range options.Entrypoint {
+		query.Add("entrypoint", e)
+	}
+	for _, a := range options.Args {
+		query.Add("args", a)
+	}
+	if options.RestartPolicy.Name != "" {
+		query.Set("restartPolicy", options.RestartPolicy.Name)
+	}
+	if options.RestartPolicy.MaximumRetryCount != 0 {
+		query.Set("restartMaxRetries", strconv.Itoa(options.RestartPolicy.MaximumRetryCount))
+	}
+	if options.Resources.Memory != 0 {
+		query.Set("memory", strconv.FormatInt(options.Resources.Memory, 10))
+	}
+	if options.Resources.NanoCPUs != 0 {
+		query.Set("nanoCpus", strconv.FormatInt(options.Resources.NanoCPUs, 10))
+	}
 
 	resp, err := cli.post(ctx, "/plugins/"+name+"/enable", query, nil, nil)
 	ensureReaderClosed(resp)
@@ -12,6 +12,8 @@ import (
 const (
 	// defaultShutdownTimeout is the default shutdown timeout for the daemon
 	defaultShutdownTimeout = 15
+	// defaultPluginStopTimeout is the default time plugins are given to exit
+	defaultPluginStopTimeout = 10
 	// defaultTrustKeyFile is the default filename for the trust key
 	defaultTrustKeyFile = "key.json"
 )
@@ -25,6 +27,9 @@ func installCommonConfigFlags(conf *config.Config, flags *pflag.FlagSet) {
 	flags.Var(opts.NewNamedListOptsRef("storage-opts", &conf.GraphOptions, nil), "storage-opt", "Storage driver options")
 	flags.Var(opts.NewNamedListOptsRef("authorization-plugins", &conf.AuthorizationPlugins, nil), "authorization-plugin", "Authorization plugins to load")
 	flags.Var(opts.NewNamedListOptsRef("exec-opts", &conf.ExecOptions, nil), "exec-opt", "Runtime execution options")
+	flags.Var(opts.NewNamedListOptsRef("allowed-plugins", &conf.AllowedPlugins, nil), "allowed-plugin", "Pattern of the plugin references which can be installed")
+	flags.Var(opts.NewNamedListOptsRef("denied-plugins", &conf.DeniedPlugins, nil), "denied-plugin", "Pattern of the plugin references which cannot be installed")
+	flags.Var(opts.NewNamedListOptsRef("plugin-readonly-roots", &conf.PluginReadOnlyRoots, nil), "plugin-readonly-root", "Read-only directory plugins are also loaded from")
 	flags.StringVarP(&conf.Pidfile, "pidfile", "p", defaultPidFile, "Path to use for daemon PID file")
 	flags.StringVarP(&conf.Root, "graph", "g", defaultDataRoot, "Root of the Docker runtime")
 	flags.StringVar(&conf.ExecRoot, "exec-root", defaultExecRoot, "Root directory for execution state files")
@@ -60,6 +65,14 @@ func installCommonConfigFlags(conf *config.Config, flags *pflag.FlagSet) {
 	flags.IntVar(&maxConcurrentDownloads, "max-concurrent-downloads", config.DefaultMaxConcurrentDownloads, "Set the max concurrent downloads for each pull")
 	flags.IntVar(&maxConcurrentUploads, "max-concurrent-uploads", config.DefaultMaxConcurrentUploads, "Set the max concurrent uploads for each push")
 	flags.IntVar(&conf.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "Set the default shutdown timeout")
+	flags.IntVar(&conf.PluginStopTimeout, "plugin-stop-timeout", defaultPluginStopTimeout, "Set the time in seconds plugins are given to exit when stopped")
+	flags.IntVar(&conf.PluginRestoreConcurrency, "plugin-restore-concurrency", 0, "Set the max number of plugins restored at the same time on startup (0 for GOMAXPROCS)")
+	flags.Var(&conf.PluginMemory, "plugin-memory", "Default memory limit of plugins")
+	flags.Float64Var(&conf.PluginCPUs, "plugin-cpus", 0, "Default number of CPUs of plugins")
+	flags.StringVar(&conf.PluginUmask, "plugin-umask", "", "Octal umask plugin processes are run with, such as 0027")
+	flags.StringVar(&conf.PluginHTTPProxy, "plugin-http-proxy", "", "HTTP proxy for plugin pulls, pushes and processes")
+	flags.StringVar(&conf.PluginHTTPSProxy, "plugin-https-proxy", "", "HTTPS proxy for plugin pulls, pushes and processes")
+	flags.StringVar(&conf.PluginNoProxy, "plugin-no-proxy", "", "Hosts which plugin pulls, pushes and processes do not use the proxy for")
 	flags.IntVar(&conf.NetworkDiagnosticPort, "network-diagnostic-port", 0, "TCP port number of the network diagnostic server")
 	flags.MarkHidden("network-diagnostic-port")
 
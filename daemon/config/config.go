@@ -171,6 +171,39 @@ type CommonConfig struct {
 	// to stop when daemon is being shutdown
 	ShutdownTimeout int `json:"shutdown-timeout,omitempty"`
 
+	// PluginStopTimeout is the time in seconds plugins are given to exit
+	// when they are stopped, before they are killed.
+	PluginStopTimeout int `json:"plugin-stop-timeout,omitempty"`
+
+	// PluginRestoreConcurrency is the maximum number of plugins restored at
+	// the same time when the daemon starts. 0 means GOMAXPROCS.
+	PluginRestoreConcurrency int `json:"plugin-restore-concurrency,omitempty"`
+
+	// AllowedPlugins, if set, are patterns of the only plugin references
+	// which can be installed. DeniedPlugins are patterns of plugin
+	// references which cannot be installed, even if they are allowed.
+	AllowedPlugins []string `json:"allowed-plugins,omitempty"`
+	DeniedPlugins  []string `json:"denied-plugins,omitempty"`
+
+	// PluginReadOnlyRoots are additional directories plugins are loaded from,
+	// which are never modified.
+	PluginReadOnlyRoots []string `json:"plugin-readonly-roots,omitempty"`
+
+	// PluginMemory and PluginCPUs are the default memory limit and number of
+	// CPUs of plugins, which can be overridden when a plugin is enabled.
+	PluginMemory opts.MemBytes `json:"plugin-memory,omitempty"`
+	PluginCPUs   float64       `json:"plugin-cpus,omitempty"`
+
+	// PluginUmask, if set, is the octal umask plugin processes are run with.
+	PluginUmask string `json:"plugin-umask,omitempty"`
+
+	// PluginHTTPProxy, PluginHTTPSProxy and PluginNoProxy are the proxy
+	// configuration used to pull and push plugins, which is also passed to
+	// plugin processes through their environment.
+	PluginHTTPProxy  string `json:"plugin-http-proxy,omitempty"`
+	PluginHTTPSProxy string `json:"plugin-https-proxy,omitempty"`
+	PluginNoProxy    string `json:"plugin-no-proxy,omitempty"`
+
 	Debug     bool     `json:"debug,omitempty"`
 	Hosts     []string `json:"hosts,omitempty"`
 	LogLevel  string   `json:"log-level,omitempty"`
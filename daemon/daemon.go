@@ -833,6 +833,21 @@ func NewDaemon(ctx context.Context, config *config.Config, pluginStore *plugin.S
 		LiveRestoreEnabled: config.LiveRestoreEnabled,
 		LogPluginEvent:     d.LogPluginEvent, // todo: make private
 		AuthzMiddleware:    config.AuthzMiddleware,
+		StopTimeout:        time.Duration(config.PluginStopTimeout) * time.Second,
+		RestoreConcurrency: config.PluginRestoreConcurrency,
+		AllowedPlugins:     config.AllowedPlugins,
+		DeniedPlugins:      config.DeniedPlugins,
+		ReadOnlyRoots:      config.PluginReadOnlyRoots,
+		Resources: types.PluginResources{
+			Memory:   config.PluginMemory.Value(),
+			NanoCPUs: int64(config.PluginCPUs * 1e9),
+		},
+		Umask: config.PluginUmask,
+		Proxy: plugin.ProxyConfig{
+			HTTPProxy:  config.PluginHTTPProxy,
+			HTTPSProxy: config.PluginHTTPSProxy,
+			NoProxy:    config.PluginNoProxy,
+		},
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "couldn't create plugin manager")
@@ -1076,6 +1091,23 @@ func (daemon *Daemon) ShutdownTimeout() int {
 	return shutdownTimeout
 }
 
+// pluginShutdownTimeout returns the time in seconds the plugins are given
+// to stop when the daemon shuts down, or -1 for no limit. Like
+// ShutdownTimeout, it is extended if needed so that plugins are given their
+// stop timeout, and a grace period to be killed.
+func (daemon *Daemon) pluginShutdownTimeout() int {
+	shutdownTimeout := daemon.configStore.ShutdownTimeout
+	if shutdownTimeout < 0 {
+		return -1
+	}
+
+	graceTimeout := 5
+	if stopTimeout := daemon.configStore.PluginStopTimeout; stopTimeout+graceTimeout > shutdownTimeout {
+		shutdownTimeout = stopTimeout + graceTimeout
+	}
+	return shutdownTimeout
+}
+
 // Shutdown stops the daemon.
 func (daemon *Daemon) Shutdown() error {
 	daemon.shutdown = true
@@ -1350,7 +1382,15 @@ func (daemon *Daemon) pluginShutdown() {
 	// Check for a valid manager object. In error conditions, daemon init can fail
 	// and shutdown called, before plugin manager is initialized.
 	if manager != nil {
-		manager.Shutdown()
+		ctx := context.Background()
+		if timeout := daemon.pluginShutdownTimeout(); timeout >= 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer cancel()
+		}
+		if err := manager.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Error("error shutting down plugins")
+		}
 	}
 }
 
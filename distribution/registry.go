@@ -78,6 +78,9 @@ func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, end
 		// TODO(dmcgowan): Call close idle connections when complete and use keep alive
 		DisableKeepAlives: true,
 	}
+	if endpoint.Proxy != nil {
+		base.Proxy = endpoint.Proxy
+	}
 
 	proxyDialer, err := sockets.DialerFromEnvironment(direct)
 	if err == nil {
@@ -66,7 +66,7 @@ func TestTagInvalidReference(t *testing.T) {
 
 	// test setting tag fails
 	err = client.ImageTag(ctx, "busybox:latest", "sha256:sometag")
-	assert.Check(t, is.ErrorContains(err, "refusing to create an ambiguous tag using digest algorithm as name"))
+	assert.Check(t, is.ErrorContains(err, "refusing to create an ambiguous tag using digest algorithm sha256 as name"))
 }
 
 // ensure we allow the use of valid tags
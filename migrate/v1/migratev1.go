@@ -297,12 +297,6 @@ func migrateRefs(root, driverName string, rs refAdder, mappings map[string]image
 		return err
 	}
 
-	type repositories struct {
-		Repositories map[string]map[string]string
-	}
-
-	var repos repositories
-
 	f, err := os.Open(filepath.Join(root, repositoriesFilePrefixLegacy+driverName))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -311,40 +305,25 @@ func migrateRefs(root, driverName string, rs refAdder, mappings map[string]image
 		return err
 	}
 	defer f.Close()
-	if err := json.NewDecoder(f).Decode(&repos); err != nil {
+	repos, err := refstore.ReadLegacyV1(f)
+	if err != nil {
 		return err
 	}
 
 	for name, repo := range repos.Repositories {
 		for tag, id := range repo {
 			if strongID, exists := mappings[id]; exists {
-				ref, err := reference.ParseNormalizedNamed(name)
+				ref, err := refstore.ParseLegacyV1Reference(name, tag)
 				if err != nil {
-					logrus.Errorf("migrate tags: invalid name %q, %q", name, err)
+					logrus.Errorf("migrate tags: invalid reference %q in %q, %q", tag, name, err)
 					continue
 				}
-				if !reference.IsNameOnly(ref) {
-					logrus.Errorf("migrate tags: invalid name %q, unexpected tag or digest", name)
-					continue
-				}
-				if dgst, err := digest.Parse(tag); err == nil {
-					canonical, err := reference.WithDigest(reference.TrimNamed(ref), dgst)
-					if err != nil {
-						logrus.Errorf("migrate tags: invalid digest %q, %q", dgst, err)
-						continue
-					}
+				if canonical, ok := ref.(reference.Canonical); ok {
 					if err := rs.AddDigest(canonical, strongID.Digest(), false); err != nil {
 						logrus.Errorf("can't migrate digest %q for %q, err: %q", reference.FamiliarString(ref), strongID, err)
 					}
-				} else {
-					tagRef, err := reference.WithTag(ref, tag)
-					if err != nil {
-						logrus.Errorf("migrate tags: invalid tag %q, %q", tag, err)
-						continue
-					}
-					if err := rs.AddTag(tagRef, strongID.Digest(), false); err != nil {
-						logrus.Errorf("can't migrate tag %q for %q, err: %q", reference.FamiliarString(ref), strongID, err)
-					}
+				} else if err := rs.AddTag(ref, strongID.Digest(), false); err != nil {
+					logrus.Errorf("can't migrate tag %q for %q, err: %q", reference.FamiliarString(ref), strongID, err)
 				}
 				logrus.Infof("migrated tag %s:%s to point to %s", name, tag, strongID)
 			}
@@ -38,17 +38,35 @@ func (m *Middleware) SetPlugins(names []string) {
 	m.mu.Unlock()
 }
 
-// RemovePlugin removes a single plugin from this authz middleware chain
-func (m *Middleware) RemovePlugin(name string) {
+// RemovePlugin removes a single plugin from this authz middleware chain, and
+// returns whether it was in the chain
+func (m *Middleware) RemovePlugin(name string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	removed := false
 	plugins := m.plugins[:0]
 	for _, authPlugin := range m.plugins {
 		if authPlugin.Name() != name {
 			plugins = append(plugins, authPlugin)
+		} else {
+			removed = true
 		}
 	}
 	m.plugins = plugins
+	return removed
+}
+
+// AddPlugin adds a single plugin to the end of this authz middleware chain,
+// unless it is already in the chain
+func (m *Middleware) AddPlugin(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, authPlugin := range m.plugins {
+		if authPlugin.Name() == name {
+			return
+		}
+	}
+	m.plugins = append(m.plugins, newAuthorizationPlugin(name))
 }
 
 // WrapHandler returns a new handler function wrapping the previous one in the request chain.
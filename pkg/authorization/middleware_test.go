@@ -20,6 +20,24 @@ func TestMiddleware(t *testing.T) {
 	assert.Equal(t, pluginNames[1], authPlugins[1].Name())
 }
 
+func TestMiddlewareRemoveAndAddPlugin(t *testing.T) {
+	var pluginGetter plugingetter.PluginGetter
+	m := NewMiddleware([]string{"testPlugin1", "testPlugin2"}, pluginGetter)
+
+	assert.Assert(t, m.RemovePlugin("testPlugin1"))
+	assert.Assert(t, !m.RemovePlugin("testPlugin1"))
+	authPlugins := m.getAuthzPlugins()
+	assert.Equal(t, 1, len(authPlugins))
+	assert.Equal(t, "testPlugin2", authPlugins[0].Name())
+
+	m.AddPlugin("testPlugin1")
+	m.AddPlugin("testPlugin2")
+	authPlugins = m.getAuthzPlugins()
+	assert.Equal(t, 2, len(authPlugins))
+	assert.Equal(t, "testPlugin2", authPlugins[0].Name())
+	assert.Equal(t, "testPlugin1", authPlugins[1].Name())
+}
+
 func TestNewResponseModifier(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	modifier := NewResponseModifier(recorder)
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
@@ -46,6 +47,15 @@ var acceptedPluginFilterTags = map[string]bool{
 
 // Disable deactivates a plugin. This means resources (volumes, networks) cant use them.
 func (pm *Manager) Disable(refOrID string, config *types.PluginDisableConfig) error {
+	pm.ops.acquire()
+	defer pm.ops.release()
+
+	return pm.disablePlugin(refOrID, config)
+}
+
+// disablePlugin is Disable, for callers which already hold a slot of the
+// operation limiter.
+func (pm *Manager) disablePlugin(refOrID string, config *types.PluginDisableConfig) error {
 	p, err := pm.config.Store.GetV2Plugin(refOrID)
 	if err != nil {
 		return err
@@ -64,30 +74,131 @@ func (pm *Manager) Disable(refOrID string, config *types.PluginDisableConfig) er
 		}
 	}
 
-	if err := pm.disable(p, c); err != nil {
+	timeout := pm.stopTimeout()
+	if config.Timeout != nil {
+		timeout = time.Duration(*config.Timeout) * time.Second
+	}
+	if err := pm.disable(p, c, timeout); err != nil {
 		return err
 	}
-	pm.publisher.Publish(EventDisable{Plugin: p.PluginObj})
+	pm.publisher.Publish(EventDisable{Plugin: p.Object(), Time: pm.clock().Now()})
 	pm.config.LogPluginEvent(p.GetID(), refOrID, "disable")
 	return nil
 }
 
+// Checkpoint saves the state of a running plugin to disk, and stops it. The
+// plugin is disabled, and is restored from the checkpoint, rather than
+// started from scratch, the next time it is enabled.
+func (pm *Manager) Checkpoint(refOrID string) error {
+	pm.ops.acquire()
+	defer pm.ops.release()
+
+	p, err := pm.config.Store.GetV2Plugin(refOrID)
+	if err != nil {
+		return err
+	}
+	if pm.isReadOnly(p.GetID()) {
+		return errors.Wrap(readOnlyError(p.Name()), "cannot checkpoint plugin")
+	}
+	pm.mu.RLock()
+	c := pm.cMap[p]
+	pm.mu.RUnlock()
+	if c == nil {
+		return errors.Wrap(errDisabled(p.Name()), "cannot checkpoint a disabled plugin")
+	}
+
+	if p.GetRefCount() > 0 {
+		return errors.WithStack(inUseError(p.Name()))
+	}
+
+	removedAuthz := false
+	for _, typ := range p.GetTypes() {
+		if typ.Capability == authorization.AuthZApiImplements {
+			removedAuthz = pm.config.AuthzMiddleware.RemovePlugin(p.Name())
+		}
+	}
+
+	if err := pm.checkpoint(p, c); err != nil {
+		// The plugin keeps running if it could not be checkpointed, so it
+		// keeps authorizing requests.
+		if removedAuthz && p.IsEnabled() {
+			pm.config.AuthzMiddleware.AddPlugin(p.Name())
+		}
+		return err
+	}
+	pm.publisher.Publish(EventDisable{Plugin: p.Object(), Time: pm.clock().Now()})
+	pm.config.LogPluginEvent(p.GetID(), refOrID, "checkpoint")
+	return nil
+}
+
 // Enable activates a plugin, which implies that they are ready to be used by containers.
 func (pm *Manager) Enable(refOrID string, config *types.PluginEnableConfig) error {
+	pm.ops.acquire()
+	defer pm.ops.release()
+
+	return pm.enablePlugin(refOrID, config)
+}
+
+// enablePlugin is Enable, for callers which already hold a slot of the
+// operation limiter.
+func (pm *Manager) enablePlugin(refOrID string, config *types.PluginEnableConfig) error {
 	p, err := pm.config.Store.GetV2Plugin(refOrID)
 	if err != nil {
 		return err
 	}
 
-	c := &controller{timeoutInSecs: config.Timeout}
+	if err := validateEnableConfig(config); err != nil {
+		return err
+	}
+
+	c := newController(config)
 	if err := pm.enable(p, c, false); err != nil {
 		return err
 	}
-	pm.publisher.Publish(EventEnable{Plugin: p.PluginObj})
+	pm.publisher.Publish(EventEnable{Plugin: p.Object(), Time: pm.clock().Now()})
 	pm.config.LogPluginEvent(p.GetID(), refOrID, "enable")
 	return nil
 }
 
+// ValidateEnable checks that a disabled plugin could be enabled, without
+// starting it. It runs the checks enable would, such as that the rootfs, the
+// sources of the mounts, the devices, and the entrypoint of the plugin are
+// present, that its capabilities are supported and its dependencies enabled,
+// and that its entrypoint is built for the platform of the daemon, and builds
+// its runtime spec. All the problems found are reported.
+func (pm *Manager) ValidateEnable(refOrID string) error {
+	p, err := pm.config.Store.GetV2Plugin(refOrID)
+	if err != nil {
+		return err
+	}
+	if problems := pm.validateEnable(p, &controller{}); len(problems) > 0 {
+		return errdefs.InvalidParameter(errors.Errorf("plugin %s cannot be enabled: %s", p.Name(), strings.Join(problems, "; ")))
+	}
+	return nil
+}
+
+// RuntimeSpec returns the JSON runtime spec that the enabled plugin was
+// started with, including the mounts, environment, resources, and security
+// settings generated by the manager.
+func (pm *Manager) RuntimeSpec(refOrID string) ([]byte, error) {
+	p, err := pm.config.Store.GetV2Plugin(refOrID)
+	if err != nil {
+		return nil, err
+	}
+	if !p.IsEnabled() {
+		return nil, errors.Wrap(errDisabled(p.Name()), "plugin has no runtime spec")
+	}
+
+	pm.mu.RLock()
+	c := pm.cMap[p]
+	pm.mu.RUnlock()
+	if c == nil || c.spec == nil {
+		// The plugin was live-restored, and not started by this daemon.
+		return nil, errdefs.NotFound(errors.Errorf("the runtime spec of plugin %s is not known", p.Name()))
+	}
+	return json.Marshal(c.spec)
+}
+
 // Inspect examines a plugin config
 func (pm *Manager) Inspect(refOrID string) (tp *types.Plugin, err error) {
 	p, err := pm.config.Store.GetV2Plugin(refOrID)
@@ -98,6 +209,44 @@ func (pm *Manager) Inspect(refOrID string) (tp *types.Plugin, err error) {
 	return &p.PluginObj, nil
 }
 
+// Logs returns the last tail lines of the output of a plugin, or all the
+// lines kept if tail is negative. If follow is true, the output of the
+// plugin is then streamed until the returned reader is closed, or the
+// plugin is removed. Only the last lines of output since the daemon started
+// are kept, and the output of a plugin which was not started since then is
+// empty, even if follow is true.
+func (pm *Manager) Logs(refOrID string, follow bool, tail int) (io.ReadCloser, error) {
+	p, err := pm.config.Store.GetV2Plugin(refOrID)
+	if err != nil {
+		return nil, err
+	}
+	buf := pm.logBuffer(p.GetID())
+	if buf == nil {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	return buf.reader(follow, tail), nil
+}
+
+// Stats returns the resource usage of an enabled plugin.
+func (pm *Manager) Stats(refOrID string) (*types.PluginStats, error) {
+	p, err := pm.config.Store.GetV2Plugin(refOrID)
+	if err != nil {
+		return nil, err
+	}
+	se, ok := pm.executor.(StatsExecutor)
+	if !ok {
+		return nil, errdefs.NotImplemented(errors.New("the plugin executor does not support stats"))
+	}
+	if !p.IsEnabled() {
+		return nil, errors.Wrap(errDisabled(p.Name()), "cannot get the stats of a disabled plugin")
+	}
+	stats, err := se.Stats(p.GetID())
+	if err != nil {
+		return nil, err
+	}
+	return &types.PluginStats{Stats: *stats, ID: p.GetID(), Name: p.Name()}, nil
+}
+
 func (pm *Manager) pull(ctx context.Context, ref reference.Named, config *distribution.ImagePullConfig, outStream io.Writer) error {
 	if outStream != nil {
 		// Include a buffer so that slow client connections don't affect
@@ -158,7 +307,7 @@ func (s *tempConfigStore) PlatformFromConfig(c []byte) (*specs.Platform, error)
 
 func computePrivileges(c types.PluginConfig) types.PluginPrivileges {
 	var privileges types.PluginPrivileges
-	if c.Network.Type != "null" && c.Network.Type != "bridge" && c.Network.Type != "" {
+	if c.Network.Type != "null" && c.Network.Type != "none" && c.Network.Type != "bridge" && c.Network.Type != "" {
 		privileges = append(privileges, types.PluginPrivilege{
 			Name:        "network",
 			Description: "permissions to access a network",
@@ -249,26 +398,41 @@ func (pm *Manager) Privileges(ctx context.Context, ref reference.Named, metaHead
 
 // Upgrade upgrades a plugin
 func (pm *Manager) Upgrade(ctx context.Context, ref reference.Named, name string, metaHeader http.Header, authConfig *types.AuthConfig, privileges types.PluginPrivileges, outStream io.Writer) (err error) {
+	pm.muGC.RLock()
+	defer pm.muGC.RUnlock()
+
+	_, _, err = pm.upgrade(ctx, ref, name, metaHeader, authConfig, privileges, outStream, false)
+	return err
+}
+
+// upgrade pulls ref and installs it over the disabled plugin name. If
+// keepBackup is set, the previous version of the plugin is kept, and
+// returned, so that the upgrade can be rolled back. pm.muGC must be held for
+// reading.
+func (pm *Manager) upgrade(ctx context.Context, ref reference.Named, name string, metaHeader http.Header, authConfig *types.AuthConfig, privileges types.PluginPrivileges, outStream io.Writer, keepBackup bool) (*v2.Plugin, *pluginBackup, error) {
 	p, err := pm.config.Store.GetV2Plugin(name)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	if p.IsEnabled() {
-		return errors.Wrap(enabledError(p.Name()), "plugin must be disabled before upgrading")
+		return nil, nil, errors.Wrap(enabledError(p.Name()), "plugin must be disabled before upgrading")
+	}
+	if pm.isReadOnly(p.GetID()) {
+		return nil, nil, errors.Wrap(readOnlyError(p.Name()), "cannot upgrade plugin")
 	}
-
-	pm.muGC.RLock()
-	defer pm.muGC.RUnlock()
 
 	// revalidate because Pull is public
 	if _, err := reference.ParseNormalizedNamed(name); err != nil {
-		return errors.Wrapf(errdefs.InvalidParameter(err), "failed to parse %q", name)
+		return nil, nil, errors.Wrapf(errdefs.InvalidParameter(err), "failed to parse %q", name)
+	}
+	if err := pm.policy.check(ref); err != nil {
+		return nil, nil, err
 	}
 
 	tmpRootFSDir, err := ioutil.TempDir(pm.tmpDir(), ".rootfs")
 	if err != nil {
-		return errors.Wrap(errdefs.System(err), "error preparing upgrade")
+		return nil, nil, errors.Wrap(errdefs.System(err), "error preparing upgrade")
 	}
 	defer os.RemoveAll(tmpRootFSDir)
 
@@ -292,14 +456,15 @@ func (pm *Manager) Upgrade(ctx context.Context, ref reference.Named, name string
 	err = pm.pull(ctx, ref, pluginPullConfig, outStream)
 	if err != nil {
 		go pm.GC()
-		return err
+		return nil, nil, err
 	}
 
-	if err := pm.upgradePlugin(p, dm.configDigest, dm.blobs, tmpRootFSDir, &privileges); err != nil {
-		return err
+	backup, err := pm.upgradePlugin(p, dm.configDigest, dm.blobs, tmpRootFSDir, &privileges, keepBackup)
+	if err != nil {
+		return nil, nil, err
 	}
 	p.PluginObj.PluginReference = ref.String()
-	return nil
+	return p, backup, nil
 }
 
 // Pull pulls a plugin, check if the correct privileges are provided and install the plugin.
@@ -317,6 +482,9 @@ func (pm *Manager) Pull(ctx context.Context, ref reference.Named, name string, m
 	if err := pm.config.Store.validateName(name); err != nil {
 		return errdefs.InvalidParameter(err)
 	}
+	if err := pm.policy.check(ref); err != nil {
+		return err
+	}
 
 	tmpRootFSDir, err := ioutil.TempDir(pm.tmpDir(), ".rootfs")
 	if err != nil {
@@ -359,7 +527,7 @@ func (pm *Manager) Pull(ctx context.Context, ref reference.Named, name string, m
 		return err
 	}
 
-	pm.publisher.Publish(EventCreate{Plugin: p.PluginObj})
+	pm.publisher.Publish(EventCreate{Plugin: p.Object(), Time: pm.clock().Now()})
 	return nil
 }
 
@@ -615,6 +783,9 @@ func (l *pluginLayer) Release() {
 
 // Remove deletes plugin's root directory.
 func (pm *Manager) Remove(name string, config *types.PluginRmConfig) error {
+	pm.ops.acquire()
+	defer pm.ops.release()
+
 	p, err := pm.config.Store.GetV2Plugin(name)
 	pm.mu.RLock()
 	c := pm.cMap[p]
@@ -624,6 +795,10 @@ func (pm *Manager) Remove(name string, config *types.PluginRmConfig) error {
 		return err
 	}
 
+	if pm.isReadOnly(p.GetID()) {
+		return errors.Wrap(readOnlyError(p.Name()), "cannot remove plugin")
+	}
+
 	if !config.ForceRemove {
 		if p.GetRefCount() > 0 {
 			return inUseError(p.Name())
@@ -634,7 +809,7 @@ func (pm *Manager) Remove(name string, config *types.PluginRmConfig) error {
 	}
 
 	if p.IsEnabled() {
-		if err := pm.disable(p, c); err != nil {
+		if err := pm.disable(p, c, pm.stopTimeout()); err != nil {
 			logrus.Errorf("failed to disable plugin '%s': %s", p.Name(), err)
 		}
 	}
@@ -655,25 +830,75 @@ func (pm *Manager) Remove(name string, config *types.PluginRmConfig) error {
 	}
 
 	pm.config.Store.Remove(p)
+	pm.removeLogger(id)
 	pm.config.LogPluginEvent(id, name, "remove")
-	pm.publisher.Publish(EventRemove{Plugin: p.PluginObj})
+	pm.publisher.Publish(EventRemove{Plugin: p.Object(), Time: pm.clock().Now()})
 	return nil
 }
 
-// Set sets plugin args
-func (pm *Manager) Set(name string, args []string) error {
+// Set sets plugin args. An enabled plugin is only modified if config
+// requests it to be restarted, or the restart to be skipped.
+func (pm *Manager) Set(name string, args []string, config *types.PluginSetConfig) error {
 	p, err := pm.config.Store.GetV2Plugin(name)
 	if err != nil {
 		return err
 	}
-	if err := p.Set(args); err != nil {
-		return err
+	if config == nil {
+		config = &types.PluginSetConfig{}
+	}
+
+	switch {
+	case !p.IsEnabled(), !config.Restart && !config.SkipRestart:
+		if err := p.Set(args); err != nil {
+			return err
+		}
+	case config.SkipRestart:
+		if err := p.SetDeferred(args); err != nil {
+			return err
+		}
+	default:
+		pm.ops.acquire()
+		defer pm.ops.release()
+		return pm.setAndRestart(p, args)
 	}
 	return pm.save(p)
 }
 
+// setAndRestart disables p, applies args to it, and enables it again. The
+// plugin is re-enabled even if the settings could not be applied. The caller
+// must hold a slot of the operation limiter.
+func (pm *Manager) setAndRestart(p *v2.Plugin, args []string) error {
+	pm.mu.RLock()
+	c := pm.cMap[p]
+	pm.mu.RUnlock()
+
+	config := &types.PluginEnableConfig{}
+	if c != nil {
+		config = c.enableConfig()
+	}
+
+	if err := pm.disablePlugin(p.GetID(), &types.PluginDisableConfig{}); err != nil {
+		return errors.Wrap(err, "error disabling plugin to apply settings")
+	}
+
+	setErr := p.Set(args)
+	if setErr == nil {
+		setErr = pm.save(p)
+	}
+
+	if err := pm.enablePlugin(p.GetID(), config); err != nil {
+		if setErr != nil {
+			logrus.WithError(setErr).WithField("plugin", p.Name()).Error("error applying plugin settings")
+		}
+		return errors.Wrap(err, "error enabling plugin after applying settings")
+	}
+	return setErr
+}
+
 // CreateFromContext creates a plugin from the given pluginDir which contains
-// both the rootfs and the config.json and a repoName with optional tag.
+// both the rootfs and the config.json and a repoName with optional tag. If
+// options.RemoteContext is set, the context is fetched from it instead of
+// being read from tarCtx.
 func (pm *Manager) CreateFromContext(ctx context.Context, tarCtx io.ReadCloser, options *types.PluginCreateOptions) (err error) {
 	pm.muGC.RLock()
 	defer pm.muGC.RUnlock()
@@ -690,6 +915,18 @@ func (pm *Manager) CreateFromContext(ctx context.Context, tarCtx io.ReadCloser,
 	if err := pm.config.Store.validateName(name); err != nil { // fast check, real check is in createPlugin()
 		return err
 	}
+	if err := pm.policy.check(ref); err != nil {
+		return err
+	}
+
+	if options.RemoteContext != "" {
+		remote, err := openRemoteContext(options.RemoteContext)
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		tarCtx = remote
+	}
 
 	tmpRootFSDir, err := ioutil.TempDir(pm.tmpDir(), ".rootfs")
 	if err != nil {
@@ -772,7 +1009,7 @@ func (pm *Manager) CreateFromContext(ctx context.Context, tarCtx io.ReadCloser,
 	}
 	p.PluginObj.PluginReference = name
 
-	pm.publisher.Publish(EventCreate{Plugin: p.PluginObj})
+	pm.publisher.Publish(EventCreate{Plugin: p.Object(), Time: pm.clock().Now()})
 	pm.config.LogPluginEvent(p.PluginObj.ID, name, "create")
 
 	return nil
@@ -4,7 +4,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/plugin/v2"
 )
 
 func TestAtomicRemoveAllNormal(t *testing.T) {
@@ -79,3 +84,77 @@ func TestAtomicRemoveAllNotExist(t *testing.T) {
 		t.Fatalf("dir should be gone: %v", err)
 	}
 }
+
+type statsExecutor struct {
+	simpleExecutor
+}
+
+func (e *statsExecutor) Stats(id string) (*types.Stats, error) {
+	return &types.Stats{MemoryStats: types.MemoryStats{Usage: 42}}, nil
+}
+
+func TestStats(t *testing.T) {
+	p := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("1", 64), Name: "stats:latest"}}
+	s := NewStore()
+	s.SetAll(map[string]*v2.Plugin{p.GetID(): p})
+	m := &Manager{config: ManagerConfig{Store: s}, executor: &simpleExecutor{}}
+
+	if _, err := m.Stats("stats"); !errdefs.IsNotImplemented(err) {
+		t.Fatalf("expected stats to be unsupported by the executor, got %v", err)
+	}
+
+	m.executor = &statsExecutor{}
+	if _, err := m.Stats("stats"); !errdefs.IsConflict(err) {
+		t.Fatalf("expected getting the stats of a disabled plugin to fail, got %v", err)
+	}
+
+	s.SetState(p, true)
+	stats, err := m.Stats("stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ID != p.GetID() || stats.Name != p.Name() || stats.MemoryStats.Usage != 42 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLogsOfPluginNotStarted(t *testing.T) {
+	p := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("1", 64), Name: "logs:latest"}}
+	s := NewStore()
+	s.SetAll(map[string]*v2.Plugin{p.GetID(): p})
+	m := &Manager{config: ManagerConfig{Store: s}}
+
+	if _, err := m.Logs("missing", false, -1); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected getting the logs of a missing plugin to fail, got %v", err)
+	}
+
+	r, err := m.Logs("logs", true, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if len(out) != 0 {
+		t.Fatalf("expected the logs of a plugin which was not started to be empty, got %q", out)
+	}
+	if len(m.loggers) != 0 {
+		t.Fatalf("expected no logger to be created for a plugin which was not started, got %d loggers", len(m.loggers))
+	}
+
+	stdout, _ := m.makeLoggerStreams(p.GetID())
+	defer m.removeLogger(p.GetID())
+	if _, err := stdout.Write([]byte("started\n")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = m.Logs("logs", false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if out, err := ioutil.ReadAll(r); err != nil || string(out) != "started\n" {
+		t.Fatalf("expected the output of the started plugin, got %q (%v)", out, err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
@@ -20,11 +21,28 @@ func (pm *Manager) Disable(name string, config *types.PluginDisableConfig) error
 	return errNotSupported
 }
 
+// Checkpoint saves the state of a running plugin to disk, and stops it.
+func (pm *Manager) Checkpoint(name string) error {
+	return errNotSupported
+}
+
 // Enable activates a plugin, which implies that they are ready to be used by containers.
 func (pm *Manager) Enable(name string, config *types.PluginEnableConfig) error {
 	return errNotSupported
 }
 
+// ValidateEnable checks that a disabled plugin could be enabled, without
+// starting it.
+func (pm *Manager) ValidateEnable(refOrID string) error {
+	return errNotSupported
+}
+
+// RuntimeSpec returns the JSON runtime spec that the enabled plugin was
+// started with.
+func (pm *Manager) RuntimeSpec(refOrID string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
 // Inspect examines a plugin config
 func (pm *Manager) Inspect(refOrID string) (tp *types.Plugin, err error) {
 	return nil, errNotSupported
@@ -45,6 +63,22 @@ func (pm *Manager) Upgrade(ctx context.Context, ref reference.Named, name string
 	return errNotSupported
 }
 
+// StagedUpgrade upgrades a plugin, and rolls it back if the upgraded plugin
+// fails its probation.
+func (pm *Manager) StagedUpgrade(ctx context.Context, ref reference.Named, name string, metaHeader http.Header, authConfig *types.AuthConfig, privileges types.PluginPrivileges, outStream io.Writer, enableConfig *types.PluginEnableConfig, probation time.Duration) (UpgradeResult, error) {
+	return UpgradeResult{}, errNotSupported
+}
+
+// Logs returns the output of a plugin.
+func (pm *Manager) Logs(refOrID string, follow bool, tail int) (io.ReadCloser, error) {
+	return nil, errNotSupported
+}
+
+// Stats returns the resource usage of a plugin.
+func (pm *Manager) Stats(refOrID string) (*types.PluginStats, error) {
+	return nil, errNotSupported
+}
+
 // List displays the list of plugins and associated metadata.
 func (pm *Manager) List(pluginFilters filters.Args) ([]types.Plugin, error) {
 	return nil, errNotSupported
@@ -61,7 +95,7 @@ func (pm *Manager) Remove(name string, config *types.PluginRmConfig) error {
 }
 
 // Set sets plugin args
-func (pm *Manager) Set(name string, args []string) error {
+func (pm *Manager) Set(name string, args []string, config *types.PluginSetConfig) error {
 	return errNotSupported
 }
 
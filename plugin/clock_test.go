@@ -0,0 +1,151 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/plugin/v2"
+)
+
+// fakeClock is a Clock which only moves when advanced. Functions scheduled
+// with AfterFunc are called synchronously by Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+	f     func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.addTimer(d, nil)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.addTimer(d, f)
+}
+
+func (c *fakeClock) addTimer(d time.Duration, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers which expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var fired, pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			fired = append(fired, t)
+		}
+	}
+	c.timers = pending
+	now := c.now
+	c.mu.Unlock()
+
+	for _, t := range fired {
+		if t.f != nil {
+			t.f()
+		} else {
+			t.c <- now
+		}
+	}
+}
+
+// waiters returns the number of timers which have not fired.
+func (c *fakeClock) waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	return active
+}
+
+func waitForWaiters(t *testing.T, c *fakeClock, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d timers, got %d", n, c.waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitEnabledClock(t *testing.T) {
+	p := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("1", 64), Name: "wait:latest"}}
+	s := NewStore()
+	s.SetAll(map[string]*v2.Plugin{p.GetID(): p})
+	clock := &fakeClock{}
+	m := &Manager{
+		config: ManagerConfig{Store: s, Clock: clock},
+		cMap:   map[*v2.Plugin]*controller{p: {restart: true, exitChan: make(chan bool)}},
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- m.WaitEnabled(p.GetID(), time.Minute)
+	}()
+
+	// The deadline, and the next check of the plugin state.
+	waitForWaiters(t, clock, 2)
+	clock.Advance(59 * time.Second)
+	waitForWaiters(t, clock, 2)
+	select {
+	case err := <-errCh:
+		t.Fatalf("WaitEnabled returned before its timeout: %v", err)
+	default:
+	}
+
+	clock.Advance(time.Second)
+	if err := <-errCh; !errdefs.IsDeadline(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
@@ -17,14 +17,17 @@ type Store struct {
 	 * to the new model. Legacy plugins use Handle() for registering an
 	 * activation callback.*/
 	handlers map[string][]func(string, *plugins.Client)
+	// enabledByCap indexes the enabled plugins by capability, then by ID.
+	enabledByCap map[string]map[string]*v2.Plugin
 }
 
 // NewStore creates a Store.
 func NewStore() *Store {
 	return &Store{
-		plugins:  make(map[string]*v2.Plugin),
-		specOpts: make(map[string][]SpecOpt),
-		handlers: make(map[string][]func(string, *plugins.Client)),
+		plugins:      make(map[string]*v2.Plugin),
+		specOpts:     make(map[string][]SpecOpt),
+		handlers:     make(map[string][]func(string, *plugins.Client)),
+		enabledByCap: make(map[string]map[string]*v2.Plugin),
 	}
 }
 
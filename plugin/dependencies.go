@@ -0,0 +1,124 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/plugin/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// findPlugin returns the ID of the plugin among plugins with the given name
+// or ID.
+func findPlugin(plugins map[string]*v2.Plugin, nameOrID string) (string, bool) {
+	if _, ok := plugins[nameOrID]; ok {
+		return nameOrID, true
+	}
+	name := nameOrID
+	if ref, err := reference.ParseNormalizedNamed(nameOrID); err == nil {
+		name = reference.FamiliarString(reference.TagNameOnly(ref))
+	}
+	for id, p := range plugins {
+		if p.Name() == name {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// checkDependencies returns an ErrDependencyNotEnabled listing the declared
+// dependencies of p which are not enabled, if any.
+func (pm *Manager) checkDependencies(p *v2.Plugin) error {
+	deps := p.PluginObj.Config.Dependencies
+	if len(deps) == 0 {
+		return nil
+	}
+	plugins := pm.config.Store.GetAll()
+	var missing []string
+	for _, dep := range deps {
+		if id, ok := findPlugin(plugins, dep); !ok || !plugins[id].IsEnabled() {
+			missing = append(missing, dep)
+		}
+	}
+	if len(missing) > 0 {
+		return ErrDependencyNotEnabled{Plugin: p.Name(), Dependencies: missing}
+	}
+	return nil
+}
+
+// restoreOrder sorts plugins so that each of them comes after the plugins it
+// depends on, and returns the IDs of the dependencies of each plugin.
+// Dependencies which are not installed are ignored. If dependencies form a
+// cycle, an error naming the plugins which could not be sorted is returned,
+// and these plugins are put last, without their dependencies on each other.
+func restoreOrder(plugins map[string]*v2.Plugin) ([]*v2.Plugin, map[string][]string, error) {
+	ids := make([]string, 0, len(plugins))
+	for id := range plugins {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	deps := make(map[string][]string)
+	dependents := make(map[string][]string)
+	pending := make(map[string]int)
+	for _, id := range ids {
+		p := plugins[id]
+		seen := make(map[string]bool)
+		for _, dep := range p.PluginObj.Config.Dependencies {
+			depID, ok := findPlugin(plugins, dep)
+			if !ok {
+				logrus.WithField("id", id).Warnf("dependency %s of plugin %s is not installed", dep, p.Name())
+				continue
+			}
+			if seen[depID] {
+				continue
+			}
+			seen[depID] = true
+			deps[id] = append(deps[id], depID)
+			dependents[depID] = append(dependents[depID], id)
+			pending[id]++
+		}
+	}
+
+	order := make([]*v2.Plugin, 0, len(plugins))
+	var ready []string
+	for _, id := range ids {
+		if pending[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, plugins[id])
+		for _, dependent := range dependents[id] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(order) == len(plugins) {
+		return order, deps, nil
+	}
+
+	// The remaining plugins are in a cycle, or depend on a plugin in one.
+	// Only their dependencies on plugins which were sorted are kept.
+	var names []string
+	for _, id := range ids {
+		if pending[id] == 0 {
+			continue
+		}
+		var sorted []string
+		for _, depID := range deps[id] {
+			if pending[depID] == 0 {
+				sorted = append(sorted, depID)
+			}
+		}
+		deps[id] = sorted
+		order = append(order, plugins[id])
+		names = append(names, plugins[id].Name())
+	}
+	return order, deps, errors.Errorf("dependency cycle between plugins %s", strings.Join(names, ", "))
+}
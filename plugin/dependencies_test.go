@@ -0,0 +1,95 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/plugin/v2"
+	"github.com/pkg/errors"
+)
+
+func TestRestoreOrder(t *testing.T) {
+	newPlugin := func(id, name string, deps ...string) *v2.Plugin {
+		p := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat(id, 64), Name: name}}
+		p.PluginObj.Config.Dependencies = deps
+		return p
+	}
+	names := func(order []*v2.Plugin) []string {
+		var names []string
+		for _, p := range order {
+			names = append(names, p.Name())
+		}
+		return names
+	}
+
+	volume := newPlugin("1", "volume:latest", "logging", "missing")
+	logging := newPlugin("2", "logging:latest", "example.com/base:v1")
+	base := newPlugin("3", "example.com/base:v1")
+	plugins := map[string]*v2.Plugin{volume.GetID(): volume, logging.GetID(): logging, base.GetID(): base}
+
+	order, deps, err := restoreOrder(plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"example.com/base:v1", "logging:latest", "volume:latest"}; !reflect.DeepEqual(names(order), expected) {
+		t.Fatalf("expected order %v, got %v", expected, names(order))
+	}
+	if expected := []string{logging.GetID()}; !reflect.DeepEqual(deps[volume.GetID()], expected) {
+		t.Fatalf("expected the missing dependency to be ignored, got %v", deps[volume.GetID()])
+	}
+
+	// A cycle is reported, and the plugins in it are put last.
+	base.PluginObj.Config.Dependencies = []string{"volume:latest"}
+	other := newPlugin("4", "other:latest")
+	plugins[other.GetID()] = other
+	order, deps, err = restoreOrder(plugins)
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Fatalf("expected a dependency cycle error, got %v", err)
+	}
+	if len(order) != 4 || order[0] != other {
+		t.Fatalf("expected the plugins outside the cycle first, got %v", names(order))
+	}
+	for _, p := range order[1:] {
+		if len(deps[p.GetID()]) != 0 {
+			t.Fatalf("expected the dependencies of %s within the cycle to be dropped, got %v", p.Name(), deps[p.GetID()])
+		}
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	newPlugin := func(id, name string, deps ...string) *v2.Plugin {
+		p := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat(id, 64), Name: name}}
+		p.PluginObj.Config.Dependencies = deps
+		return p
+	}
+	volume := newPlugin("1", "volume:latest", "logging", "base", "missing")
+	logging := newPlugin("2", "logging:latest")
+	base := newPlugin("3", "base:latest")
+	s := NewStore()
+	s.SetAll(map[string]*v2.Plugin{volume.GetID(): volume, logging.GetID(): logging, base.GetID(): base})
+	s.SetState(base, true)
+	m := &Manager{config: ManagerConfig{Store: s}}
+
+	err := m.enable(volume, &controller{}, false)
+	depErr, ok := errors.Cause(err).(ErrDependencyNotEnabled)
+	if !ok {
+		t.Fatalf("expected ErrDependencyNotEnabled, got %v", err)
+	}
+	if expected := []string{"logging", "missing"}; !reflect.DeepEqual(depErr.Dependencies, expected) {
+		t.Fatalf("expected missing dependencies %v, got %v", expected, depErr.Dependencies)
+	}
+	if !errdefs.IsConflict(err) {
+		t.Fatalf("expected a conflict error, got %v", err)
+	}
+
+	if err := m.checkDependencies(logging); err != nil {
+		t.Fatalf("expected a plugin without dependencies to pass, got %v", err)
+	}
+	volume.PluginObj.Config.Dependencies = []string{"base"}
+	if err := m.checkDependencies(volume); err != nil {
+		t.Fatalf("expected enabled dependencies to pass, got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package plugin // import "github.com/docker/docker/plugin"
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type errNotFound string
 
@@ -64,3 +67,62 @@ func (e alreadyExistsError) Error() string {
 }
 
 func (alreadyExistsError) Conflict() {}
+
+type readOnlyError string
+
+func (e readOnlyError) Error() string {
+	return "plugin " + string(e) + " is read-only"
+}
+
+func (readOnlyError) Forbidden() {}
+
+type runtimeUnavailableError struct {
+	cause error
+}
+
+func (e runtimeUnavailableError) Error() string {
+	if e.cause == nil {
+		return "plugin runtime temporarily unavailable"
+	}
+	return "plugin runtime temporarily unavailable: " + e.cause.Error()
+}
+
+func (runtimeUnavailableError) Unavailable() {}
+
+type exitedError string
+
+func (e exitedError) Error() string {
+	return "plugin " + string(e) + " exited before it was ready"
+}
+
+func (exitedError) System() {}
+
+type waitTimeoutError string
+
+func (e waitTimeoutError) Error() string {
+	return "timed out waiting for plugin " + string(e) + " to be enabled"
+}
+
+func (waitTimeoutError) DeadlineExceeded() {}
+
+type policyError string
+
+func (e policyError) Error() string {
+	return "plugin " + string(e)
+}
+
+func (policyError) Forbidden() {}
+
+// ErrDependencyNotEnabled is returned when enabling a plugin some of whose
+// declared dependencies are not enabled, or not installed.
+type ErrDependencyNotEnabled struct {
+	Plugin       string
+	Dependencies []string
+}
+
+func (e ErrDependencyNotEnabled) Error() string {
+	return fmt.Sprintf("plugin %s depends on plugins which are not enabled: %s", e.Plugin, strings.Join(e.Dependencies, ", "))
+}
+
+// Conflict implements errdefs.ErrConflict.
+func (ErrDependencyNotEnabled) Conflict() {}
@@ -3,6 +3,7 @@ package plugin // import "github.com/docker/docker/plugin"
 import (
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/docker/docker/api/types"
 )
@@ -22,6 +23,8 @@ type Event interface {
 type EventCreate struct {
 	Interfaces map[string]bool
 	Plugin     types.Plugin
+	// Time is when the event happened.
+	Time time.Time
 }
 
 func (e EventCreate) matches(observed Event) bool {
@@ -47,6 +50,8 @@ func (e EventCreate) matches(observed Event) bool {
 // It maches on the passed in plugin's ID only.
 type EventRemove struct {
 	Plugin types.Plugin
+	// Time is when the event happened.
+	Time time.Time
 }
 
 func (e EventRemove) matches(observed Event) bool {
@@ -61,6 +66,8 @@ func (e EventRemove) matches(observed Event) bool {
 // It maches on the passed in plugin's ID only.
 type EventDisable struct {
 	Plugin types.Plugin
+	// Time is when the event happened.
+	Time time.Time
 }
 
 func (e EventDisable) matches(observed Event) bool {
@@ -75,6 +82,8 @@ func (e EventDisable) matches(observed Event) bool {
 // It maches on the passed in plugin's ID only.
 type EventEnable struct {
 	Plugin types.Plugin
+	// Time is when the event happened.
+	Time time.Time
 }
 
 func (e EventEnable) matches(observed Event) bool {
@@ -85,6 +94,42 @@ func (e EventEnable) matches(observed Event) bool {
 	return e.Plugin.ID == oe.Plugin.ID
 }
 
+// EventExit is an event that is emitted when an enabled plugin exits.
+// Restarting is true if the plugin is going to be restarted; otherwise it
+// stays stopped, and its state is saved before the event is emitted.
+// It matches on the passed in plugin's ID only.
+type EventExit struct {
+	Plugin     types.Plugin
+	Restarting bool
+	// Time is when the event happened.
+	Time time.Time
+}
+
+func (e EventExit) matches(observed Event) bool {
+	oe, ok := observed.(EventExit)
+	if !ok {
+		return false
+	}
+	return e.Plugin.ID == oe.Plugin.ID
+}
+
+// EventRestart is an event that is emitted when a plugin which exited was
+// restarted.
+// It matches on the passed in plugin's ID only.
+type EventRestart struct {
+	Plugin types.Plugin
+	// Time is when the event happened.
+	Time time.Time
+}
+
+func (e EventRestart) matches(observed Event) bool {
+	oe, ok := observed.(EventRestart)
+	if !ok {
+		return false
+	}
+	return e.Plugin.ID == oe.Plugin.ID
+}
+
 // SubscribeEvents provides an event channel to listen for structured events from
 // the plugin manager actions, CRUD operations.
 // The caller must call the returned `cancel()` function once done with the channel
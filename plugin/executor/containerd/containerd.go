@@ -36,17 +36,23 @@ type Client interface {
 	DeleteTask(ctx context.Context, containerID string) (uint32, time.Time, error)
 	Start(ctx context.Context, containerID, checkpointDir string, withStdin bool, attachStdio libcontainerd.StdioCallback) (pid int, err error)
 	SignalProcess(ctx context.Context, containerID, processID string, signal int) error
+	CreateCheckpoint(ctx context.Context, containerID, checkpointDir string, exit bool) error
+	Stats(ctx context.Context, containerID string) (*libcontainerd.Stats, error)
 }
 
 // New creates a new containerd plugin executor
 func New(ctx context.Context, rootDir string, cli *containerd.Client, exitHandler ExitHandler) (*Executor, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	e := &Executor{
 		rootDir:     rootDir,
 		exitHandler: exitHandler,
+		cli:         cli,
+		cancel:      cancel,
 	}
 
 	client, err := libcontainerd.NewClient(ctx, cli, rootDir, PluginNamespace, e)
 	if err != nil {
+		cancel()
 		return nil, errors.Wrap(err, "error creating containerd exec client")
 	}
 	e.client = client
@@ -58,6 +64,22 @@ type Executor struct {
 	rootDir     string
 	client      Client
 	exitHandler ExitHandler
+	// cli is the containerd client the executor was created with, and
+	// cancel stops processing its events.
+	cli    *containerd.Client
+	cancel context.CancelFunc
+}
+
+// Close stops processing the events of containerd, and closes the
+// containerd client of the executor.
+func (e *Executor) Close() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	if e.cli == nil {
+		return nil
+	}
+	return e.cli.Close()
 }
 
 // deleteTaskAndContainer deletes plugin task and then plugin container from containerd
@@ -75,6 +97,16 @@ func deleteTaskAndContainer(ctx context.Context, cli Client, id string) {
 
 // Create creates a new container
 func (e *Executor) Create(id string, spec specs.Spec, stdout, stderr io.WriteCloser) error {
+	return e.create(id, spec, "", stdout, stderr)
+}
+
+// CreateFromCheckpoint creates a new container, restoring its process from
+// the checkpoint in checkpointDir.
+func (e *Executor) CreateFromCheckpoint(id string, spec specs.Spec, checkpointDir string, stdout, stderr io.WriteCloser) error {
+	return e.create(id, spec, checkpointDir, stdout, stderr)
+}
+
+func (e *Executor) create(id string, spec specs.Spec, checkpointDir string, stdout, stderr io.WriteCloser) error {
 	opts := runctypes.RuncOptions{
 		RuntimeRoot: filepath.Join(e.rootDir, "runtime-root"),
 	}
@@ -100,7 +132,7 @@ func (e *Executor) Create(id string, spec specs.Spec, stdout, stderr io.WriteClo
 		}
 	}
 
-	_, err = e.client.Start(ctx, id, "", false, attachStreamsFunc(stdout, stderr))
+	_, err = e.client.Start(ctx, id, checkpointDir, false, attachStreamsFunc(stdout, stderr))
 	if err != nil {
 		deleteTaskAndContainer(ctx, e.client, id)
 	}
@@ -130,6 +162,11 @@ func (e *Executor) Signal(id string, signal int) error {
 	return e.client.SignalProcess(context.Background(), id, libcontainerd.InitProcessName, signal)
 }
 
+// Checkpoint checkpoints the container to checkpointDir, and stops it.
+func (e *Executor) Checkpoint(id, checkpointDir string) error {
+	return e.client.CreateCheckpoint(context.Background(), id, checkpointDir, true)
+}
+
 // ProcessEvent handles events from containerd
 // All events are ignored except the exit event, which is sent of to the stored handler
 func (e *Executor) ProcessEvent(id string, et libcontainerd.EventType, ei libcontainerd.EventInfo) error {
@@ -126,6 +126,14 @@ func (c *mockClient) Start(ctx context.Context, id, checkpointDir string, withSt
 	return 1, nil
 }
 
+func (c *mockClient) CreateCheckpoint(ctx context.Context, containerID, checkpointDir string, exit bool) error {
+	return nil
+}
+
+func (c *mockClient) Stats(ctx context.Context, containerID string) (*libcontainerd.Stats, error) {
+	return &libcontainerd.Stats{}, nil
+}
+
 func (c *mockClient) SignalProcess(ctx context.Context, containerID, processID string, signal int) error {
 	return nil
 }
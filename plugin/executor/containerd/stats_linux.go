@@ -0,0 +1,85 @@
+package containerd // import "github.com/docker/docker/plugin/executor/containerd"
+
+import (
+	"context"
+
+	"github.com/containerd/cgroups"
+	"github.com/docker/docker/api/types"
+)
+
+// Stats returns the CPU, memory, and block IO usage of the plugin.
+func (e *Executor) Stats(id string) (*types.Stats, error) {
+	cs, err := e.client.Stats(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	s := statsFromMetrics(cs.Metrics)
+	s.Read = cs.Read
+	return s, nil
+}
+
+// statsFromMetrics converts the cgroup metrics of a plugin like the daemon
+// does for containers.
+func statsFromMetrics(m *cgroups.Metrics) *types.Stats {
+	s := &types.Stats{}
+	if m == nil {
+		return s
+	}
+	if m.CPU != nil {
+		if m.CPU.Usage != nil {
+			s.CPUStats.CPUUsage = types.CPUUsage{
+				TotalUsage:        m.CPU.Usage.Total,
+				PercpuUsage:       m.CPU.Usage.PerCPU,
+				UsageInKernelmode: m.CPU.Usage.Kernel,
+				UsageInUsermode:   m.CPU.Usage.User,
+			}
+		}
+		if m.CPU.Throttling != nil {
+			s.CPUStats.ThrottlingData = types.ThrottlingData{
+				Periods:          m.CPU.Throttling.Periods,
+				ThrottledPeriods: m.CPU.Throttling.ThrottledPeriods,
+				ThrottledTime:    m.CPU.Throttling.ThrottledTime,
+			}
+		}
+	}
+	if m.Memory != nil {
+		s.MemoryStats.Stats = map[string]uint64{
+			"cache":         m.Memory.Cache,
+			"rss":           m.Memory.RSS,
+			"mapped_file":   m.Memory.MappedFile,
+			"pgfault":       m.Memory.PgFault,
+			"pgmajfault":    m.Memory.PgMajFault,
+			"inactive_file": m.Memory.InactiveFile,
+			"active_file":   m.Memory.ActiveFile,
+		}
+		if m.Memory.Usage != nil {
+			s.MemoryStats.Usage = m.Memory.Usage.Usage
+			s.MemoryStats.MaxUsage = m.Memory.Usage.Max
+			s.MemoryStats.Failcnt = m.Memory.Usage.Failcnt
+			s.MemoryStats.Limit = m.Memory.Usage.Limit
+		}
+	}
+	if m.Blkio != nil {
+		s.BlkioStats = types.BlkioStats{
+			IoServiceBytesRecursive: copyBlkioEntry(m.Blkio.IoServiceBytesRecursive),
+			IoServicedRecursive:     copyBlkioEntry(m.Blkio.IoServicedRecursive),
+		}
+	}
+	if m.Pids != nil {
+		s.PidsStats = types.PidsStats{Current: m.Pids.Current, Limit: m.Pids.Limit}
+	}
+	return s
+}
+
+func copyBlkioEntry(entries []*cgroups.BlkIOEntry) []types.BlkioStatEntry {
+	out := make([]types.BlkioStatEntry, len(entries))
+	for i, re := range entries {
+		out[i] = types.BlkioStatEntry{
+			Major: re.Major,
+			Minor: re.Minor,
+			Op:    re.Op,
+			Value: re.Value,
+		}
+	}
+	return out
+}
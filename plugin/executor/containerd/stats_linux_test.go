@@ -0,0 +1,29 @@
+package containerd
+
+import (
+	"testing"
+
+	"github.com/containerd/cgroups"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestStatsFromMetrics(t *testing.T) {
+	s := statsFromMetrics(&cgroups.Metrics{
+		CPU: &cgroups.CPUStat{Usage: &cgroups.CPUUsage{Total: 100, Kernel: 40, User: 60}},
+		Memory: &cgroups.MemoryStat{
+			RSS:   10,
+			Usage: &cgroups.MemoryEntry{Usage: 20, Max: 30, Limit: 40, Failcnt: 1},
+		},
+		Blkio: &cgroups.BlkIOStat{IoServiceBytesRecursive: []*cgroups.BlkIOEntry{{Op: "Read", Major: 8, Value: 512}}},
+	})
+	assert.Check(t, is.Equal(s.CPUStats.CPUUsage.TotalUsage, uint64(100)))
+	assert.Check(t, is.Equal(s.CPUStats.CPUUsage.UsageInKernelmode, uint64(40)))
+	assert.Check(t, is.Equal(s.MemoryStats.Usage, uint64(20)))
+	assert.Check(t, is.Equal(s.MemoryStats.Limit, uint64(40)))
+	assert.Check(t, is.Equal(s.MemoryStats.Stats["rss"], uint64(10)))
+	assert.Check(t, is.Len(s.BlkioStats.IoServiceBytesRecursive, 1))
+	assert.Check(t, is.Equal(s.BlkioStats.IoServiceBytesRecursive[0].Value, uint64(512)))
+
+	assert.Check(t, statsFromMetrics(nil) != nil)
+}
@@ -0,0 +1,122 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/plugin/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 10 * time.Second
+	defaultHealthRetries  = 3
+
+	// maxHealthResponse is the maximum size of a health response body that
+	// is read.
+	maxHealthResponse = 4096
+)
+
+// healthCheckParams returns the interval, timeout and retries of check,
+// filling in the defaults for unset values.
+func healthCheckParams(check types.PluginConfigHealthCheck) (interval, timeout time.Duration, retries int64) {
+	interval, timeout, retries = time.Duration(check.Interval), time.Duration(check.Timeout), check.Retries
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	if retries <= 0 {
+		retries = defaultHealthRetries
+	}
+	return interval, timeout, retries
+}
+
+// probeHealth requests path over the plugin socket at addr. It returns an
+// error if the plugin could not be reached, or reported itself unhealthy.
+func probeHealth(addr net.Addr, path string, timeout time.Duration) error {
+	if addr == nil {
+		return errors.New("plugin address is not set")
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, addr.Network(), addr.String())
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	client := &http.Client{Transport: tr, Timeout: timeout}
+	resp, err := client.Get("http://plugin/" + strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return errors.Wrap(err, "error requesting plugin health")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthResponse))
+	if err != nil {
+		return errors.Wrap(err, "error reading plugin health")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	if strings.EqualFold(strings.TrimSpace(string(body)), types.Unhealthy) {
+		return errors.New("plugin reported itself unhealthy")
+	}
+	return nil
+}
+
+// monitorHealth polls the health check of p until stop is closed. Once the
+// plugin is unhealthy, it is shut down so that it is restarted, unless the
+// controller says it should not be.
+func (pm *Manager) monitorHealth(p *v2.Plugin, c *controller, check types.PluginConfigHealthCheck, stop chan bool) {
+	interval, timeout, retries := healthCheckParams(check)
+	p.SetHealth(&types.PluginHealth{Status: types.Starting})
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-pm.clock().After(interval):
+		}
+
+		err := probeHealth(p.Addr(), check.Path, timeout)
+		if err == nil {
+			p.SetHealth(&types.PluginHealth{Status: types.Healthy})
+			continue
+		}
+
+		h := p.Health()
+		if h == nil {
+			h = &types.PluginHealth{Status: types.Starting}
+		}
+		h.FailingStreak++
+		h.LastError = err.Error()
+		logrus.WithError(err).WithField("plugin", p.Name()).WithField("failing-streak", h.FailingStreak).Debug("plugin health check failed")
+		if h.FailingStreak < retries {
+			p.SetHealth(h)
+			continue
+		}
+
+		h.Status = types.Unhealthy
+		p.SetHealth(h)
+
+		pm.mu.RLock()
+		restart := c.restart
+		pm.mu.RUnlock()
+		if restart {
+			logrus.WithError(err).WithField("plugin", p.Name()).Warn("plugin is unhealthy, restarting")
+			shutdownPlugin(p, stop, pm.executor, pm.clock(), pm.stopTimeout())
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/plugin/v2"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/poll"
+)
+
+func newHealthServer(t *testing.T, healthy *int32) (net.Addr, func()) {
+	dir, err := ioutil.TempDir("", "plugin-health")
+	assert.NilError(t, err)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "plugin.sock"))
+	assert.NilError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Health", func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(healthy) {
+		case 0:
+			w.Write([]byte("unhealthy"))
+		case 1:
+			w.Write([]byte("healthy"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	go http.Serve(l, mux)
+
+	return l.Addr(), func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProbeHealth(t *testing.T) {
+	var healthy int32 = 1
+	addr, cleanup := newHealthServer(t, &healthy)
+	defer cleanup()
+
+	assert.Check(t, probeHealth(addr, "/Plugin.Health", time.Second))
+
+	atomic.StoreInt32(&healthy, 0)
+	assert.Check(t, is.ErrorContains(probeHealth(addr, "/Plugin.Health", time.Second), "unhealthy"))
+
+	atomic.StoreInt32(&healthy, 2)
+	assert.Check(t, is.ErrorContains(probeHealth(addr, "/Plugin.Health", time.Second), "status 500"))
+
+	assert.Check(t, is.ErrorContains(probeHealth(addr, "/missing", time.Second), "status 404"))
+}
+
+func TestMonitorHealth(t *testing.T) {
+	var healthy int32 = 1
+	addr, cleanup := newHealthServer(t, &healthy)
+	defer cleanup()
+
+	p := &v2.Plugin{PluginObj: types.Plugin{Name: "health"}}
+	p.SetAddr(addr)
+
+	pm := &Manager{}
+	stop := make(chan bool)
+	check := types.PluginConfigHealthCheck{
+		Path:     "/Plugin.Health",
+		Interval: int64(10 * time.Millisecond),
+		Retries:  2,
+	}
+	done := make(chan struct{})
+	go func() {
+		pm.monitorHealth(p, &controller{}, check, stop)
+		close(done)
+	}()
+
+	pollStatus := func(status string) func(poll.LogT) poll.Result {
+		return func(poll.LogT) poll.Result {
+			if h := p.Health(); h != nil && h.Status == status {
+				return poll.Success()
+			}
+			return poll.Continue("plugin health is %v", p.Health())
+		}
+	}
+	poll.WaitOn(t, pollStatus(types.Healthy), poll.WithTimeout(5*time.Second))
+
+	atomic.StoreInt32(&healthy, 0)
+	poll.WaitOn(t, pollStatus(types.Unhealthy), poll.WithTimeout(5*time.Second))
+	assert.Check(t, p.Health().FailingStreak >= 2)
+	assert.Check(t, is.Contains(p.Health().LastError, "unhealthy"))
+
+	atomic.StoreInt32(&healthy, 1)
+	poll.WaitOn(t, pollStatus(types.Healthy), poll.WithTimeout(5*time.Second))
+	assert.Check(t, is.Equal(p.Health().FailingStreak, int64(0)))
+	assert.Check(t, is.Equal(p.Health().LastError, ""))
+
+	close(stop)
+	<-done
+}
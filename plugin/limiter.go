@@ -0,0 +1,44 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import "sync"
+
+// opLimiter limits the number of plugin lifecycle operations which run
+// concurrently. Operations beyond the limit wait for a slot. The zero value
+// is an unlimited limiter.
+type opLimiter struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	limit  int
+	active int
+}
+
+// acquire waits until an operation can run.
+func (l *opLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond.L == nil {
+		l.cond.L = &l.mu
+	}
+	for l.limit > 0 && l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release marks an operation started with acquire as done.
+func (l *opLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
+
+// setLimit changes the number of operations which may run concurrently. A
+// limit of 0 or less removes the limit. Operations already running are not
+// affected when the limit is lowered.
+func (l *opLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
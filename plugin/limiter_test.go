@@ -0,0 +1,48 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpLimiter(t *testing.T) {
+	var l opLimiter
+	l.setLimit(1)
+	l.acquire()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done int
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.acquire()
+			mu.Lock()
+			done++
+			mu.Unlock()
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if done != 0 {
+		t.Fatalf("expected operations beyond the limit to wait, %d ran", done)
+	}
+	mu.Unlock()
+
+	// Raising the limit lets the waiting operations run.
+	l.setLimit(3)
+	wg.Wait()
+
+	l.release()
+	l.release()
+	l.release()
+	l.setLimit(0)
+	for i := 0; i < 10; i++ {
+		l.acquire()
+	}
+}
@@ -0,0 +1,292 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// logBufferLines is the number of lines of output kept for each plugin.
+	logBufferLines = 1000
+	// logFollowBuffer is the number of lines buffered for each follower of
+	// the output of a plugin. Lines which do not fit are dropped rather than
+	// blocking the plugin.
+	logFollowBuffer = 256
+)
+
+// logBuffer is a ring buffer of the last lines of output of a plugin, which
+// also passes new lines on to followers.
+type logBuffer struct {
+	mu        sync.Mutex
+	lines     [][]byte
+	next      int
+	full      bool
+	followers map[chan []byte]struct{}
+	closed    bool
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{
+		lines:     make([][]byte, size),
+		followers: make(map[chan []byte]struct{}),
+	}
+}
+
+// add appends a line to the buffer, overwriting the oldest one if the
+// buffer is full, and sends it to the followers.
+func (b *logBuffer) add(line []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+	for ch := range b.followers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// tail returns the last n lines of the buffer, oldest first, or all of them
+// if n is negative. b.mu must be held.
+func (b *logBuffer) tail(n int) [][]byte {
+	var lines [][]byte
+	if b.full {
+		lines = append(lines, b.lines[b.next:]...)
+	}
+	lines = append(lines, b.lines[:b.next]...)
+	if n >= 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// last returns the last n lines of the buffer.
+func (b *logBuffer) last(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return string(bytes.Join(b.tail(n), nil))
+}
+
+// reader returns a reader of the last tail lines of the buffer, or of all
+// of them if tail is negative. If follow is true, the reader then returns
+// the lines added to the buffer until it is closed, or the buffer is.
+func (b *logBuffer) reader(follow bool, tail int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	r := &logReader{PipeReader: pr, done: make(chan struct{})}
+
+	b.mu.Lock()
+	lines := b.tail(tail)
+	var ch chan []byte
+	if follow && !b.closed {
+		ch = make(chan []byte, logFollowBuffer)
+		b.followers[ch] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	go func() {
+		defer pw.Close()
+		if ch != nil {
+			defer b.unfollow(ch)
+		}
+		for _, line := range lines {
+			if _, err := pw.Write(line); err != nil {
+				return
+			}
+		}
+		if ch == nil {
+			return
+		}
+		for {
+			select {
+			case line, ok := <-ch:
+				if !ok {
+					return
+				}
+				if _, err := pw.Write(line); err != nil {
+					return
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (b *logBuffer) unfollow(ch chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.followers[ch]; ok {
+		delete(b.followers, ch)
+		close(ch)
+	}
+}
+
+// close stops the followers of the buffer, and makes it drop new lines.
+func (b *logBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.followers {
+		delete(b.followers, ch)
+		close(ch)
+	}
+}
+
+// logReader is the reader returned by logBuffer.reader.
+type logReader struct {
+	*io.PipeReader
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *logReader) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return r.PipeReader.Close()
+}
+
+// logBufferWriter splits the output of a plugin into lines, and adds them
+// to a logBuffer.
+type logBufferWriter struct {
+	buf     *logBuffer
+	partial []byte
+}
+
+func (w *logBufferWriter) Write(p []byte) (int, error) {
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := make([]byte, i+1)
+		copy(line, data[:i+1])
+		w.buf.add(line)
+		data = data[i+1:]
+	}
+	w.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Close adds the last line of output, if it is not terminated by a newline.
+func (w *logBufferWriter) Close() error {
+	if len(w.partial) > 0 {
+		w.buf.add(append(w.partial, '\n'))
+		w.partial = nil
+	}
+	return nil
+}
+
+// teeWriteCloser writes to both the daemon log and the log buffer of a
+// plugin. It is safe for concurrent use, as the streams of a plugin are
+// shared by all its attaches.
+type teeWriteCloser struct {
+	mu  sync.Mutex
+	w   io.Writer
+	log io.WriteCloser
+	buf io.WriteCloser
+}
+
+func newTeeWriteCloser(log, buf io.WriteCloser) *teeWriteCloser {
+	return &teeWriteCloser{w: io.MultiWriter(buf, log), log: log, buf: buf}
+}
+
+func (t *teeWriteCloser) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.Write(p)
+}
+
+func (t *teeWriteCloser) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf.Close()
+	return t.log.Close()
+}
+
+// loggerState holds the log buffer of a plugin, and the streams its output
+// is written to. The streams are created once, and reused each time the
+// plugin is attached to, as each of them runs a goroutine until it is
+// closed when the plugin is removed.
+type loggerState struct {
+	buf            *logBuffer
+	stdout, stderr *teeWriteCloser
+}
+
+// loggerState returns the logger state of the plugin with the given ID,
+// creating it if needed.
+func (pm *Manager) loggerState(id string) *loggerState {
+	pm.logsMu.Lock()
+	defer pm.logsMu.Unlock()
+
+	if pm.loggers == nil {
+		pm.loggers = make(map[string]*loggerState)
+	}
+	state, ok := pm.loggers[id]
+	if !ok {
+		// The output of the plugin goes through the logger of the daemon,
+		// so that it follows its level: stdout is logged as info, and
+		// stderr as errors, which are still shown when only warnings are.
+		logger := logrus.WithField("plugin", id)
+		buf := newLogBuffer(logBufferLines)
+		state = &loggerState{
+			buf:    buf,
+			stdout: newTeeWriteCloser(logger.WriterLevel(logrus.InfoLevel), &logBufferWriter{buf: buf}),
+			stderr: newTeeWriteCloser(logger.WriterLevel(logrus.ErrorLevel), &logBufferWriter{buf: buf}),
+		}
+		pm.loggers[id] = state
+	}
+	return state
+}
+
+// logBuffer returns the log buffer of the plugin with the given ID, or nil
+// if it was not started since the daemon started. Unlike loggerState, it
+// never creates the buffer.
+func (pm *Manager) logBuffer(id string) *logBuffer {
+	pm.logsMu.Lock()
+	defer pm.logsMu.Unlock()
+
+	if state, ok := pm.loggers[id]; ok {
+		return state.buf
+	}
+	return nil
+}
+
+// removeLogger closes the streams and the log buffer of the plugin with the
+// given ID, ending the streams following it.
+func (pm *Manager) removeLogger(id string) {
+	pm.logsMu.Lock()
+	state, ok := pm.loggers[id]
+	delete(pm.loggers, id)
+	pm.logsMu.Unlock()
+
+	if ok {
+		state.stdout.Close()
+		state.stderr.Close()
+		state.buf.close()
+	}
+}
+
+// makeLoggerStreams returns the streams to attach to the stdout and stderr
+// of the plugin with the given ID, which write its output to the daemon log
+// and to the log buffer of the plugin. Closing them, as the executor does
+// when the plugin exits, does not close the shared streams of the plugin.
+func (pm *Manager) makeLoggerStreams(id string) (stdout, stderr io.WriteCloser) {
+	state := pm.loggerState(id)
+	return ioutils.NopWriteCloser(state.stdout), ioutils.NopWriteCloser(state.stderr)
+}
@@ -0,0 +1,154 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/poll"
+)
+
+func TestLogBufferTail(t *testing.T) {
+	buf := newLogBuffer(3)
+	w := &logBufferWriter{buf: buf}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree\nfour\nfive"))
+
+	for _, tc := range []struct {
+		tail     int
+		expected string
+	}{
+		{tail: -1, expected: "two\nthree\nfour\n"},
+		{tail: 2, expected: "three\nfour\n"},
+		{tail: 0, expected: ""},
+		{tail: 10, expected: "two\nthree\nfour\n"},
+	} {
+		out, err := ioutil.ReadAll(buf.reader(false, tc.tail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tc.expected {
+			t.Fatalf("tail %d: expected %q, got %q", tc.tail, tc.expected, out)
+		}
+	}
+
+	// Closing the writer adds the unterminated last line.
+	w.Close()
+	out, err := ioutil.ReadAll(buf.reader(false, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "five\n" {
+		t.Fatalf("expected the last line, got %q", out)
+	}
+}
+
+func TestLogBufferFollow(t *testing.T) {
+	buf := newLogBuffer(10)
+	buf.add([]byte("old\n"))
+
+	r := buf.reader(true, -1)
+	lines := bufio.NewScanner(r)
+	if !lines.Scan() || lines.Text() != "old" {
+		t.Fatalf("expected the buffered line, got %q", lines.Text())
+	}
+	buf.add([]byte("new\n"))
+	if !lines.Scan() || lines.Text() != "new" {
+		t.Fatalf("expected the new line, got %q", lines.Text())
+	}
+
+	// Closing the buffer, as when the plugin is removed, ends the stream.
+	buf.close()
+	if lines.Scan() {
+		t.Fatalf("expected the stream to end, got %q", lines.Text())
+	}
+	if err := lines.Err(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// Closing the reader stops following.
+	buf = newLogBuffer(10)
+	r = buf.reader(true, -1)
+	r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected reading a closed reader to fail")
+	}
+	buf.add([]byte("ignored\n"))
+}
+
+func TestLoggerStreamsReused(t *testing.T) {
+	m := &Manager{}
+	stdout, stderr := m.makeLoggerStreams("id")
+	// The executor closes the streams when the plugin exits.
+	stdout.Close()
+	stderr.Close()
+
+	stdout, _ = m.makeLoggerStreams("id")
+	if len(m.loggers) != 1 {
+		t.Fatalf("expected the streams of the plugin to be reused, got %d loggers", len(m.loggers))
+	}
+	if _, err := stdout.Write([]byte("still attached\n")); err != nil {
+		t.Fatal(err)
+	}
+	if out := m.logBuffer("id").last(1); out != "still attached\n" {
+		t.Fatalf("expected the output to be buffered, got %q", out)
+	}
+
+	// Removing the plugin closes its streams.
+	m.removeLogger("id")
+	if len(m.loggers) != 0 {
+		t.Fatalf("expected the logger of the plugin to be removed, got %d loggers", len(m.loggers))
+	}
+	if _, err := stdout.Write([]byte("detached\n")); err == nil {
+		t.Fatal("expected writing to the streams of a removed plugin to fail")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggerStreamsLevels(t *testing.T) {
+	out := &syncBuffer{}
+	logger := logrus.StandardLogger()
+	defer logrus.SetOutput(logger.Out)
+	defer logrus.SetFormatter(logger.Formatter)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetOutput(out)
+	logrus.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	logrus.SetLevel(logrus.InfoLevel)
+
+	m := &Manager{}
+	defer m.removeLogger("id")
+	stdout, stderr := m.makeLoggerStreams("id")
+	stdout.Write([]byte("started\n"))
+	stderr.Write([]byte("failed\n"))
+
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		logged := out.String()
+		if strings.Contains(logged, "level=info msg=started plugin=id") && strings.Contains(logged, "level=error msg=failed plugin=id") {
+			return poll.Success()
+		}
+		return poll.Continue("plugin output not logged at its level yet: %q", logged)
+	}, poll.WithDelay(time.Millisecond), poll.WithTimeout(5*time.Second))
+}
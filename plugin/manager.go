@@ -2,18 +2,24 @@ package plugin // import "github.com/docker/docker/plugin"
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
 	"github.com/docker/docker/pkg/authorization"
@@ -32,6 +38,13 @@ import (
 const configFileName = "config.json"
 const rootFSFileName = "rootfs"
 
+// exitEventWindow is how long exit events for a plugin are coalesced before
+// they are processed.
+const exitEventWindow = 100 * time.Millisecond
+
+// waitEnabledInterval is how often WaitEnabled checks the state of a plugin.
+const waitEnabledInterval = 50 * time.Millisecond
+
 var validFullID = regexp.MustCompile(`^([a-f0-9]{64})$`)
 
 // Executor is the interface that the plugin manager uses to interact with for starting/stopping plugins
@@ -42,6 +55,25 @@ type Executor interface {
 	Signal(id string, signal int) error
 }
 
+// CheckpointExecutor is implemented by executors which can checkpoint a
+// running plugin to disk, and restore it from the checkpoint later.
+type CheckpointExecutor interface {
+	Executor
+	// Checkpoint checkpoints the plugin to checkpointDir, and stops it.
+	Checkpoint(id, checkpointDir string) error
+	// CreateFromCheckpoint is like Create, but restores the plugin process
+	// from the checkpoint in checkpointDir.
+	CreateFromCheckpoint(id string, spec specs.Spec, checkpointDir string, stdout, stderr io.WriteCloser) error
+}
+
+// StatsExecutor is implemented by executors which can report the resource
+// usage of a running plugin.
+type StatsExecutor interface {
+	Executor
+	// Stats returns the CPU, memory, and block IO usage of the plugin.
+	Stats(id string) (*types.Stats, error)
+}
+
 func (pm *Manager) restorePlugin(p *v2.Plugin, c *controller) error {
 	if p.IsEnabled() {
 		return pm.restore(p, c)
@@ -61,8 +93,86 @@ type ManagerConfig struct {
 	ExecRoot           string
 	CreateExecutor     ExecutorCreator
 	AuthzMiddleware    *authorization.Middleware
+	// Proxy is used for plugin pulls and pushes, and is passed to plugin
+	// processes through their environment.
+	Proxy ProxyConfig
+	// CleanupGracePeriod delays cleaning up the bundle and mounts of a
+	// plugin which exited and is not restarted. The cleanup is skipped if
+	// the plugin is enabled again in the meantime.
+	CleanupGracePeriod time.Duration
+	// ReadOnlyRoots are additional directories plugins are loaded from, in
+	// priority order, after Root. Plugins in these directories are never
+	// modified on disk: they cannot be removed or upgraded, and changes to
+	// their state are not persisted. New plugins are always installed in
+	// Root.
+	ReadOnlyRoots []string
+	// Umask, if set, is the octal umask plugin processes are run with, such
+	// as "0027". It requires /bin/sh in the plugin rootfs; plugins without a
+	// shell are run with the default umask.
+	Umask string
+	// RequiredPlugins are the names or IDs of plugins which must be
+	// installed, and which must be restored or enabled successfully if
+	// they are enabled, for NewManager to succeed.
+	RequiredPlugins []string
+	// MaxConcurrentOperations limits the number of plugin lifecycle
+	// operations, such as enable, disable, and remove, which run at the same
+	// time across all plugins. Further operations wait for one to finish. A
+	// value of 0 means no limit. It can be changed with
+	// SetMaxConcurrentOperations.
+	MaxConcurrentOperations int
+	// AllowedPlugins, if set, are patterns of the only plugin references
+	// which can be installed, such as "registry.internal/*". DeniedPlugins
+	// are patterns of plugin references which cannot be installed, even if
+	// they are allowed.
+	AllowedPlugins []string
+	DeniedPlugins  []string
+	// Clock is the source of time for restarts, timeouts, and backoffs. It
+	// defaults to the wall clock.
+	Clock Clock
+	// PropagatedMountCapabilities are the capabilities of the docker 1.x
+	// plugin interface types, such as "volumedriver", for which the
+	// PropagatedMount of a plugin is set up. It defaults to
+	// defaultPropagatedMountCapabilities.
+	PropagatedMountCapabilities []string
+	// StopTimeout is how long plugins are given to exit after they are
+	// sent SIGTERM, when they are disabled or the daemon shuts down, before
+	// they are killed. It defaults to defaultStopTimeout.
+	StopTimeout time.Duration
+	// RestoreConcurrency limits the number of plugins which are restored at
+	// the same time when the manager is created. It defaults to GOMAXPROCS.
+	RestoreConcurrency int
+	// Resources are the default resource limits of plugins, which can be
+	// overridden when a plugin is enabled. A plugin which exceeds its memory
+	// limit is killed, and restarted according to its restart policy.
+	Resources types.PluginResources
+}
+
+// defaultStopTimeout is how long plugins are given to exit when they are
+// stopped, unless ManagerConfig.StopTimeout is set.
+const defaultStopTimeout = 10 * time.Second
+
+// stopTimeout returns how long plugins are given to exit when they are
+// stopped.
+func (pm *Manager) stopTimeout() time.Duration {
+	if pm.config.StopTimeout <= 0 {
+		return defaultStopTimeout
+	}
+	return pm.config.StopTimeout
+}
+
+// restoreConcurrency returns the number of plugins which are restored at the
+// same time.
+func (pm *Manager) restoreConcurrency() int {
+	if pm.config.RestoreConcurrency <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return pm.config.RestoreConcurrency
 }
 
+// defaultPropagatedMountCapabilities are the plugin capabilities which need
+// mount propagation, unless ManagerConfig.PropagatedMountCapabilities is set.
+var defaultPropagatedMountCapabilities = []string{"volumedriver", "graphdriver"}
+
 // ExecutorCreator is used in the manager config to pass in an `Executor`
 type ExecutorCreator func(*Manager) (Executor, error)
 
@@ -75,19 +185,116 @@ type Manager struct {
 	blobStore *basicBlobStore
 	publisher *pubsub.Publisher
 	executor  Executor
+
+	// readOnlyRoots maps the IDs of plugins loaded from one of the
+	// read-only roots to that root. It is only written by reload.
+	readOnlyRoots map[string]string
+
+	exitEventWindow time.Duration
+	exitMu          sync.Mutex // protects pendingExits
+	pendingExits    map[string]*pendingExit
+
+	ops    opLimiter
+	policy installPolicy
+
+	// propagatedMountCapabilities is the set of capabilities for which
+	// the PropagatedMount of plugins is set up.
+	propagatedMountCapabilities map[string]bool
+
+	logsMu  sync.Mutex // protects loggers
+	loggers map[string]*loggerState
+}
+
+// propagatedMountCapabilities returns the set of the given capabilities, or
+// of the default ones if capabilities is nil.
+func propagatedMountCapabilities(capabilities []string) map[string]bool {
+	if capabilities == nil {
+		capabilities = defaultPropagatedMountCapabilities
+	}
+	set := make(map[string]bool, len(capabilities))
+	for _, capability := range capabilities {
+		set[capability] = true
+	}
+	return set
+}
+
+// needsPropagatedMount reports whether plugins implementing the interface
+// type typ need their PropagatedMount to be set up.
+func (pm *Manager) needsPropagatedMount(typ types.PluginInterfaceType) bool {
+	return pm.propagatedMountCapabilities[typ.Capability] && typ.Prefix == "docker" && strings.HasPrefix(typ.Version, "1.")
 }
 
 // controller represents the manager's control on a plugin.
 type controller struct {
+	// restart is whether the plugin is restarted if it exits. It is reset
+	// each time the plugin is started, whereas disabled is set for good once
+	// the plugin is disabled, so that a restart which is in progress or
+	// pending cannot bring it back. Both are guarded by the lock of the
+	// manager. lifecycle serializes restarting the plugin and disabling it.
 	restart       bool
+	disabled      bool
+	lifecycle     sync.Mutex
 	exitChan      chan bool
 	timeoutInSecs int
+	// entrypoint and args override the plugin's command for as long as
+	// the plugin stays enabled. They are never persisted.
+	entrypoint []string
+	args       []string
+	// spec is the runtime spec the plugin was last started with.
+	spec *specs.Spec
+	// restartPolicy decides whether the plugin is restarted when it exits
+	// unexpectedly. restartCount is the number of restarts since the plugin
+	// was enabled, backoff the delay before the last one, startedAt the
+	// time the plugin last started, and exits the times it exited within
+	// the crash loop window.
+	restartPolicy container.RestartPolicy
+	restartCount  int
+	backoff       time.Duration
+	startedAt     time.Time
+	exits         []time.Time
+	// resources are the resource limits requested when the plugin was
+	// enabled. Unset limits default to those of the manager.
+	resources types.PluginResources
+}
+
+// validateEnableConfig checks the restart policy and the resource limits
+// of config, before a plugin is enabled with it.
+func validateEnableConfig(config *types.PluginEnableConfig) error {
+	if err := validateRestartPolicy(config.RestartPolicy); err != nil {
+		return err
+	}
+	return validateResources(config.Resources)
+}
+
+// newController returns the controller of a plugin enabled with config,
+// which must have been validated with validateEnableConfig.
+func newController(config *types.PluginEnableConfig) *controller {
+	return &controller{
+		timeoutInSecs: config.Timeout,
+		entrypoint:    config.Entrypoint,
+		args:          config.Args,
+		restartPolicy: config.RestartPolicy,
+		resources:     config.Resources,
+	}
+}
+
+// enableConfig returns the config the plugin controlled by c was enabled
+// with, to enable it again with the same settings.
+func (c *controller) enableConfig() *types.PluginEnableConfig {
+	return &types.PluginEnableConfig{
+		Timeout:       c.timeoutInSecs,
+		Entrypoint:    c.entrypoint,
+		Args:          c.args,
+		RestartPolicy: c.restartPolicy,
+		Resources:     c.resources,
+	}
 }
 
 // pluginRegistryService ensures that all resolved repositories
 // are of the plugin class.
 type pluginRegistryService struct {
 	registry.Service
+	proxy func(*http.Request) (*url.URL, error)
 }
 
 func (s pluginRegistryService) ResolveRepository(name reference.Named) (repoInfo *registry.RepositoryInfo, err error) {
@@ -98,36 +305,79 @@ func (s pluginRegistryService) ResolveRepository(name reference.Named) (repoInfo
 	return
 }
 
+func (s pluginRegistryService) LookupPullEndpoints(hostname string) ([]registry.APIEndpoint, error) {
+	endpoints, err := s.Service.LookupPullEndpoints(hostname)
+	if s.proxy != nil {
+		endpoints = withProxy(endpoints, s.proxy)
+	}
+	return endpoints, err
+}
+
+func (s pluginRegistryService) LookupPushEndpoints(hostname string) ([]registry.APIEndpoint, error) {
+	endpoints, err := s.Service.LookupPushEndpoints(hostname)
+	if s.proxy != nil {
+		endpoints = withProxy(endpoints, s.proxy)
+	}
+	return endpoints, err
+}
+
 // NewManager returns a new plugin manager.
 func NewManager(config ManagerConfig) (*Manager, error) {
+	if config.Umask != "" {
+		if _, err := parseUmask(config.Umask); err != nil {
+			return nil, errors.Wrap(err, "invalid plugin umask")
+		}
+	}
+	if err := validateResources(config.Resources); err != nil {
+		return nil, errors.Wrap(err, "invalid plugin resource limits")
+	}
+	policy, err := newInstallPolicy(config.AllowedPlugins, config.DeniedPlugins)
+	if err != nil {
+		return nil, err
+	}
 	if config.RegistryService != nil {
-		config.RegistryService = pluginRegistryService{config.RegistryService}
+		rs := pluginRegistryService{Service: config.RegistryService}
+		if !config.Proxy.IsZero() {
+			proxy, err := config.Proxy.ProxyFunc()
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid plugin proxy configuration")
+			}
+			rs.proxy = proxy
+		}
+		config.RegistryService = rs
 	}
 	manager := &Manager{
-		config: config,
+		config:          config,
+		exitEventWindow: exitEventWindow,
+		pendingExits:    make(map[string]*pendingExit),
+		policy:          policy,
 	}
+	manager.ops.setLimit(config.MaxConcurrentOperations)
+	manager.propagatedMountCapabilities = propagatedMountCapabilities(config.PropagatedMountCapabilities)
 	for _, dirName := range []string{manager.config.Root, manager.config.ExecRoot, manager.tmpDir()} {
 		if err := os.MkdirAll(dirName, 0700); err != nil {
 			return nil, errors.Wrapf(err, "failed to mkdir %v", dirName)
 		}
 	}
-	var err error
-	manager.executor, err = config.CreateExecutor(manager)
+	executor, err := config.CreateExecutor(manager)
 	if err != nil {
 		return nil, err
 	}
+	if executor != nil {
+		manager.executor = newReconnectingExecutor(manager, executor)
+	}
 
 	manager.blobStore, err = newBasicBlobStore(filepath.Join(manager.config.Root, "storage/blobs"))
 	if err != nil {
 		return nil, err
 	}
 
+	// Plugins may exit, and publish events, while they are restored.
+	manager.publisher = pubsub.NewPublisher(0, 0)
 	manager.cMap = make(map[*v2.Plugin]*controller)
 	if err := manager.reload(); err != nil {
 		return nil, errors.Wrap(err, "failed to restore plugins")
 	}
-
-	manager.publisher = pubsub.NewPublisher(0, 0)
 	return manager, nil
 }
 
@@ -135,6 +385,26 @@ func (pm *Manager) tmpDir() string {
 	return filepath.Join(pm.config.Root, "tmp")
 }
 
+// pluginDir returns the directory holding the plugin with the given ID.
+func (pm *Manager) pluginDir(id string) string {
+	if root, ok := pm.readOnlyRoots[id]; ok {
+		return filepath.Join(root, id)
+	}
+	return filepath.Join(pm.config.Root, id)
+}
+
+// checkpointDir returns the directory holding the checkpoint of the plugin
+// with the given ID.
+func (pm *Manager) checkpointDir(id string) string {
+	return filepath.Join(pm.pluginDir(id), "checkpoint")
+}
+
+// isReadOnly reports whether the plugin was loaded from a read-only root.
+func (pm *Manager) isReadOnly(id string) bool {
+	_, ok := pm.readOnlyRoots[id]
+	return ok
+}
+
 // HandleExitEvent is called when the executor receives the exit event
 // In the future we may change this, but for now all we care about is the exit event.
 func (pm *Manager) HandleExitEvent(id string) error {
@@ -143,26 +413,174 @@ func (pm *Manager) HandleExitEvent(id string) error {
 		return err
 	}
 
-	if err := os.RemoveAll(filepath.Join(pm.config.ExecRoot, id)); err != nil && !os.IsNotExist(err) {
-		logrus.WithError(err).WithField("id", id).Error("Could not remove plugin bundle dir")
-	}
-
 	pm.mu.RLock()
 	c := pm.cMap[p]
 	if c.exitChan != nil {
 		close(c.exitChan)
 		c.exitChan = nil // ignore duplicate events (containerd issue #2299)
 	}
-	restart := c.restart
 	pm.mu.RUnlock()
 
+	if pm.exitEventWindow <= 0 {
+		return pm.processExitEvent(p, c)
+	}
+
+	// Coalesce the events received for a plugin within the window, so that
+	// a flapping plugin is only restarted or cleaned up once, based on the
+	// state observed when the window expires.
+	pm.exitMu.Lock()
+	defer pm.exitMu.Unlock()
+	if e, ok := pm.pendingExits[id]; ok {
+		e.c = c
+		e.timer.Reset(pm.exitEventWindow)
+		return nil
+	}
+	e := &pendingExit{p: p, c: c}
+	e.timer = pm.clock().AfterFunc(pm.exitEventWindow, func() {
+		pm.exitMu.Lock()
+		if pm.pendingExits[id] != e {
+			// Already processed by flushExitEvents.
+			pm.exitMu.Unlock()
+			return
+		}
+		delete(pm.pendingExits, id)
+		c := e.c
+		pm.exitMu.Unlock()
+
+		if err := pm.processExitEvent(p, c); err != nil {
+			logrus.WithError(err).WithField("id", id).Error("Could not handle plugin exit")
+		}
+	})
+	pm.pendingExits[id] = e
+	return nil
+}
+
+// pendingExit is an exit event waiting for the coalescing window to expire.
+// c is only accessed with Manager.exitMu held.
+type pendingExit struct {
+	p     *v2.Plugin
+	c     *controller
+	timer Timer
+}
+
+// flushExitEvents processes the pending exit events right away.
+func (pm *Manager) flushExitEvents() {
+	pm.exitMu.Lock()
+	pending := pm.pendingExits
+	pm.pendingExits = make(map[string]*pendingExit)
+	pm.exitMu.Unlock()
+
+	for id, e := range pending {
+		e.timer.Stop()
+		if err := pm.processExitEvent(e.p, e.c); err != nil {
+			logrus.WithError(err).WithField("id", id).Error("Could not handle plugin exit")
+		}
+	}
+}
+
+// processExitEvent restarts or cleans up the plugin after it exited.
+func (pm *Manager) processExitEvent(p *v2.Plugin, c *controller) error {
+	id := p.GetID()
+
+	pm.mu.Lock()
+	if pm.cMap[p] != c || c.exitChan != nil {
+		// The plugin was removed or enabled again since it exited.
+		pm.mu.Unlock()
+		return nil
+	}
+	var (
+		delay   time.Duration
+		restart = c.restart && !c.disabled
+		reason  string
+	)
 	if restart {
-		pm.enable(p, c, true)
-	} else {
-		if err := mount.RecursiveUnmount(filepath.Join(pm.config.Root, id)); err != nil {
-			return errors.Wrap(err, "error cleaning up plugin mounts")
+		now := pm.clock().Now()
+		if c.crashLooping(now) {
+			restart = false
+			reason = fmt.Sprintf("it exited %d times within %v", len(c.exits), crashLoopWindow)
+		} else if delay, restart = c.nextRestart(now); !restart {
+			reason = fmt.Sprintf("it exited, and its restart policy %q does not allow restarting it after %d restarts", c.restartPolicy.Name, c.restartCount)
 		}
 	}
+	pm.mu.Unlock()
+
+	if restart {
+		pm.clock().AfterFunc(delay, func() {
+			c.lifecycle.Lock()
+			defer c.lifecycle.Unlock()
+			pm.mu.RLock()
+			current := pm.cMap[p] == c && c.restart && !c.disabled
+			pm.mu.RUnlock()
+			if !current {
+				// The plugin was disabled, removed, or enabled again.
+				return
+			}
+			// The bundle dir is reused by the restarted plugin; only remove
+			// the stale socket so that the plugin can listen on it again.
+			if err := os.Remove(filepath.Join(pm.config.ExecRoot, id, p.GetSocket())); err != nil && !os.IsNotExist(err) {
+				logrus.WithError(err).WithField("id", id).Error("Could not remove plugin socket")
+			}
+			if err := pm.enable(p, c, true); err != nil {
+				logrus.WithError(err).WithField("id", id).Error("Could not restart plugin")
+				return
+			}
+			pm.publisher.Publish(EventRestart{Plugin: p.Object(), Time: pm.clock().Now()})
+		})
+		pm.publisher.Publish(EventExit{Plugin: p.Object(), Restarting: true, Time: pm.clock().Now()})
+		return nil
+	}
+
+	if reason != "" {
+		pm.markFailed(p, reason)
+	}
+	pm.publisher.Publish(EventExit{Plugin: p.Object(), Time: pm.clock().Now()})
+
+	if pm.config.CleanupGracePeriod > 0 {
+		pm.clock().AfterFunc(pm.config.CleanupGracePeriod, func() {
+			// Hold the lock so that the plugin cannot be enabled again
+			// while it is being cleaned up.
+			pm.mu.RLock()
+			defer pm.mu.RUnlock()
+			if pm.cMap[p] != c || c.exitChan != nil {
+				// The plugin was enabled again.
+				return
+			}
+			if err := pm.cleanupPlugin(id); err != nil {
+				logrus.WithError(err).WithField("id", id).Error("Could not clean up plugin")
+			}
+		})
+		return nil
+	}
+	return pm.cleanupPlugin(id)
+}
+
+// markFailed disables a plugin which is not restarted after it exited, and
+// marks it as failed, logging reason along with the last lines of its
+// output.
+func (pm *Manager) markFailed(p *v2.Plugin, reason string) {
+	id := p.GetID()
+	pm.config.Store.SetState(p, false)
+	p.SetFailed(true)
+	p.SetHealth(nil)
+	if err := pm.save(p); err != nil {
+		logrus.WithError(err).WithField("id", id).Error("Could not save plugin state")
+	}
+	var output string
+	if buf := pm.logBuffer(id); buf != nil {
+		output = buf.last(failedLogLines)
+	}
+	logrus.WithField("id", id).Errorf("plugin %s failed and was disabled because %s: fix the plugin or its settings, then enable it again. Last output of the plugin:\n%s", p.Name(), reason, output)
+}
+
+// cleanupPlugin removes the bundle dir of an exited plugin, and unmounts its
+// mounts.
+func (pm *Manager) cleanupPlugin(id string) error {
+	if err := os.RemoveAll(filepath.Join(pm.config.ExecRoot, id)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("id", id).Error("Could not remove plugin bundle dir")
+	}
+	if err := pm.retryMount(func() error { return mount.RecursiveUnmount(pm.pluginDir(id)) }); err != nil {
+		return errors.Wrap(err, "error cleaning up plugin mounts")
+	}
 	return nil
 }
 
@@ -179,25 +597,99 @@ func handleLoadError(err error, id string) {
 	logger.Error("error loading plugin, skipping")
 }
 
-func (pm *Manager) reload() error { // todo: restore
-	dir, err := ioutil.ReadDir(pm.config.Root)
+// propagatedMountPath returns the path of the PropagatedMount mnt of a
+// plugin within its rootfs. It fails if the path, once cleaned and once its
+// symlinks are followed, is not strictly within the rootfs, so that a
+// plugin config cannot make the daemon touch files outside of its rootfs.
+func propagatedMountPath(rootfs, mnt string) (string, error) {
+	if mnt == "" {
+		return "", nil
+	}
+	path := filepath.Join(rootfs, mnt)
+	if !isWithin(rootfs, path) {
+		return "", errors.Errorf("invalid PropagatedMount %q: must be within the plugin rootfs", mnt)
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(rootfs)
 	if err != nil {
-		return errors.Wrapf(err, "failed to read %v", pm.config.Root)
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		return "", errors.Wrap(err, "error resolving the plugin rootfs")
 	}
+	// Only the longest existing prefix of the path can be resolved, as the
+	// rest may not have been created yet.
+	existing := path
+	for existing != rootfs {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", errors.Wrapf(err, "error resolving PropagatedMount %q", mnt)
+	}
+	resolved = filepath.Join(resolved, strings.TrimPrefix(path, existing))
+	if !isWithin(resolvedRoot, resolved) {
+		return "", errors.Errorf("invalid PropagatedMount %q: resolves to %s, outside of the plugin rootfs", mnt, resolved)
+	}
+	return path, nil
+}
+
+// isWithin reports whether path is strictly within the directory root. Both
+// must be clean.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (pm *Manager) reload() error { // todo: restore
 	plugins := make(map[string]*v2.Plugin)
-	for _, v := range dir {
-		if validFullID.MatchString(v.Name()) {
-			p, err := pm.loadPlugin(v.Name())
-			if err != nil {
-				handleLoadError(err, v.Name())
+	names := make(map[string]string)
+	pm.readOnlyRoots = make(map[string]string)
+	for i, root := range append([]string{pm.config.Root}, pm.config.ReadOnlyRoots...) {
+		readOnly := i > 0
+		dir, err := ioutil.ReadDir(root)
+		if err != nil {
+			if readOnly {
+				logrus.WithError(err).WithField("root", root).Warn("failed to read read-only plugin root, skipping")
 				continue
 			}
-			plugins[p.GetID()] = p
-		} else {
-			if validFullID.MatchString(strings.TrimSuffix(v.Name(), "-removing")) {
-				// There was likely some error while removing this plugin, let's try to remove again here
-				if err := system.EnsureRemoveAll(v.Name()); err != nil {
-					logrus.WithError(err).WithField("id", v.Name()).Warn("error while attempting to clean up previously removed plugin")
+			return errors.Wrapf(err, "failed to read %v", root)
+		}
+		for _, v := range dir {
+			if validFullID.MatchString(v.Name()) {
+				p, err := pm.loadPlugin(root, v.Name())
+				if err != nil {
+					handleLoadError(err, v.Name())
+					continue
+				}
+				// Plugins from higher priority roots win.
+				logger := logrus.WithField("id", p.GetID()).WithField("root", root)
+				if _, exists := plugins[p.GetID()]; exists {
+					logger.Warn("a plugin with the same ID was loaded from a higher priority root, skipping")
+					continue
+				}
+				if id, exists := names[p.Name()]; exists {
+					logger.WithField("name", p.Name()).Warnf("plugin %s with the same name was loaded from a higher priority root, skipping", id)
+					continue
+				}
+				if _, err := propagatedMountPath(filepath.Join(root, p.GetID(), rootFSFileName), p.PluginObj.Config.PropagatedMount); err != nil {
+					handleLoadError(err, p.GetID())
+					continue
+				}
+				plugins[p.GetID()] = p
+				names[p.Name()] = p.GetID()
+				if readOnly {
+					pm.readOnlyRoots[p.GetID()] = root
+				}
+			} else if !readOnly {
+				if validFullID.MatchString(strings.TrimSuffix(v.Name(), "-removing")) {
+					// There was likely some error while removing this plugin, let's try to remove again here
+					if err := system.EnsureRemoveAll(v.Name()); err != nil {
+						logrus.WithError(err).WithField("id", v.Name()).Warn("error while attempting to clean up previously removed plugin")
+					}
 				}
 			}
 		}
@@ -205,43 +697,84 @@ func (pm *Manager) reload() error { // todo: restore
 
 	pm.config.Store.SetAll(plugins)
 
-	var wg sync.WaitGroup
+	required, err := pm.requiredPlugins(plugins)
+	if err != nil {
+		return err
+	}
+	var (
+		wg           sync.WaitGroup
+		requiredMu   sync.Mutex
+		requiredErrs []string
+	)
+	failRequired := func(p *v2.Plugin, err error) {
+		if required[p.GetID()] {
+			requiredMu.Lock()
+			requiredErrs = append(requiredErrs, fmt.Sprintf("%s: %v", p.Name(), err))
+			requiredMu.Unlock()
+		}
+	}
+	// Plugins are restored after the plugins they depend on. As they are
+	// started in that order, a plugin waiting for its dependencies cannot
+	// keep them from getting a slot.
+	order, deps, err := restoreOrder(plugins)
+	if err != nil {
+		logrus.WithError(err).Error("plugins in a dependency cycle are restored without waiting for each other")
+	}
+	done := make(map[string]chan struct{}, len(plugins))
+	for id := range plugins {
+		done[id] = make(chan struct{})
+	}
+
+	// Restoring a plugin may start it, so restores are bounded so as not to
+	// overload containerd when there are many plugins.
+	sem := make(chan struct{}, pm.restoreConcurrency())
 	wg.Add(len(plugins))
-	for _, p := range plugins {
+	for _, p := range order {
 		c := &controller{exitChan: make(chan bool)}
 		pm.mu.Lock()
 		pm.cMap[p] = c
 		pm.mu.Unlock()
 
+		sem <- struct{}{}
 		go func(p *v2.Plugin) {
-			defer wg.Done()
+			defer func() {
+				close(done[p.GetID()])
+				<-sem
+				wg.Done()
+			}()
+			for _, dep := range deps[p.GetID()] {
+				<-done[dep]
+			}
 			if err := pm.restorePlugin(p, c); err != nil {
 				logrus.WithError(err).WithField("id", p.GetID()).Error("Failed to restore plugin")
+				failRequired(p, err)
 				return
 			}
 
 			if p.Rootfs != "" {
-				p.Rootfs = filepath.Join(pm.config.Root, p.PluginObj.ID, "rootfs")
+				p.Rootfs = filepath.Join(pm.pluginDir(p.PluginObj.ID), "rootfs")
 			}
 
 			// We should only enable rootfs propagation for certain plugin types that need it.
 			for _, typ := range p.PluginObj.Config.Interface.Types {
-				if (typ.Capability == "volumedriver" || typ.Capability == "graphdriver") && typ.Prefix == "docker" && strings.HasPrefix(typ.Version, "1.") {
+				if pm.needsPropagatedMount(typ) {
 					if p.PluginObj.Config.PropagatedMount != "" {
 						propRoot := filepath.Join(filepath.Dir(p.Rootfs), "propagated-mount")
 
 						// check if we need to migrate an older propagated mount from before
 						// these mounts were stored outside the plugin rootfs
 						if _, err := os.Stat(propRoot); os.IsNotExist(err) {
-							rootfsProp := filepath.Join(p.Rootfs, p.PluginObj.Config.PropagatedMount)
-							if _, err := os.Stat(rootfsProp); err == nil {
+							rootfsProp, err := propagatedMountPath(p.Rootfs, p.PluginObj.Config.PropagatedMount)
+							if err != nil {
+								logrus.WithError(err).WithField("id", p.GetID()).Error("not migrating propagated mount storage")
+							} else if _, err := os.Stat(rootfsProp); err == nil {
 								if err := os.Rename(rootfsProp, propRoot); err != nil {
 									logrus.WithError(err).WithField("dir", propRoot).Error("error migrating propagated mount storage")
 								}
 							}
 						}
 
-						if err := os.MkdirAll(propRoot, 0755); err != nil {
+						if err := pm.retryMount(func() error { return os.MkdirAll(propRoot, 0755) }); err != nil {
 							logrus.Errorf("failed to create PropagatedMount directory at %s: %v", propRoot, err)
 						}
 					}
@@ -255,21 +788,49 @@ func (pm *Manager) reload() error { // todo: restore
 				// if liveRestore is not enabled, the plugin will be stopped now so we should enable it
 				if err := pm.enable(p, c, true); err != nil {
 					logrus.WithError(err).WithField("id", p.GetID()).Error("failed to enable plugin")
+					failRequired(p, err)
 				}
 			}
 		}(p)
 	}
 	wg.Wait()
+
+	if len(requiredErrs) > 0 {
+		sort.Strings(requiredErrs)
+		return errors.Errorf("failed to enable required plugins: %s", strings.Join(requiredErrs, "; "))
+	}
 	return nil
 }
 
+// requiredPlugins returns the set of IDs of the required plugins, or an error
+// if one of them is not installed.
+func (pm *Manager) requiredPlugins(plugins map[string]*v2.Plugin) (map[string]bool, error) {
+	required := make(map[string]bool, len(pm.config.RequiredPlugins))
+	for _, nameOrID := range pm.config.RequiredPlugins {
+		id, ok := findPlugin(plugins, nameOrID)
+		if !ok {
+			return nil, errors.Errorf("required plugin %s is not installed", nameOrID)
+		}
+		required[id] = true
+	}
+	return required, nil
+}
+
 // Get looks up the requested plugin in the store.
 func (pm *Manager) Get(idOrName string) (*v2.Plugin, error) {
 	return pm.config.Store.GetV2Plugin(idOrName)
 }
 
-func (pm *Manager) loadPlugin(id string) (*v2.Plugin, error) {
-	p := filepath.Join(pm.config.Root, id, configFileName)
+// PluginsByCapability returns the enabled plugins implementing the given
+// capability, such as "volumedriver", sorted by name. It uses an index kept
+// up to date as plugins are enabled and disabled, rather than scanning all
+// plugins.
+func (pm *Manager) PluginsByCapability(capability string) []*v2.Plugin {
+	return pm.config.Store.enabledByCapability(capability)
+}
+
+func (pm *Manager) loadPlugin(root, id string) (*v2.Plugin, error) {
+	p := filepath.Join(root, id, configFileName)
 	dt, err := ioutil.ReadFile(p)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error reading %v", p)
@@ -278,10 +839,57 @@ func (pm *Manager) loadPlugin(id string) (*v2.Plugin, error) {
 	if err := json.Unmarshal(dt, &plugin); err != nil {
 		return nil, errors.Wrapf(err, "error decoding %v", p)
 	}
+	if err := validateLoadedPlugin(id, &plugin); err != nil {
+		return nil, errors.Wrapf(err, "invalid config %v", p)
+	}
 	return &plugin, nil
 }
 
+// validateLoadedPlugin checks the fields of a plugin loaded from the
+// directory id which the manager relies on, so that a corrupt or hand-edited
+// config fails to load instead of failing later on.
+func validateLoadedPlugin(id string, p *v2.Plugin) error {
+	if p.PluginObj.ID != id {
+		return errors.Errorf("plugin ID %q does not match the plugin directory %s", p.PluginObj.ID, id)
+	}
+	if p.PluginObj.Name == "" {
+		return errors.Errorf("plugin %s has no Name", id)
+	}
+	config := p.PluginObj.Config
+	if config.Interface.Socket == "" {
+		return errors.Errorf("plugin %s has no Config.Interface.Socket", id)
+	}
+	if len(config.Interface.Types) == 0 {
+		return errors.Errorf("plugin %s has no Config.Interface.Types", id)
+	}
+	for i, typ := range config.Interface.Types {
+		if typ.Capability == "" {
+			return errors.Errorf("plugin %s has an invalid Config.Interface.Types[%d] %q", id, i, typ.String())
+		}
+	}
+	for i, m := range config.Mounts {
+		if m.Destination == "" {
+			return errors.Errorf("plugin %s has no Config.Mounts[%d].Destination", id, i)
+		}
+	}
+	for i, m := range p.PluginObj.Settings.Mounts {
+		if m.Destination == "" {
+			return errors.Errorf("plugin %s has no Settings.Mounts[%d].Destination", id, i)
+		}
+	}
+	for i, d := range p.PluginObj.Settings.Devices {
+		if d.Path == nil {
+			return errors.Errorf("plugin %s has no Settings.Devices[%d].Path", id, i)
+		}
+	}
+	return nil
+}
+
 func (pm *Manager) save(p *v2.Plugin) error {
+	if pm.isReadOnly(p.GetID()) {
+		logrus.WithField("id", p.GetID()).Debug("not saving the state of a read-only plugin")
+		return nil
+	}
 	pluginJSON, err := json.Marshal(p)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal plugin json")
@@ -292,6 +900,92 @@ func (pm *Manager) save(p *v2.Plugin) error {
 	return nil
 }
 
+// SetMaxConcurrentOperations changes the number of plugin lifecycle
+// operations which may run at the same time. A limit of 0 or less removes the
+// limit. Operations already running are not interrupted.
+func (pm *Manager) SetMaxConcurrentOperations(limit int) {
+	pm.ops.setLimit(limit)
+}
+
+// WaitEnabled blocks until the plugin with the given name or ID is enabled
+// and ready to be used, which may be done by another goroutine. It returns an
+// error if the plugin exits or fails to start first, unless it is restarted,
+// or if it is not ready within timeout.
+func (pm *Manager) WaitEnabled(refOrID string, timeout time.Duration) error {
+	p, err := pm.config.Store.GetV2Plugin(refOrID)
+	if err != nil {
+		return err
+	}
+
+	clock := pm.clock()
+	deadline := clock.NewTimer(timeout)
+	defer deadline.Stop()
+
+	// running is whether the plugin was seen running. A plugin which was
+	// not, such as one which is still disabled, may yet be enabled.
+	var running bool
+	for {
+		if p.IsEnabled() {
+			return nil
+		}
+
+		pm.mu.RLock()
+		var (
+			exitChan chan bool
+			exited   bool
+		)
+		if c := pm.cMap[p]; c != nil {
+			exitChan = c.exitChan
+			// The exit channel is reset once the plugin exited.
+			exited = running && exitChan == nil && !c.restart
+		}
+		pm.mu.RUnlock()
+		if exited {
+			return errors.WithStack(exitedError(p.Name()))
+		}
+		running = running || exitChan != nil
+
+		select {
+		case <-exitChan:
+		case <-clock.After(waitEnabledInterval):
+		case <-deadline.C():
+			return errors.WithStack(waitTimeoutError(p.Name()))
+		}
+	}
+}
+
+// Reconcile checks that the controllers of the manager agree with the plugin
+// store, and repairs them: enabled plugins without a controller get one, and
+// controllers of plugins which are no longer in the store are removed. It
+// returns a description of each repair, sorted lexically.
+func (pm *Manager) Reconcile() []string {
+	plugins := pm.config.Store.GetAll()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var fixed []string
+	for p := range pm.cMap {
+		if plugins[p.GetID()] != p {
+			delete(pm.cMap, p)
+			fixed = append(fixed, fmt.Sprintf("removed orphan controller of plugin %s (%s)", p.Name(), p.GetID()))
+		}
+	}
+	for id, p := range plugins {
+		if _, ok := pm.cMap[p]; ok || !p.IsEnabled() {
+			continue
+		}
+		pm.cMap[p] = &controller{restart: true, exitChan: make(chan bool)}
+		fixed = append(fixed, fmt.Sprintf("created missing controller of enabled plugin %s (%s)", p.Name(), id))
+	}
+	sort.Strings(fixed)
+
+	for _, f := range fixed {
+		logrus.Warnf("plugin reconciliation: %s", f)
+	}
+	return fixed
+}
+
 // GC cleans up unreferenced blobs. This is recommended to run in a goroutine
 func (pm *Manager) GC() {
 	pm.muGC.Lock()
@@ -308,23 +1002,6 @@ func (pm *Manager) GC() {
 	pm.blobStore.gc(whitelist)
 }
 
-type logHook struct{ id string }
-
-func (logHook) Levels() []logrus.Level {
-	return logrus.AllLevels
-}
-
-func (l logHook) Fire(entry *logrus.Entry) error {
-	entry.Data = logrus.Fields{"plugin": l.id}
-	return nil
-}
-
-func makeLoggerStreams(id string) (stdout, stderr io.WriteCloser) {
-	logger := logrus.New()
-	logger.Hooks.Add(logHook{id})
-	return logger.WriterLevel(logrus.InfoLevel), logger.WriterLevel(logrus.ErrorLevel)
-}
-
 func validatePrivileges(requiredPrivileges, privileges types.PluginPrivileges) error {
 	if !isEqual(requiredPrivileges, privileges, isEqualPrivilege) {
 		return errors.New("incorrect privileges")
@@ -1,10 +1,14 @@
 package plugin // import "github.com/docker/docker/plugin"
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -15,27 +19,49 @@ import (
 	"github.com/docker/docker/pkg/mount"
 	"github.com/docker/docker/pkg/plugins"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/plugin/v2"
 	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+// enable starts p with the settings of c. Unless force is set, as it is for
+// the plugins which the manager restores or restarts itself, p must not be
+// enabled already, and the plugins it depends on must be.
 func (pm *Manager) enable(p *v2.Plugin, c *controller, force bool) error {
-	p.Rootfs = filepath.Join(pm.config.Root, p.PluginObj.ID, "rootfs")
-	if p.IsEnabled() && !force {
-		return errors.Wrap(enabledError(p.Name()), "plugin already enabled")
+	p.Rootfs = filepath.Join(pm.pluginDir(p.PluginObj.ID), "rootfs")
+	if !force {
+		if p.IsEnabled() {
+			return errors.Wrap(enabledError(p.Name()), "plugin already enabled")
+		}
+		if err := pm.checkDependencies(p); err != nil {
+			return err
+		}
+	}
+	if problems := append(checkDevices(p), checkCapabilities(p)...); len(problems) > 0 {
+		return errdefs.InvalidParameter(errors.Errorf("plugin %s cannot be enabled: %s", p.Name(), strings.Join(problems, "; ")))
 	}
 	spec, err := p.InitSpec(pm.config.ExecRoot)
 	if err != nil {
 		return err
 	}
+	spec.Process.Env = pm.config.Proxy.withProxyEnv(spec.Process.Env)
+	spec.Process.Args = c.processArgs(p, spec.Process.Args)
+	spec.Process.Args = pm.withUmask(p, spec.Process.Args)
+	if len(spec.Process.Args) > 0 {
+		if err := checkPlatform(p.Rootfs, spec.Process.Args[0]); err != nil {
+			return errdefs.InvalidParameter(err)
+		}
+	}
+	setResources(spec, pm.resources(c))
+	c.spec = spec
 
+	pm.mu.Lock()
 	c.restart = true
 	c.exitChan = make(chan bool)
-
-	pm.mu.Lock()
 	pm.cMap[p] = c
 	pm.mu.Unlock()
 
@@ -43,7 +69,7 @@ func (pm *Manager) enable(p *v2.Plugin, c *controller, force bool) error {
 	if p.PluginObj.Config.PropagatedMount != "" {
 		propRoot = filepath.Join(filepath.Dir(p.Rootfs), "propagated-mount")
 
-		if err := os.MkdirAll(propRoot, 0755); err != nil {
+		if err := pm.retryMount(func() error { return os.MkdirAll(propRoot, 0755) }); err != nil {
 			logrus.Errorf("failed to create PropagatedMount directory at %s: %v", propRoot, err)
 		}
 
@@ -52,15 +78,14 @@ func (pm *Manager) enable(p *v2.Plugin, c *controller, force bool) error {
 		}
 	}
 
-	rootFS := containerfs.NewLocalContainerFS(filepath.Join(pm.config.Root, p.PluginObj.ID, rootFSFileName))
+	rootFS := containerfs.NewLocalContainerFS(filepath.Join(pm.pluginDir(p.PluginObj.ID), rootFSFileName))
 	if err := initlayer.Setup(rootFS, idtools.Identity{UID: 0, GID: 0}); err != nil {
 		return errors.WithStack(err)
 	}
 
-	stdout, stderr := makeLoggerStreams(p.GetID())
-	if err := pm.executor.Create(p.GetID(), *spec, stdout, stderr); err != nil {
+	if err := pm.create(p, *spec); err != nil {
 		if p.PluginObj.Config.PropagatedMount != "" {
-			if err := mount.Unmount(propRoot); err != nil {
+			if err := pm.retryMount(func() error { return mount.Unmount(propRoot) }); err != nil {
 				logrus.Warnf("Could not unmount %s: %v", propRoot, err)
 			}
 		}
@@ -69,6 +94,190 @@ func (pm *Manager) enable(p *v2.Plugin, c *controller, force bool) error {
 	return pm.pluginPostStart(p, c)
 }
 
+// validateEnable runs the checks enable would, and builds the runtime spec
+// of the plugin, without starting it. It returns the problems found.
+func (pm *Manager) validateEnable(p *v2.Plugin, c *controller) []string {
+	if p.IsEnabled() {
+		return []string{enabledError(p.Name()).Error()}
+	}
+	if pm.executor == nil {
+		return []string{"no plugin executor is available"}
+	}
+
+	var problems []string
+	if err := pm.checkDependencies(p); err != nil {
+		problems = append(problems, err.Error())
+	}
+	rootfs := filepath.Join(pm.pluginDir(p.GetID()), rootFSFileName)
+	fi, err := os.Stat(rootfs)
+	if err != nil {
+		return append(problems, fmt.Sprintf("plugin rootfs is missing: %v", err))
+	}
+	if !fi.IsDir() {
+		return append(problems, fmt.Sprintf("plugin rootfs %s is not a directory", rootfs))
+	}
+	if p.IsCheckpointed() {
+		if _, err := os.Stat(pm.checkpointDir(p.GetID())); err != nil {
+			problems = append(problems, fmt.Sprintf("plugin checkpoint is missing: %v", err))
+		}
+	}
+	deviceProblems := checkDevices(p)
+	problems = append(problems, deviceProblems...)
+	problems = append(problems, checkCapabilities(p)...)
+	if len(deviceProblems) > 0 {
+		// InitSpec fails on devices which are not available.
+		return problems
+	}
+
+	// InitSpec creates the bundle directory; do not leave it behind.
+	bundleDir := filepath.Join(pm.config.ExecRoot, p.GetID())
+	if _, err := os.Stat(bundleDir); os.IsNotExist(err) {
+		defer os.Remove(bundleDir)
+	}
+	p.Rootfs = rootfs
+	spec, err := p.InitSpec(pm.config.ExecRoot)
+	if err != nil {
+		return append(problems, fmt.Sprintf("invalid plugin runtime spec: %v", err))
+	}
+
+	propRoot := filepath.Join(filepath.Dir(rootfs), "propagated-mount")
+	for _, m := range spec.Mounts {
+		if m.Type != "bind" || m.Source == propRoot || m.Source == bundleDir {
+			// These are created when the plugin is started.
+			continue
+		}
+		if _, err := os.Stat(m.Source); err != nil {
+			problems = append(problems, fmt.Sprintf("source of mount %s is not available: %v", m.Destination, err))
+		}
+	}
+
+	args := pm.withUmask(p, c.processArgs(p, spec.Process.Args))
+	if len(args) == 0 {
+		return append(problems, "plugin has no entrypoint")
+	}
+	if filepath.IsAbs(args[0]) {
+		entrypoint, err := symlink.FollowSymlinkInScope(filepath.Join(rootfs, args[0]), rootfs)
+		if err == nil {
+			_, err = os.Stat(entrypoint)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("plugin entrypoint %s is not available: %v", args[0], err))
+		}
+	}
+	if err := checkPlatform(rootfs, args[0]); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// create starts the plugin process. A checkpointed plugin is restored from
+// its checkpoint, or started from scratch if that fails. Either way, the
+// checkpoint is only used once.
+func (pm *Manager) create(p *v2.Plugin, spec specs.Spec) error {
+	if ce, ok := pm.executor.(CheckpointExecutor); ok && p.IsCheckpointed() {
+		dir := pm.checkpointDir(p.GetID())
+		stdout, stderr := pm.makeLoggerStreams(p.GetID())
+		err := ce.CreateFromCheckpoint(p.GetID(), spec, dir, stdout, stderr)
+		p.SetCheckpointed(false)
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.WithError(err).WithField("id", p.GetID()).Warn("failed to remove plugin checkpoint")
+		}
+		if err == nil {
+			return nil
+		}
+		logrus.WithError(err).WithField("id", p.GetID()).Warn("failed to restore plugin from checkpoint, starting it from scratch")
+	}
+
+	stdout, stderr := pm.makeLoggerStreams(p.GetID())
+	return pm.executor.Create(p.GetID(), spec, stdout, stderr)
+}
+
+// checkpoint checkpoints a running plugin to disk and stops it. The plugin is
+// restored from the checkpoint the next time it is enabled.
+func (pm *Manager) checkpoint(p *v2.Plugin, c *controller) error {
+	ce, ok := pm.executor.(CheckpointExecutor)
+	if !ok {
+		return errdefs.NotImplemented(errors.New("the plugin executor does not support checkpoints"))
+	}
+	if !p.IsEnabled() {
+		return errors.Wrap(errDisabled(p.Name()), "cannot checkpoint a disabled plugin")
+	}
+
+	dir := pm.checkpointDir(p.GetID())
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "error removing previous plugin checkpoint")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "error creating plugin checkpoint dir")
+	}
+
+	// Like disable, wait for a restart in progress to finish, so that the
+	// plugin it starts is the one checkpointed.
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	pm.mu.Lock()
+	c.restart = false
+	exitChan := c.exitChan
+	pm.mu.Unlock()
+	if err := ce.Checkpoint(p.GetID(), dir); err != nil {
+		pm.mu.Lock()
+		c.restart = true
+		pm.mu.Unlock()
+		os.RemoveAll(dir)
+		return errors.Wrap(err, "error checkpointing plugin")
+	}
+	select {
+	case <-exitChan:
+	case <-pm.clock().After(pm.stopTimeout()):
+		logrus.WithField("id", p.GetID()).Warn("timed out waiting for the checkpointed plugin to exit")
+	}
+
+	p.SetCheckpointed(true)
+	pm.config.Store.SetState(p, false)
+	p.SetHealth(nil)
+	return pm.save(p)
+}
+
+// withUmask wraps the process arguments of the plugin to set the configured
+// umask, if any. Plugins without a shell in their rootfs are left untouched.
+func (pm *Manager) withUmask(p *v2.Plugin, args []string) []string {
+	if pm.config.Umask == "" || len(args) == 0 {
+		return args
+	}
+	umask, err := parseUmask(pm.config.Umask)
+	if err != nil {
+		// Already validated by NewManager.
+		return args
+	}
+	shell, err := symlink.FollowSymlinkInScope(filepath.Join(p.Rootfs, umaskShell), p.Rootfs)
+	if err == nil {
+		_, err = os.Stat(shell)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("id", p.GetID()).Warnf("plugin has no %s, not setting its umask", umaskShell)
+		return args
+	}
+	return umaskArgs(umask, args)
+}
+
+// processArgs applies the entrypoint and args overrides of the controller to
+// the plugin's process arguments. Like `docker run --entrypoint`, overriding
+// the entrypoint also discards the plugin's args, unless args are overridden
+// as well.
+func (c *controller) processArgs(p *v2.Plugin, args []string) []string {
+	if c.entrypoint == nil && c.args == nil {
+		return args
+	}
+	entrypoint, pluginArgs := p.PluginObj.Config.Entrypoint, p.PluginObj.Settings.Args
+	if c.entrypoint != nil {
+		entrypoint, pluginArgs = c.entrypoint, nil
+	}
+	if c.args != nil {
+		pluginArgs = c.args
+	}
+	return append(append([]string{}, entrypoint...), pluginArgs...)
+}
+
 func (pm *Manager) pluginPostStart(p *v2.Plugin, c *controller) error {
 	sockAddr := filepath.Join(pm.config.ExecRoot, p.GetID(), p.GetSocket())
 	p.SetTimeout(time.Duration(c.timeoutInSecs) * time.Second)
@@ -79,7 +288,7 @@ func (pm *Manager) pluginPostStart(p *v2.Plugin, c *controller) error {
 		client, err := plugins.NewClientWithTimeout(addr.Network()+"://"+addr.String(), nil, p.Timeout())
 		if err != nil {
 			c.restart = false
-			shutdownPlugin(p, c.exitChan, pm.executor)
+			shutdownPlugin(p, c.exitChan, pm.executor, pm.clock(), pm.stopTimeout())
 			return errors.WithStack(err)
 		}
 
@@ -87,7 +296,7 @@ func (pm *Manager) pluginPostStart(p *v2.Plugin, c *controller) error {
 	}
 
 	// Initial sleep before net Dial to allow plugin to listen on socket.
-	time.Sleep(500 * time.Millisecond)
+	<-pm.clock().After(500 * time.Millisecond)
 	maxRetries := 3
 	var retries int
 	for {
@@ -98,7 +307,7 @@ func (pm *Manager) pluginPostStart(p *v2.Plugin, c *controller) error {
 			break
 		}
 
-		time.Sleep(3 * time.Second)
+		<-pm.clock().After(3 * time.Second)
 		retries++
 
 		if retries > maxRetries {
@@ -106,19 +315,25 @@ func (pm *Manager) pluginPostStart(p *v2.Plugin, c *controller) error {
 			c.restart = false
 			// While restoring plugins, we need to explicitly set the state to disabled
 			pm.config.Store.SetState(p, false)
-			shutdownPlugin(p, c.exitChan, pm.executor)
+			shutdownPlugin(p, c.exitChan, pm.executor, pm.clock(), pm.stopTimeout())
 			return err
 		}
 
 	}
+	c.startedAt = pm.clock().Now()
+	p.SetFailed(false)
 	pm.config.Store.SetState(p, true)
 	pm.config.Store.CallHandler(p)
 
+	if check := p.PluginObj.Config.HealthCheck; check != nil && check.Path != "" {
+		go pm.monitorHealth(p, c, *check, c.exitChan)
+	}
+
 	return pm.save(p)
 }
 
 func (pm *Manager) restore(p *v2.Plugin, c *controller) error {
-	stdout, stderr := makeLoggerStreams(p.GetID())
+	stdout, stderr := pm.makeLoggerStreams(p.GetID())
 	alive, err := pm.executor.Restore(p.GetID(), stdout, stderr)
 	if err != nil {
 		return err
@@ -140,13 +355,15 @@ func (pm *Manager) restore(p *v2.Plugin, c *controller) error {
 	if alive {
 		// TODO(@cpuguy83): Should we always just re-attach to the running plugin instead of doing this?
 		c.restart = false
-		shutdownPlugin(p, c.exitChan, pm.executor)
+		shutdownPlugin(p, c.exitChan, pm.executor, pm.clock(), pm.stopTimeout())
 	}
 
 	return nil
 }
 
-func shutdownPlugin(p *v2.Plugin, ec chan bool, executor Executor) {
+// shutdownPlugin sends SIGTERM to the plugin, and kills it if it did not
+// exit within timeout, as measured by clock.
+func shutdownPlugin(p *v2.Plugin, ec chan bool, executor Executor, clock Clock, timeout time.Duration) {
 	pluginID := p.GetID()
 
 	err := executor.Signal(pluginID, int(unix.SIGTERM))
@@ -156,7 +373,7 @@ func shutdownPlugin(p *v2.Plugin, ec chan bool, executor Executor) {
 		select {
 		case <-ec:
 			logrus.Debug("Clean shutdown of plugin")
-		case <-time.After(time.Second * 10):
+		case <-clock.After(timeout):
 			logrus.Debug("Force shutdown plugin")
 			if err := executor.Signal(pluginID, int(unix.SIGKILL)); err != nil {
 				logrus.Errorf("Sending SIGKILL to plugin failed with error: %v", err)
@@ -164,50 +381,143 @@ func shutdownPlugin(p *v2.Plugin, ec chan bool, executor Executor) {
 			select {
 			case <-ec:
 				logrus.Debug("SIGKILL plugin shutdown")
-			case <-time.After(time.Second * 10):
+			case <-clock.After(time.Second * 10):
 				logrus.Debug("Force shutdown plugin FAILED")
 			}
 		}
 	}
 }
 
-func (pm *Manager) disable(p *v2.Plugin, c *controller) error {
+// disable stops the plugin, giving it timeout to exit before it is killed.
+func (pm *Manager) disable(p *v2.Plugin, c *controller, timeout time.Duration) error {
 	if !p.IsEnabled() {
 		return errors.Wrap(errDisabled(p.Name()), "plugin is already disabled")
 	}
 
+	pm.mu.Lock()
 	c.restart = false
-	shutdownPlugin(p, c.exitChan, pm.executor)
+	c.disabled = true
+	pm.mu.Unlock()
+	// Wait for a restart in progress to finish, so that the plugin it
+	// starts is the one stopped.
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	shutdownPlugin(p, c.exitChan, pm.executor, pm.clock(), timeout)
 	pm.config.Store.SetState(p, false)
+	p.SetHealth(nil)
 	return pm.save(p)
 }
 
-// Shutdown stops all plugins and called during daemon shutdown.
-func (pm *Manager) Shutdown() {
+// Shutdown stops the enabled plugins, unless live restore is enabled, and
+// cleans up their mounts. It is called during daemon shutdown. Plugins are
+// stopped at the same time, and each is given the stop timeout of the
+// manager to exit before it is killed, or less if ctx expires sooner. It
+// returns the error of ctx if it expired before all the plugins were
+// stopped.
+func (pm *Manager) Shutdown(ctx context.Context) error {
+	deadline, hasDeadline := ctx.Deadline()
+
+	var (
+		wg      sync.WaitGroup
+		stopped []*controller
+	)
 	plugins := pm.config.Store.GetAll()
 	for _, p := range plugins {
-		pm.mu.RLock()
-		c := pm.cMap[p]
-		pm.mu.RUnlock()
-
 		if pm.config.LiveRestoreEnabled && p.IsEnabled() {
 			logrus.Debug("Plugin active when liveRestore is set, skipping shutdown")
 			continue
 		}
-		if pm.executor != nil && p.IsEnabled() {
+		if pm.executor == nil || !p.IsEnabled() {
+			continue
+		}
+
+		pm.mu.Lock()
+		c := pm.cMap[p]
+		if c != nil {
 			c.restart = false
-			shutdownPlugin(p, c.exitChan, pm.executor)
+			c.disabled = true
+		}
+		pm.mu.Unlock()
+		if c == nil {
+			logrus.WithField("id", p.GetID()).Warn("enabled plugin has no controller, not stopping it")
+			continue
+		}
+		timeout := pm.stopTimeout()
+		if hasDeadline {
+			if d := deadline.Sub(pm.clock().Now()); d < timeout {
+				timeout = d
+			}
 		}
+
+		stopped = append(stopped, c)
+		wg.Add(1)
+		go func(p *v2.Plugin, c *controller, timeout time.Duration) {
+			defer wg.Done()
+			// Wait for a restart in progress to finish, so that the plugin
+			// it starts is the one stopped.
+			c.lifecycle.Lock()
+			defer c.lifecycle.Unlock()
+			pm.mu.RLock()
+			exitChan := c.exitChan
+			pm.mu.RUnlock()
+			shutdownPlugin(p, exitChan, pm.executor, pm.clock(), timeout)
+		}(p, c, timeout)
 	}
-	if err := mount.RecursiveUnmount(pm.config.Root); err != nil {
-		logrus.WithError(err).Warn("error cleaning up plugin mounts")
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "error waiting for plugins to stop")
 	}
+
+	// Release whoever still waits for a plugin to exit, such as WaitEnabled
+	// and health checks, if it did not exit in time.
+	pm.mu.Lock()
+	for _, c := range stopped {
+		if c.exitChan != nil {
+			close(c.exitChan)
+			c.exitChan = nil
+		}
+	}
+	pm.mu.Unlock()
+
+	pm.flushExitEvents()
+	if e, ok := pm.executor.(*reconnectingExecutor); ok {
+		e.close()
+	}
+	for _, root := range append([]string{pm.config.Root}, pm.config.ReadOnlyRoots...) {
+		if err := mount.RecursiveUnmount(root); err != nil {
+			logrus.WithError(err).WithField("root", root).Warn("error cleaning up plugin mounts")
+		}
+	}
+	return err
 }
 
-func (pm *Manager) upgradePlugin(p *v2.Plugin, configDigest digest.Digest, blobsums []digest.Digest, tmpRootFSDir string, privileges *types.PluginPrivileges) (err error) {
+// pluginBackup is the state of a plugin before an upgrade, which the upgrade
+// can be rolled back to.
+type pluginBackup struct {
+	rootfs       string
+	config       types.PluginConfig
+	configDigest digest.Digest
+	blobsums     []digest.Digest
+	reference    string
+}
+
+// upgradePlugin replaces the rootfs and config of p with the pulled ones. If
+// keepBackup is set, the previous rootfs is kept and returned with the
+// previous config, rather than removed.
+func (pm *Manager) upgradePlugin(p *v2.Plugin, configDigest digest.Digest, blobsums []digest.Digest, tmpRootFSDir string, privileges *types.PluginPrivileges, keepBackup bool) (prev *pluginBackup, err error) {
 	config, err := pm.setupNewPlugin(configDigest, blobsums, privileges)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := validateUpgradeConfig(p.PluginObj.Config, config); err != nil {
+		return nil, err
 	}
 
 	pdir := filepath.Join(pm.config.Root, p.PluginObj.ID)
@@ -217,12 +527,19 @@ func (pm *Manager) upgradePlugin(p *v2.Plugin, configDigest digest.Digest, blobs
 	// This could happen if the plugin was disabled with `-f` with active mounts.
 	// If there is anything in `orig` is still mounted, this should error out.
 	if err := mount.RecursiveUnmount(orig); err != nil {
-		return errdefs.System(err)
+		return nil, errdefs.System(err)
 	}
 
 	backup := orig + "-old"
 	if err := os.Rename(orig, backup); err != nil {
-		return errors.Wrap(errdefs.System(err), "error backing up plugin data before upgrade")
+		return nil, errors.Wrap(errdefs.System(err), "error backing up plugin data before upgrade")
+	}
+	prev = &pluginBackup{
+		rootfs:       backup,
+		config:       p.PluginObj.Config,
+		configDigest: p.Config,
+		blobsums:     p.Blobsums,
+		reference:    p.PluginObj.PluginReference,
 	}
 
 	defer func() {
@@ -238,8 +555,10 @@ func (pm *Manager) upgradePlugin(p *v2.Plugin, configDigest digest.Digest, blobs
 				logrus.WithError(rmErr).WithField("plugin", p.Name()).Errorf("error cleaning up plugin upgrade dir: %s", tmpRootFSDir)
 			}
 		} else {
-			if rmErr := os.RemoveAll(backup); rmErr != nil && !os.IsNotExist(rmErr) {
-				logrus.WithError(rmErr).WithField("dir", backup).Error("error cleaning up old plugin root after successful upgrade")
+			if !keepBackup {
+				if rmErr := os.RemoveAll(backup); rmErr != nil && !os.IsNotExist(rmErr) {
+					logrus.WithError(rmErr).WithField("dir", backup).Error("error cleaning up old plugin root after successful upgrade")
+				}
 			}
 
 			p.Config = configDigest
@@ -248,12 +567,17 @@ func (pm *Manager) upgradePlugin(p *v2.Plugin, configDigest digest.Digest, blobs
 	}()
 
 	if err := os.Rename(tmpRootFSDir, orig); err != nil {
-		return errors.Wrap(errdefs.System(err), "error upgrading")
+		return nil, errors.Wrap(errdefs.System(err), "error upgrading")
 	}
 
 	p.PluginObj.Config = config
-	err = pm.save(p)
-	return errors.Wrap(err, "error saving upgraded plugin config")
+	if err = pm.save(p); err != nil {
+		return nil, errors.Wrap(err, "error saving upgraded plugin config")
+	}
+	if !keepBackup {
+		return nil, nil
+	}
+	return prev, nil
 }
 
 func (pm *Manager) setupNewPlugin(configDigest digest.Digest, blobsums []digest.Digest, privileges *types.PluginPrivileges) (types.PluginConfig, error) {
@@ -272,6 +596,10 @@ func (pm *Manager) setupNewPlugin(configDigest digest.Digest, blobsums []digest.
 		return types.PluginConfig{}, errors.New("invalid config json")
 	}
 
+	if err := v2.ValidateNetworkType(config.Network.Type); err != nil {
+		return types.PluginConfig{}, errdefs.InvalidParameter(err)
+	}
+
 	requiredPrivileges := computePrivileges(config)
 	if err != nil {
 		return types.PluginConfig{}, err
@@ -1,20 +1,34 @@
 package plugin // import "github.com/docker/docker/plugin"
 
 import (
+	"context"
+	"debug/elf"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/authorization"
 	"github.com/docker/docker/pkg/mount"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/plugin/v2"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"gotest.tools/poll"
 	"gotest.tools/skip"
 )
 
@@ -78,14 +92,18 @@ func newTestPlugin(t *testing.T, name, cap, root string) *v2.Plugin {
 
 	p := v2.Plugin{PluginObj: types.Plugin{ID: id, Name: name}}
 	p.Rootfs = rootfs
-	iType := types.PluginInterfaceType{Capability: cap, Prefix: "docker", Version: "1.0"}
-	i := types.PluginConfigInterface{Socket: "plugin.sock", Types: []types.PluginInterfaceType{iType}}
-	p.PluginObj.Config.Interface = i
+	p.PluginObj.Config.Interface = testPluginInterface(cap)
 	p.PluginObj.ID = id
 
 	return &p
 }
 
+// testPluginInterface returns the interface of a test plugin implementing cap.
+func testPluginInterface(cap string) types.PluginConfigInterface {
+	iType := types.PluginInterfaceType{Capability: cap, Prefix: "docker", Version: "1.0"}
+	return types.PluginConfigInterface{Socket: "plugin.sock", Types: []types.PluginInterfaceType{iType}}
+}
+
 type simpleExecutor struct {
 }
 
@@ -242,7 +260,7 @@ func TestPluginAlreadyRunningOnStartup(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			defer m.Shutdown()
+			defer m.Shutdown(context.Background())
 
 			p = s.GetAll()[p.GetID()] // refresh `p` with what the manager knows
 			if p.Client() == nil {
@@ -277,3 +295,1197 @@ func listenTestPlugin(sockAddr string, exit chan struct{}) (net.Listener, error)
 	}()
 	return l, nil
 }
+
+func TestSetRestart(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	// Need a short-ish path here so we don't run into unix socket path length issues.
+	execRoot, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(execRoot)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	p := newTestPlugin(t, "set", "testset", managerRoot)
+	p.PluginObj.Config.Env = []types.PluginEnv{{Name: "DEBUG", Settable: []string{"value"}}}
+	p.InitEmptySettings()
+
+	executor := &executorWithRunning{root: execRoot}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       execRoot,
+			CreateExecutor: func(m *Manager) (Executor, error) { executor.m = m; return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown(context.Background())
+
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	config := &types.PluginEnableConfig{
+		Timeout:       5,
+		Entrypoint:    []string{"/custom"},
+		Args:          []string{"--debug"},
+		RestartPolicy: container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3},
+	}
+	if err := m.Enable(p.GetID(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Set(p.GetID(), []string{"DEBUG=1"}, nil); err == nil {
+		t.Fatal("expected an error setting an enabled plugin")
+	}
+
+	if err := m.Set(p.GetID(), []string{"DEBUG=1"}, &types.PluginSetConfig{Restart: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsEnabled() {
+		t.Fatal("plugin should be enabled after restart")
+	}
+	if env := p.PluginObj.Settings.Env; len(env) != 1 || env[0] != "DEBUG=1" {
+		t.Fatalf("unexpected plugin env: %v", env)
+	}
+	m.mu.RLock()
+	restarted := m.cMap[p].enableConfig()
+	m.mu.RUnlock()
+	if !reflect.DeepEqual(restarted, config) {
+		t.Fatalf("expected the plugin to be restarted with %+v, got %+v", config, restarted)
+	}
+
+	if err := m.Set(p.GetID(), []string{"DEBUG=2"}, &types.PluginSetConfig{SkipRestart: true}); err != nil {
+		t.Fatal(err)
+	}
+	if env := p.PluginObj.Settings.Env; len(env) != 1 || env[0] != "DEBUG=2" {
+		t.Fatalf("unexpected plugin env: %v", env)
+	}
+}
+
+func TestSetRestartOperationLimit(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	execRoot, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(execRoot)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	p := newTestPlugin(t, "set", "testset", managerRoot)
+	p.PluginObj.Config.Env = []types.PluginEnv{{Name: "DEBUG", Settable: []string{"value"}}}
+	p.InitEmptySettings()
+
+	executor := &executorWithRunning{root: execRoot}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:                   s,
+			Root:                    managerRoot,
+			ExecRoot:                execRoot,
+			CreateExecutor:          func(m *Manager) (Executor, error) { executor.m = m; return executor, nil },
+			LogPluginEvent:          func(_, _, _ string) {},
+			MaxConcurrentOperations: 1,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown(context.Background())
+
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Enable(p.GetID(), &types.PluginEnableConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarting the plugin must not take a second slot of the limiter.
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Set(p.GetID(), []string{"DEBUG=1"}, &types.PluginSetConfig{Restart: true})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the plugin to be restarted")
+	}
+	if !p.IsEnabled() {
+		t.Fatal("plugin should be enabled after restart")
+	}
+}
+
+func TestControllerProcessArgs(t *testing.T) {
+	p := &v2.Plugin{}
+	p.PluginObj.Config.Entrypoint = []string{"/plugin"}
+	p.PluginObj.Settings.Args = []string{"--debug"}
+	args := []string{"/plugin", "--debug"}
+
+	for _, tc := range []struct {
+		c        *controller
+		expected []string
+	}{
+		{c: &controller{}, expected: []string{"/plugin", "--debug"}},
+		{c: &controller{entrypoint: []string{"/bin/sh"}}, expected: []string{"/bin/sh"}},
+		{c: &controller{args: []string{"--verbose"}}, expected: []string{"/plugin", "--verbose"}},
+		{c: &controller{entrypoint: []string{"/bin/sh", "-c"}, args: []string{"ls"}}, expected: []string{"/bin/sh", "-c", "ls"}},
+	} {
+		got := tc.c.processArgs(p, args)
+		if strings.Join(got, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("expected %v, got %v", tc.expected, got)
+		}
+	}
+	if p.PluginObj.Config.Entrypoint[0] != "/plugin" || p.PluginObj.Settings.Args[0] != "--debug" {
+		t.Fatal("the plugin config must not be modified")
+	}
+}
+
+func TestHandleExitEventCleanupGracePeriod(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	execRoot := filepath.Join(root, "exec")
+	m, err := NewManager(
+		ManagerConfig{
+			Store:              s,
+			Root:               managerRoot,
+			ExecRoot:           execRoot,
+			CreateExecutor:     func(m *Manager) (Executor, error) { return nil, nil },
+			LogPluginEvent:     func(_, _, _ string) {},
+			CleanupGracePeriod: 50 * time.Millisecond,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(t, "cleanup", "testcleanup", managerRoot)
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	bundleDir := filepath.Join(execRoot, p.GetID())
+
+	exit := func() {
+		if err := os.MkdirAll(bundleDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		m.mu.Lock()
+		m.cMap[p] = &controller{}
+		m.mu.Unlock()
+		if err := m.HandleExitEvent(p.GetID()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(bundleDir); err != nil {
+			t.Fatalf("bundle dir should not be removed before the grace period: %v", err)
+		}
+	}
+
+	// The plugin is enabled again before the grace period expires.
+	exit()
+	m.mu.Lock()
+	m.cMap[p] = &controller{}
+	m.mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(bundleDir); err != nil {
+		t.Fatalf("bundle dir of a re-enabled plugin should not be removed: %v", err)
+	}
+
+	exit()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if _, err := os.Stat(bundleDir); os.IsNotExist(err) {
+			return poll.Success()
+		}
+		return poll.Continue("bundle dir still exists")
+	}, poll.WithDelay(10*time.Millisecond), poll.WithTimeout(5*time.Second))
+}
+
+type countingExecutor struct {
+	simpleExecutor
+	mu      sync.Mutex
+	creates int
+}
+
+func (e *countingExecutor) Create(id string, spec specs.Spec, stdout, stderr io.WriteCloser) error {
+	e.mu.Lock()
+	e.creates++
+	e.mu.Unlock()
+	return e.simpleExecutor.Create(id, spec, stdout, stderr)
+}
+
+func (e *countingExecutor) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.creates
+}
+
+func TestHandleExitEventCoalesce(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	execRoot := filepath.Join(root, "exec")
+	executor := &countingExecutor{}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       execRoot,
+			CreateExecutor: func(*Manager) (Executor, error) { return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.exitEventWindow = 50 * time.Millisecond
+
+	p := newTestPlugin(t, "coalesce", "testcoalesce", managerRoot)
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flapping plugin is only restarted once.
+	c := &controller{restart: true}
+	m.mu.Lock()
+	m.cMap[p] = c
+	m.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		if err := m.HandleExitEvent(p.GetID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if executor.count() == 1 {
+			return poll.Success()
+		}
+		return poll.Continue("plugin was restarted %d times", executor.count())
+	}, poll.WithDelay(10*time.Millisecond), poll.WithTimeout(5*time.Second))
+	time.Sleep(200 * time.Millisecond)
+	if n := executor.count(); n != 1 {
+		t.Fatalf("expected the plugin to be restarted once, got %d", n)
+	}
+
+	// The state observed when the window expires is honored.
+	bundleDir := filepath.Join(execRoot, p.GetID())
+	if err := os.MkdirAll(bundleDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c = &controller{restart: true}
+	m.mu.Lock()
+	m.cMap[p] = c
+	m.mu.Unlock()
+	if err := m.HandleExitEvent(p.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	c.restart = false
+	m.mu.Unlock()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if _, err := os.Stat(bundleDir); os.IsNotExist(err) {
+			return poll.Success()
+		}
+		return poll.Continue("bundle dir still exists")
+	}, poll.WithDelay(10*time.Millisecond), poll.WithTimeout(5*time.Second))
+	if n := executor.count(); n != 1 {
+		t.Fatalf("a plugin that should not restart was restarted")
+	}
+
+	// An exit is ignored if the plugin was started again before the window
+	// expired.
+	c = &controller{restart: true}
+	m.mu.Lock()
+	m.cMap[p] = c
+	m.mu.Unlock()
+	if err := m.HandleExitEvent(p.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	c.exitChan = make(chan bool)
+	m.mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if n := executor.count(); n != 1 {
+		t.Fatalf("a plugin that was started again was restarted")
+	}
+}
+
+func TestReadOnlyRoots(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	writableRoot := filepath.Join(root, "writable")
+	vendorRoot := filepath.Join(root, "vendor")
+	writePlugin := func(root, id, name string) {
+		p := v2.Plugin{PluginObj: types.Plugin{ID: id, Name: name}}
+		p.PluginObj.Config.Interface = testPluginInterface("testcap")
+		dt, err := json.Marshal(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(root, id), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, id, configFileName), dt, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id1 := strings.Repeat("1", 64)
+	id2 := strings.Repeat("2", 64)
+	id3 := strings.Repeat("3", 64)
+	writePlugin(writableRoot, id1, "user:latest")
+	writePlugin(vendorRoot, id1, "shadowed-id:latest")
+	writePlugin(vendorRoot, id2, "vendor:latest")
+	writePlugin(vendorRoot, id3, "user:latest")
+
+	s := NewStore()
+	m, err := NewManager(ManagerConfig{
+		Store:          s,
+		Root:           writableRoot,
+		ExecRoot:       filepath.Join(root, "exec"),
+		ReadOnlyRoots:  []string{vendorRoot, filepath.Join(root, "missing")},
+		CreateExecutor: func(m *Manager) (Executor, error) { return nil, nil },
+		LogPluginEvent: func(_, _, _ string) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugins := s.GetAll()
+	if len(plugins) != 2 {
+		t.Fatalf("expected 2 plugins, got %d", len(plugins))
+	}
+	if p := plugins[id1]; p == nil || p.Name() != "user:latest" {
+		t.Fatalf("expected the plugin from the writable root to take priority, got %+v", p)
+	}
+	if m.isReadOnly(id1) || !m.isReadOnly(id2) {
+		t.Fatal("unexpected read-only plugins")
+	}
+	if dir := m.pluginDir(id2); dir != filepath.Join(vendorRoot, id2) {
+		t.Fatalf("unexpected plugin dir %s", dir)
+	}
+
+	err = m.Remove("vendor", &types.PluginRmConfig{})
+	if !errdefs.IsForbidden(err) {
+		t.Fatalf("expected a forbidden error removing a read-only plugin, got %v", err)
+	}
+	if err := m.save(plugins[id2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(writableRoot, id2)); !os.IsNotExist(err) {
+		t.Fatalf("read-only plugin state should not be written to the writable root: %v", err)
+	}
+}
+
+type checkpointExecutor struct {
+	executorWithRunning
+	restoredFrom  string
+	checkpointErr error
+}
+
+func (e *checkpointExecutor) Checkpoint(id, checkpointDir string) error {
+	if e.checkpointErr != nil {
+		return e.checkpointErr
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkpointDir, "state"), []byte("state"), 0600); err != nil {
+		return err
+	}
+	return e.Signal(id, 0)
+}
+
+func (e *checkpointExecutor) CreateFromCheckpoint(id string, spec specs.Spec, checkpointDir string, stdout, stderr io.WriteCloser) error {
+	if _, err := os.Stat(filepath.Join(checkpointDir, "state")); err != nil {
+		return err
+	}
+	e.restoredFrom = checkpointDir
+	return e.Create(id, spec, stdout, stderr)
+}
+
+func TestCheckpoint(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	// Need a short-ish path here so we don't run into unix socket path length issues.
+	execRoot, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(execRoot)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	p := newTestPlugin(t, "checkpoint", "testcheckpoint", managerRoot)
+
+	executor := &checkpointExecutor{executorWithRunning: executorWithRunning{root: execRoot}}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       execRoot,
+			CreateExecutor: func(m *Manager) (Executor, error) { executor.m = m; return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown(context.Background())
+
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Checkpoint(p.GetID()); !errdefs.IsConflict(err) {
+		t.Fatalf("expected an error checkpointing a disabled plugin, got %v", err)
+	}
+	if err := m.Enable(p.GetID(), &types.PluginEnableConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if executor.restoredFrom != "" {
+		t.Fatal("a plugin without a checkpoint should be started from scratch")
+	}
+
+	if err := m.Checkpoint(p.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsEnabled() || !p.IsCheckpointed() {
+		t.Fatal("a checkpointed plugin should be disabled, and marked as checkpointed")
+	}
+
+	if err := m.Enable(p.GetID(), &types.PluginEnableConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if executor.restoredFrom != m.checkpointDir(p.GetID()) {
+		t.Fatalf("expected the plugin to be restored from its checkpoint, got %q", executor.restoredFrom)
+	}
+	if p.IsCheckpointed() {
+		t.Fatal("the checkpoint should only be used once")
+	}
+	if _, err := os.Stat(m.checkpointDir(p.GetID())); !os.IsNotExist(err) {
+		t.Fatalf("the checkpoint should be removed once restored: %v", err)
+	}
+}
+
+func TestCheckpointFailureKeepsAuthzPlugin(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	// Need a short-ish path here so we don't run into unix socket path length issues.
+	execRoot, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(execRoot)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	p := newTestPlugin(t, "authz", authorization.AuthZApiImplements, managerRoot)
+
+	executor := &checkpointExecutor{
+		executorWithRunning: executorWithRunning{root: execRoot},
+		checkpointErr:       errors.New("checkpoint failed"),
+	}
+	middleware := authorization.NewMiddleware([]string{p.Name()}, nil)
+	m, err := NewManager(
+		ManagerConfig{
+			Store:           s,
+			Root:            managerRoot,
+			ExecRoot:        execRoot,
+			CreateExecutor:  func(m *Manager) (Executor, error) { executor.m = m; return executor, nil },
+			LogPluginEvent:  func(_, _, _ string) {},
+			AuthzMiddleware: middleware,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown(context.Background())
+
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Checkpoint(p.GetID()); !errdefs.IsConflict(err) {
+		t.Fatalf("expected an error checkpointing a plugin which was never enabled, got %v", err)
+	}
+	if err := m.Enable(p.GetID(), &types.PluginEnableConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Checkpoint(p.GetID()); err == nil {
+		t.Fatal("expected the checkpoint to fail")
+	}
+	if !p.IsEnabled() {
+		t.Fatal("a plugin which failed to be checkpointed should still be enabled")
+	}
+	if !middleware.RemovePlugin(p.Name()) {
+		t.Fatal("a plugin which failed to be checkpointed should still authorize requests")
+	}
+}
+
+func TestRuntimeSpec(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	// Need a short-ish path here so we don't run into unix socket path length issues.
+	execRoot, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(execRoot)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	p := newTestPlugin(t, "spec", "testspec", managerRoot)
+	p.PluginObj.Config.Entrypoint = []string{"/plugin"}
+
+	executor := &executorWithRunning{root: execRoot}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       execRoot,
+			CreateExecutor: func(m *Manager) (Executor, error) { executor.m = m; return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown(context.Background())
+
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.RuntimeSpec(p.GetID()); !errdefs.IsConflict(err) {
+		t.Fatalf("expected an error getting the spec of a disabled plugin, got %v", err)
+	}
+
+	if err := m.Enable(p.GetID(), &types.PluginEnableConfig{Args: []string{"--debug"}}); err != nil {
+		t.Fatal(err)
+	}
+	dt, err := m.RuntimeSpec(p.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(dt, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(spec.Process.Args, " "); args != "/plugin --debug" {
+		t.Fatalf("unexpected process args %q", args)
+	}
+	if spec.Root == nil || spec.Root.Path != filepath.Join(managerRoot, p.GetID(), "rootfs") {
+		t.Fatalf("unexpected root %+v", spec.Root)
+	}
+}
+
+func TestRequiredPlugins(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	managerRoot := filepath.Join(root, "manager")
+	id := strings.Repeat("1", 64)
+	p := v2.Plugin{PluginObj: types.Plugin{ID: id, Name: "storage:latest", Enabled: true}}
+	p.PluginObj.Config.Interface = testPluginInterface("testcap")
+	dt, err := json.Marshal(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(managerRoot, id, rootFSFileName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(managerRoot, id, configFileName), dt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newManager := func(required ...string) error {
+		_, err := NewManager(ManagerConfig{
+			Store:           NewStore(),
+			Root:            managerRoot,
+			ExecRoot:        filepath.Join(root, "exec"),
+			CreateExecutor:  func(m *Manager) (Executor, error) { return &simpleExecutor{}, nil },
+			LogPluginEvent:  func(_, _, _ string) {},
+			RequiredPlugins: required,
+		})
+		return err
+	}
+
+	// The plugin fails to enable, as the executor fails to create it.
+	if err := newManager(); err != nil {
+		t.Fatalf("a plugin which is not required should not fail the manager: %v", err)
+	}
+	for _, required := range []string{"storage", "storage:latest", id} {
+		err := newManager(required)
+		if err == nil || !strings.Contains(err.Error(), "failed to enable required plugins: storage:latest: Create failed") {
+			t.Fatalf("expected the required plugin %s to fail the manager, got %v", required, err)
+		}
+	}
+	if err := newManager("missing"); err == nil || !strings.Contains(err.Error(), "required plugin missing is not installed") {
+		t.Fatalf("expected a missing required plugin to fail the manager, got %v", err)
+	}
+}
+
+func TestValidateEnable(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	execRoot := filepath.Join(root, "exec")
+	executor := &countingExecutor{}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       execRoot,
+			CreateExecutor: func(*Manager) (Executor, error) { return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(t, "validate", "testvalidate", managerRoot)
+	p.PluginObj.Config.Entrypoint = []string{"/plugin"}
+	source := filepath.Join(root, "data")
+	p.PluginObj.Config.Mounts = []types.PluginMount{{Source: &source, Destination: "/data", Type: "bind", Options: []string{"rbind"}}}
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.ValidateEnable(p.GetID())
+	if !errdefs.IsInvalidParameter(err) || !strings.Contains(err.Error(), "plugin rootfs is missing") {
+		t.Fatalf("expected the missing rootfs to be reported, got %v", err)
+	}
+
+	rootfs := filepath.Join(managerRoot, p.GetID(), "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = m.ValidateEnable(p.GetID())
+	if err == nil || !strings.Contains(err.Error(), "source of mount /data is not available") || !strings.Contains(err.Error(), "plugin entrypoint /plugin is not available") {
+		t.Fatalf("expected the missing mount source and entrypoint to be reported, got %v", err)
+	}
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "plugin"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ValidateEnable(p.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsEnabled() || executor.count() != 0 {
+		t.Fatal("validating a plugin must not start it")
+	}
+	if _, err := os.Stat(filepath.Join(execRoot, p.GetID())); !os.IsNotExist(err) {
+		t.Fatalf("validating a plugin must not leave its bundle dir behind: %v", err)
+	}
+
+	device := filepath.Join(root, "device")
+	p.PluginObj.Settings.Devices = []types.PluginDevice{{Path: &device}}
+	p.PluginObj.Config.Linux.Capabilities = []string{"CAP_DOES_NOT_EXIST"}
+	err = m.ValidateEnable(p.GetID())
+	if err == nil || !strings.Contains(err.Error(), "device "+device+" is not available") || !strings.Contains(err.Error(), "capability CAP_DOES_NOT_EXIST is not supported") {
+		t.Fatalf("expected the missing device and the unknown capability to be reported, got %v", err)
+	}
+	p.PluginObj.Settings.Devices = nil
+	p.PluginObj.Config.Linux.Capabilities = nil
+
+	if machine, ok := elfMachines[runtime.GOARCH]; ok {
+		other := elf.EM_X86_64
+		if machine == other {
+			other = elf.EM_AARCH64
+		}
+		writeELF(t, filepath.Join(rootfs, "plugin"), other)
+		err = m.ValidateEnable(p.GetID())
+		if err == nil || !strings.Contains(err.Error(), "plugin entrypoint /plugin is built for "+other.String()) {
+			t.Fatalf("expected the entrypoint built for another platform to be reported, got %v", err)
+		}
+	}
+}
+
+func TestPropagatedMountPath(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(rootfs, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../..", filepath.Join(rootfs, "data", "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data", filepath.Join(rootfs, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mnt := range []string{"/data/mount", "/not/created/yet", "/inside/mount"} {
+		path, err := propagatedMountPath(rootfs, mnt)
+		if err != nil {
+			t.Fatalf("%s: %v", mnt, err)
+		}
+		if expected := filepath.Join(rootfs, mnt); path != expected {
+			t.Fatalf("%s: expected %s, got %s", mnt, expected, path)
+		}
+	}
+
+	for _, mnt := range []string{"../../..", "/../../etc", "/", "/escape/mount", "/data/up/mount"} {
+		if _, err := propagatedMountPath(rootfs, mnt); err == nil {
+			t.Fatalf("expected %s to be rejected", mnt)
+		}
+	}
+}
+
+// signalExecutor records the signals it sends to a plugin which only exits
+// when it is killed. The exit is reported to pm, if set, like a real executor
+// does, and otherwise by closing exit.
+type signalExecutor struct {
+	simpleExecutor
+	mu      sync.Mutex
+	signals []int
+	exit    chan bool
+	pm      *Manager
+}
+
+func (e *signalExecutor) Signal(id string, signal int) error {
+	e.mu.Lock()
+	e.signals = append(e.signals, signal)
+	e.mu.Unlock()
+	if signal == int(unix.SIGKILL) {
+		if e.pm != nil {
+			go e.pm.HandleExitEvent(id)
+		} else {
+			close(e.exit)
+		}
+	}
+	return nil
+}
+
+// waitKilled waits for the plugin to be sent SIGKILL.
+func (e *signalExecutor) waitKilled(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.mu.Lock()
+		n := len(e.signals)
+		killed := n > 0 && e.signals[n-1] == int(unix.SIGKILL)
+		e.mu.Unlock()
+		if killed {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the plugin to be killed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownPluginTimeout(t *testing.T) {
+	p := &v2.Plugin{PluginObj: types.Plugin{ID: "1", Name: "stubborn:latest"}}
+	exit := make(chan bool)
+	executor := &signalExecutor{exit: exit}
+
+	start := time.Now()
+	shutdownPlugin(p, exit, executor, realClock{}, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the plugin to be killed after the timeout, took %v", elapsed)
+	}
+	if expected := []int{int(unix.SIGTERM), int(unix.SIGKILL)}; !reflect.DeepEqual(executor.signals, expected) {
+		t.Fatalf("expected signals %v, got %v", expected, executor.signals)
+	}
+}
+
+// concurrencyExecutor records the maximum number of plugins it creates at the
+// same time.
+type concurrencyExecutor struct {
+	simpleExecutor
+	mu            sync.Mutex
+	running, peak int
+}
+
+func (e *concurrencyExecutor) Create(id string, spec specs.Spec, stdout, stderr io.WriteCloser) error {
+	e.mu.Lock()
+	e.running++
+	if e.running > e.peak {
+		e.peak = e.running
+	}
+	e.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	e.mu.Lock()
+	e.running--
+	e.mu.Unlock()
+	return e.simpleExecutor.Create(id, spec, stdout, stderr)
+}
+
+func TestRestoreConcurrency(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	managerRoot := filepath.Join(root, "manager")
+	for i := 0; i < 8; i++ {
+		id := stringid.GenerateRandomID()
+		p := v2.Plugin{PluginObj: types.Plugin{ID: id, Name: "plugin" + strconv.Itoa(i) + ":latest", Enabled: true}}
+		p.PluginObj.Config.Interface = testPluginInterface("testcap")
+		dt, err := json.Marshal(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(managerRoot, id, rootFSFileName), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(managerRoot, id, configFileName), dt, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	executor := &concurrencyExecutor{}
+	if _, err := NewManager(ManagerConfig{
+		Store:              NewStore(),
+		Root:               managerRoot,
+		ExecRoot:           filepath.Join(root, "exec"),
+		CreateExecutor:     func(*Manager) (Executor, error) { return executor, nil },
+		LogPluginEvent:     func(_, _, _ string) {},
+		RestoreConcurrency: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NewManager waits for all the plugins to be restored.
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	if executor.running != 0 {
+		t.Fatalf("expected all the restores to be done, %d are running", executor.running)
+	}
+	if executor.peak == 0 || executor.peak > 2 {
+		t.Fatalf("expected at most 2 plugins to be restored at the same time, got %d", executor.peak)
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	exit := make(chan bool)
+	executor := &signalExecutor{}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:    s,
+			Root:     managerRoot,
+			ExecRoot: filepath.Join(root, "exec"),
+			CreateExecutor: func(m *Manager) (Executor, error) {
+				executor.pm = m
+				return executor, nil
+			},
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(t, "stubborn", "testshutdown", managerRoot)
+	p.PluginObj.Enabled = true
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.cMap[p] = &controller{exitChan: exit, restart: true}
+	m.mu.Unlock()
+
+	// The plugin ignores SIGTERM, and is killed once the context expires
+	// rather than after the stop timeout of the manager.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	m.Shutdown(ctx)
+	executor.waitKilled(t)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the shutdown to be bounded by the context, took %v", elapsed)
+	}
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	if expected := []int{int(unix.SIGTERM), int(unix.SIGKILL)}; !reflect.DeepEqual(executor.signals, expected) {
+		t.Fatalf("expected signals %v, got %v", expected, executor.signals)
+	}
+	select {
+	case <-exit:
+	default:
+		t.Fatal("expected the exit channel of the plugin to be closed")
+	}
+}
+
+func TestShutdownStopTimeout(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	clock := &fakeClock{}
+	executor := &signalExecutor{}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:    s,
+			Root:     managerRoot,
+			ExecRoot: filepath.Join(root, "exec"),
+			CreateExecutor: func(m *Manager) (Executor, error) {
+				executor.pm = m
+				return executor, nil
+			},
+			LogPluginEvent: func(_, _, _ string) {},
+			Clock:          clock,
+			StopTimeout:    2 * time.Second,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(t, "stubborn", "testshutdown", managerRoot)
+	p.PluginObj.Enabled = true
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.cMap[p] = &controller{exitChan: make(chan bool), restart: true, timeoutInSecs: 30}
+	m.mu.Unlock()
+
+	done := make(chan error)
+	go func() {
+		done <- m.Shutdown(context.Background())
+	}()
+
+	// The plugin is killed after the stop timeout of the manager, not the
+	// timeout its client was enabled with.
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Second)
+	executor.mu.Lock()
+	signals := append([]int(nil), executor.signals...)
+	executor.mu.Unlock()
+	if expected := []int{int(unix.SIGTERM)}; !reflect.DeepEqual(signals, expected) {
+		t.Fatalf("expected signals %v before the stop timeout, got %v", expected, signals)
+	}
+	clock.Advance(time.Second)
+	executor.waitKilled(t)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the shutdown to return once the plugin was killed")
+	}
+}
+
+func TestShutdownWithoutController(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	executor := &signalExecutor{}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       filepath.Join(root, "exec"),
+			CreateExecutor: func(*Manager) (Executor, error) { return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An enabled plugin without a controller, such as one whose controller
+	// Reconcile has not restored yet, is skipped.
+	p := newTestPlugin(t, "orphan", "testshutdown", managerRoot)
+	p.PluginObj.Enabled = true
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	if len(executor.signals) != 0 {
+		t.Fatalf("expected no signals, got %v", executor.signals)
+	}
+}
+
+func TestExitEvent(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       filepath.Join(root, "exec"),
+			CreateExecutor: func(m *Manager) (Executor, error) { return nil, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(t, "exit", "testexit", managerRoot)
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := m.SubscribeEvents(1, EventExit{Plugin: p.Object()})
+	defer cancel()
+
+	m.mu.Lock()
+	m.cMap[p] = &controller{}
+	m.mu.Unlock()
+	if err := m.HandleExitEvent(p.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		exit, ok := e.(EventExit)
+		if !ok {
+			t.Fatalf("expected an exit event, got %#v", e)
+		}
+		if exit.Plugin.ID != p.GetID() || exit.Restarting || exit.Time.IsZero() {
+			t.Fatalf("unexpected exit event %+v", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an exit event")
+	}
+}
+
+func TestDisablePendingRestart(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.EnsureRemoveAll(root)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	clock := &fakeClock{}
+	executor := &countingExecutor{}
+	m, err := NewManager(
+		ManagerConfig{
+			Store:          s,
+			Root:           managerRoot,
+			ExecRoot:       filepath.Join(root, "exec"),
+			CreateExecutor: func(*Manager) (Executor, error) { return executor, nil },
+			LogPluginEvent: func(_, _, _ string) {},
+			Clock:          clock,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(t, "crashing", "testrestart", managerRoot)
+	p.PluginObj.Enabled = true
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{restart: true, exitChan: make(chan bool)}
+	m.mu.Lock()
+	m.cMap[p] = c
+	m.mu.Unlock()
+
+	// The plugin exits, and is disabled before it is restarted.
+	if err := m.processExitEvent(p, c); err != nil {
+		t.Fatal(err)
+	}
+	close(c.exitChan)
+	if err := m.disable(p, c, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(restartMaxBackoff)
+	if n := executor.count(); n != 0 {
+		t.Fatalf("expected the disabled plugin not to be restarted, got %d creates", n)
+	}
+
+	// Even if a restart already started it again, its exit does not restart
+	// it.
+	m.mu.Lock()
+	c.restart = true
+	m.mu.Unlock()
+	if err := m.processExitEvent(p, c); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(restartMaxBackoff)
+	if n := executor.count(); n != 0 {
+		t.Fatalf("expected the disabled plugin not to be restarted, got %d creates", n)
+	}
+}
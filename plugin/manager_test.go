@@ -1,9 +1,17 @@
 package plugin // import "github.com/docker/docker/plugin"
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/plugin/v2"
 )
 
 func TestValidatePrivileges(t *testing.T) {
@@ -53,3 +61,227 @@ func TestValidatePrivileges(t *testing.T) {
 		}
 	}
 }
+
+func TestReconcile(t *testing.T) {
+	enabled := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("1", 64), Name: "enabled:latest", Enabled: true}}
+	disabled := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("2", 64), Name: "disabled:latest"}}
+	removed := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("3", 64), Name: "removed:latest"}}
+
+	s := NewStore()
+	s.SetAll(map[string]*v2.Plugin{enabled.GetID(): enabled, disabled.GetID(): disabled})
+	m := &Manager{
+		config: ManagerConfig{Store: s},
+		cMap:   map[*v2.Plugin]*controller{disabled: {}, removed: {}},
+	}
+
+	fixed := m.Reconcile()
+	expected := []string{
+		"created missing controller of enabled plugin enabled:latest (" + enabled.GetID() + ")",
+		"removed orphan controller of plugin removed:latest (" + removed.GetID() + ")",
+	}
+	if !reflect.DeepEqual(fixed, expected) {
+		t.Fatalf("expected %v, got %v", expected, fixed)
+	}
+	if len(m.cMap) != 2 {
+		t.Fatalf("expected 2 controllers, got %d", len(m.cMap))
+	}
+	if c := m.cMap[enabled]; c == nil || !c.restart || c.exitChan == nil {
+		t.Fatalf("unexpected controller for the enabled plugin: %+v", c)
+	}
+
+	if fixed := m.Reconcile(); len(fixed) != 0 {
+		t.Fatalf("expected nothing to fix, got %v", fixed)
+	}
+}
+
+func TestWaitEnabled(t *testing.T) {
+	p := &v2.Plugin{PluginObj: types.Plugin{ID: strings.Repeat("1", 64), Name: "wait:latest"}}
+	s := NewStore()
+	s.SetAll(map[string]*v2.Plugin{p.GetID(): p})
+	c := &controller{restart: true, exitChan: make(chan bool)}
+	m := &Manager{
+		config: ManagerConfig{Store: s},
+		cMap:   map[*v2.Plugin]*controller{p: c},
+	}
+
+	if err := m.WaitEnabled("wait", 100*time.Millisecond); !errdefs.IsDeadline(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// The plugin is enabled by another goroutine.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.SetState(p, true)
+	}()
+	if err := m.WaitEnabled("wait", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plugin exits before it is ready.
+	s.SetState(p, false)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		m.mu.Lock()
+		c.restart = false
+		close(c.exitChan)
+		c.exitChan = nil
+		m.mu.Unlock()
+	}()
+	if err := m.WaitEnabled(p.GetID(), 5*time.Second); !errdefs.IsSystem(err) {
+		t.Fatalf("expected the plugin to have exited, got %v", err)
+	}
+
+	// A plugin which was disabled before the wait started is waited for,
+	// rather than considered to have exited.
+	if err := m.WaitEnabled(p.GetID(), 100*time.Millisecond); !errdefs.IsDeadline(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		m.mu.Lock()
+		c.restart = true
+		c.exitChan = make(chan bool)
+		m.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		s.SetState(p, true)
+	}()
+	if err := m.WaitEnabled(p.GetID(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.WaitEnabled("missing", time.Second); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestNeedsPropagatedMount(t *testing.T) {
+	volume := types.PluginInterfaceType{Capability: "volumedriver", Prefix: "docker", Version: "1.0"}
+	network := types.PluginInterfaceType{Capability: "networkdriver", Prefix: "docker", Version: "1.0"}
+	custom := types.PluginInterfaceType{Capability: "customdriver", Prefix: "docker", Version: "1.0"}
+	customV2 := types.PluginInterfaceType{Capability: "customdriver", Prefix: "docker", Version: "2.0"}
+
+	m := &Manager{propagatedMountCapabilities: propagatedMountCapabilities(nil)}
+	if !m.needsPropagatedMount(volume) {
+		t.Fatal("expected volume drivers to need mount propagation by default")
+	}
+	if m.needsPropagatedMount(network) || m.needsPropagatedMount(custom) {
+		t.Fatal("expected only volume and graph drivers to need mount propagation by default")
+	}
+
+	m = &Manager{propagatedMountCapabilities: propagatedMountCapabilities([]string{"customdriver"})}
+	if !m.needsPropagatedMount(custom) {
+		t.Fatal("expected the configured capability to need mount propagation")
+	}
+	if m.needsPropagatedMount(customV2) || m.needsPropagatedMount(volume) {
+		t.Fatal("expected only docker 1.x types of the configured capabilities to need mount propagation")
+	}
+}
+
+func TestPluginsByCapability(t *testing.T) {
+	newPlugin := func(id, name string, capabilities ...string) *v2.Plugin {
+		p := &v2.Plugin{PluginObj: types.Plugin{ID: id, Name: name}}
+		for _, capability := range capabilities {
+			p.PluginObj.Config.Interface.Types = append(p.PluginObj.Config.Interface.Types, types.PluginInterfaceType{Capability: capability, Prefix: "docker", Version: "1.0"})
+		}
+		return p
+	}
+	volume := newPlugin("1", "volume:latest", "volumedriver")
+	both := newPlugin("2", "both:latest", "volumedriver", "networkdriver")
+	disabled := newPlugin("3", "disabled:latest", "volumedriver")
+
+	s := NewStore()
+	m := &Manager{config: ManagerConfig{Store: s}}
+	for _, p := range []*v2.Plugin{volume, both, disabled} {
+		if err := s.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if plugins := m.PluginsByCapability("volumedriver"); len(plugins) != 0 {
+		t.Fatalf("expected no enabled volume drivers, got %d", len(plugins))
+	}
+
+	s.SetState(volume, true)
+	s.SetState(both, true)
+	if plugins := m.PluginsByCapability("VolumeDriver"); !reflect.DeepEqual(plugins, []*v2.Plugin{both, volume}) {
+		t.Fatalf("expected both enabled volume drivers, got %v", plugins)
+	}
+	if plugins := m.PluginsByCapability("networkdriver"); !reflect.DeepEqual(plugins, []*v2.Plugin{both}) {
+		t.Fatalf("expected the enabled network driver, got %v", plugins)
+	}
+
+	s.SetState(both, false)
+	s.Remove(volume)
+	if plugins := m.PluginsByCapability("volumedriver"); len(plugins) != 0 {
+		t.Fatalf("expected no enabled volume drivers after disable and remove, got %d", len(plugins))
+	}
+	if plugins := m.PluginsByCapability("networkdriver"); len(plugins) != 0 {
+		t.Fatalf("expected no enabled network drivers after disable, got %d", len(plugins))
+	}
+}
+
+func TestMarkFailed(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStore()
+	m := &Manager{config: ManagerConfig{Store: s, Root: root}}
+	p := &v2.Plugin{PluginObj: types.Plugin{ID: "1", Name: "failing:latest"}}
+	if err := s.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, p.GetID()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	s.SetState(p, true)
+	m.loggerState(p.GetID()).buf.add([]byte("cannot connect to backend\n"))
+
+	m.markFailed(p, "it exited 5 times within 1m0s")
+	if p.IsEnabled() || !p.IsFailed() {
+		t.Fatalf("expected the plugin to be disabled and failed, got enabled=%v failed=%v", p.IsEnabled(), p.IsFailed())
+	}
+	saved, err := ioutil.ReadFile(filepath.Join(root, p.GetID(), configFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), `"Failed":true`) {
+		t.Fatalf("expected the failed state to be saved, got %s", saved)
+	}
+}
+
+func TestValidateLoadedPlugin(t *testing.T) {
+	id := strings.Repeat("1", 64)
+	newPlugin := func() *v2.Plugin {
+		p := &v2.Plugin{PluginObj: types.Plugin{ID: id, Name: "valid:latest"}}
+		p.PluginObj.Config.Interface = types.PluginConfigInterface{
+			Socket: "plugin.sock",
+			Types:  []types.PluginInterfaceType{{Prefix: "docker", Capability: "volumedriver", Version: "1.0"}},
+		}
+		return p
+	}
+	if err := validateLoadedPlugin(id, newPlugin()); err != nil {
+		t.Fatal(err)
+	}
+
+	for expected, modify := range map[string]func(*v2.Plugin){
+		"does not match the plugin directory": func(p *v2.Plugin) { p.PluginObj.ID = "" },
+		"has no Name":                         func(p *v2.Plugin) { p.PluginObj.Name = "" },
+		"has no Config.Interface.Socket":      func(p *v2.Plugin) { p.PluginObj.Config.Interface.Socket = "" },
+		"has no Config.Interface.Types":       func(p *v2.Plugin) { p.PluginObj.Config.Interface.Types = nil },
+		"invalid Config.Interface.Types[0]":   func(p *v2.Plugin) { p.PluginObj.Config.Interface.Types[0].Capability = "" },
+		"has no Config.Mounts[0].Destination": func(p *v2.Plugin) { p.PluginObj.Config.Mounts = []types.PluginMount{{}} },
+		"has no Settings.Devices[0].Path":     func(p *v2.Plugin) { p.PluginObj.Settings.Devices = []types.PluginDevice{{}} },
+	} {
+		p := newPlugin()
+		modify(p)
+		err := validateLoadedPlugin(id, p)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected an error containing %q, got %v", expected, err)
+		}
+		if !strings.Contains(err.Error(), id) {
+			t.Fatalf("expected the error to name the plugin ID, got %v", err)
+		}
+	}
+}
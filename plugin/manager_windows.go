@@ -1,6 +1,7 @@
 package plugin // import "github.com/docker/docker/plugin"
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/docker/docker/plugin/v2"
@@ -24,5 +25,6 @@ func (pm *Manager) restore(p *v2.Plugin, c *controller) error {
 }
 
 // Shutdown plugins
-func (pm *Manager) Shutdown() {
+func (pm *Manager) Shutdown(ctx context.Context) error {
+	return nil
 }
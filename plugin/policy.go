@@ -0,0 +1,59 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// installPolicy decides which plugins can be installed, based on their
+// reference. Patterns are matched against the full and the familiar name of
+// the plugin, with and without its tag, such as "registry.internal/team/foo",
+// "vieux/sshfs", or "vieux/sshfs:1.0". They use path.Match syntax, and a
+// pattern ending with "/*" also matches any name below that prefix.
+type installPolicy struct {
+	allowed []string
+	denied  []string
+}
+
+func newInstallPolicy(allowed, denied []string) (installPolicy, error) {
+	for _, pattern := range append(append([]string(nil), allowed...), denied...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return installPolicy{}, errors.Wrapf(err, "invalid plugin pattern %q", pattern)
+		}
+	}
+	return installPolicy{allowed: allowed, denied: denied}, nil
+}
+
+// check returns a policyError if the plugin ref may not be installed. Denied
+// patterns take precedence over allowed ones. If no plugin is explicitly
+// allowed, all plugins which are not denied are.
+func (p installPolicy) check(ref reference.Named) error {
+	if matchAny(p.denied, ref) {
+		return errors.WithStack(policyError(reference.FamiliarString(ref) + " is denied by the plugin install policy"))
+	}
+	if len(p.allowed) > 0 && !matchAny(p.allowed, ref) {
+		return errors.WithStack(policyError(reference.FamiliarString(ref) + " is not allowed by the plugin install policy"))
+	}
+	return nil
+}
+
+func matchAny(patterns []string, ref reference.Named) bool {
+	names := []string{ref.Name(), reference.FamiliarName(ref)}
+	if tagged, ok := ref.(reference.Tagged); ok {
+		names = append(names, ref.Name()+":"+tagged.Tag(), reference.FamiliarName(ref)+":"+tagged.Tag())
+	}
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestInstallPolicy(t *testing.T) {
+	policy, err := newInstallPolicy(
+		[]string{"registry.internal/*", "vieux/sshfs", "docker.io/library/*:1.*"},
+		[]string{"registry.internal/untrusted/*"},
+	)
+	assert.NilError(t, err)
+
+	for _, tc := range []struct {
+		ref      string
+		expected string
+	}{
+		{ref: "registry.internal/team/plugin:latest"},
+		{ref: "registry.internal/plugin"},
+		{ref: "vieux/sshfs:next"},
+		{ref: "docker.io/vieux/sshfs"},
+		{ref: "foo:1.0"},
+		{ref: "foo:2.0", expected: "plugin foo:2.0 is not allowed by the plugin install policy"},
+		{ref: "vieux/other", expected: "plugin vieux/other is not allowed by the plugin install policy"},
+		{ref: "registry.internal/untrusted/plugin", expected: "plugin registry.internal/untrusted/plugin is denied by the plugin install policy"},
+	} {
+		ref, err := reference.ParseNormalizedNamed(tc.ref)
+		assert.NilError(t, err)
+		err = policy.check(ref)
+		if tc.expected == "" {
+			assert.NilError(t, err, tc.ref)
+			continue
+		}
+		assert.Check(t, is.Error(err, tc.expected), tc.ref)
+		assert.Check(t, errdefs.IsForbidden(err), tc.ref)
+	}
+
+	ref, err := reference.ParseNormalizedNamed("anything")
+	assert.NilError(t, err)
+	assert.NilError(t, installPolicy{}.check(ref))
+
+	_, err = newInstallPolicy([]string{"registry.internal/["}, nil)
+	assert.Check(t, is.ErrorContains(err, `invalid plugin pattern "registry.internal/["`))
+}
@@ -0,0 +1,125 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+)
+
+// ProxyConfig holds the proxy settings used for outbound traffic by plugin
+// pulls and pushes, and by the plugin processes themselves.
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// IsZero reports whether no proxy is configured.
+func (c ProxyConfig) IsZero() bool {
+	return c.HTTPProxy == "" && c.HTTPSProxy == "" && c.NoProxy == ""
+}
+
+// Env returns the proxy configuration as environment variables, in both
+// their upper and lower case forms.
+func (c ProxyConfig) Env() []string {
+	var env []string
+	for _, kv := range []struct{ name, value string }{
+		{"HTTP_PROXY", c.HTTPProxy},
+		{"HTTPS_PROXY", c.HTTPSProxy},
+		{"NO_PROXY", c.NoProxy},
+	} {
+		if kv.value == "" {
+			continue
+		}
+		env = append(env, kv.name+"="+kv.value, strings.ToLower(kv.name)+"="+kv.value)
+	}
+	return env
+}
+
+// withProxyEnv adds the proxy environment to env. Variables already set in
+// env, for example by the plugin settings, are left untouched.
+func (c ProxyConfig) withProxyEnv(env []string) []string {
+	set := make(map[string]struct{}, len(env))
+	for _, e := range env {
+		set[strings.SplitN(e, "=", 2)[0]] = struct{}{}
+	}
+	for _, e := range c.Env() {
+		if _, ok := set[strings.SplitN(e, "=", 2)[0]]; !ok {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// ProxyFunc returns a function which selects the proxy to use for a request,
+// suitable for use as http.Transport.Proxy.
+func (c ProxyConfig) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	httpProxy, err := parseProxy(c.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
+	httpsProxy, err := parseProxy(c.HTTPSProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if c.bypass(req.URL) {
+			return nil, nil
+		}
+		if req.URL.Scheme == "https" {
+			return httpsProxy, nil
+		}
+		return httpProxy, nil
+	}, nil
+}
+
+// bypass reports whether requests to u should not be proxied according to
+// NoProxy, which is a comma separated list of hosts, domain suffixes, or `*`.
+func (c ProxyConfig) bypass(u *url.URL) bool {
+	host := u.Hostname()
+	for _, p := range strings.Split(c.NoProxy, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(p); err == nil {
+			p = h
+		}
+		p = strings.TrimPrefix(p, ".")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		// Like the environment, accept proxies given without a scheme.
+		if u, err := url.Parse("http://" + proxy); err == nil && u.Host != "" {
+			return u, nil
+		}
+		return nil, errors.Errorf("invalid proxy address %q", proxy)
+	}
+	return u, nil
+}
+
+// withProxy sets proxy on each of the endpoints.
+func withProxy(endpoints []registry.APIEndpoint, proxy func(*http.Request) (*url.URL, error)) []registry.APIEndpoint {
+	for i := range endpoints {
+		endpoints[i].Proxy = proxy
+	}
+	return endpoints
+}
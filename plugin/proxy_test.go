@@ -0,0 +1,88 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/docker/docker/registry"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestProxyFunc(t *testing.T) {
+	c := ProxyConfig{
+		HTTPProxy:  "proxy.internal:3128",
+		HTTPSProxy: "https://secure-proxy.internal:3129",
+		NoProxy:    "localhost, .corp.example.com,registry.internal:5000",
+	}
+	proxy, err := c.ProxyFunc()
+	assert.NilError(t, err)
+
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{url: "http://example.com/v2/", expected: "http://proxy.internal:3128"},
+		{url: "https://example.com/v2/", expected: "https://secure-proxy.internal:3129"},
+		{url: "https://localhost:5000/v2/"},
+		{url: "https://corp.example.com/v2/"},
+		{url: "https://hub.corp.example.com/v2/"},
+		{url: "https://registry.internal/v2/"},
+		{url: "https://notcorp.example.com/v2/", expected: "https://secure-proxy.internal:3129"},
+	} {
+		u, err := url.Parse(tc.url)
+		assert.NilError(t, err)
+		p, err := proxy(&http.Request{URL: u})
+		assert.NilError(t, err)
+		if tc.expected == "" {
+			assert.Check(t, is.Nil(p), tc.url)
+			continue
+		}
+		assert.Check(t, is.Equal(p.String(), tc.expected), tc.url)
+	}
+
+	_, err = ProxyConfig{HTTPProxy: "http://%zz"}.ProxyFunc()
+	assert.Check(t, is.ErrorContains(err, "invalid proxy address"))
+}
+
+func TestProxyEnv(t *testing.T) {
+	c := ProxyConfig{HTTPProxy: "http://proxy:3128", NoProxy: "localhost"}
+	env := c.withProxyEnv([]string{"PATH=/bin", "http_proxy=http://plugin-proxy:8080"})
+	assert.Check(t, is.DeepEqual(env, []string{
+		"PATH=/bin",
+		"http_proxy=http://plugin-proxy:8080",
+		"HTTP_PROXY=http://proxy:3128",
+		"NO_PROXY=localhost",
+		"no_proxy=localhost",
+	}))
+
+	assert.Check(t, is.Len(ProxyConfig{}.withProxyEnv(nil), 0))
+}
+
+type endpointsRegistryService struct {
+	registry.Service
+}
+
+func (endpointsRegistryService) LookupPullEndpoints(hostname string) ([]registry.APIEndpoint, error) {
+	return []registry.APIEndpoint{{}, {}}, nil
+}
+
+func TestPluginRegistryServiceProxy(t *testing.T) {
+	proxy, err := ProxyConfig{HTTPProxy: "http://proxy:3128"}.ProxyFunc()
+	assert.NilError(t, err)
+
+	s := pluginRegistryService{Service: endpointsRegistryService{}, proxy: proxy}
+	endpoints, err := s.LookupPullEndpoints("example.com")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(endpoints, 2))
+	for _, e := range endpoints {
+		assert.Check(t, e.Proxy != nil)
+	}
+
+	endpoints, err = pluginRegistryService{Service: endpointsRegistryService{}}.LookupPullEndpoints("example.com")
+	assert.NilError(t, err)
+	for _, e := range endpoints {
+		assert.Check(t, e.Proxy == nil)
+	}
+}
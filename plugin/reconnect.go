@@ -0,0 +1,235 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	containerderrdefs "github.com/containerd/containerd/errdefs"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 5 * time.Second
+)
+
+// reconnectingExecutor wraps the executor created by
+// ManagerConfig.CreateExecutor. When the runtime becomes unavailable, for
+// example because containerd was restarted, it creates a new executor and
+// re-attaches the enabled plugins to it. Calls made in the meantime fail
+// right away with a runtimeUnavailableError.
+type reconnectingExecutor struct {
+	pm *Manager
+
+	mu           sync.RWMutex // protects executor and reconnecting
+	executor     Executor
+	reconnecting bool
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newReconnectingExecutor(pm *Manager, executor Executor) *reconnectingExecutor {
+	return &reconnectingExecutor{pm: pm, executor: executor, done: make(chan struct{})}
+}
+
+// isRuntimeUnavailable reports whether err means that the runtime cannot be
+// reached.
+func isRuntimeUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	return errdefs.IsUnavailable(err) || containerderrdefs.IsUnavailable(cause) || status.Code(cause) == codes.Unavailable
+}
+
+// do calls f with the current executor, and starts reconnecting if the
+// runtime turns out to be unavailable.
+func (e *reconnectingExecutor) do(f func(Executor) error) error {
+	e.mu.RLock()
+	executor, reconnecting := e.executor, e.reconnecting
+	e.mu.RUnlock()
+	if reconnecting {
+		return errors.WithStack(runtimeUnavailableError{})
+	}
+
+	err := f(executor)
+	if isRuntimeUnavailable(err) {
+		e.reconnect()
+		return errors.WithStack(runtimeUnavailableError{cause: err})
+	}
+	return err
+}
+
+func (e *reconnectingExecutor) Create(id string, spec specs.Spec, stdout, stderr io.WriteCloser) error {
+	return e.do(func(executor Executor) error {
+		return executor.Create(id, spec, stdout, stderr)
+	})
+}
+
+func (e *reconnectingExecutor) IsRunning(id string) (running bool, err error) {
+	err = e.do(func(executor Executor) error {
+		running, err = executor.IsRunning(id)
+		return err
+	})
+	return running, err
+}
+
+func (e *reconnectingExecutor) Restore(id string, stdout, stderr io.WriteCloser) (alive bool, err error) {
+	err = e.do(func(executor Executor) error {
+		alive, err = executor.Restore(id, stdout, stderr)
+		return err
+	})
+	return alive, err
+}
+
+func (e *reconnectingExecutor) Signal(id string, signal int) error {
+	return e.do(func(executor Executor) error {
+		return executor.Signal(id, signal)
+	})
+}
+
+func (e *reconnectingExecutor) Checkpoint(id, checkpointDir string) error {
+	return e.do(func(executor Executor) error {
+		ce, ok := executor.(CheckpointExecutor)
+		if !ok {
+			return errdefs.NotImplemented(errors.New("the plugin executor does not support checkpoints"))
+		}
+		return ce.Checkpoint(id, checkpointDir)
+	})
+}
+
+// CreateFromCheckpoint starts the plugin from scratch if the executor does
+// not support checkpoints.
+func (e *reconnectingExecutor) CreateFromCheckpoint(id string, spec specs.Spec, checkpointDir string, stdout, stderr io.WriteCloser) error {
+	return e.do(func(executor Executor) error {
+		ce, ok := executor.(CheckpointExecutor)
+		if !ok {
+			return executor.Create(id, spec, stdout, stderr)
+		}
+		return ce.CreateFromCheckpoint(id, spec, checkpointDir, stdout, stderr)
+	})
+}
+
+// Stats returns the resource usage of the plugin, if the executor supports
+// it.
+func (e *reconnectingExecutor) Stats(id string) (stats *types.Stats, err error) {
+	err = e.do(func(executor Executor) error {
+		se, ok := executor.(StatsExecutor)
+		if !ok {
+			return errdefs.NotImplemented(errors.New("the plugin executor does not support stats"))
+		}
+		stats, err = se.Stats(id)
+		return err
+	})
+	return stats, err
+}
+
+// reconnect starts reconnecting to the runtime in the background, unless it
+// is already being done.
+func (e *reconnectingExecutor) reconnect() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.reconnecting {
+		return
+	}
+	e.reconnecting = true
+	logrus.Warn("plugin runtime is unavailable, reconnecting")
+	go e.reconnectLoop()
+}
+
+func (e *reconnectingExecutor) reconnectLoop() {
+	backoff := reconnectMinBackoff
+	for {
+		executor, exited, err := e.connect()
+		if err == nil {
+			e.mu.Lock()
+			previous := e.executor
+			e.executor = executor
+			e.reconnecting = false
+			e.mu.Unlock()
+			closeExecutor(previous)
+			logrus.Info("reconnected to the plugin runtime")
+
+			// The exit events of these plugins were lost while the
+			// runtime was unavailable.
+			for _, id := range exited {
+				if err := e.pm.HandleExitEvent(id); err != nil {
+					logrus.WithError(err).WithField("id", id).Error("Could not handle plugin exit")
+				}
+			}
+			return
+		}
+		logrus.WithError(err).Debugf("failed to reconnect to the plugin runtime, retrying in %v", backoff)
+
+		select {
+		case <-e.done:
+			return
+		case <-e.pm.clock().After(backoff):
+		}
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// connect creates a new executor, and re-attaches the enabled plugins to it.
+// It returns the IDs of the enabled plugins which are no longer running.
+func (e *reconnectingExecutor) connect() (Executor, []string, error) {
+	executor, err := e.pm.config.CreateExecutor(e.pm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if executor == nil {
+		return nil, nil, errors.New("no plugin executor")
+	}
+
+	var exited []string
+	for _, p := range e.pm.config.Store.GetAll() {
+		if !p.IsEnabled() {
+			continue
+		}
+		e.pm.mu.RLock()
+		c := e.pm.cMap[p]
+		e.pm.mu.RUnlock()
+		if c == nil {
+			continue
+		}
+
+		stdout, stderr := e.pm.makeLoggerStreams(p.GetID())
+		alive, err := executor.Restore(p.GetID(), stdout, stderr)
+		if isRuntimeUnavailable(err) {
+			closeExecutor(executor)
+			return nil, nil, err
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("id", p.GetID()).Error("failed to re-attach to plugin")
+			continue
+		}
+		if !alive {
+			exited = append(exited, p.GetID())
+		}
+	}
+	return executor, exited, nil
+}
+
+// closeExecutor closes executor if it holds resources, such as the
+// connection to the runtime of the containerd executor.
+func closeExecutor(executor Executor) {
+	if c, ok := executor.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logrus.WithError(err).Warn("error closing plugin executor")
+		}
+	}
+}
+
+// close stops reconnecting to the runtime.
+func (e *reconnectingExecutor) close() {
+	e.closeOnce.Do(func() { close(e.done) })
+}
@@ -0,0 +1,139 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	containerderrdefs "github.com/containerd/containerd/errdefs"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/system"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/poll"
+)
+
+// fakeRuntimeExecutor fails every call with an unavailable error while down
+// is set.
+type fakeRuntimeExecutor struct {
+	mu       sync.Mutex
+	down     bool
+	restored []string
+	closed   bool
+}
+
+func (e *fakeRuntimeExecutor) err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.down {
+		return errors.Wrap(containerderrdefs.ErrUnavailable, "connection refused")
+	}
+	return nil
+}
+
+func (e *fakeRuntimeExecutor) Create(id string, spec specs.Spec, stdout, stderr io.WriteCloser) error {
+	return e.err()
+}
+
+func (e *fakeRuntimeExecutor) IsRunning(id string) (bool, error) {
+	return true, e.err()
+}
+
+func (e *fakeRuntimeExecutor) Restore(id string, stdout, stderr io.WriteCloser) (bool, error) {
+	if err := e.err(); err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.restored = append(e.restored, id)
+	return true, nil
+}
+
+func (e *fakeRuntimeExecutor) Signal(id string, signal int) error {
+	return e.err()
+}
+
+func (e *fakeRuntimeExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
+
+func TestReconnectingExecutor(t *testing.T) {
+	root, err := ioutil.TempDir("", t.Name())
+	assert.NilError(t, err)
+	defer system.EnsureRemoveAll(root)
+
+	var (
+		mu        sync.Mutex
+		executors []*fakeRuntimeExecutor
+		down      = true
+	)
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	m, err := NewManager(ManagerConfig{
+		Store:    s,
+		Root:     managerRoot,
+		ExecRoot: filepath.Join(root, "exec"),
+		CreateExecutor: func(*Manager) (Executor, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			e := &fakeRuntimeExecutor{down: len(executors) > 0 && down}
+			executors = append(executors, e)
+			return e, nil
+		},
+		LogPluginEvent: func(_, _, _ string) {},
+	})
+	assert.NilError(t, err)
+	executor := m.executor.(*reconnectingExecutor)
+	defer executor.close()
+	executor.executor.(*fakeRuntimeExecutor).down = true
+
+	p := newTestPlugin(t, "reconnect", "testreconnect", managerRoot)
+	p.PluginObj.Enabled = true
+	assert.NilError(t, s.Add(p))
+	m.mu.Lock()
+	m.cMap[p] = &controller{}
+	m.mu.Unlock()
+
+	// The runtime goes away; calls fail with a clear error, including the
+	// ones made while reconnecting.
+	err = m.executor.Signal(p.GetID(), 15)
+	assert.Check(t, errdefs.IsUnavailable(err))
+	assert.Check(t, is.ErrorContains(err, "plugin runtime temporarily unavailable"))
+	_, err = m.executor.IsRunning(p.GetID())
+	assert.Check(t, errdefs.IsUnavailable(err))
+
+	// Once the runtime is back, the enabled plugins are re-attached.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		executor.mu.RLock()
+		defer executor.mu.RUnlock()
+		if executor.reconnecting {
+			return poll.Continue("still reconnecting")
+		}
+		return poll.Success()
+	}, poll.WithDelay(10*time.Millisecond), poll.WithTimeout(10*time.Second))
+
+	current := executor.executor.(*fakeRuntimeExecutor)
+	assert.Check(t, is.DeepEqual(current.restored, []string{p.GetID()}))
+	// The executors replaced, or which failed to connect, were closed.
+	mu.Lock()
+	for _, e := range executors {
+		e.mu.Lock()
+		assert.Check(t, is.Equal(e.closed, e != current))
+		e.mu.Unlock()
+	}
+	mu.Unlock()
+	running, err := m.executor.IsRunning(p.GetID())
+	assert.NilError(t, err)
+	assert.Check(t, running)
+}
@@ -0,0 +1,68 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/builder/remotecontext/git"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/urlutil"
+	"github.com/pkg/errors"
+)
+
+// openRemoteContext returns the tar stream of the plugin context at remote,
+// which is either a git repository, or the URL of a tar archive which may be
+// compressed. The stream may be closed more than once, as both
+// splitConfigRootFSFromTar and CreateFromContext close it.
+func openRemoteContext(remote string) (io.ReadCloser, error) {
+	switch {
+	case urlutil.IsGitURL(remote):
+		root, err := git.Clone(remote)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error cloning plugin context %s", remote)
+		}
+		tarCtx, err := archive.Tar(root, archive.Uncompressed)
+		if err != nil {
+			os.RemoveAll(root)
+			return nil, err
+		}
+		return closeOnce(tarCtx, func() error {
+			err := tarCtx.Close()
+			os.RemoveAll(root)
+			return err
+		}), nil
+	case urlutil.IsURL(remote):
+		resp, err := remotecontext.GetWithStatusError(remote)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error downloading plugin context %s", remote)
+		}
+		tarCtx, err := archive.DecompressStream(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrapf(err, "error reading plugin context %s", remote)
+		}
+		return closeOnce(tarCtx, func() error {
+			tarCtx.Close()
+			return resp.Body.Close()
+		}), nil
+	default:
+		return nil, errdefs.InvalidParameter(errors.Errorf("invalid plugin context %q: must be a git repository or a URL", remote))
+	}
+}
+
+// closeOnce returns a reader of r which calls closer the first time it is
+// closed only.
+func closeOnce(r io.Reader, closer func() error) io.ReadCloser {
+	var (
+		once sync.Once
+		err  error
+	)
+	return ioutils.NewReadCloserWrapper(r, func() error {
+		once.Do(func() { err = closer() })
+		return err
+	})
+}
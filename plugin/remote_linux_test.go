@@ -0,0 +1,79 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+)
+
+func TestOpenRemoteContext(t *testing.T) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	config := []byte(`{}`)
+	if err := tw.WriteHeader(&tar.Header{Name: "config.json", Mode: 0644, Size: int64(len(config))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/context.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	rc, err := openRemoteContext(ts.URL + "/context.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "config.json" {
+		t.Fatalf("expected config.json, got %s", hdr.Name)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, config) {
+		t.Fatalf("expected %s, got %s", config, data)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("expected the end of the archive, got %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The stream is closed by both splitConfigRootFSFromTar and
+	// CreateFromContext.
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openRemoteContext(ts.URL + "/missing.tar"); err == nil {
+		t.Fatal("expected downloading a missing context to fail")
+	}
+
+	if _, err := openRemoteContext("context.tar"); !errdefs.IsInvalidParameter(err) {
+		t.Fatalf("expected an invalid parameter error, got %v", err)
+	}
+}
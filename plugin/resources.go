@@ -0,0 +1,62 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// minPluginMemory is the lowest memory limit of a plugin, like the lowest
+// memory limit of a container.
+const minPluginMemory = 4 * 1024 * 1024
+
+// validateResources checks the resource limits of a plugin.
+func validateResources(r types.PluginResources) error {
+	if r.Memory < 0 || (r.Memory > 0 && r.Memory < minPluginMemory) {
+		return errdefs.InvalidParameter(errors.Errorf("minimum memory limit allowed is %dMB", minPluginMemory/1024/1024))
+	}
+	if max := int64(runtime.NumCPU()) * 1e9; r.NanoCPUs < 0 || r.NanoCPUs > max {
+		return errdefs.InvalidParameter(errors.Errorf("range of CPUs is from 0.01 to %d.00, as there are only %d CPUs available", runtime.NumCPU(), runtime.NumCPU()))
+	}
+	return nil
+}
+
+// resources returns the resource limits of the plugin controlled by c, which
+// default to those of the manager.
+func (pm *Manager) resources(c *controller) types.PluginResources {
+	r := c.resources
+	if r.Memory == 0 {
+		r.Memory = pm.config.Resources.Memory
+	}
+	if r.NanoCPUs == 0 {
+		r.NanoCPUs = pm.config.Resources.NanoCPUs
+	}
+	return r
+}
+
+// setResources sets the cgroup limits of spec to r.
+func setResources(spec *specs.Spec, r types.PluginResources) {
+	if r.Memory == 0 && r.NanoCPUs == 0 {
+		return
+	}
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	if r.Memory > 0 {
+		memory := r.Memory
+		spec.Linux.Resources.Memory = &specs.LinuxMemory{Limit: &memory}
+	}
+	if r.NanoCPUs > 0 {
+		// https://www.kernel.org/doc/Documentation/scheduler/sched-bwc.txt
+		period := uint64(100 * time.Millisecond / time.Microsecond)
+		quota := r.NanoCPUs * int64(period) / 1e9
+		spec.Linux.Resources.CPU = &specs.LinuxCPU{Period: &period, Quota: &quota}
+	}
+}
@@ -0,0 +1,53 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateResources(t *testing.T) {
+	for _, r := range []types.PluginResources{
+		{},
+		{Memory: minPluginMemory},
+		{NanoCPUs: 5e8},
+	} {
+		if err := validateResources(r); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", r, err)
+		}
+	}
+	for _, r := range []types.PluginResources{
+		{Memory: -1},
+		{Memory: 1024},
+		{NanoCPUs: -1},
+		{NanoCPUs: 1 << 62},
+	} {
+		if err := validateResources(r); !errdefs.IsInvalidParameter(err) {
+			t.Fatalf("expected %+v to be invalid, got %v", r, err)
+		}
+	}
+}
+
+func TestSetResources(t *testing.T) {
+	pm := &Manager{config: ManagerConfig{Resources: types.PluginResources{Memory: 64 << 20, NanoCPUs: 1e9}}}
+
+	var spec specs.Spec
+	setResources(&spec, pm.resources(&controller{resources: types.PluginResources{NanoCPUs: 5e8}}))
+	if spec.Linux == nil || spec.Linux.Resources == nil {
+		t.Fatal("expected resources to be set")
+	}
+	if m := spec.Linux.Resources.Memory; m == nil || m.Limit == nil || *m.Limit != 64<<20 {
+		t.Fatalf("expected the memory limit of the manager, got %+v", m)
+	}
+	if cpu := spec.Linux.Resources.CPU; cpu == nil || *cpu.Period != 100000 || *cpu.Quota != 50000 {
+		t.Fatalf("expected the CPU quota of the plugin, got %+v", cpu)
+	}
+
+	spec = specs.Spec{}
+	setResources(&spec, (&Manager{}).resources(&controller{}))
+	if spec.Linux != nil {
+		t.Fatalf("expected no resources to be set, got %+v", spec.Linux)
+	}
+}
@@ -0,0 +1,87 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// restartMinBackoff and restartMaxBackoff bound the delay before a
+	// plugin which exited is restarted. The delay doubles with each restart,
+	// and is reset once the plugin ran for restartResetWindow.
+	restartMinBackoff  = 100 * time.Millisecond
+	restartMaxBackoff  = time.Minute
+	restartResetWindow = 10 * time.Second
+
+	// crashLoopExits is the number of exits within crashLoopWindow after
+	// which a plugin is considered crash-looping, and is not restarted
+	// anymore whatever its restart policy.
+	crashLoopExits  = 5
+	crashLoopWindow = time.Minute
+	// failedLogLines is the number of lines of output of a failed plugin
+	// which are logged.
+	failedLogLines = 20
+)
+
+// validateRestartPolicy checks that policy is a restart policy supported
+// for plugins: "no", "always", or "on-failure" with an optional maximum
+// retry count. The empty policy is "always".
+func validateRestartPolicy(policy container.RestartPolicy) error {
+	switch policy.Name {
+	case "", "no", "always":
+		if policy.MaximumRetryCount != 0 {
+			return errdefs.InvalidParameter(errors.Errorf("maximum retry count cannot be used with restart policy %q", policy.Name))
+		}
+	case "on-failure":
+		if policy.MaximumRetryCount < 0 {
+			return errdefs.InvalidParameter(errors.New("maximum retry count cannot be negative"))
+		}
+	default:
+		return errdefs.InvalidParameter(errors.Errorf("invalid restart policy %q for a plugin", policy.Name))
+	}
+	return nil
+}
+
+// nextRestart returns the delay before restarting the plugin, which exited
+// unexpectedly at now, or false if its restart policy says it must not be
+// restarted. Plugins are expected to keep running, so any such exit counts
+// as a failure for the on-failure policy. The caller must hold the lock of
+// the manager for writing.
+func (c *controller) nextRestart(now time.Time) (time.Duration, bool) {
+	switch c.restartPolicy.Name {
+	case "no":
+		return 0, false
+	case "on-failure":
+		if max := c.restartPolicy.MaximumRetryCount; max > 0 && c.restartCount >= max {
+			return 0, false
+		}
+	}
+
+	if !c.startedAt.IsZero() && now.Sub(c.startedAt) >= restartResetWindow {
+		c.backoff = 0
+	}
+	if c.backoff *= 2; c.backoff == 0 {
+		c.backoff = restartMinBackoff
+	} else if c.backoff > restartMaxBackoff {
+		c.backoff = restartMaxBackoff
+	}
+	c.restartCount++
+	return c.backoff, true
+}
+
+// crashLooping records that the plugin exited at now, and reports whether it
+// exited crashLoopExits times within crashLoopWindow. The caller must hold
+// the lock of the manager for writing.
+func (c *controller) crashLooping(now time.Time) bool {
+	exits := c.exits[:0]
+	for _, t := range c.exits {
+		if now.Sub(t) < crashLoopWindow {
+			exits = append(exits, t)
+		}
+	}
+	c.exits = append(exits, now)
+	return len(c.exits) >= crashLoopExits
+}
@@ -0,0 +1,96 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestValidateRestartPolicy(t *testing.T) {
+	for _, policy := range []container.RestartPolicy{
+		{},
+		{Name: "no"},
+		{Name: "always"},
+		{Name: "on-failure"},
+		{Name: "on-failure", MaximumRetryCount: 3},
+	} {
+		if err := validateRestartPolicy(policy); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", policy, err)
+		}
+	}
+
+	for _, policy := range []container.RestartPolicy{
+		{Name: "unless-stopped"},
+		{Name: "always", MaximumRetryCount: 3},
+		{Name: "on-failure", MaximumRetryCount: -1},
+	} {
+		if err := validateRestartPolicy(policy); !errdefs.IsInvalidParameter(err) {
+			t.Fatalf("expected %+v to be invalid, got %v", policy, err)
+		}
+	}
+}
+
+func TestControllerNextRestart(t *testing.T) {
+	now := time.Now()
+
+	c := &controller{restartPolicy: container.RestartPolicy{Name: "no"}}
+	if _, ok := c.nextRestart(now); ok {
+		t.Fatal("expected a plugin with the no restart policy not to be restarted")
+	}
+
+	// The backoff doubles with each restart, up to the maximum.
+	c = &controller{startedAt: now}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	for _, d := range expected {
+		delay, ok := c.nextRestart(now)
+		if !ok || delay != d {
+			t.Fatalf("expected a restart after %v, got %v (%v)", d, delay, ok)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		c.nextRestart(now)
+	}
+	if delay, _ := c.nextRestart(now); delay != restartMaxBackoff {
+		t.Fatalf("expected the backoff to be capped at %v, got %v", restartMaxBackoff, delay)
+	}
+
+	// The backoff is reset once the plugin ran long enough.
+	if delay, _ := c.nextRestart(now.Add(restartResetWindow)); delay != restartMinBackoff {
+		t.Fatalf("expected the backoff to be reset, got %v", delay)
+	}
+
+	// The on-failure policy gives up after the maximum retry count.
+	c = &controller{restartPolicy: container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 2}}
+	for i := 0; i < 2; i++ {
+		if _, ok := c.nextRestart(now); !ok {
+			t.Fatalf("expected restart %d to be allowed", i+1)
+		}
+	}
+	if _, ok := c.nextRestart(now); ok {
+		t.Fatal("expected the plugin not to be restarted beyond the maximum retry count")
+	}
+}
+
+func TestControllerCrashLooping(t *testing.T) {
+	now := time.Now()
+	c := &controller{}
+	for i := 0; i < crashLoopExits-1; i++ {
+		if c.crashLooping(now.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("exit %d should not be a crash loop", i+1)
+		}
+	}
+
+	// Exits outside of the window are forgotten.
+	later := now.Add(crashLoopWindow + crashLoopExits*time.Second)
+	if c.crashLooping(later) {
+		t.Fatal("exits outside of the window should not count")
+	}
+	for i := 0; i < crashLoopExits-2; i++ {
+		c.crashLooping(later)
+	}
+	if !c.crashLooping(later) {
+		t.Fatalf("expected %d exits within the window to be a crash loop", crashLoopExits)
+	}
+}
@@ -0,0 +1,26 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import "time"
+
+const (
+	// mountRetries is the number of times setting up or cleaning up the
+	// mounts of a plugin is retried after failing, and mountRetryDelay the
+	// delay before the first retry, which doubles with each retry.
+	mountRetries    = 3
+	mountRetryDelay = 100 * time.Millisecond
+)
+
+// retryMount calls op, retrying it with a backoff while it fails, up to
+// mountRetries times. It returns the error of the last attempt. Unmounts
+// are already lazy, so this mostly helps with transient errors, such as
+// a mount point still being busy right after the plugin exited.
+func (pm *Manager) retryMount(op func() error) error {
+	delay := mountRetryDelay
+	err := op()
+	for i := 0; err != nil && i < mountRetries; i++ {
+		<-pm.clock().After(delay)
+		delay *= 2
+		err = op()
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryMount(t *testing.T) {
+	clock := &fakeClock{}
+	pm := &Manager{config: ManagerConfig{Clock: clock}}
+
+	retry := func(failures int) (int, error) {
+		calls := 0
+		done := make(chan error)
+		go func() {
+			done <- pm.retryMount(func() error {
+				calls++
+				if calls <= failures {
+					return errors.New("busy")
+				}
+				return nil
+			})
+		}()
+		delay := mountRetryDelay
+		for {
+			select {
+			case err := <-done:
+				return calls, err
+			default:
+			}
+			if clock.waiters() == 0 {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			clock.Advance(delay)
+			delay *= 2
+		}
+	}
+
+	if calls, err := retry(2); err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %d calls, error %v", calls, err)
+	}
+	if calls, err := retry(mountRetries + 1); err == nil || calls != mountRetries+1 {
+		t.Fatalf("expected failure after %d calls, got %d calls, error %v", mountRetries+1, calls, err)
+	}
+}
@@ -0,0 +1,80 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/docker/docker/daemon/caps"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/docker/docker/plugin/v2"
+	"github.com/pkg/errors"
+)
+
+// elfMachines maps the architectures the daemon may be built for to the
+// machine of the executables they run.
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+}
+
+// checkDevices returns the problems with the host devices which p is set to
+// use: each of them must exist, and be a device or a directory of devices.
+func checkDevices(p *v2.Plugin) []string {
+	var problems []string
+	for _, dev := range p.PluginObj.Settings.Devices {
+		if dev.Path == nil {
+			continue
+		}
+		fi, err := os.Stat(*dev.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("device %s is not available: %v", *dev.Path, err))
+			continue
+		}
+		if fi.Mode()&os.ModeDevice == 0 && !fi.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s is not a device", *dev.Path))
+		}
+	}
+	return problems
+}
+
+// checkCapabilities returns the problems with the privileges which p
+// requires: each capability it is granted must be known to the kernel.
+func checkCapabilities(p *v2.Plugin) []string {
+	var problems []string
+	for _, c := range p.PluginObj.Config.Linux.Capabilities {
+		if caps.GetCapability(c) == nil {
+			problems = append(problems, fmt.Sprintf("capability %s is not supported", c))
+		}
+	}
+	return problems
+}
+
+// checkPlatform returns an error if the executable at path, in rootfs, is
+// built for another architecture than the daemon. Executables which are not
+// ELF binaries, such as scripts, are not checked.
+func checkPlatform(rootfs, path string) error {
+	machine, ok := elfMachines[runtime.GOARCH]
+	if !ok || !filepath.IsAbs(path) {
+		return nil
+	}
+	resolved, err := symlink.FollowSymlinkInScope(filepath.Join(rootfs, path), rootfs)
+	if err != nil {
+		return nil
+	}
+	f, err := elf.Open(resolved)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if f.Machine != machine {
+		return errors.Errorf("plugin entrypoint %s is built for %s, not %s", path, f.Machine, runtime.GOARCH)
+	}
+	return nil
+}
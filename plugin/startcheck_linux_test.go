@@ -0,0 +1,104 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/plugin/v2"
+)
+
+func TestCheckDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	devNull, missing := "/dev/null", filepath.Join(dir, "missing")
+
+	p := &v2.Plugin{}
+	p.PluginObj.Settings.Devices = []types.PluginDevice{{Path: &devNull}, {Path: &dir}, {Path: &missing}, {Path: &file}}
+	problems := checkDevices(p)
+	if len(problems) != 2 || !strings.Contains(problems[0], "device "+missing+" is not available") || problems[1] != file+" is not a device" {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	p := &v2.Plugin{}
+	p.PluginObj.Config.Linux.Capabilities = []string{"CAP_SYS_ADMIN", "CAP_DOES_NOT_EXIST"}
+	problems := checkCapabilities(p)
+	if len(problems) != 1 || problems[0] != "capability CAP_DOES_NOT_EXIST is not supported" {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+
+	m := &Manager{config: ManagerConfig{Store: NewStore()}}
+	if err := m.enable(p, &controller{}, false); !errdefs.IsInvalidParameter(err) || !strings.Contains(err.Error(), "CAP_DOES_NOT_EXIST") {
+		t.Fatalf("expected enabling the plugin to fail, got %v", err)
+	}
+}
+
+// writeELF writes the header of an ELF executable for machine at path.
+func writeELF(t *testing.T, path string, machine elf.Machine) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    64,
+		Shentsize: 64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	if err := binary.Write(f, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	machine, ok := elfMachines[runtime.GOARCH]
+	if !ok {
+		t.Skipf("no ELF machine known for %s", runtime.GOARCH)
+	}
+	other := elf.EM_X86_64
+	if machine == other {
+		other = elf.EM_AARCH64
+	}
+
+	rootfs, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	writeELF(t, filepath.Join(rootfs, "native"), machine)
+	writeELF(t, filepath.Join(rootfs, "foreign"), other)
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "script"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/native", "/script", "/missing", "relative"} {
+		if err := checkPlatform(rootfs, path); err != nil {
+			t.Errorf("expected %s to pass, got %v", path, err)
+		}
+	}
+	if err := checkPlatform(rootfs, "/foreign"); err == nil || !strings.Contains(err.Error(), "is built for "+other.String()) {
+		t.Fatalf("expected an executable for %s to be rejected, got %v", other, err)
+	}
+}
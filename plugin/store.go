@@ -2,6 +2,7 @@ package plugin // import "github.com/docker/docker/plugin"
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/docker/distribution/reference"
@@ -66,8 +67,12 @@ func (ps *Store) SetAll(plugins map[string]*v2.Plugin) {
 	ps.Lock()
 	defer ps.Unlock()
 
+	ps.enabledByCap = make(map[string]map[string]*v2.Plugin)
 	for _, p := range plugins {
 		ps.setSpecOpts(p)
+		if p.IsEnabled() {
+			ps.indexEnabled(p)
+		}
 	}
 	ps.plugins = plugins
 }
@@ -92,7 +97,57 @@ func (ps *Store) SetState(p *v2.Plugin, state bool) {
 	ps.Lock()
 	defer ps.Unlock()
 
-	p.PluginObj.Enabled = state
+	p.SetEnabled(state)
+	if state {
+		ps.indexEnabled(p)
+	} else {
+		ps.unindexEnabled(p)
+	}
+}
+
+// indexEnabled adds p to the index of enabled plugins for each of its
+// capabilities. It must be called with the store locked.
+func (ps *Store) indexEnabled(p *v2.Plugin) {
+	for _, typ := range p.GetTypes() {
+		if typ.Prefix != "docker" {
+			continue
+		}
+		byID, ok := ps.enabledByCap[typ.Capability]
+		if !ok {
+			byID = make(map[string]*v2.Plugin)
+			ps.enabledByCap[typ.Capability] = byID
+		}
+		byID[p.GetID()] = p
+	}
+}
+
+// unindexEnabled removes p from the index of enabled plugins. It must be
+// called with the store locked.
+func (ps *Store) unindexEnabled(p *v2.Plugin) {
+	id := p.GetID()
+	for capability, byID := range ps.enabledByCap {
+		delete(byID, id)
+		if len(byID) == 0 {
+			delete(ps.enabledByCap, capability)
+		}
+	}
+}
+
+// enabledByCapability returns the enabled plugins providing the given
+// capability, sorted by name.
+func (ps *Store) enabledByCapability(capability string) []*v2.Plugin {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	byID := ps.enabledByCap[strings.ToLower(capability)]
+	result := make([]*v2.Plugin, 0, len(byID))
+	for _, p := range byID {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result
 }
 
 func (ps *Store) setSpecOpts(p *v2.Plugin) {
@@ -124,6 +179,9 @@ func (ps *Store) Add(p *v2.Plugin) error {
 	ps.setSpecOpts(p)
 
 	ps.plugins[p.GetID()] = p
+	if p.IsEnabled() {
+		ps.indexEnabled(p)
+	}
 	return nil
 }
 
@@ -131,6 +189,7 @@ func (ps *Store) Add(p *v2.Plugin) error {
 func (ps *Store) Remove(p *v2.Plugin) {
 	ps.Lock()
 	delete(ps.plugins, p.GetID())
+	ps.unindexEnabled(p)
 	ps.Unlock()
 }
 
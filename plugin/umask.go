@@ -0,0 +1,28 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// umaskShell is the shell used to set the umask of plugin processes. The
+// runtime spec has no way to set the umask of a process, so the plugin
+// entrypoint is wrapped in a shell which sets it before exec'ing.
+const umaskShell = "/bin/sh"
+
+// parseUmask parses an octal umask, such as "0027".
+func parseUmask(umask string) (uint32, error) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, errors.Errorf("invalid umask %q: must be an octal value between 0000 and 0777", umask)
+	}
+	return uint32(mask), nil
+}
+
+// umaskArgs wraps the process arguments so that the process is run with the
+// given umask.
+func umaskArgs(umask uint32, args []string) []string {
+	return append([]string{umaskShell, "-c", fmt.Sprintf(`umask %04o && exec "$@"`, umask), "sh"}, args...)
+}
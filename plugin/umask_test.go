@@ -0,0 +1,38 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestParseUmask(t *testing.T) {
+	for _, tc := range []struct {
+		umask    string
+		expected uint32
+		invalid  bool
+	}{
+		{umask: "0027", expected: 027},
+		{umask: "22", expected: 022},
+		{umask: "0000"},
+		{umask: "0777", expected: 0777},
+		{umask: "1777", invalid: true},
+		{umask: "0089", invalid: true},
+		{umask: "", invalid: true},
+	} {
+		mask, err := parseUmask(tc.umask)
+		if tc.invalid {
+			assert.Check(t, is.ErrorContains(err, "invalid umask"), tc.umask)
+			continue
+		}
+		assert.NilError(t, err, tc.umask)
+		assert.Check(t, is.Equal(mask, tc.expected), tc.umask)
+	}
+}
+
+func TestUmaskArgs(t *testing.T) {
+	assert.Check(t, is.DeepEqual(umaskArgs(027, []string{"/plugin", "--debug"}), []string{
+		"/bin/sh", "-c", `umask 0027 && exec "$@"`, "sh", "/plugin", "--debug",
+	}))
+}
@@ -0,0 +1,50 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+// UpgradeOutcome is what a staged upgrade did.
+type UpgradeOutcome string
+
+const (
+	// UpgradeOutcomeUpgraded means the upgraded plugin passed its
+	// probation, and its previous version was removed.
+	UpgradeOutcomeUpgraded UpgradeOutcome = "upgraded"
+	// UpgradeOutcomeRolledBack means the upgraded plugin failed its
+	// probation, and its previous version was restored and enabled.
+	UpgradeOutcomeRolledBack UpgradeOutcome = "rolled-back"
+)
+
+// UpgradeResult reports the outcome of StagedUpgrade.
+type UpgradeResult struct {
+	Outcome UpgradeOutcome
+	// Reason is why the upgraded plugin failed its probation, if it was
+	// rolled back.
+	Reason string
+}
+
+// validateUpgradeConfig checks that the config of the upgraded plugin is
+// compatible with the config of its current version, which is that it still
+// implements all of its interface types, so that the containers and daemon
+// subsystems using the plugin keep working.
+func validateUpgradeConfig(current, upgraded types.PluginConfig) error {
+	implemented := make(map[types.PluginInterfaceType]bool, len(upgraded.Interface.Types))
+	for _, typ := range upgraded.Interface.Types {
+		implemented[typ] = true
+	}
+	var missing []string
+	for _, typ := range current.Interface.Types {
+		if !implemented[typ] {
+			missing = append(missing, typ.String())
+		}
+	}
+	if len(missing) > 0 {
+		return errdefs.InvalidParameter(errors.Errorf("upgraded plugin does not implement %s anymore", strings.Join(missing, ", ")))
+	}
+	return nil
+}
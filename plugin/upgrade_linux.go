@@ -0,0 +1,159 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/plugin/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// StagedUpgrade upgrades a disabled plugin like Upgrade, then enables it with
+// enableConfig, and keeps its previous version until the upgraded plugin has
+// passed a probation: it must start, keep running for the probation period,
+// and, if it has a health check, never be unhealthy and be healthy at the end
+// of it. Otherwise, the previous version is restored and enabled instead. The
+// probation should be longer than the interval of the health check.
+func (pm *Manager) StagedUpgrade(ctx context.Context, ref reference.Named, name string, metaHeader http.Header, authConfig *types.AuthConfig, privileges types.PluginPrivileges, outStream io.Writer, enableConfig *types.PluginEnableConfig, probation time.Duration) (UpgradeResult, error) {
+	if err := validateEnableConfig(enableConfig); err != nil {
+		return UpgradeResult{}, err
+	}
+
+	// The blobs of the previous version are kept until the upgrade is
+	// settled.
+	pm.muGC.RLock()
+	defer pm.muGC.RUnlock()
+
+	p, prev, err := pm.upgrade(ctx, ref, name, metaHeader, authConfig, privileges, outStream, true)
+	if err != nil {
+		return UpgradeResult{}, err
+	}
+	return pm.settleUpgrade(ctx, p, prev, enableConfig, probation)
+}
+
+// settleUpgrade enables the upgraded plugin p with enableConfig, which must
+// have been validated. Once it passed its probation, its previous version is
+// removed; otherwise it is rolled back to it.
+func (pm *Manager) settleUpgrade(ctx context.Context, p *v2.Plugin, prev *pluginBackup, enableConfig *types.PluginEnableConfig, probation time.Duration) (UpgradeResult, error) {
+	c := newController(enableConfig)
+	err := pm.enableUpgraded(p, c)
+	if err == nil {
+		err = pm.probation(ctx, p, c, probation)
+	}
+	if err == nil {
+		if err := os.RemoveAll(prev.rootfs); err != nil {
+			logrus.WithError(err).WithField("dir", prev.rootfs).Error("error cleaning up old plugin root after successful upgrade")
+		}
+		return UpgradeResult{Outcome: UpgradeOutcomeUpgraded}, nil
+	}
+
+	logrus.WithError(err).WithField("plugin", p.Name()).Warn("upgraded plugin failed its probation, rolling back")
+	result := UpgradeResult{Outcome: UpgradeOutcomeRolledBack, Reason: err.Error()}
+	if err := pm.rollbackUpgrade(p, c, prev); err != nil {
+		return UpgradeResult{}, errors.Wrapf(err, "error rolling back plugin upgrade which failed its probation (%s)", result.Reason)
+	}
+	c = newController(enableConfig)
+	if err := pm.enableUpgraded(p, c); err != nil {
+		return result, errors.Wrap(err, "rolled back plugin upgrade, but could not enable the previous version")
+	}
+	return result, nil
+}
+
+// enableUpgraded enables p like Enable.
+func (pm *Manager) enableUpgraded(p *v2.Plugin, c *controller) error {
+	pm.ops.acquire()
+	defer pm.ops.release()
+
+	if err := pm.enable(p, c, false); err != nil {
+		return err
+	}
+	pm.publisher.Publish(EventEnable{Plugin: p.Object(), Time: pm.clock().Now()})
+	pm.config.LogPluginEvent(p.GetID(), p.Name(), "enable")
+	return nil
+}
+
+// probation waits for d while the enabled plugin p runs, and returns why it
+// failed its probation if it exited, or if it has a health check and became
+// unhealthy, or was not healthy yet at the end.
+func (pm *Manager) probation(ctx context.Context, p *v2.Plugin, c *controller, d time.Duration) error {
+	pm.mu.RLock()
+	exitChan := c.exitChan
+	pm.mu.RUnlock()
+	check := p.PluginObj.Config.HealthCheck
+
+	clock := pm.clock()
+	deadline := clock.NewTimer(d)
+	defer deadline.Stop()
+
+	for {
+		if h := p.Health(); h != nil && h.Status == types.Unhealthy {
+			return errors.New("plugin became unhealthy")
+		}
+
+		select {
+		case <-exitChan:
+			return errors.New("plugin exited")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C():
+			if check == nil || check.Path == "" {
+				return nil
+			}
+			if h := p.Health(); h == nil || h.Status != types.Healthy {
+				return errors.New("plugin did not report itself healthy")
+			}
+			return nil
+		case <-clock.After(waitEnabledInterval):
+		}
+	}
+}
+
+// rollbackUpgrade disables the upgraded plugin p if it is still enabled, and
+// restores the rootfs and config of its previous version.
+func (pm *Manager) rollbackUpgrade(p *v2.Plugin, c *controller, prev *pluginBackup) error {
+	pm.ops.acquire()
+	defer pm.ops.release()
+
+	pm.mu.Lock()
+	c.restart = false
+	pm.mu.Unlock()
+	if p.IsEnabled() {
+		for _, typ := range p.GetTypes() {
+			if typ.Capability == authorization.AuthZApiImplements {
+				pm.config.AuthzMiddleware.RemovePlugin(p.Name())
+			}
+		}
+		if err := pm.disable(p, c, pm.stopTimeout()); err != nil {
+			return err
+		}
+		pm.publisher.Publish(EventDisable{Plugin: p.Object(), Time: pm.clock().Now()})
+		pm.config.LogPluginEvent(p.GetID(), p.Name(), "disable")
+	}
+
+	orig := filepath.Join(pm.pluginDir(p.GetID()), rootFSFileName)
+	if err := mount.RecursiveUnmount(orig); err != nil {
+		return errdefs.System(err)
+	}
+	if err := os.RemoveAll(orig); err != nil {
+		return errors.Wrap(errdefs.System(err), "error removing upgraded plugin root")
+	}
+	if err := os.Rename(prev.rootfs, orig); err != nil {
+		return errors.Wrap(errdefs.System(err), "error restoring old plugin root")
+	}
+
+	p.PluginObj.Config = prev.config
+	p.Config = prev.configDigest
+	p.Blobsums = prev.blobsums
+	p.PluginObj.PluginReference = prev.reference
+	return errors.Wrap(pm.save(p), "error saving rolled back plugin config")
+}
@@ -0,0 +1,138 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/system"
+	"github.com/docker/docker/plugin/v2"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/skip"
+)
+
+func TestProbation(t *testing.T) {
+	m := &Manager{}
+	p := &v2.Plugin{}
+	c := &controller{exitChan: make(chan bool)}
+	ctx := context.Background()
+
+	assert.NilError(t, m.probation(ctx, p, c, 50*time.Millisecond))
+
+	p.PluginObj.Config.HealthCheck = &types.PluginConfigHealthCheck{Path: "/Plugin.Health"}
+	p.SetHealth(&types.PluginHealth{Status: types.Starting})
+	assert.Check(t, is.Error(m.probation(ctx, p, c, 50*time.Millisecond), "plugin did not report itself healthy"))
+	p.SetHealth(&types.PluginHealth{Status: types.Healthy})
+	assert.NilError(t, m.probation(ctx, p, c, 50*time.Millisecond))
+	p.SetHealth(&types.PluginHealth{Status: types.Unhealthy})
+	assert.Check(t, is.Error(m.probation(ctx, p, c, time.Minute), "plugin became unhealthy"))
+
+	p.SetHealth(nil)
+	p.PluginObj.Config.HealthCheck = nil
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(c.exitChan)
+	}()
+	assert.Check(t, is.Error(m.probation(ctx, p, c, time.Minute), "plugin exited"))
+}
+
+// brokenEntrypointExecutor fails to start plugins with the /broken
+// entrypoint.
+type brokenEntrypointExecutor struct {
+	executorWithRunning
+}
+
+func (e *brokenEntrypointExecutor) Create(id string, spec specs.Spec, stdout, stderr io.WriteCloser) error {
+	if len(spec.Process.Args) > 0 && spec.Process.Args[0] == "/broken" {
+		return errors.New("broken entrypoint")
+	}
+	return e.executorWithRunning.Create(id, spec, stdout, stderr)
+}
+
+func TestSettleUpgrade(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root, err := ioutil.TempDir("", t.Name())
+	assert.NilError(t, err)
+	defer system.EnsureRemoveAll(root)
+
+	// Need a short-ish path here so we don't run into unix socket path length issues.
+	execRoot, err := ioutil.TempDir("", "plugintest")
+	assert.NilError(t, err)
+	defer system.EnsureRemoveAll(execRoot)
+
+	s := NewStore()
+	managerRoot := filepath.Join(root, "manager")
+	executor := &brokenEntrypointExecutor{executorWithRunning{root: execRoot}}
+	m, err := NewManager(ManagerConfig{
+		Store:          s,
+		Root:           managerRoot,
+		ExecRoot:       execRoot,
+		CreateExecutor: func(m *Manager) (Executor, error) { executor.m = m; return executor, nil },
+		LogPluginEvent: func(_, _, _ string) {},
+	})
+	assert.NilError(t, err)
+	defer m.Shutdown(context.Background())
+
+	p := newTestPlugin(t, "upgrade", "testupgrade", managerRoot)
+	assert.NilError(t, s.Add(p))
+	oldConfig := p.PluginObj.Config
+	oldConfig.Entrypoint = []string{"/old"}
+
+	rootfs := filepath.Join(managerRoot, p.GetID(), "rootfs")
+	stage := func(entrypoint string) *pluginBackup {
+		for _, dir := range []string{rootfs, rootfs + "-old"} {
+			assert.NilError(t, os.MkdirAll(dir, 0755))
+			assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "version"), []byte(filepath.Base(dir)), 0644))
+		}
+		p.PluginObj.Config.Entrypoint = []string{entrypoint}
+		p.PluginObj.PluginReference = "upgrade:new"
+		return &pluginBackup{rootfs: rootfs + "-old", config: oldConfig, reference: "upgrade:old"}
+	}
+	version := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(rootfs, "version"))
+		assert.NilError(t, err)
+		return string(data)
+	}
+
+	enableConfig := &types.PluginEnableConfig{RestartPolicy: container.RestartPolicy{Name: "no"}}
+	result, err := m.settleUpgrade(context.Background(), p, stage("/new"), enableConfig, 100*time.Millisecond)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(result, UpgradeResult{Outcome: UpgradeOutcomeUpgraded}))
+	assert.Check(t, p.IsEnabled())
+	m.mu.RLock()
+	assert.Check(t, is.DeepEqual(m.cMap[p].restartPolicy, enableConfig.RestartPolicy))
+	m.mu.RUnlock()
+	assert.Check(t, is.Equal(version(), "rootfs"))
+	_, err = os.Stat(rootfs + "-old")
+	assert.Check(t, os.IsNotExist(err))
+	assert.NilError(t, m.Disable(p.GetID(), &types.PluginDisableConfig{}))
+
+	result, err = m.settleUpgrade(context.Background(), p, stage("/broken"), enableConfig, 100*time.Millisecond)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(result.Outcome, UpgradeOutcomeRolledBack))
+	assert.Check(t, is.Contains(result.Reason, "broken entrypoint"))
+	assert.Check(t, p.IsEnabled())
+	m.mu.RLock()
+	assert.Check(t, is.DeepEqual(m.cMap[p].restartPolicy, enableConfig.RestartPolicy))
+	m.mu.RUnlock()
+	assert.Check(t, is.Equal(version(), "rootfs-old"))
+	assert.Check(t, is.DeepEqual(p.PluginObj.Config.Entrypoint, []string{"/old"}))
+	assert.Check(t, is.Equal(p.PluginObj.PluginReference, "upgrade:old"))
+}
+
+func TestStagedUpgradeInvalidEnableConfig(t *testing.T) {
+	m := &Manager{}
+	enableConfig := &types.PluginEnableConfig{RestartPolicy: container.RestartPolicy{Name: "unless-stopped"}}
+	_, err := m.StagedUpgrade(context.Background(), nil, "upgrade", nil, nil, nil, nil, enableConfig, time.Second)
+	assert.Check(t, errdefs.IsInvalidParameter(err))
+}
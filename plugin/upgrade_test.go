@@ -0,0 +1,29 @@
+package plugin // import "github.com/docker/docker/plugin"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestValidateUpgradeConfig(t *testing.T) {
+	volume := types.PluginInterfaceType{Prefix: "docker", Capability: "volumedriver", Version: "1.0"}
+	network := types.PluginInterfaceType{Prefix: "docker", Capability: "networkdriver", Version: "1.0"}
+	config := func(typs ...types.PluginInterfaceType) types.PluginConfig {
+		var c types.PluginConfig
+		c.Interface.Types = typs
+		return c
+	}
+
+	if err := validateUpgradeConfig(config(volume), config(volume, network)); err != nil {
+		t.Fatalf("expected an upgrade adding an interface type to be valid, got %v", err)
+	}
+	err := validateUpgradeConfig(config(volume, network), config(network))
+	if !errdefs.IsInvalidParameter(err) {
+		t.Fatalf("expected an upgrade dropping an interface type to be invalid, got %v", err)
+	}
+	if expected := "upgraded plugin does not implement docker.volumedriver/1.0 anymore"; err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err)
+	}
+}
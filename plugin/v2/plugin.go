@@ -31,6 +31,10 @@ type Plugin struct {
 	SwarmServiceID string
 	timeout        time.Duration
 	addr           net.Addr
+
+	// Checkpointed is set when the plugin was checkpointed to disk, and has
+	// not been restored yet.
+	Checkpointed bool `json:",omitempty"`
 }
 
 const defaultPluginRuntimeDestination = "/run/docker/plugins"
@@ -117,6 +121,20 @@ func (p *Plugin) Set(args []string) error {
 		return fmt.Errorf("cannot set on an active plugin, disable plugin before setting")
 	}
 
+	return p.set(args)
+}
+
+// SetDeferred is used to pass arguments to the plugin, even while it is
+// enabled. The new settings only take effect the next time the plugin is
+// enabled.
+func (p *Plugin) SetDeferred(args []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.set(args)
+}
+
+func (p *Plugin) set(args []string) error {
 	sets, err := newSettables(args)
 	if err != nil {
 		return err
@@ -210,6 +228,13 @@ func (p *Plugin) IsEnabled() bool {
 	return p.PluginObj.Enabled
 }
 
+// SetEnabled sets the active state of the plugin.
+func (p *Plugin) SetEnabled(enabled bool) {
+	p.mu.Lock()
+	p.PluginObj.Enabled = enabled
+	p.mu.Unlock()
+}
+
 // GetID returns the plugin's ID.
 func (p *Plugin) GetID() string {
 	p.mu.RLock()
@@ -218,6 +243,20 @@ func (p *Plugin) GetID() string {
 	return p.PluginObj.ID
 }
 
+// Object returns a copy of the plugin object, which is safe to use while the
+// plugin is being changed.
+func (p *Plugin) Object() types.Plugin {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	obj := p.PluginObj
+	if obj.Health != nil {
+		h := *obj.Health
+		obj.Health = &h
+	}
+	return obj
+}
+
 // GetSocket returns the plugin socket.
 func (p *Plugin) GetSocket() string {
 	p.mu.RLock()
@@ -302,6 +341,57 @@ func (p *Plugin) SetAddr(addr net.Addr) {
 	p.mu.Unlock()
 }
 
+// Health returns the current health of the plugin, or nil if it has no
+// health check.
+func (p *Plugin) Health() *types.PluginHealth {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.PluginObj.Health == nil {
+		return nil
+	}
+	h := *p.PluginObj.Health
+	return &h
+}
+
+// SetHealth sets the current health of the plugin.
+func (p *Plugin) SetHealth(h *types.PluginHealth) {
+	p.mu.Lock()
+	p.PluginObj.Health = h
+	p.mu.Unlock()
+}
+
+// IsFailed returns whether the plugin was disabled because it kept exiting.
+func (p *Plugin) IsFailed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.PluginObj.Failed
+}
+
+// SetFailed sets whether the plugin was disabled because it kept exiting.
+func (p *Plugin) SetFailed(failed bool) {
+	p.mu.Lock()
+	p.PluginObj.Failed = failed
+	p.mu.Unlock()
+}
+
+// IsCheckpointed returns whether the plugin has a checkpoint to be restored
+// from when it is next enabled.
+func (p *Plugin) IsCheckpointed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.Checkpointed
+}
+
+// SetCheckpointed sets whether the plugin has a checkpoint.
+func (p *Plugin) SetCheckpointed(checkpointed bool) {
+	p.mu.Lock()
+	p.Checkpointed = checkpointed
+	p.mu.Unlock()
+}
+
 // Protocol is the protocol that should be used for interacting with the plugin.
 func (p *Plugin) Protocol() string {
 	if p.PluginObj.Config.Interface.ProtocolScheme != "" {
@@ -8,11 +8,28 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/oci"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/pkg/system"
+	"github.com/opencontainers/runc/libcontainer/user"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
 
+// ValidateNetworkType returns an error if networkType is not a supported
+// plugin network type. Plugins without a network type, or with "none" (or
+// its legacy spelling "null"), get their own network namespace with only a
+// loopback interface. "host" plugins use the host's network namespace.
+// "bridge" plugins get their own network namespace, with the host's
+// /etc/hosts and /etc/resolv.conf.
+func ValidateNetworkType(networkType string) error {
+	switch networkType {
+	case "", "none", "null", "host", "bridge":
+		return nil
+	default:
+		return errors.Errorf("invalid plugin network type %q: must be one of host, none or bridge", networkType)
+	}
+}
+
 // InitSpec creates an OCI spec from the plugin's config.
 func (p *Plugin) InitSpec(execRoot string) (*specs.Spec, error) {
 	s := oci.DefaultSpec()
@@ -50,7 +67,11 @@ func (p *Plugin) InitSpec(execRoot string) (*specs.Spec, error) {
 		Options:     []string{"rbind", "rshared"},
 	})
 
-	if p.PluginObj.Config.Network.Type != "" {
+	networkType := p.PluginObj.Config.Network.Type
+	if err := ValidateNetworkType(networkType); err != nil {
+		return nil, err
+	}
+	if networkType != "" && networkType != "none" && networkType != "null" {
 		// TODO: if net == bridge, use libnetwork controller to create a new plugin-specific bridge, bind mount /etc/hosts and /etc/resolv.conf look at the docker code (allocateNetwork, initialize)
 		if p.PluginObj.Config.Network.Type == "host" {
 			oci.RemoveNamespace(&s, specs.LinuxNamespaceType("network"))
@@ -122,10 +143,18 @@ func (p *Plugin) InitSpec(execRoot string) (*specs.Spec, error) {
 	if len(cwd) == 0 {
 		cwd = "/"
 	}
+	if !filepath.IsAbs(cwd) {
+		return nil, errors.Errorf("plugin working directory %q is not an absolute path", cwd)
+	}
+	processUser, err := p.processUser()
+	if err != nil {
+		return nil, err
+	}
 	s.Process.Terminal = false
 	s.Process.Args = args
 	s.Process.Cwd = cwd
 	s.Process.Env = envs
+	s.Process.User = processUser
 
 	caps := s.Process.Capabilities
 	caps.Bounding = append(caps.Bounding, p.PluginObj.Config.Linux.Capabilities...)
@@ -139,3 +168,37 @@ func (p *Plugin) InitSpec(execRoot string) (*specs.Spec, error) {
 
 	return &s, nil
 }
+
+// processUser returns the user to run the plugin process as. Users other than
+// root must exist in the plugin rootfs.
+func (p *Plugin) processUser() (specs.User, error) {
+	u := p.PluginObj.Config.User
+	if u.UID != 0 {
+		users, err := lookupInRootfs(p.Rootfs, "/etc/passwd", func(path string) (int, error) {
+			users, err := user.ParsePasswdFileFilter(path, func(e user.User) bool { return e.Uid == int(u.UID) })
+			return len(users), err
+		})
+		if err != nil || users == 0 {
+			return specs.User{}, errors.Errorf("plugin user %d does not exist in the plugin rootfs", u.UID)
+		}
+	}
+	if u.GID != 0 {
+		groups, err := lookupInRootfs(p.Rootfs, "/etc/group", func(path string) (int, error) {
+			groups, err := user.ParseGroupFileFilter(path, func(e user.Group) bool { return e.Gid == int(u.GID) })
+			return len(groups), err
+		})
+		if err != nil || groups == 0 {
+			return specs.User{}, errors.Errorf("plugin group %d does not exist in the plugin rootfs", u.GID)
+		}
+	}
+	return specs.User{UID: u.UID, GID: u.GID}, nil
+}
+
+// lookupInRootfs calls count with the path to file, resolved within rootfs.
+func lookupInRootfs(rootfs, file string, count func(path string) (int, error)) (int, error) {
+	path, err := symlink.FollowSymlinkInScope(filepath.Join(rootfs, file), rootfs)
+	if err != nil {
+		return 0, err
+	}
+	return count(path)
+}
@@ -0,0 +1,107 @@
+package v2 // import "github.com/docker/docker/plugin/v2"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newTestPlugin(t *testing.T) (*Plugin, string, func()) {
+	root, err := ioutil.TempDir("", "plugin-spec-test")
+	assert.NilError(t, err)
+
+	rootfs := filepath.Join(root, "rootfs")
+	assert.NilError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\nplugin:x:1000:1000::/:/bin/sh\n"), 0644))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("root:x:0:\nplugin:x:1000:\n"), 0644))
+
+	p := &Plugin{PluginObj: types.Plugin{ID: "test"}, Rootfs: rootfs}
+	return p, filepath.Join(root, "exec"), func() { os.RemoveAll(root) }
+}
+
+func TestInitSpecProcess(t *testing.T) {
+	p, execRoot, cleanup := newTestPlugin(t)
+	defer cleanup()
+
+	s, err := p.InitSpec(execRoot)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(s.Process.Cwd, "/"))
+	assert.Check(t, is.Equal(s.Process.User.UID, uint32(0)))
+	assert.Check(t, is.Equal(s.Process.User.GID, uint32(0)))
+
+	p.PluginObj.Config.WorkDir = "/data"
+	p.PluginObj.Config.User = types.PluginConfigUser{UID: 1000, GID: 1000}
+	s, err = p.InitSpec(execRoot)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(s.Process.Cwd, "/data"))
+	assert.Check(t, is.Equal(s.Process.User.UID, uint32(1000)))
+	assert.Check(t, is.Equal(s.Process.User.GID, uint32(1000)))
+}
+
+func TestInitSpecProcessInvalid(t *testing.T) {
+	p, execRoot, cleanup := newTestPlugin(t)
+	defer cleanup()
+
+	p.PluginObj.Config.WorkDir = "data"
+	_, err := p.InitSpec(execRoot)
+	assert.Check(t, is.ErrorContains(err, "not an absolute path"))
+
+	p.PluginObj.Config.WorkDir = ""
+	p.PluginObj.Config.User = types.PluginConfigUser{UID: 1001}
+	_, err = p.InitSpec(execRoot)
+	assert.Check(t, is.ErrorContains(err, "plugin user 1001 does not exist"))
+
+	p.PluginObj.Config.User = types.PluginConfigUser{UID: 1000, GID: 1001}
+	_, err = p.InitSpec(execRoot)
+	assert.Check(t, is.ErrorContains(err, "plugin group 1001 does not exist"))
+}
+
+func TestInitSpecNetwork(t *testing.T) {
+	p, execRoot, cleanup := newTestPlugin(t)
+	defer cleanup()
+
+	hasNetNS := func(s *specs.Spec) bool {
+		for _, ns := range s.Linux.Namespaces {
+			if ns.Type == specs.NetworkNamespace {
+				return true
+			}
+		}
+		return false
+	}
+	hasMount := func(s *specs.Spec, dest string) bool {
+		for _, m := range s.Mounts {
+			if m.Destination == dest {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tc := range []struct {
+		networkType string
+		netNS       bool
+		resolvConf  bool
+	}{
+		{networkType: "", netNS: true},
+		{networkType: "none", netNS: true},
+		{networkType: "null", netNS: true},
+		{networkType: "bridge", netNS: true, resolvConf: true},
+		{networkType: "host", resolvConf: true},
+	} {
+		p.PluginObj.Config.Network.Type = tc.networkType
+		s, err := p.InitSpec(execRoot)
+		assert.NilError(t, err, tc.networkType)
+		assert.Check(t, is.Equal(hasNetNS(s), tc.netNS), tc.networkType)
+		assert.Check(t, is.Equal(hasMount(s, "/etc/resolv.conf"), tc.resolvConf), tc.networkType)
+	}
+
+	p.PluginObj.Config.Network.Type = "container:foo"
+	_, err := p.InitSpec(execRoot)
+	assert.Check(t, is.ErrorContains(err, `invalid plugin network type "container:foo"`))
+}
@@ -0,0 +1,24 @@
+package v2 // import "github.com/docker/docker/plugin/v2"
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestObject(t *testing.T) {
+	p := &Plugin{PluginObj: types.Plugin{ID: "test", Health: &types.PluginHealth{Status: types.Healthy}}}
+
+	obj := p.Object()
+	p.SetHealth(&types.PluginHealth{Status: types.Unhealthy})
+	p.SetFailed(true)
+
+	assert.Check(t, is.Equal(obj.ID, "test"))
+	assert.Check(t, !obj.Failed)
+	assert.Check(t, is.Equal(obj.Health.Status, types.Healthy))
+
+	obj.Health.Status = types.Starting
+	assert.Check(t, is.Equal(p.Health().Status, types.Unhealthy))
+}
@@ -0,0 +1,77 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// A Backend persists the references of a store, instead of the file of the
+// store. Repositories are indexed by their familiar name, such as
+// "username/repo", and references by their familiar form, such as
+// "username/repo:latest".
+type Backend interface {
+	// Load returns the persisted repositories, or an empty map if there
+	// are none yet. The store takes ownership of the returned map.
+	Load() (map[string]map[string]digest.Digest, error)
+	// Persist applies the changes made since the last successful call, in
+	// order. If it fails, the changes are passed again, along with the
+	// following ones, to the next call.
+	Persist(changes []Change) error
+}
+
+// A Change is a change to a single reference, passed to Backend.Persist.
+type Change struct {
+	// Name is the familiar name of the repository of the reference.
+	Name string
+	// Ref is the familiar form of the reference.
+	Ref string
+	// ID is the ID the reference points to. It is empty when the
+	// reference is deleted.
+	ID     digest.Digest
+	Delete bool
+}
+
+// NewReferenceStoreWithBackend creates a reference store persisted by
+// backend, rather than by a file. Options which only apply to the file of
+// the store, such as WithWriteAheadLog, WithBackupDepth, WithCompression,
+// WithPersistedReverseIndex and WithRecoverOnCorruption, have no effect.
+func NewReferenceStoreWithBackend(backend Backend, opts ...StoreOption) (Store, error) {
+	store := &store{
+		backend:             backend,
+		Repositories:        make(map[string]repository),
+		referencesByIDCache: make(map[digest.Digest]map[string]reference.Named),
+		unsaved:             make(map[string]reference.Named),
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	store.wal = nil
+	store.backupDepth = 0
+	store.persistReverseIndex = false
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// recordChange buffers a change to be persisted by the next save, if the
+// store has a backend. store.mu must be held for writing.
+func (store *store) recordChange(c Change) {
+	if store.backend != nil {
+		store.changes = append(store.changes, c)
+	}
+}
+
+// loadBackend replaces the repositories of the store with those loaded from
+// its backend. store.mu must be held for writing.
+func (store *store) loadBackend() error {
+	repositories, err := store.backend.Load()
+	if err != nil {
+		return err
+	}
+	store.Repositories = make(map[string]repository, len(repositories))
+	for refName, refs := range repositories {
+		store.Repositories[refName] = repository(refs)
+	}
+	return nil
+}
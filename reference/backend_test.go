@@ -0,0 +1,86 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type testBackend struct {
+	repositories map[string]map[string]digest.Digest
+	persisted    [][]Change
+	err          error
+}
+
+func (b *testBackend) Load() (map[string]map[string]digest.Digest, error) {
+	repositories := make(map[string]map[string]digest.Digest)
+	for refName, refs := range b.repositories {
+		repositories[refName] = make(map[string]digest.Digest)
+		for refStr, id := range refs {
+			repositories[refName][refStr] = id
+		}
+	}
+	return repositories, nil
+}
+
+func (b *testBackend) Persist(changes []Change) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.persisted = append(b.persisted, changes)
+	for _, c := range changes {
+		if c.Delete {
+			delete(b.repositories[c.Name], c.Ref)
+			continue
+		}
+		if b.repositories[c.Name] == nil {
+			b.repositories[c.Name] = make(map[string]digest.Digest)
+		}
+		b.repositories[c.Name][c.Ref] = c.ID
+	}
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	backend := &testBackend{repositories: map[string]map[string]digest.Digest{
+		"username/repo": {"username/repo:latest": id1},
+	}}
+	store, err := NewReferenceStoreWithBackend(backend)
+	assert.NilError(t, err)
+
+	latest, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	got, err := store.Get(latest)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id1))
+	assert.Check(t, is.Len(store.References(id1), 1))
+
+	other, err := reference.ParseNormalizedNamed("username/repo:other")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(other, id2, false))
+	assert.Check(t, is.DeepEqual(backend.persisted, [][]Change{
+		{{Name: "username/repo", Ref: "username/repo:other", ID: id2}},
+	}))
+
+	// Changes which failed to persist are passed again by the next save.
+	backend.err = errors.New("disk full")
+	_, err = store.Delete(latest)
+	assert.Check(t, is.Error(err, "disk full"))
+	backend.err = nil
+	assert.NilError(t, store.AddTag(latest, id2, false))
+	assert.Check(t, is.DeepEqual(backend.persisted[1], []Change{
+		{Name: "username/repo", Ref: "username/repo:latest", Delete: true},
+		{Name: "username/repo", Ref: "username/repo:latest", ID: id2},
+	}))
+
+	reloaded, err := NewReferenceStoreWithBackend(backend)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(reloaded.References(id2), 2))
+	assert.Check(t, is.Len(reloaded.References(id1), 0))
+}
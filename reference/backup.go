@@ -0,0 +1,118 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// WithBackupDepth makes the store keep the previous depth versions of its
+// file, as <file>.bak.1 (the most recent) to <file>.bak.<depth>. They are
+// rotated each time the store is saved successfully. A depth of 0 disables
+// backups.
+func WithBackupDepth(depth int) StoreOption {
+	return func(store *store) {
+		store.backupDepth = depth
+	}
+}
+
+// backupPath returns the path of the nth most recent backup.
+func (store *store) backupPath(n int) string {
+	return fmt.Sprintf("%s.bak.%d", store.jsonPath, n)
+}
+
+// writeFile atomically replaces the file of the store with data, keeping
+// the previous version as a backup if backups are enabled.
+func (store *store) writeFile(data []byte) error {
+	if store.backupDepth <= 0 {
+		return ioutils.AtomicWriteFile(store.jsonPath, data, store.fileMode)
+	}
+
+	// Hard link the current file rather than renaming it, so that there is
+	// always a valid file at jsonPath.
+	previous := store.jsonPath + ".bak.tmp"
+	if err := os.Remove(previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	linked := true
+	if err := os.Link(store.jsonPath, previous); err != nil {
+		linked = false
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Warn("failed to back up the reference store")
+		}
+	}
+	if err := ioutils.AtomicWriteFile(store.jsonPath, data, store.fileMode); err != nil {
+		if linked {
+			os.Remove(previous)
+		}
+		return err
+	}
+	if linked {
+		store.rotateBackups(previous)
+	}
+	return nil
+}
+
+// rotateBackups shifts the existing backups, dropping the oldest, and makes
+// previous the most recent one.
+func (store *store) rotateBackups(previous string) {
+	for n := store.backupDepth - 1; n >= 1; n-- {
+		if err := os.Rename(store.backupPath(n), store.backupPath(n+1)); err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).Warn("failed to rotate reference store backups")
+		}
+	}
+	if err := os.Rename(previous, store.backupPath(1)); err != nil {
+		logrus.WithError(err).Warn("failed to rotate reference store backups")
+	}
+}
+
+// RestoreBackup replaces the references in the store with those of the nth
+// most recent backup, and saves the store. The version being replaced
+// becomes the most recent backup, so a restore can itself be undone.
+func (store *store) RestoreBackup(n int) error {
+	store.lock()
+	defer store.unlock()
+
+	if n < 1 || n > store.backupDepth {
+		return errors.Errorf("invalid backup %d: the store keeps %d backups", n, store.backupDepth)
+	}
+
+	backup, err := loadBackup(store.backupPath(n), store.persistReverseIndex)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrapf(ErrDoesNotExist, "backup %d", n)
+		}
+		return errors.Wrapf(err, "failed to load backup %d", n)
+	}
+
+	repositories, cache, warnings := store.Repositories, store.referencesByIDCache, store.loadWarnings
+	store.Repositories = backup.Repositories
+	store.referencesByIDCache = backup.referencesByIDCache
+	store.loadWarnings = backup.loadWarnings
+	store.rebuildTagIndex()
+	if err := store.save(); err != nil {
+		store.Repositories, store.referencesByIDCache, store.loadWarnings = repositories, cache, warnings
+		store.rebuildTagIndex()
+		return err
+	}
+	return nil
+}
+
+// loadBackup loads the backup at path into a new store.
+func loadBackup(path string, persistReverseIndex bool) (*store, error) {
+	backup := &store{
+		jsonPath:            path,
+		Repositories:        make(map[string]repository),
+		referencesByIDCache: make(map[digest.Digest]map[string]reference.Named),
+		persistReverseIndex: persistReverseIndex,
+	}
+	if err := backup.reload(); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
@@ -0,0 +1,77 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestBackups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath, WithBackupDepth(2)))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	var refs []reference.Named
+	for _, refStr := range []string{"username/repo:one", "username/repo:two", "username/repo:three"} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+		refs = append(refs, ref)
+	}
+
+	// Only the two most recent previous versions are kept.
+	_, err = os.Stat(jsonPath + ".bak.3")
+	assert.Check(t, os.IsNotExist(err))
+	for n, expected := range map[int]int{1: 2, 2: 1} {
+		backup, err := loadBackup(fmt.Sprintf("%s.bak.%d", jsonPath, n), false)
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(backup.References(id), expected), "backup %d", n)
+	}
+
+	assert.NilError(t, store.RestoreBackup(2))
+	assert.Check(t, is.Len(store.References(id), 1))
+	_, err = store.Get(refs[0])
+	assert.NilError(t, err)
+	_, err = store.Get(refs[2])
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	// The restored state was saved, and the replaced one backed up.
+	reloaded, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(reloaded.References(id), 1))
+	assert.NilError(t, store.RestoreBackup(1))
+	assert.Check(t, is.Len(store.References(id), 3))
+
+	assert.Check(t, is.ErrorContains(store.RestoreBackup(3), "invalid backup 3"))
+	assert.Check(t, is.ErrorContains(store.RestoreBackup(0), "invalid backup 0"))
+}
+
+func TestBackupsDisabled(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"), false))
+
+	matches, err := filepath.Glob(jsonPath + ".bak*")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(matches, 0))
+	assert.Check(t, is.ErrorContains(store.RestoreBackup(1), "the store keeps 0 backups"))
+}
@@ -0,0 +1,48 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipMagic is the header of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// WithCompression makes the store gzip its file when it is saved. Files are
+// decompressed on load whether or not this option is set, so a store can
+// switch between compressed and plain files.
+func WithCompression(enabled bool) StoreOption {
+	return func(store *store) {
+		store.compress = enabled
+	}
+}
+
+// WithGzip is WithCompression, under the name of the format it writes.
+func WithGzip(enabled bool) StoreOption {
+	return WithCompression(enabled)
+}
+
+// compress returns data gzip compressed.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressReader returns a reader of the decompressed content of r if it
+// is gzip compressed, or of its content otherwise.
+func decompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
@@ -0,0 +1,120 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithDeferredSave makes the store coalesce its saves: changes are written
+// at most interval after they are made, along with all the changes made in
+// the meantime, rather than each time. Changes which are not written yet are
+// reported by UnsavedReferences, and lost if the daemon exits before Flush,
+// SaveContext or Close is called. An interval of 0 disables deferred saves.
+func WithDeferredSave(interval time.Duration) StoreOption {
+	return func(store *store) {
+		store.saveInterval = interval
+	}
+}
+
+// scheduleSave marks the store dirty, and schedules a deferred save if none
+// is pending. store.mu must be held for writing.
+func (store *store) scheduleSave() {
+	store.dirty = true
+	if store.saveTimer == nil {
+		store.saveTimer = time.AfterFunc(store.saveInterval, store.deferredSave)
+	}
+}
+
+// deferredSave writes the store when a scheduled save is due. If writing
+// fails, it is retried after the save interval.
+func (store *store) deferredSave() {
+	store.lock()
+	defer store.unlock()
+
+	store.saveTimer = nil
+	if !store.dirty {
+		return
+	}
+	if err := store.write(); err != nil {
+		logrus.WithError(err).Warn("failed to save the reference store, retrying")
+		if store.saveInterval > 0 {
+			store.saveTimer = time.AfterFunc(store.saveInterval, store.deferredSave)
+		}
+		return
+	}
+	store.dirty = false
+}
+
+// Flush writes the changes whose save was deferred by WithDeferredSave, if
+// any. It does nothing for stores which save each change.
+func (store *store) Flush() error {
+	store.lock()
+	defer store.unlock()
+
+	return store.flush()
+}
+
+// SaveContext writes the store, including the changes whose save was
+// deferred, like Flush, but gives up when ctx is done, such as when the
+// daemon must shut down within a deadline. A write which already started
+// cannot be interrupted: it goes on in the background, holding the lock of
+// the store, and SaveContext returns the error of ctx.
+func (store *store) SaveContext(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		store.lock()
+		defer store.unlock()
+
+		if err := ctx.Err(); err != nil {
+			done <- err
+			return
+		}
+		store.dirty = true
+		done <- store.flush()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush cancels the pending deferred save, and writes the store if it is
+// dirty. store.mu must be held for writing.
+func (store *store) flush() error {
+	if store.saveTimer != nil {
+		store.saveTimer.Stop()
+		store.saveTimer = nil
+	}
+	if !store.dirty {
+		return nil
+	}
+	if err := store.write(); err != nil {
+		return err
+	}
+	store.dirty = false
+	return nil
+}
+
+// Close flushes the store, makes it save each change from then on, and
+// releases the lock of its file, even if the flush failed. It can be called
+// several times, and the store remains usable, but another process can then
+// open its file.
+func (store *store) Close() error {
+	store.lock()
+	defer store.unlock()
+
+	store.saveInterval = 0
+	err := store.flush()
+	if store.locked {
+		store.locked = false
+		if unlockErr := unlockStoreFile(store.jsonPath); err == nil {
+			err = unlockErr
+		}
+	}
+	return err
+}
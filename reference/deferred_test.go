@@ -0,0 +1,103 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/poll"
+)
+
+func TestDeferredSave(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath, WithDeferredSave(time.Hour)))
+	assert.NilError(t, err)
+	_, err = os.Stat(jsonPath)
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{"username/repo:one", "username/repo:two"} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+	}
+	assert.Check(t, is.Len(store.UnsavedReferences(), 2))
+	saved, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(saved.References(id), 0))
+
+	assert.NilError(t, store.Flush())
+	assert.Check(t, is.Len(store.UnsavedReferences(), 0))
+	saved, err = full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(saved.References(id), 2))
+
+	// After Close, each change is saved.
+	assert.NilError(t, store.Close())
+	assert.NilError(t, store.Close())
+	ref, err := reference.ParseNormalizedNamed("username/repo:three")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+	saved, err = full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(saved.References(id), 3))
+}
+
+func TestDeferredSaveTimer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json"), WithDeferredSave(10*time.Millisecond)))
+	assert.NilError(t, err)
+	defer store.Close()
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if n := len(store.UnsavedReferences()); n != 0 {
+			return poll.Continue("%d unsaved references", n)
+		}
+		return poll.Success()
+	}, poll.WithDelay(5*time.Millisecond), poll.WithTimeout(5*time.Second))
+}
+
+func TestSaveContext(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath, WithDeferredSave(time.Hour)))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Check(t, is.Equal(store.SaveContext(ctx), context.Canceled))
+	assert.Check(t, is.Len(store.UnsavedReferences(), 1))
+
+	assert.NilError(t, store.SaveContext(context.Background()))
+	assert.Check(t, is.Len(store.UnsavedReferences(), 0))
+	saved, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(saved.References(id), 1))
+}
@@ -0,0 +1,31 @@
+package reference // import "github.com/docker/docker/reference"
+
+// Diff compares the references of the stores a and b. It returns the
+// associations only in b, those only in a, and those of b whose reference is
+// in both stores but points to a different ID, each sorted lexically.
+func Diff(a, b QueryStore) (added, removed, changed []Association) {
+	references := a.AllReferences()
+	before := make(map[string]Association, len(references))
+	for _, assoc := range references {
+		before[assoc.Ref.String()] = assoc
+	}
+
+	for _, assoc := range b.AllReferences() {
+		key := assoc.Ref.String()
+		old, ok := before[key]
+		switch {
+		case !ok:
+			added = append(added, assoc)
+		case old.ID != assoc.ID:
+			changed = append(changed, assoc)
+		}
+		delete(before, key)
+	}
+
+	for _, assoc := range references {
+		if _, ok := before[assoc.Ref.String()]; ok {
+			removed = append(removed, assoc)
+		}
+	}
+	return added, removed, changed
+}
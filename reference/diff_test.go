@@ -0,0 +1,53 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	newStore := func(refs map[string]digest.Digest) fullStore {
+		store := NewInMemoryReferenceStore().(fullStore)
+		for refStr, id := range refs {
+			ref, err := reference.ParseNormalizedNamed(refStr)
+			assert.NilError(t, err)
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+		return store
+	}
+	familiar := func(associations []Association) []string {
+		var refStrs []string
+		for _, a := range associations {
+			refStrs = append(refStrs, reference.FamiliarString(a.Ref)+"="+a.ID.Encoded()[:4])
+		}
+		return refStrs
+	}
+
+	a := newStore(map[string]digest.Digest{
+		"username/repo:same":    id1,
+		"username/repo:moved":   id1,
+		"username/repo:removed": id1,
+		"busybox:removed":       id2,
+	})
+	b := newStore(map[string]digest.Digest{
+		"username/repo:same":  id1,
+		"username/repo:moved": id2,
+		"username/repo:added": id2,
+	})
+
+	added, removed, changed := Diff(a, b)
+	assert.Check(t, is.DeepEqual(familiar(added), []string{"username/repo:added=ae30"}))
+	assert.Check(t, is.DeepEqual(familiar(removed), []string{"busybox:removed=ae30", "username/repo:removed=4700"}))
+	assert.Check(t, is.DeepEqual(familiar(changed), []string{"username/repo:moved=ae30"}))
+
+	added, removed, changed = Diff(a, a)
+	assert.Check(t, is.Len(added, 0))
+	assert.Check(t, is.Len(removed, 0))
+	assert.Check(t, is.Len(changed, 0))
+}
@@ -23,3 +23,35 @@ func (e conflictingTagError) Error() string {
 }
 
 func (conflictingTagError) Conflict() {}
+
+type shadowingTagError string
+
+func (e shadowingTagError) Error() string {
+	return string(e)
+}
+
+func (shadowingTagError) Conflict() {}
+
+type caseCollisionError string
+
+func (e caseCollisionError) Error() string {
+	return string(e)
+}
+
+func (caseCollisionError) Conflict() {}
+
+type readOnlyError string
+
+func (e readOnlyError) Error() string {
+	return string(e)
+}
+
+func (readOnlyError) Forbidden() {}
+
+type storeLockedError string
+
+func (e storeLockedError) Error() string {
+	return string(e)
+}
+
+func (storeLockedError) Conflict() {}
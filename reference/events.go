@@ -0,0 +1,90 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// eventBufferSize is the number of events buffered for each subscriber.
+// Events for a subscriber whose buffer is full are dropped.
+const eventBufferSize = 64
+
+// ReferenceAction is the kind of change reported by a ReferenceEvent.
+type ReferenceAction string
+
+const (
+	// ReferenceAdded is reported when a reference is added, or moved to a
+	// different ID.
+	ReferenceAdded ReferenceAction = "add"
+	// ReferenceDeleted is reported when a reference is deleted.
+	ReferenceDeleted ReferenceAction = "delete"
+)
+
+// A ReferenceEvent reports a change to a reference of the store.
+type ReferenceEvent struct {
+	Action ReferenceAction
+	Ref    reference.Named
+	// ID is the ID the reference points to, or pointed to before it was
+	// deleted.
+	ID digest.Digest
+}
+
+// Subscribe returns a channel on which the changes to the references of the
+// store are reported, in order, once they were saved successfully. Changes
+// which are saved together are reported together. The channel is buffered,
+// and events which do not fit in the buffer are dropped rather than blocking
+// the store. Restoring a backup is not reported.
+func (store *store) Subscribe() <-chan ReferenceEvent {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	ch := make(chan ReferenceEvent, eventBufferSize)
+	store.subscribers = append(store.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe stops reporting changes on ch, a channel returned by
+// Subscribe, and closes it.
+func (store *store) Unsubscribe(ch <-chan ReferenceEvent) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, sub := range store.subscribers {
+		if sub == ch {
+			store.subscribers = append(store.subscribers[:i], store.subscribers[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// recordEvent buffers an event to be published by the next successful save,
+// if there are subscribers. store.mu must be held for writing.
+func (store *store) recordEvent(action ReferenceAction, ref reference.Named, refStr string, id digest.Digest) {
+	if len(store.subscribers) == 0 {
+		return
+	}
+	if ref == nil {
+		var err error
+		if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+			// Should never happen
+			return
+		}
+	}
+	store.pendingEvents = append(store.pendingEvents, ReferenceEvent{Action: action, Ref: ref, ID: id})
+}
+
+// publishEvents sends the first n buffered events to the subscribers,
+// dropping those which do not fit in their buffers. store.mu must be held
+// for writing.
+func (store *store) publishEvents(n int) {
+	for _, ev := range store.pendingEvents[:n] {
+		for _, sub := range store.subscribers {
+			select {
+			case sub <- ev:
+			default:
+			}
+		}
+	}
+	store.pendingEvents = append([]ReferenceEvent(nil), store.pendingEvents[n:]...)
+}
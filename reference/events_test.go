@@ -0,0 +1,54 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSubscribe(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+	ch := store.Subscribe()
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id1, false))
+	assert.NilError(t, store.AddTag(ref, id2, true))
+	_, err = store.Delete(ref)
+	assert.NilError(t, err)
+
+	for _, expected := range []ReferenceEvent{
+		{Action: ReferenceAdded, Ref: ref, ID: id1},
+		{Action: ReferenceAdded, Ref: ref, ID: id2},
+		{Action: ReferenceDeleted, Ref: ref, ID: id2},
+	} {
+		select {
+		case ev := <-ch:
+			assert.Check(t, is.Equal(ev.Action, expected.Action))
+			assert.Check(t, is.Equal(ev.Ref.String(), expected.Ref.String()))
+			assert.Check(t, is.Equal(ev.ID, expected.ID))
+		default:
+			t.Fatalf("missing %s event", expected.Action)
+		}
+	}
+
+	// Events which do not fit in the buffer are dropped.
+	var associations []Association
+	for i := 0; i < eventBufferSize+1; i++ {
+		tagged, err := reference.WithTag(ref, fmt.Sprintf("tag%d", i))
+		assert.NilError(t, err)
+		associations = append(associations, Association{Ref: tagged, ID: id1})
+	}
+	assert.NilError(t, store.AddTags(associations, false))
+	assert.Check(t, is.Len(ch, eventBufferSize))
+
+	store.Unsubscribe(ch)
+	for range ch {
+	}
+}
@@ -0,0 +1,78 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// exportVersion is the version of the format written by Export.
+const exportVersion = 1
+
+// exportedStore is the format written by Export and read by Import.
+type exportedStore struct {
+	Version    int                 `json:"version"`
+	References []exportedReference `json:"references"`
+}
+
+// exportedReference is a reference in its familiar form, such as
+// "username/repo:latest", and the ID it points to.
+type exportedReference struct {
+	Ref string        `json:"ref"`
+	ID  digest.Digest `json:"id"`
+}
+
+// Export writes all the references of the store to w, in a versioned JSON
+// format which Import reads. References are written sorted lexically, so
+// exporting the same references always produces the same output.
+func (store *store) Export(w io.Writer) error {
+	exported := exportedStore{
+		Version:    exportVersion,
+		References: []exportedReference{},
+	}
+	for _, a := range store.AllReferences() {
+		exported.References = append(exported.References, exportedReference{Ref: reference.FamiliarString(a.Ref), ID: a.ID})
+	}
+	return json.NewEncoder(w).Encode(exported)
+}
+
+// Import merges the references written by Export from r into the store,
+// under a single write lock, saving the store once. If force is set to true,
+// existing tags pointing to other IDs are overwritten. Every reference and
+// ID is validated before the store is modified, and either all references
+// are imported, or none are.
+func (store *store) Import(r io.Reader, force bool) error {
+	var imported exportedStore
+	if err := json.NewDecoder(r).Decode(&imported); err != nil {
+		return errors.Wrap(err, "failed to parse exported references")
+	}
+	if imported.Version != exportVersion {
+		return errors.Errorf("unsupported exported references version %d", imported.Version)
+	}
+
+	txn := store.Begin()
+	for _, e := range imported.References {
+		ref, err := reference.ParseNormalizedNamed(e.Ref)
+		if err != nil {
+			txn.Rollback()
+			return errors.Wrapf(err, "invalid exported reference %q", e.Ref)
+		}
+		if err := e.ID.Validate(); err != nil {
+			txn.Rollback()
+			return errors.Wrapf(err, "invalid image ID for exported reference %q", e.Ref)
+		}
+		if canonical, ok := ref.(reference.Canonical); ok {
+			err = txn.AddDigest(canonical, e.ID, force)
+		} else {
+			err = txn.AddTag(ref, e.ID, force)
+		}
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
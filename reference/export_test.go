@@ -0,0 +1,65 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestExportImport(t *testing.T) {
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+
+	source := NewInMemoryReferenceStore().(fullStore)
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:latest":          id1,
+		"username/repo@" + id1.String(): id1,
+		"busybox:latest":                id2,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, source.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, source.AddTag(ref, id, false))
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.NilError(t, source.Export(&buf))
+	assert.Check(t, is.Equal(buf.String(), `{"version":1,"references":[`+
+		`{"ref":"busybox:latest","id":"`+id2.String()+`"},`+
+		`{"ref":"username/repo:latest","id":"`+id1.String()+`"},`+
+		`{"ref":"username/repo@`+id1.String()+`","id":"`+id1.String()+`"}]}`+"\n"))
+	exported := buf.String()
+
+	// A conflicting tag fails the import, unless forced.
+	target := NewInMemoryReferenceStore().(fullStore)
+	latest, err := reference.ParseNormalizedNamed("busybox:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, target.AddTag(latest, id1, false))
+	err = target.Import(strings.NewReader(exported), false)
+	assert.Check(t, is.ErrorContains(err, "Conflict:"))
+	assert.Check(t, is.Len(target.AllReferences(), 1))
+
+	assert.NilError(t, target.Import(strings.NewReader(exported), true))
+	buf.Reset()
+	assert.NilError(t, target.Export(&buf))
+	assert.Check(t, is.Equal(buf.String(), exported))
+
+	for _, invalid := range []string{
+		`{"version":2,"references":[]}`,
+		`{"version":1,"references":[{"ref":"Invalid:latest","id":"` + id1.String() + `"}]}`,
+		`{"version":1,"references":[{"ref":"valid:latest","id":"sha256:abc"}]}`,
+		`{"version":1`,
+	} {
+		store := NewInMemoryReferenceStore().(fullStore)
+		assert.Check(t, store.Import(strings.NewReader(invalid), false) != nil, invalid)
+		assert.Check(t, is.Len(store.AllReferences(), 0), invalid)
+	}
+}
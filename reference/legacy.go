@@ -0,0 +1,141 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LegacyV1Repositories is the format of the tag store of docker 1.9 and
+// older, which maps repository names to tags, or digests, and image IDs. It
+// is read by ImportLegacyV1, and when migrating a v1 graph in migrate/v1.
+type LegacyV1Repositories struct {
+	Repositories map[string]map[string]string
+}
+
+// ReadLegacyV1 decodes a tag store file in the legacy v1 format.
+func ReadLegacyV1(r io.Reader) (LegacyV1Repositories, error) {
+	var legacy LegacyV1Repositories
+	err := json.NewDecoder(r).Decode(&legacy)
+	return legacy, err
+}
+
+// ParseLegacyV1Reference returns the reference of the entry key of the
+// repository name in a legacy v1 tag store: a digest reference if key is a
+// digest, and a tag otherwise.
+func ParseLegacyV1Reference(name, key string) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	if !reference.IsNameOnly(named) {
+		return nil, errors.New("unexpected tag or digest in repository name")
+	}
+	if dgst, err := digest.Parse(key); err == nil {
+		canonical, err := reference.WithDigest(named, dgst)
+		if err != nil {
+			return nil, err
+		}
+		return canonical, nil
+	}
+	tagged, err := reference.WithTag(named, key)
+	if err != nil {
+		return nil, err
+	}
+	return tagged, nil
+}
+
+// LegacyImportError is returned by ImportLegacyV1 when some entries of the
+// legacy file could not be imported. The other entries were imported.
+type LegacyImportError struct {
+	// Problems describes each entry which was not imported, sorted
+	// lexically.
+	Problems []string
+}
+
+func (e *LegacyImportError) Error() string {
+	return fmt.Sprintf("failed to import %d legacy references: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// ImportLegacyV1 reads a tag store file in the legacy v1 format, and merges
+// its references into the store, saving it once. Keys which are digests
+// become digest references, and all others tags. Image IDs without an
+// algorithm are taken to be sha256 digests.
+//
+// Entries which cannot be parsed, or which conflict with an existing
+// reference to a different image, are skipped, and reported by returning a
+// *LegacyImportError after the other entries were imported.
+func (store *store) ImportLegacyV1(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	legacy, err := ReadLegacyV1(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse legacy tag store %s", path)
+	}
+
+	store.lock()
+	defer store.unlock()
+
+	var (
+		problems []string
+		adds     uint64
+	)
+	for name, repo := range legacy.Repositories {
+		for key, id := range repo {
+			changed, err := store.importLegacyV1Ref(name, key, id)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s %s: %v", name, key, err))
+				continue
+			}
+			if changed {
+				adds++
+			}
+		}
+	}
+	if adds > 0 {
+		if err := store.save(); err != nil {
+			return err
+		}
+		atomic.AddUint64(&store.counters.adds, adds)
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &LegacyImportError{Problems: problems}
+	}
+	return nil
+}
+
+// importLegacyV1Ref adds the reference of a legacy v1 tag store entry, and
+// returns whether the store was modified. store.mu must be held for writing.
+func (store *store) importLegacyV1Ref(name, key, id string) (bool, error) {
+	ref, err := ParseLegacyV1Reference(name, key)
+	if err != nil {
+		return false, err
+	}
+
+	imageID, err := digest.Parse(id)
+	if err != nil {
+		imageID = digest.NewDigestFromHex(string(digest.Canonical), id)
+		if err := imageID.Validate(); err != nil {
+			return false, errors.Errorf("invalid image ID %q", id)
+		}
+	}
+
+	ref, refName, refStr, err := prepareAddReference(ref)
+	if err != nil {
+		return false, err
+	}
+	return store.addReferenceLocked(ref, refName, refStr, imageID, nil)
+}
@@ -0,0 +1,87 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestImportLegacyV1(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	legacyPath := filepath.Join(tmpDir, "repositories-aufs")
+	legacy := `{"Repositories":{
+		"ubuntu":{
+			"latest":"470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6",
+			"sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793":"sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"
+		},
+		"username/repo":{
+			"conflict":"470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6",
+			"same":"ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+			"badid":"not-an-id"
+		},
+		"Invalid Name":{"latest":"470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"}
+	}}`
+	assert.NilError(t, ioutil.WriteFile(legacyPath, []byte(legacy), 0600))
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for _, refStr := range []string{"username/repo:conflict", "username/repo:same"} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id2, false))
+	}
+
+	err = store.ImportLegacyV1(legacyPath)
+	importErr, ok := err.(*LegacyImportError)
+	assert.Assert(t, ok, "unexpected error %v", err)
+	assert.Check(t, is.Len(importErr.Problems, 3))
+	assert.Check(t, is.Contains(importErr.Problems[0], "Invalid Name latest"))
+	assert.Check(t, is.Contains(importErr.Problems[1], "username/repo badid: invalid image ID"))
+	assert.Check(t, is.Contains(importErr.Problems[2], "username/repo conflict: Conflict"))
+
+	// The valid entries were imported and saved.
+	reloaded, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	var refStrs []string
+	for _, ref := range reloaded.References(id1) {
+		refStrs = append(refStrs, reference.FamiliarString(ref))
+	}
+	assert.Check(t, is.DeepEqual(refStrs, []string{
+		"ubuntu:latest",
+		"ubuntu@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+	}))
+	assert.Check(t, is.Len(reloaded.References(id2), 2))
+
+	assert.Check(t, is.ErrorContains(store.ImportLegacyV1(filepath.Join(tmpDir, "missing")), "no such file"))
+}
+
+func TestParseLegacyV1Reference(t *testing.T) {
+	ref, err := ParseLegacyV1Reference("username/repo", "latest")
+	assert.NilError(t, err)
+	_, isTagged := ref.(reference.NamedTagged)
+	assert.Check(t, isTagged)
+	assert.Check(t, is.Equal(reference.FamiliarString(ref), "username/repo:latest"))
+
+	ref, err = ParseLegacyV1Reference("busybox", "sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	assert.NilError(t, err)
+	_, isCanonical := ref.(reference.Canonical)
+	assert.Check(t, isCanonical)
+
+	_, err = ParseLegacyV1Reference("busybox:latest", "latest")
+	assert.Check(t, is.ErrorContains(err, "unexpected tag or digest"))
+	_, err = ParseLegacyV1Reference("Invalid Name", "latest")
+	assert.Check(t, err != nil)
+}
@@ -0,0 +1,66 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"os"
+	"sync"
+)
+
+// storeFileLock is a lock file locked by this process, and the number of
+// stores holding it.
+type storeFileLock struct {
+	f    *os.File
+	refs int
+}
+
+var (
+	// lockedFilesMu guards lockedFiles.
+	lockedFilesMu sync.Mutex
+	// lockedFiles holds the lock files locked by this process, by path. They
+	// are kept open, and thus locked, until every store holding them is
+	// closed, so that no other process can open the same store in the
+	// meantime, while stores opened more than once within this process
+	// share the lock.
+	lockedFiles = make(map[string]*storeFileLock)
+)
+
+// lockStoreFile locks the lock file of the store whose file is at jsonPath,
+// which is a sibling of it. It returns a storeLockedError if another process
+// holds the lock. Each successful call must be paired with a call to
+// unlockStoreFile. On Windows, the lock file is opened but not locked.
+func lockStoreFile(jsonPath string) error {
+	lockPath := jsonPath + ".lock"
+
+	lockedFilesMu.Lock()
+	defer lockedFilesMu.Unlock()
+
+	if l, ok := lockedFiles[lockPath]; ok {
+		l.refs++
+		return nil
+	}
+	f, err := tryLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	lockedFiles[lockPath] = &storeFileLock{f: f, refs: 1}
+	return nil
+}
+
+// unlockStoreFile releases the lock taken by lockStoreFile for the store
+// whose file is at jsonPath. The lock file is closed, and thus unlocked,
+// once every store of this process holding it released it.
+func unlockStoreFile(jsonPath string) error {
+	lockPath := jsonPath + ".lock"
+
+	lockedFilesMu.Lock()
+	defer lockedFilesMu.Unlock()
+
+	l, ok := lockedFiles[lockPath]
+	if !ok {
+		return nil
+	}
+	if l.refs--; l.refs > 0 {
+		return nil
+	}
+	delete(lockedFiles, lockPath)
+	return l.f.Close()
+}
@@ -0,0 +1,27 @@
+// +build !windows
+
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLockFile opens the file at path, creating it if needed, and takes an
+// exclusive advisory lock on it without blocking.
+func tryLockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, storeLockedError(fmt.Sprintf("reference store is in use by another process: %s is locked", path))
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,85 @@
+// +build !windows
+
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+	"golang.org/x/sys/unix"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestStoreLockedByAnotherProcess(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+
+	// A lock taken through another open file description conflicts just
+	// like one taken by another process.
+	f, err := os.OpenFile(jsonPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	assert.NilError(t, err)
+	assert.NilError(t, unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+
+	_, err = NewReferenceStore(jsonPath)
+	assert.Check(t, is.ErrorContains(err, "in use by another process"))
+	assert.Check(t, errdefs.IsConflict(err))
+	_, err = os.Stat(jsonPath)
+	assert.Check(t, os.IsNotExist(err))
+
+	assert.NilError(t, f.Close())
+	_, err = NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+
+	// The store can be opened again within this process.
+	_, err = NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+}
+
+// lockedByAnotherProcess returns whether the lock file of the store at
+// jsonPath is locked, as seen from another open file description.
+func lockedByAnotherProcess(t *testing.T, jsonPath string) bool {
+	f, err := os.OpenFile(jsonPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	assert.NilError(t, err)
+	defer f.Close()
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return true
+	}
+	assert.NilError(t, err)
+	assert.NilError(t, unix.Flock(int(f.Fd()), unix.LOCK_UN))
+	return false
+}
+
+func TestStoreLockReleased(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+
+	// The lock is released when the store fails to load.
+	assert.NilError(t, ioutil.WriteFile(jsonPath, []byte("{corrupt"), 0600))
+	_, err = NewReferenceStore(jsonPath)
+	assert.Check(t, err != nil)
+	assert.Check(t, !lockedByAnotherProcess(t, jsonPath))
+	assert.NilError(t, os.Remove(jsonPath))
+
+	// The lock is released once every store of this process holding it is
+	// closed.
+	store1, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	store2, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, lockedByAnotherProcess(t, jsonPath))
+
+	assert.NilError(t, store1.(PersistentStore).Close())
+	assert.NilError(t, store1.(PersistentStore).Close())
+	assert.Check(t, lockedByAnotherProcess(t, jsonPath))
+	assert.NilError(t, store2.(PersistentStore).Close())
+	assert.Check(t, !lockedByAnotherProcess(t, jsonPath))
+}
@@ -0,0 +1,12 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"os"
+)
+
+// tryLockFile opens the file at path, creating it if needed. Locking is not
+// implemented on Windows, where the daemon root is not shared in practice,
+// so the lock of a store is a no-op there.
+func tryLockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
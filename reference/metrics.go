@@ -0,0 +1,85 @@
+package reference // import "github.com/docker/docker/reference"
+
+import "sync/atomic"
+
+// Metrics describes the operations performed on a reference store since it
+// was created.
+type Metrics struct {
+	// Gets is the number of lookups performed with Get.
+	Gets uint64
+	// GetHits is the number of lookups which found a reference.
+	GetHits uint64
+	// GetMisses is the number of lookups which returned ErrDoesNotExist.
+	GetMisses uint64
+	// Adds is the number of references added or overwritten.
+	Adds uint64
+	// Deletes is the number of references deleted.
+	Deletes uint64
+	// CachedIDs is the number of image IDs in the reverse lookup cache.
+	CachedIDs int
+}
+
+// counters holds the operation counts of a store. All fields are accessed
+// atomically.
+type counters struct {
+	gets      uint64
+	getMisses uint64
+	adds      uint64
+	deletes   uint64
+}
+
+// Metrics returns the operation counts of the store, and the size of its
+// cache.
+func (store *store) Metrics() Metrics {
+	store.mu.RLock()
+	cached := len(store.referencesByIDCache)
+	store.mu.RUnlock()
+
+	// A lookup counts its miss after counting itself, so loading the
+	// misses first ensures that they never exceed the lookups loaded.
+	misses := atomic.LoadUint64(&store.counters.getMisses)
+	gets := atomic.LoadUint64(&store.counters.gets)
+	return Metrics{
+		Gets:      gets,
+		GetHits:   gets - misses,
+		GetMisses: misses,
+		Adds:      atomic.LoadUint64(&store.counters.adds),
+		Deletes:   atomic.LoadUint64(&store.counters.deletes),
+		CachedIDs: cached,
+	}
+}
+
+// Stats describes the contents of a reference store.
+type Stats struct {
+	// Repositories is the number of repositories.
+	Repositories int
+	// Tags is the number of tag references.
+	Tags int
+	// Digests is the number of digest references.
+	Digests int
+	// UniqueImageIDs is the number of image IDs with at least one
+	// reference.
+	UniqueImageIDs int
+}
+
+// Stats returns the number of repositories, references and image IDs in the
+// store, counted in a single pass under the read lock.
+func (store *store) Stats() Stats {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	stats := Stats{
+		Repositories:   len(store.Repositories),
+		UniqueImageIDs: len(store.referencesByIDCache),
+	}
+	for refName, repository := range store.Repositories {
+		for refStr := range repository {
+			if _, ok := refTag(refName, refStr); ok {
+				stats.Tags++
+			} else {
+				stats.Digests++
+			}
+		}
+	}
+	return stats
+}
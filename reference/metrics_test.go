@@ -0,0 +1,81 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestMetrics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref1, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	ref2, err := reference.ParseNormalizedNamed("username/repo:two")
+	assert.NilError(t, err)
+
+	assert.NilError(t, store.AddTag(ref1, id, false))
+	// Redundant adds don't modify the store.
+	assert.NilError(t, store.AddTag(ref1, id, false))
+
+	txn := store.Begin()
+	assert.NilError(t, txn.AddTag(ref2, id, false))
+	assert.NilError(t, txn.Commit())
+
+	_, err = store.Get(ref1)
+	assert.NilError(t, err)
+	_, err = store.Delete(ref1)
+	assert.NilError(t, err)
+	_, err = store.Get(ref1)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	assert.Check(t, is.DeepEqual(store.Metrics(), Metrics{
+		Gets:      2,
+		GetHits:   1,
+		GetMisses: 1,
+		Adds:      2,
+		Deletes:   1,
+		CachedIDs: 1,
+	}))
+}
+
+func TestStats(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+	assert.Check(t, is.DeepEqual(store.Stats(), Stats{}))
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:one":             id1,
+		"username/repo:two":             id1,
+		"username/repo@" + id1.String(): id1,
+		"busybox:latest":                id2,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	assert.Check(t, is.DeepEqual(store.Stats(), Stats{
+		Repositories:   2,
+		Tags:           3,
+		Digests:        1,
+		UniqueImageIDs: 2,
+	}))
+}
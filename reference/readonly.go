@@ -0,0 +1,113 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrReadOnly is returned by the methods modifying a store created with
+// NewReadOnlyReferenceStore.
+var ErrReadOnly readOnlyError = "reference store is read-only"
+
+// readOnlyStore is a store whose methods modifying it fail with ErrReadOnly.
+type readOnlyStore struct {
+	*store
+}
+
+// NewReadOnlyReferenceStore creates a reference store loaded from the file
+// at jsonPath, which must exist, and which is never written. The methods
+// modifying the store fail with ErrReadOnly, and committing its transactions
+// fails likewise. The write-ahead log of the store, if any, is not replayed.
+func NewReadOnlyReferenceStore(jsonPath string, opts ...StoreOption) (Store, error) {
+	abspath, err := filepath.Abs(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &store{
+		jsonPath:            abspath,
+		Repositories:        make(map[string]repository),
+		referencesByIDCache: make(map[digest.Digest]map[string]reference.Named),
+		unsaved:             make(map[string]reference.Named),
+		fileMode:            defaultFileMode,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	store.readOnly = true
+	store.wal = nil
+	store.recoverOnCorruption = false
+	store.saveInterval = 0
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return readOnlyStore{store}, nil
+}
+
+func (readOnlyStore) AddTag(reference.Named, digest.Digest, bool) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) AddTagWithResolver(reference.Named, digest.Digest, ConflictResolver) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) AddTagIfUntagged(reference.Named, digest.Digest) (bool, error) {
+	return false, ErrReadOnly
+}
+
+func (readOnlyStore) AddTags([]Association, bool) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) AddDigest(reference.Canonical, digest.Digest, bool) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) Delete(reference.Named) (bool, error) {
+	return false, ErrReadOnly
+}
+
+func (readOnlyStore) Rename(reference.Named, reference.Named, bool) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) DeleteRepository(reference.Named) ([]reference.Named, error) {
+	return nil, ErrReadOnly
+}
+
+func (readOnlyStore) DeleteAllForID(digest.Digest) ([]reference.Named, error) {
+	return nil, ErrReadOnly
+}
+
+func (readOnlyStore) Prune(func(digest.Digest) bool) ([]Association, error) {
+	return nil, ErrReadOnly
+}
+
+func (readOnlyStore) PruneEmptyRepositories() (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (readOnlyStore) RestoreBackup(int) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) Restore(Snapshot) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) Import(io.Reader, bool) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) SaveContext(context.Context) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) ImportLegacyV1(string) error {
+	return ErrReadOnly
+}
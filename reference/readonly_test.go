@@ -0,0 +1,65 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestReadOnlyStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	_, err = NewReadOnlyReferenceStore(jsonPath)
+	assert.Check(t, os.IsNotExist(err))
+
+	writable, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, writable.AddTag(ref, id, false))
+	before, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+
+	store, err := full(NewReadOnlyReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	got, err := store.Get(ref)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id))
+	assert.Check(t, store.Has(ref))
+	assert.Check(t, is.Len(store.References(id), 1))
+	assert.Check(t, is.Len(store.ReferencesByName(ref), 1))
+
+	other, err := reference.ParseNormalizedNamed("username/repo:other")
+	assert.NilError(t, err)
+	err = store.AddTag(other, id, false)
+	assert.Check(t, is.Equal(err, ErrReadOnly))
+	assert.Check(t, errdefs.IsForbidden(err))
+	_, err = store.Delete(ref)
+	assert.Check(t, is.Equal(err, ErrReadOnly))
+	_, err = store.DeleteAllForID(id)
+	assert.Check(t, is.Equal(err, ErrReadOnly))
+	assert.Check(t, is.Equal(store.Rename(ref, other, false), ErrReadOnly))
+	snapshot, err := store.Snapshot()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(store.Restore(snapshot), ErrReadOnly))
+
+	txn := store.Begin()
+	assert.NilError(t, txn.AddTag(other, id, false))
+	assert.Check(t, is.Equal(txn.Commit(), ErrReadOnly))
+	assert.Check(t, !store.Has(other))
+
+	after, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(after), string(before)))
+}
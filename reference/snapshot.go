@@ -0,0 +1,92 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// A Snapshot is the state of the references of a store at the time it was
+// taken with Snapshot, which Restore reverts the store to.
+type Snapshot struct {
+	store        *store
+	repositories map[string]repository
+	references   map[digest.Digest]map[string]reference.Named
+}
+
+// Snapshot returns the current state of the references of the store, so
+// that changes made from then on can be reverted with Restore.
+func (store *store) Snapshot() (Snapshot, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	snapshot := Snapshot{
+		store:        store,
+		repositories: make(map[string]repository, len(store.Repositories)),
+		references:   make(map[digest.Digest]map[string]reference.Named, len(store.referencesByIDCache)),
+	}
+	for refName, repo := range store.Repositories {
+		copied := make(repository, len(repo))
+		for refStr, id := range repo {
+			copied[refStr] = id
+		}
+		snapshot.repositories[refName] = copied
+	}
+	for id, refs := range store.referencesByIDCache {
+		copied := make(map[string]reference.Named, len(refs))
+		for refStr, ref := range refs {
+			copied[refStr] = ref
+		}
+		snapshot.references[id] = copied
+	}
+	return snapshot, nil
+}
+
+// Restore reverts the references of the store to the given snapshot, which
+// must have been taken of this store, and saves it. The references added or
+// deleted are reported to subscribers like any other change, but neither
+// the add validator nor the before delete hook are called. Either all the
+// references are reverted, or none are.
+func (store *store) Restore(snapshot Snapshot) error {
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if snapshot.store != store {
+		return errors.New("snapshot was not taken of this reference store")
+	}
+
+	store.lock()
+	defer store.unlock()
+
+	var (
+		undo []txnUndo
+		mark = store.markPending()
+	)
+	for refName, repo := range store.Repositories {
+		for refStr := range repo {
+			if _, ok := snapshot.repositories[refName][refStr]; ok {
+				continue
+			}
+			undo = append(undo, store.undoRecord(refName, refStr))
+			store.removeReference(refName, refStr)
+		}
+	}
+	for refName, repo := range snapshot.repositories {
+		for refStr, id := range repo {
+			if current, ok := store.Repositories[refName][refStr]; ok && current == id {
+				continue
+			}
+			undo = append(undo, store.undoRecord(refName, refStr))
+			store.setReference(snapshot.references[id][refStr], refName, refStr, id)
+		}
+	}
+
+	if len(undo) == 0 {
+		return nil
+	}
+	if err := store.save(); err != nil {
+		store.undo(undo, mark)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	kept, err := reference.ParseNormalizedNamed("username/repo:kept")
+	assert.NilError(t, err)
+	deleted, err := reference.ParseNormalizedNamed("username/repo:deleted")
+	assert.NilError(t, err)
+	moved, err := reference.ParseNormalizedNamed("other/repo:moved")
+	assert.NilError(t, err)
+	added, err := reference.ParseNormalizedNamed("new/repo:added")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(kept, id1, false))
+	assert.NilError(t, store.AddTag(deleted, id1, false))
+	assert.NilError(t, store.AddTag(moved, id1, false))
+
+	snapshot, err := store.Snapshot()
+	assert.NilError(t, err)
+
+	_, err = store.Delete(deleted)
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(moved, id2, true))
+	assert.NilError(t, store.AddTag(added, id2, false))
+
+	assert.NilError(t, store.Restore(snapshot))
+	check := func(s fullStore) {
+		t.Helper()
+		var refs []string
+		for _, ref := range s.References(id1) {
+			refs = append(refs, reference.FamiliarString(ref))
+		}
+		assert.Check(t, is.DeepEqual(refs, []string{"other/repo:moved", "username/repo:deleted", "username/repo:kept"}))
+		assert.Check(t, is.Len(s.References(id2), 0))
+		assert.Check(t, !s.Has(added))
+	}
+	check(store)
+
+	reloaded, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	check(reloaded)
+
+	// Restoring again changes nothing.
+	assert.NilError(t, store.Restore(snapshot))
+	check(store)
+
+	err = reloaded.Restore(snapshot)
+	assert.Check(t, is.ErrorContains(err, "not taken of this reference store"))
+	assert.Check(t, is.ErrorContains(store.Restore(Snapshot{}), "not taken of this reference store"))
+}
@@ -1,17 +1,22 @@
 package reference // import "github.com/docker/docker/reference"
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/distribution/reference"
-	"github.com/docker/docker/pkg/ioutils"
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -27,8 +32,18 @@ type Association struct {
 }
 
 // Store provides the set of methods which can operate on a reference store.
+//
+// Methods returning several references sort them lexically by the string
+// form of the fully-qualified reference, as returned by Named.String(). This
+// ordering is part of the contract, and callers may rely on it: for example,
+// "docker.io/library/busybox:latest" sorts before
+// "registry:5000/busybox:latest", and within a repository, tags sort before
+// digests because ':' sorts before '@'.
 type Store interface {
+	// References returns the references to the given ID, sorted lexically.
 	References(id digest.Digest) []reference.Named
+	// ReferencesByName returns the associations for the given repository
+	// name, sorted lexically by reference.
 	ReferencesByName(ref reference.Named) []Association
 	AddTag(ref reference.Named, id digest.Digest, force bool) error
 	AddDigest(ref reference.Canonical, id digest.Digest, force bool) error
@@ -36,16 +51,237 @@ type Store interface {
 	Get(ref reference.Named) (digest.Digest, error)
 }
 
+// The stores created by this package implement the following interfaces in
+// addition to Store. Callers check for them with a type assertion, so that
+// other implementations of Store need not provide them.
+
+// QueryStore is implemented by stores which can look up their references in
+// other ways than Store.
+type QueryStore interface {
+	// ReferencesGrouped returns the references to the given ID, grouped by
+	// familiar repository name and sorted lexically.
+	ReferencesGrouped(id digest.Digest) map[string][]reference.Named
+	// DistinctImageCount returns the number of IDs with at least one
+	// reference.
+	DistinctImageCount() int
+	// IsReferenced reports whether the given ID has at least one
+	// reference.
+	IsReferenced(id digest.Digest) bool
+	// PrimaryReference returns the reference which best names the given
+	// ID, or false if it has none.
+	PrimaryReference(id digest.Digest) (reference.Named, bool)
+	// Walk calls fn for each reference in the store, until fn returns an
+	// error.
+	Walk(fn func(Association) error) error
+	// FilterByName returns the associations for the given repository name
+	// of the given kind, sorted lexically by reference.
+	FilterByName(ref reference.Named, kind RefKind) []Association
+	// DanglingByRepository returns the references to IDs for which exists
+	// returns false, grouped by repository name and sorted lexically.
+	DanglingByRepository(exists func(digest.Digest) bool) map[string][]reference.Named
+	// ExportRegistryFormat returns the tags of the given repository in the
+	// JSON format of the registry v2 tags list.
+	ExportRegistryFormat(repo reference.Named) ([]byte, error)
+	// ReferencesByRegistry returns the associations for all repositories
+	// on the given registry host, sorted lexically by reference.
+	ReferencesByRegistry(host string) []Association
+	// ReferencesByTag returns the associations for the given tag in all
+	// repositories, sorted lexically by reference.
+	ReferencesByTag(tag string) []Association
+	// AllReferences returns the associations for every reference in the
+	// store, sorted lexically by reference.
+	AllReferences() []Association
+	// Resolve looks up the reference like Get, and also returns a digest
+	// reference to the same ID in the same repository, if there is one.
+	Resolve(ref reference.Named) (digest.Digest, reference.Canonical, error)
+	// Has reports whether the store has the reference, matching it like
+	// Get.
+	Has(ref reference.Named) bool
+	// GetByString returns the ID of the reference with the given key, which
+	// must be in the exact form used by the store.
+	GetByString(refStr string) (digest.Digest, error)
+	// DebugResolve returns the repository name and the key Get looks up
+	// for the given reference, for diagnostics.
+	DebugResolve(ref reference.Named) (familiarName, key string)
+}
+
+// EditStore is implemented by stores which can change several references at
+// once, saving the store a single time.
+type EditStore interface {
+	// AddTagWithResolver adds a tag reference, calling resolve to decide
+	// the outcome if the tag already points to a different ID.
+	AddTagWithResolver(ref reference.Named, id digest.Digest, resolve ConflictResolver) error
+	// AddTagIfUntagged adds a tag reference only if id has no references,
+	// and returns whether it was added.
+	AddTagIfUntagged(ref reference.Named, id digest.Digest) (bool, error)
+	// AddTags adds the tag references of all the associations, saving the
+	// store once. Either all of them are added, or none are.
+	AddTags(associations []Association, force bool) error
+	// Rename moves a reference to a new tag pointing at the same ID,
+	// saving the store once.
+	Rename(oldRef, newRef reference.Named, force bool) error
+	// DeleteRepository deletes all references in the given repository,
+	// and returns them sorted lexically.
+	DeleteRepository(name reference.Named) ([]reference.Named, error)
+	// DeleteAllForID deletes all references to the given ID, and returns
+	// them sorted lexically.
+	DeleteAllForID(id digest.Digest) ([]reference.Named, error)
+	// Prune deletes the references to the IDs for which exists returns
+	// false, and returns them sorted lexically.
+	Prune(exists func(digest.Digest) bool) ([]Association, error)
+	// PruneEmptyRepositories removes the repositories without any
+	// references, and returns how many were removed.
+	PruneEmptyRepositories() (int, error)
+	// Begin starts a transaction, whose changes are applied and saved
+	// together when it is committed.
+	Begin() *Txn
+	// Snapshot returns the current state of the references of the store,
+	// and Restore reverts the store to it.
+	Snapshot() (Snapshot, error)
+	Restore(snapshot Snapshot) error
+	// RestoreBackup replaces the references in the store with those of the
+	// nth most recent backup of its file.
+	RestoreBackup(n int) error
+}
+
+// StatusStore is implemented by stores which report their state, and the
+// changes made to them.
+type StatusStore interface {
+	// Metrics returns the number of operations performed on the store
+	// since it was created, and the size of its cache.
+	Metrics() Metrics
+	// Stats returns the number of repositories, tags, digests and image
+	// IDs in the store.
+	Stats() Stats
+	// UnsavedReferences returns the references added to the store which
+	// were not saved yet, sorted lexically.
+	UnsavedReferences() []reference.Named
+	// LoadWarnings returns the problems found when the store was loaded,
+	// such as references to malformed image IDs, which were not loaded.
+	LoadWarnings() []string
+	// Subscribe returns a channel on which the changes to the references of
+	// the store are reported once they were saved. Unsubscribe stops
+	// reporting them on the channel, and closes it.
+	Subscribe() <-chan ReferenceEvent
+	Unsubscribe(ch <-chan ReferenceEvent)
+}
+
+// PersistentStore is implemented by stores whose saving can be controlled,
+// and whose references can be moved to and from other stores.
+type PersistentStore interface {
+	// Flush writes the changes whose save was deferred, and Close flushes
+	// the store, stops deferring saves and releases the lock of its file.
+	Flush() error
+	Close() error
+	// SaveContext writes the store, including the changes whose save was
+	// deferred, unless ctx is done first.
+	SaveContext(ctx context.Context) error
+	// Export writes all the references of the store to w, in a versioned
+	// format, and Import merges references written by Export into the
+	// store.
+	Export(w io.Writer) error
+	Import(r io.Reader, force bool) error
+	// ImportLegacyV1 merges the references of a legacy v1 tag store file
+	// into the store, reporting the entries which could not be imported.
+	ImportLegacyV1(path string) error
+}
+
+var (
+	_ QueryStore      = (*store)(nil)
+	_ EditStore       = (*store)(nil)
+	_ StatusStore     = (*store)(nil)
+	_ PersistentStore = (*store)(nil)
+)
+
 type store struct {
+	// counters must be kept first in the struct for 64-bit alignment, as
+	// they are accessed atomically.
+	counters counters
+
 	mu sync.RWMutex
+	// saveMu serializes the saves of the store. A change to a single
+	// repository is made under store.mu, and saved under saveMu only, by
+	// saveRepository. Other changes hold saveMu and store.mu until they are
+	// saved.
+	//
+	// The repositories are not locked separately: a change to one of them
+	// also updates referencesByIDCache, the tag index, the unsaved
+	// references and the pending events, which are shared by all of them,
+	// and the store is saved as a whole. Locks per repository would have to
+	// be taken along with store.mu, and would serialize nothing more.
+	saveMu sync.Mutex
 	// jsonPath is the path to the file where the serialized tag data is
-	// stored.
+	// stored. It is empty for in-memory stores, and stores with a backend.
 	jsonPath string
+	// locked is whether the store holds the lock of its file, which is
+	// released by Close.
+	locked bool
+	// backend, if set, persists the store instead of its file, and changes
+	// are the changes it has not persisted yet.
+	backend Backend
+	changes []Change
 	// Repositories is a map of repositories, indexed by name.
 	Repositories map[string]repository
 	// referencesByIDCache is a cache of references indexed by ID, to speed
 	// up References.
 	referencesByIDCache map[digest.Digest]map[string]reference.Named
+	// unsaved holds the references that were added since the store was last
+	// saved successfully, indexed by their key.
+	unsaved map[string]reference.Named
+	// ReverseIndex is the persisted form of referencesByIDCache. It is only
+	// written when the store was created with WithPersistedReverseIndex.
+	ReverseIndex map[digest.Digest][]string `json:",omitempty"`
+	// Sequence is the sequence number of the last write-ahead log record
+	// included in the file. It is only written when the store was created
+	// with WithWriteAheadLog.
+	Sequence uint64 `json:",omitempty"`
+	// tagIndex maps tags to the references with that tag, in all
+	// repositories. It is only maintained when the store was created with
+	// WithTagIndex.
+	tagIndex map[string]map[string]digest.Digest
+
+	persistReverseIndex bool
+	rejectShadowingTags bool
+	caseInsensitiveTags bool
+	recoverOnCorruption bool
+	strictLoad          bool
+	readOnly            bool
+	compress            bool
+	fileMode            os.FileMode
+	backupDepth         int
+	wal                 *writeAheadLog
+	beforeDelete        BeforeDeleteFunc
+	addValidator        AddValidatorFunc
+	// saveInterval is the delay of deferred saves, if the store was
+	// created with WithDeferredSave. saveTimer is the pending deferred
+	// save, and dirty whether there are changes left to write.
+	saveInterval time.Duration
+	saveTimer    *time.Timer
+	dirty        bool
+	// subscribers are the channels returned by Subscribe, and
+	// pendingEvents the changes to report to them after the next
+	// successful save.
+	subscribers   []chan ReferenceEvent
+	pendingEvents []ReferenceEvent
+	// loadWarnings are the problems found by the last reload.
+	loadWarnings []string
+	// unknownFields are the top-level fields of the file which this
+	// version does not know, such as those added by a newer version. They
+	// are written back as they are when the store is saved.
+	unknownFields map[string]json.RawMessage
+}
+
+// StoreOption configures a reference store created by NewReferenceStore.
+type StoreOption func(*store)
+
+// WithPersistedReverseIndex makes the store save the index of references by
+// ID alongside the repositories, so that it does not need to be rebuilt by
+// parsing every reference when the store is loaded. The persisted index is
+// validated against the repositories on load, and rebuilt if they disagree.
+func WithPersistedReverseIndex(enabled bool) StoreOption {
+	return func(store *store) {
+		store.persistReverseIndex = enabled
+	}
 }
 
 // Repository maps tags to digests. The key is a stringified Reference,
@@ -68,22 +304,135 @@ func (a lexicalAssociations) Less(i, j int) bool {
 	return a[i].Ref.String() < a[j].Ref.String()
 }
 
+// WithRejectShadowingTags makes the store reject tags which could be
+// confused with a digest reference in the same repository, that is tags
+// equal to the encoded form of the digest, or to a prefix of it at least
+// as long as a short ID.
+func WithRejectShadowingTags(enabled bool) StoreOption {
+	return func(store *store) {
+		store.rejectShadowingTags = enabled
+	}
+}
+
+// WithTagIndex makes the store maintain an index of references by tag, so
+// that ReferencesByTag does not need to scan every repository.
+func WithTagIndex(enabled bool) StoreOption {
+	return func(store *store) {
+		if enabled {
+			store.tagIndex = make(map[string]map[string]digest.Digest)
+		} else {
+			store.tagIndex = nil
+		}
+	}
+}
+
+// WithCaseInsensitiveTags makes the store match tags regardless of their
+// case, so that "myapp:latest" finds "myapp:LATEST". Tags keep the case they
+// were added with. Adding a tag which only differs by case from an existing
+// tag in the same repository fails.
+func WithCaseInsensitiveTags(enabled bool) StoreOption {
+	return func(store *store) {
+		store.caseInsensitiveTags = enabled
+	}
+}
+
+// WithRecoverOnCorruption makes NewReferenceStore start with an empty store
+// if its file cannot be parsed, rather than failing. The corrupt file is
+// moved aside to <file>.corrupt, and a warning is logged and reported by
+// LoadWarnings.
+func WithRecoverOnCorruption(enabled bool) StoreOption {
+	return func(store *store) {
+		store.recoverOnCorruption = enabled
+	}
+}
+
+// WithStrictLoad makes loading the store fail, listing every reference whose
+// key does not parse, or differs from the normalized form of the reference,
+// rather than silently leaving such references out of the reverse lookup
+// cache.
+func WithStrictLoad(enabled bool) StoreOption {
+	return func(store *store) {
+		store.strictLoad = enabled
+	}
+}
+
+// defaultFileMode is the mode of the file of the store, unless WithFileMode
+// is used.
+const defaultFileMode os.FileMode = 0600
+
+// WithFileMode sets the mode of the file of the store, and of its backups,
+// such as 0640 to let a group read it. It defaults to 0600.
+func WithFileMode(mode os.FileMode) StoreOption {
+	return func(store *store) {
+		store.fileMode = mode
+	}
+}
+
+// AddValidatorFunc is called before a reference is added to the store, or
+// moved to another ID, with the ID it is to point to. A non-nil error
+// rejects the reference.
+type AddValidatorFunc func(ref reference.Named, id digest.Digest) error
+
+// WithAddValidator makes the store call f before adding any reference, or
+// moving it to another ID, such as to enforce a naming policy. f is called
+// with the store locked, so it must not use the store.
+func WithAddValidator(f AddValidatorFunc) StoreOption {
+	return func(store *store) {
+		store.addValidator = f
+	}
+}
+
+// BeforeDeleteFunc is called before a reference is deleted from the store,
+// with the ID it points to. A non-nil error aborts the deletion.
+type BeforeDeleteFunc func(ref reference.Named, id digest.Digest) error
+
+// WithBeforeDelete makes the store call f before deleting any reference,
+// whether by Delete, by the methods deleting several references, or by a
+// transaction. f is called with the store locked, so it must not use the
+// store.
+func WithBeforeDelete(f BeforeDeleteFunc) StoreOption {
+	return func(store *store) {
+		store.beforeDelete = f
+	}
+}
+
 // NewReferenceStore creates a new reference store, tied to a file path where
-// the set of references are serialized in JSON format.
-func NewReferenceStore(jsonPath string) (Store, error) {
+// the set of references are serialized in JSON format. It takes an advisory
+// lock on a sibling ".lock" file, held until the store is closed, and fails
+// if another process holds it, so that two daemons cannot share a store.
+func NewReferenceStore(jsonPath string, opts ...StoreOption) (_ Store, retErr error) {
 	abspath, err := filepath.Abs(jsonPath)
 	if err != nil {
 		return nil, err
 	}
+	if err := lockStoreFile(abspath); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			unlockStoreFile(abspath)
+		}
+	}()
 
 	store := &store{
+		locked:              true,
 		jsonPath:            abspath,
 		Repositories:        make(map[string]repository),
 		referencesByIDCache: make(map[digest.Digest]map[string]reference.Named),
+		unsaved:             make(map[string]reference.Named),
+		fileMode:            defaultFileMode,
+	}
+	for _, opt := range opts {
+		opt(store)
 	}
 	// Load the json file if it exists, otherwise create it.
-	if err := store.reload(); os.IsNotExist(err) {
-		if err := store.save(); err != nil {
+	err = store.reload()
+	if _, corrupt := err.(corruptFileError); corrupt && store.recoverOnCorruption {
+		if err := store.recoverCorruptFile(err); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		if err := store.write(); err != nil {
 			return nil, err
 		}
 	} else if err != nil {
@@ -92,18 +441,127 @@ func NewReferenceStore(jsonPath string) (Store, error) {
 	return store, nil
 }
 
+// corruptFileError is returned by reload when the file of the store cannot
+// be parsed.
+type corruptFileError struct {
+	error
+}
+
+// recoverCorruptFile moves the corrupt file of the store aside, after reload
+// failed with err, and saves the store empty.
+func (store *store) recoverCorruptFile(err error) error {
+	corruptPath := store.jsonPath + ".corrupt"
+	if err := os.Rename(store.jsonPath, corruptPath); err != nil {
+		return errors.Wrap(err, "failed to move the corrupt reference store aside")
+	}
+	warning := fmt.Sprintf("the reference store %s is corrupt, and was moved to %s: %v", store.jsonPath, corruptPath, err)
+	logrus.Warn(warning)
+
+	store.Repositories = make(map[string]repository)
+	store.referencesByIDCache = make(map[digest.Digest]map[string]reference.Named)
+	store.ReverseIndex = nil
+	store.Sequence = 0
+	store.loadWarnings = []string{warning}
+	store.rebuildTagIndex()
+	return store.write()
+}
+
+// NewInMemoryReferenceStore creates a reference store which is not backed by
+// a file. Saving it only marks the references as saved, and it always starts
+// out empty.
+func NewInMemoryReferenceStore() Store {
+	return &store{
+		Repositories:        make(map[string]repository),
+		referencesByIDCache: make(map[digest.Digest]map[string]reference.Named),
+		unsaved:             make(map[string]reference.Named),
+	}
+}
+
+// ConflictResolver decides what happens when a tag is added to the store
+// while it already points to a different ID. It returns the ID the tag should
+// point to, which must be either existing or incoming, or an error to reject
+// the tag.
+type ConflictResolver func(existing, incoming digest.Digest) (keep digest.Digest, err error)
+
+// OverwriteOnConflict is a ConflictResolver which moves the tag to the
+// incoming ID. It is the resolver used by AddTag when force is set to true.
+func OverwriteOnConflict(existing, incoming digest.Digest) (digest.Digest, error) {
+	return incoming, nil
+}
+
+// forceResolver returns the resolver implementing the force flag. A nil
+// resolver rejects conflicting tags.
+func forceResolver(force bool) ConflictResolver {
+	if force {
+		return OverwriteOnConflict
+	}
+	return nil
+}
+
 // AddTag adds a tag reference to the store. If force is set to true, existing
 // references can be overwritten. This only works for tags, not digests.
 func (store *store) AddTag(ref reference.Named, id digest.Digest, force bool) error {
+	return store.AddTagWithResolver(ref, id, forceResolver(force))
+}
+
+// AddTagWithResolver adds a tag reference to the store. If the tag already
+// points to a different ID, resolve decides which ID it points to; a nil
+// resolve rejects the tag, like AddTag without force.
+func (store *store) AddTagWithResolver(ref reference.Named, id digest.Digest, resolve ConflictResolver) error {
 	if _, isCanonical := ref.(reference.Canonical); isCanonical {
 		return errors.WithStack(invalidTagError("refusing to create a tag with a digest reference"))
 	}
-	return store.addReference(reference.TagNameOnly(ref), id, force)
+	return store.addReference(reference.TagNameOnly(ref), id, resolve)
+}
+
+// AddTagIfUntagged adds a tag reference to the store if id has no references
+// at all, and returns whether the tag was added. The check and the addition
+// are done under the same lock. If the tag already points to a different ID,
+// it fails like AddTag without force.
+func (store *store) AddTagIfUntagged(ref reference.Named, id digest.Digest) (bool, error) {
+	if _, isCanonical := ref.(reference.Canonical); isCanonical {
+		return false, errors.WithStack(invalidTagError("refusing to create a tag with a digest reference"))
+	}
+	ref, refName, refStr, err := prepareAddReference(reference.TagNameOnly(ref))
+	if err != nil {
+		return false, err
+	}
+
+	store.lock()
+	defer store.unlock()
+
+	if len(store.referencesByIDCache[id]) > 0 {
+		return false, nil
+	}
+	changed, err := store.addReferenceLocked(ref, refName, refStr, id, nil)
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := store.save(); err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&store.counters.adds, 1)
+	return true, nil
+}
+
+// AddTags adds the tag references of all the associations to the store
+// under a single write lock, and saves it once. If force is set to true,
+// existing tags can be overwritten. If any of the tags cannot be added, none
+// are, and the store file is left untouched.
+func (store *store) AddTags(associations []Association, force bool) error {
+	txn := store.Begin()
+	for _, a := range associations {
+		if err := txn.AddTag(a.Ref, a.ID, force); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
 }
 
 // AddDigest adds a digest reference to the store.
 func (store *store) AddDigest(ref reference.Canonical, id digest.Digest, force bool) error {
-	return store.addReference(ref, id, force)
+	return store.addReference(ref, id, forceResolver(force))
 }
 
 func favorDigest(originalRef reference.Named) (reference.Named, error) {
@@ -124,212 +582,1363 @@ func favorDigest(originalRef reference.Named) (reference.Named, error) {
 	return ref, nil
 }
 
-func (store *store) addReference(ref reference.Named, id digest.Digest, force bool) error {
+// prepareAddReference normalizes ref into the form it is stored in and
+// returns it along with its repository name and key.
+func prepareAddReference(ref reference.Named) (reference.Named, string, string, error) {
 	ref, err := favorDigest(ref)
 	if err != nil {
-		return err
+		return nil, "", "", err
 	}
 
 	refName := reference.FamiliarName(ref)
 	refStr := reference.FamiliarString(ref)
 
-	if refName == string(digest.Canonical) {
-		return errors.WithStack(invalidTagError("refusing to create an ambiguous tag using digest algorithm as name"))
+	for _, algorithm := range digestAlgorithms {
+		if refName == string(algorithm) {
+			return nil, "", "", errors.WithStack(invalidTagError(
+				fmt.Sprintf("refusing to create an ambiguous tag using digest algorithm %s as name", algorithm),
+			))
+		}
+	}
+	return ref, refName, refStr, nil
+}
+
+// digestAlgorithms are the digest algorithms which cannot be used as
+// repository names, as references to them would be ambiguous with digests.
+// go-digest does not expose its registered algorithms, so they are listed.
+var digestAlgorithms = []digest.Algorithm{digest.SHA256, digest.SHA384, digest.SHA512}
+
+// prepareDeleteReference normalizes ref into the form it is stored in and
+// returns its repository name and key.
+func prepareDeleteReference(ref reference.Named) (string, string, error) {
+	ref, err := favorDigest(ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	ref = reference.TagNameOnly(ref)
+	return reference.FamiliarName(ref), reference.FamiliarString(ref), nil
+}
+
+func (store *store) addReference(ref reference.Named, id digest.Digest, resolve ConflictResolver) error {
+	ref, refName, refStr, err := prepareAddReference(ref)
+	if err != nil {
+		return err
 	}
 
 	store.mu.Lock()
-	defer store.mu.Unlock()
+	changed, err := store.addReferenceLocked(ref, refName, refStr, id, resolve)
+	store.mu.Unlock()
+	if err != nil || !changed {
+		return err
+	}
+	if err := store.saveRepository(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&store.counters.adds, 1)
+	return nil
+}
 
-	repository, exists := store.Repositories[refName]
-	if !exists || repository == nil {
-		repository = make(map[string]digest.Digest)
-		store.Repositories[refName] = repository
+// addReferenceLocked points refStr at id. If refStr already points to a
+// different ID, resolve decides the outcome; a nil resolve rejects the
+// change. It returns whether the store was modified. store.mu must be held
+// for writing.
+func (store *store) addReferenceLocked(ref reference.Named, refName, refStr string, id digest.Digest, resolve ConflictResolver) (bool, error) {
+	if tagged, isTagged := ref.(reference.NamedTagged); isTagged && store.rejectShadowingTags {
+		if err := store.checkShadowing(tagged, refName); err != nil {
+			return false, err
+		}
+	}
+
+	if key := store.lookupRefStr(refName, refStr); key != refStr {
+		return false, errors.WithStack(caseCollisionError(
+			fmt.Sprintf("tag %s only differs by case from the existing tag %s", refStr, key),
+		))
 	}
 
-	oldID, exists := repository[refStr]
+	oldID, exists := store.Repositories[refName][refStr]
 
 	if exists {
 		if oldID == id {
 			// Nothing to do. The caller may have checked for this using store.Get in advance, but store.mu was unlocked in the meantime, so this can legitimately happen nevertheless.
-			return nil
+			return false, nil
 		}
 
 		// force only works for tags
 		if digested, isDigest := ref.(reference.Canonical); isDigest {
-			return errors.WithStack(conflictingTagError("Cannot overwrite digest " + digested.Digest().String()))
+			return false, errors.WithStack(conflictingTagError("Cannot overwrite digest " + digested.Digest().String()))
 		}
 
-		if !force {
-			return errors.WithStack(
+		if resolve == nil {
+			return false, errors.WithStack(
 				conflictingTagError(
 					fmt.Sprintf("Conflict: Tag %s is already set to image %s, if you want to replace it, please use the force option", refStr, oldID.String()),
 				),
 			)
 		}
-
-		if store.referencesByIDCache[oldID] != nil {
-			delete(store.referencesByIDCache[oldID], refStr)
-			if len(store.referencesByIDCache[oldID]) == 0 {
-				delete(store.referencesByIDCache, oldID)
-			}
+		keep, err := resolve(oldID, id)
+		if err != nil {
+			return false, err
+		}
+		switch keep {
+		case oldID:
+			return false, nil
+		case id:
+		default:
+			return false, errors.Errorf("conflict resolver for tag %s returned %s, which is neither the existing image %s nor the new image %s", refStr, keep, oldID, id)
 		}
 	}
 
-	repository[refStr] = id
-	if store.referencesByIDCache[id] == nil {
-		store.referencesByIDCache[id] = make(map[string]reference.Named)
+	if store.addValidator != nil {
+		if err := store.addValidator(ref, id); err != nil {
+			return false, err
+		}
 	}
-	store.referencesByIDCache[id][refStr] = ref
-
-	return store.save()
+	store.setReference(ref, refName, refStr, id)
+	store.unsaved[refStr] = ref
+	return true, nil
 }
 
-// Delete deletes a reference from the store. It returns true if a deletion
-// happened, or false otherwise.
-func (store *store) Delete(ref reference.Named) (bool, error) {
-	ref, err := favorDigest(ref)
-	if err != nil {
-		return false, err
-	}
-
-	ref = reference.TagNameOnly(ref)
-
-	refName := reference.FamiliarName(ref)
-	refStr := reference.FamiliarString(ref)
-
-	store.mu.Lock()
-	defer store.mu.Unlock()
+// shortDigestLen is the length of the shortest prefix of a digest which a
+// tag may not be, when shadowing tags are rejected.
+const shortDigestLen = 12
 
-	repository, exists := store.Repositories[refName]
-	if !exists {
-		return false, ErrDoesNotExist
+// checkShadowing returns an error if the tag could be confused with a digest
+// reference in the repository refName. store.mu must be held.
+func (store *store) checkShadowing(tagged reference.NamedTagged, refName string) error {
+	tag := tagged.Tag()
+	if len(tag) < shortDigestLen {
+		return nil
 	}
-
-	if id, exists := repository[refStr]; exists {
-		delete(repository, refStr)
-		if len(repository) == 0 {
-			delete(store.Repositories, refName)
+	for refStr := range store.Repositories[refName] {
+		i := strings.LastIndex(refStr, "@")
+		if i < 0 {
+			continue
 		}
-		if store.referencesByIDCache[id] != nil {
-			delete(store.referencesByIDCache[id], refStr)
-			if len(store.referencesByIDCache[id]) == 0 {
-				delete(store.referencesByIDCache, id)
-			}
+		dgst, err := digest.Parse(refStr[i+1:])
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(dgst.Encoded(), tag) {
+			return errors.WithStack(shadowingTagError(
+				fmt.Sprintf("tag %s shadows the digest reference %s", reference.FamiliarString(tagged), refStr),
+			))
 		}
-		return true, store.save()
 	}
-
-	return false, ErrDoesNotExist
+	return nil
 }
 
-// Get retrieves an item from the store by reference
-func (store *store) Get(ref reference.Named) (digest.Digest, error) {
-	if canonical, ok := ref.(reference.Canonical); ok {
-		// If reference contains both tag and digest, only
-		// lookup by digest as it takes precedence over
-		// tag, until tag/digest combos are stored.
-		if _, ok := ref.(reference.Tagged); ok {
-			var err error
-			ref, err = reference.WithDigest(reference.TrimNamed(canonical), canonical.Digest())
-			if err != nil {
-				return "", err
-			}
+// lookupRefStr returns the key of refStr in the repository refName. If the
+// store has case-insensitive tags, and refStr is not in the repository, it is
+// the lexically first tag which only differs from refStr by case, if any.
+// store.mu must be held.
+func (store *store) lookupRefStr(refName, refStr string) string {
+	repository := store.Repositories[refName]
+	if _, exists := repository[refStr]; exists || !store.caseInsensitiveTags {
+		return refStr
+	}
+	tag, ok := refTag(refName, refStr)
+	if !ok {
+		return refStr
+	}
+	found := refStr
+	for key := range repository {
+		if t, ok := refTag(refName, key); ok && strings.EqualFold(t, tag) && (found == refStr || key < found) {
+			found = key
 		}
-	} else {
-		ref = reference.TagNameOnly(ref)
 	}
+	return found
+}
 
-	refName := reference.FamiliarName(ref)
-	refStr := reference.FamiliarString(ref)
-
-	store.mu.RLock()
-	defer store.mu.RUnlock()
-
+// setReference points refStr at id, keeping referencesByIDCache in sync.
+// store.mu must be held for writing.
+func (store *store) setReference(ref reference.Named, refName, refStr string, id digest.Digest) {
 	repository, exists := store.Repositories[refName]
 	if !exists || repository == nil {
-		return "", ErrDoesNotExist
+		repository = make(map[string]digest.Digest)
+		store.Repositories[refName] = repository
 	}
 
-	id, exists := repository[refStr]
-	if !exists {
-		return "", ErrDoesNotExist
+	if oldID, exists := repository[refStr]; exists {
+		store.uncacheReference(oldID, refStr)
 	}
 
-	return id, nil
+	repository[refStr] = id
+	store.indexTag(refName, refStr, id)
+	if store.wal != nil {
+		store.wal.record(walRecord{Name: refName, Ref: refStr, ID: id})
+	}
+	store.recordChange(Change{Name: refName, Ref: refStr, ID: id})
+	if store.referencesByIDCache[id] == nil {
+		store.referencesByIDCache[id] = make(map[string]reference.Named)
+	}
+	store.referencesByIDCache[id][refStr] = ref
+	store.recordEvent(ReferenceAdded, ref, refStr, id)
 }
 
-// References returns a slice of references to the given ID. The slice
-// will be nil if there are no references to this ID.
-func (store *store) References(id digest.Digest) []reference.Named {
-	store.mu.RLock()
-	defer store.mu.RUnlock()
-
-	// Convert the internal map to an array for two reasons:
-	// 1) We must not return a mutable
-	// 2) It would be ugly to expose the extraneous map keys to callers.
-
-	var references []reference.Named
-	for _, ref := range store.referencesByIDCache[id] {
-		references = append(references, ref)
+// removeReference removes refStr from the store, pruning its repository if
+// it becomes empty. It returns the ID the reference pointed to, and whether
+// it existed. store.mu must be held for writing.
+func (store *store) removeReference(refName, refStr string) (digest.Digest, bool) {
+	repository, exists := store.Repositories[refName]
+	if !exists {
+		return "", false
 	}
 
-	sort.Sort(lexicalRefs(references))
+	id, exists := repository[refStr]
+	if !exists {
+		return "", false
+	}
 
-	return references
+	delete(repository, refStr)
+	if len(repository) == 0 {
+		delete(store.Repositories, refName)
+	}
+	store.recordEvent(ReferenceDeleted, store.referencesByIDCache[id][refStr], refStr, id)
+	store.uncacheReference(id, refStr)
+	store.unindexTag(refName, refStr)
+	if store.wal != nil {
+		store.wal.record(walRecord{Name: refName, Ref: refStr, Delete: true})
+	}
+	store.recordChange(Change{Name: refName, Ref: refStr, Delete: true})
+	delete(store.unsaved, refStr)
+	return id, true
 }
 
-// ReferencesByName returns the references for a given repository name.
-// If there are no references known for this repository name,
-// ReferencesByName returns nil.
-func (store *store) ReferencesByName(ref reference.Named) []Association {
-	refName := reference.FamiliarName(ref)
+// refTag returns the tag of the reference refStr in the repository refName,
+// or false if it is a digest reference.
+func refTag(refName, refStr string) (string, bool) {
+	suffix := strings.TrimPrefix(refStr, refName)
+	if !strings.HasPrefix(suffix, ":") {
+		return "", false
+	}
+	return suffix[1:], true
+}
 
-	store.mu.RLock()
-	defer store.mu.RUnlock()
+// indexTag adds refStr to the tag index, if the store maintains one.
+// store.mu must be held for writing.
+func (store *store) indexTag(refName, refStr string, id digest.Digest) {
+	if store.tagIndex == nil {
+		return
+	}
+	tag, ok := refTag(refName, refStr)
+	if !ok {
+		return
+	}
+	if store.tagIndex[tag] == nil {
+		store.tagIndex[tag] = make(map[string]digest.Digest)
+	}
+	store.tagIndex[tag][refStr] = id
+}
 
-	repository, exists := store.Repositories[refName]
-	if !exists {
-		return nil
+// unindexTag removes refStr from the tag index, if the store maintains one.
+// store.mu must be held for writing.
+func (store *store) unindexTag(refName, refStr string) {
+	if store.tagIndex == nil {
+		return
+	}
+	tag, ok := refTag(refName, refStr)
+	if !ok {
+		return
 	}
+	delete(store.tagIndex[tag], refStr)
+	if len(store.tagIndex[tag]) == 0 {
+		delete(store.tagIndex, tag)
+	}
+}
 
-	var associations []Association
-	for refStr, refID := range repository {
-		ref, err := reference.ParseNormalizedNamed(refStr)
-		if err != nil {
-			// Should never happen
-			return nil
+// rebuildTagIndex rebuilds the tag index from the repositories, if the store
+// maintains one. store.mu must be held for writing.
+func (store *store) rebuildTagIndex() {
+	if store.tagIndex == nil {
+		return
+	}
+	store.tagIndex = make(map[string]map[string]digest.Digest)
+	for refName, repository := range store.Repositories {
+		for refStr, id := range repository {
+			store.indexTag(refName, refStr, id)
 		}
-		associations = append(associations,
-			Association{
-				Ref: ref,
-				ID:  refID,
-			})
 	}
-
-	sort.Sort(lexicalAssociations(associations))
-
-	return associations
 }
 
-func (store *store) save() error {
-	// Store the json
-	jsonData, err := json.Marshal(store)
-	if err != nil {
-		return err
+// uncacheReference removes refStr from the references cached for id.
+// store.mu must be held for writing.
+func (store *store) uncacheReference(id digest.Digest, refStr string) {
+	if store.referencesByIDCache[id] != nil {
+		delete(store.referencesByIDCache[id], refStr)
+		if len(store.referencesByIDCache[id]) == 0 {
+			delete(store.referencesByIDCache, id)
+		}
 	}
-	return ioutils.AtomicWriteFile(store.jsonPath, jsonData, 0600)
 }
 
-func (store *store) reload() error {
-	f, err := os.Open(store.jsonPath)
+// Delete deletes a reference from the store. It returns true if a deletion
+// happened, or false otherwise.
+func (store *store) Delete(ref reference.Named) (bool, error) {
+	refName, refStr, err := prepareDeleteReference(ref)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	store.mu.Lock()
+	refStr = store.lookupRefStr(refName, refStr)
+	id, exists := store.Repositories[refName][refStr]
+	if !exists {
+		store.mu.Unlock()
+		return false, ErrDoesNotExist
+	}
+	if err := store.checkBeforeDelete(refStr, id); err != nil {
+		store.mu.Unlock()
+		return false, err
+	}
+	store.removeReference(refName, refStr)
+	store.mu.Unlock()
+	if err := store.saveRepository(); err != nil {
+		return true, err
+	}
+	atomic.AddUint64(&store.counters.deletes, 1)
+	return true, nil
+}
+
+// Rename moves the reference oldRef to the tag newRef, pointing at the same
+// ID, under a single write lock, and saves the store once. It returns
+// ErrDoesNotExist if oldRef is not in the store. If force is set to true,
+// newRef is overwritten if it already points to another ID, like AddTag.
+// On failure, the store is left unchanged.
+func (store *store) Rename(oldRef, newRef reference.Named, force bool) error {
+	if _, isCanonical := newRef.(reference.Canonical); isCanonical {
+		return errors.WithStack(invalidTagError("refusing to create a tag with a digest reference"))
+	}
+	oldName, oldStr, err := prepareDeleteReference(oldRef)
+	if err != nil {
+		return err
+	}
+	newRef, newName, newStr, err := prepareAddReference(reference.TagNameOnly(newRef))
+	if err != nil {
+		return err
+	}
+
+	store.lock()
+	defer store.unlock()
+
+	oldStr = store.lookupRefStr(oldName, oldStr)
+	id, exists := store.Repositories[oldName][oldStr]
+	if !exists {
+		return ErrDoesNotExist
+	}
+	if oldStr == newStr {
+		return nil
+	}
+	if err := store.checkBeforeDelete(oldStr, id); err != nil {
+		return err
+	}
+
+	// Remove the old reference first, so that renaming a tag to a name only
+	// differing by case does not collide with itself.
+	mark := store.markPending()
+	undo := []txnUndo{store.undoRecord(oldName, oldStr)}
+	store.removeReference(oldName, oldStr)
+	u := store.undoRecord(newName, newStr)
+	changed, err := store.addReferenceLocked(newRef, newName, newStr, id, forceResolver(force))
+	if err != nil {
+		store.undo(undo, mark)
+		return err
+	}
+	if changed {
+		undo = append(undo, u)
+	}
+	if err := store.save(); err != nil {
+		store.undo(undo, mark)
+		return err
+	}
+	if changed {
+		atomic.AddUint64(&store.counters.adds, 1)
+	}
+	atomic.AddUint64(&store.counters.deletes, 1)
+	return nil
+}
+
+// checkBeforeDelete calls the BeforeDelete hook, if any, for the reference
+// with the key refStr pointing to id. store.mu must be held.
+func (store *store) checkBeforeDelete(refStr string, id digest.Digest) error {
+	if store.beforeDelete == nil {
+		return nil
+	}
+	ref := store.referencesByIDCache[id][refStr]
+	if ref == nil {
+		var err error
+		if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+			return err
+		}
+	}
+	return store.beforeDelete(ref, id)
+}
+
+// DeleteRepository deletes all references in the repository with the given
+// name under a single write lock, saving the store once. It returns the
+// deleted references, sorted lexically. If the repository does not exist, it
+// returns an empty slice and no error.
+func (store *store) DeleteRepository(name reference.Named) ([]reference.Named, error) {
+	refName := reference.FamiliarName(name)
+
+	deleted, err := store.deleteRepository(refName)
+	if err != nil || len(deleted) == 0 {
+		return deleted, err
+	}
+	if err := store.saveRepository(); err != nil {
+		return deleted, err
+	}
+	atomic.AddUint64(&store.counters.deletes, uint64(len(deleted)))
+	return deleted, nil
+}
+
+// deleteRepository deletes all references in the repository refName, and
+// returns them sorted lexically, without saving the store.
+func (store *store) deleteRepository(refName string) ([]reference.Named, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	repository := store.Repositories[refName]
+	deleted := make([]reference.Named, 0, len(repository))
+	for refStr := range repository {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		if err != nil {
+			// Should never happen
+			continue
+		}
+		deleted = append(deleted, ref)
+	}
+	if len(repository) == 0 {
+		return deleted, nil
+	}
+	sort.Sort(lexicalRefs(deleted))
+
+	for _, ref := range deleted {
+		refStr := reference.FamiliarString(ref)
+		if err := store.checkBeforeDelete(refStr, repository[refStr]); err != nil {
+			return nil, err
+		}
+	}
+	for refStr := range repository {
+		store.removeReference(refName, refStr)
+	}
+	return deleted, nil
+}
+
+// DeleteAllForID deletes every reference to id, in all repositories, under a
+// single write lock, saving the store once. Repositories left empty are
+// removed. It returns the deleted references, sorted lexically. If id has no
+// references, it returns an empty list and does not save the store.
+func (store *store) DeleteAllForID(id digest.Digest) ([]reference.Named, error) {
+	store.lock()
+	defer store.unlock()
+
+	refs := store.referencesByIDCache[id]
+	deleted := make([]reference.Named, 0, len(refs))
+	for refStr, ref := range refs {
+		if ref == nil {
+			var err error
+			if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+				// Should never happen
+				continue
+			}
+		}
+		deleted = append(deleted, ref)
+	}
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+	sort.Sort(lexicalRefs(deleted))
+
+	for _, ref := range deleted {
+		if err := store.checkBeforeDelete(reference.FamiliarString(ref), id); err != nil {
+			return nil, err
+		}
+	}
+	for _, ref := range deleted {
+		store.removeReference(reference.FamiliarName(ref), reference.FamiliarString(ref))
+	}
+
+	if err := store.save(); err != nil {
+		return deleted, err
+	}
+	atomic.AddUint64(&store.counters.deletes, uint64(len(deleted)))
+	return deleted, nil
+}
+
+// Prune deletes the references to the IDs for which exists returns false, in
+// all repositories, under a single write lock, saving the store once. exists
+// is called once per ID, with the lock held, so it must not call back into
+// the store. It returns the deleted associations, sorted lexically. If
+// nothing was deleted, it returns nil and does not save the store.
+func (store *store) Prune(exists func(digest.Digest) bool) ([]Association, error) {
+	store.lock()
+	defer store.unlock()
+
+	var pruned []Association
+	for id, refs := range store.referencesByIDCache {
+		if exists(id) {
+			continue
+		}
+		for refStr, ref := range refs {
+			if ref == nil {
+				var err error
+				if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+					// Should never happen
+					continue
+				}
+			}
+			pruned = append(pruned, Association{Ref: ref, ID: id})
+		}
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+	sort.Sort(lexicalAssociations(pruned))
+
+	for _, a := range pruned {
+		if err := store.checkBeforeDelete(reference.FamiliarString(a.Ref), a.ID); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range pruned {
+		store.removeReference(reference.FamiliarName(a.Ref), reference.FamiliarString(a.Ref))
+	}
+
+	if err := store.save(); err != nil {
+		return pruned, err
+	}
+	atomic.AddUint64(&store.counters.deletes, uint64(len(pruned)))
+	return pruned, nil
+}
+
+// PruneEmptyRepositories removes the repositories which have no references,
+// such as those left behind by manual edits of the store file, and saves the
+// store once. It returns the number of repositories removed.
+func (store *store) PruneEmptyRepositories() (int, error) {
+	store.lock()
+	defer store.unlock()
+
+	var pruned int
+	for refName, repository := range store.Repositories {
+		if len(repository) == 0 {
+			delete(store.Repositories, refName)
+			pruned++
+		}
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	return pruned, store.save()
+}
+
+// getKey returns the repository name and the key under which ref is looked
+// up.
+func getKey(ref reference.Named) (refName, refStr string, err error) {
+	if canonical, ok := ref.(reference.Canonical); ok {
+		// If reference contains both tag and digest, only
+		// lookup by digest as it takes precedence over
+		// tag, until tag/digest combos are stored.
+		if _, ok := ref.(reference.Tagged); ok {
+			ref, err = reference.WithDigest(reference.TrimNamed(canonical), canonical.Digest())
+			if err != nil {
+				return "", "", err
+			}
+		}
+	} else {
+		ref = reference.TagNameOnly(ref)
+	}
+	return reference.FamiliarName(ref), reference.FamiliarString(ref), nil
+}
+
+// Get retrieves an item from the store by reference
+func (store *store) Get(ref reference.Named) (digest.Digest, error) {
+	refName, refStr, err := getKey(ref)
+	if err != nil {
+		return "", err
+	}
+
+	id, exists := store.lookup(refName, refStr)
+	if !exists {
+		return "", ErrDoesNotExist
+	}
+	return id, nil
+}
+
+// Resolve looks up ref like Get, and also returns a digest reference in the
+// same repository pointing to the same ID, the lexically first if there are
+// several, or nil if there is none.
+func (store *store) Resolve(ref reference.Named) (digest.Digest, reference.Canonical, error) {
+	refName, refStr, err := getKey(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	id, exists := store.lookupLocked(refName, refStr)
+	if !exists {
+		return "", nil, ErrDoesNotExist
+	}
+
+	var found string
+	for key, keyID := range store.Repositories[refName] {
+		if keyID != id || !strings.HasPrefix(key, refName+"@") {
+			continue
+		}
+		if found == "" || key < found {
+			found = key
+		}
+	}
+	if found == "" {
+		return id, nil, nil
+	}
+	canonical, err := reference.ParseNormalizedNamed(found)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, canonical.(reference.Canonical), nil
+}
+
+// Has reports whether the store has ref. It normalizes ref and matches it
+// exactly like Get, but without allocating an error when it is missing.
+func (store *store) Has(ref reference.Named) bool {
+	refName, refStr, err := getKey(ref)
+	if err != nil {
+		return false
+	}
+	_, exists := store.lookup(refName, refStr)
+	return exists
+}
+
+// lookup returns the ID of the reference with the given repository name and
+// key, counting it as a get.
+func (store *store) lookup(refName, refStr string) (digest.Digest, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.lookupLocked(refName, refStr)
+}
+
+// lookupLocked is like lookup, with store.mu held.
+func (store *store) lookupLocked(refName, refStr string) (digest.Digest, bool) {
+	atomic.AddUint64(&store.counters.gets, 1)
+
+	id, exists := store.Repositories[refName][store.lookupRefStr(refName, refStr)]
+	if !exists {
+		atomic.AddUint64(&store.counters.getMisses, 1)
+	}
+	return id, exists
+}
+
+// DebugResolve returns the familiar repository name and the key which Get
+// looks up for ref, including the tag it matches regardless of case if
+// WithCaseInsensitiveTags is set. It is meant to explain why a lookup does or
+// does not match, and does not count as a get.
+func (store *store) DebugResolve(ref reference.Named) (familiarName, key string) {
+	refName, refStr, err := getKey(ref)
+	if err != nil {
+		return reference.FamiliarName(ref), reference.FamiliarString(ref)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return refName, store.lookupRefStr(refName, refStr)
+}
+
+// GetByString retrieves an item from the store by the key the store uses for
+// it: the familiar form of a reference with its tag, such as
+// "username/repo:latest", or with its digest, such as "busybox@sha256:...".
+// Default tags are not added, and tags are matched exactly. It returns an
+// invalid parameter error if refStr is not in that form, and ErrDoesNotExist
+// if it is not in the store.
+func (store *store) GetByString(refStr string) (digest.Digest, error) {
+	ref, err := reference.ParseNormalizedNamed(refStr)
+	if err != nil {
+		return "", errors.WithStack(invalidTagError(fmt.Sprintf("invalid reference %q: %v", refStr, err)))
+	}
+	_, isTagged := ref.(reference.Tagged)
+	_, isCanonical := ref.(reference.Canonical)
+	if isTagged == isCanonical || reference.FamiliarString(ref) != refStr {
+		expected := reference.FamiliarString(reference.TagNameOnly(ref))
+		if isCanonical {
+			canonical := ref.(reference.Canonical)
+			if ref, err := reference.WithDigest(reference.TrimNamed(canonical), canonical.Digest()); err == nil {
+				expected = reference.FamiliarString(ref)
+			}
+		}
+		return "", errors.WithStack(invalidTagError(fmt.Sprintf("reference %q is not in the form used by the store, expected %q", refStr, expected)))
+	}
+	refName := reference.FamiliarName(ref)
+
+	atomic.AddUint64(&store.counters.gets, 1)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	id, exists := store.Repositories[refName][refStr]
+	if !exists {
+		atomic.AddUint64(&store.counters.getMisses, 1)
+		return "", ErrDoesNotExist
+	}
+	return id, nil
+}
+
+// DistinctImageCount returns the number of distinct IDs which have at least
+// one reference, without allocating.
+func (store *store) DistinctImageCount() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.referencesByIDCache)
+}
+
+// IsReferenced reports whether the given ID has at least one reference,
+// without allocating.
+func (store *store) IsReferenced(id digest.Digest) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.referencesByIDCache[id]) > 0
+}
+
+// References returns a slice of references to the given ID, sorted
+// lexically. The slice will be nil if there are no references to this ID.
+func (store *store) References(id digest.Digest) []reference.Named {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	// Convert the internal map to an array for two reasons:
+	// 1) We must not return a mutable
+	// 2) It would be ugly to expose the extraneous map keys to callers.
+
+	var references []reference.Named
+	for refStr, ref := range store.referencesByIDCache[id] {
+		if ref == nil {
+			// Loaded from the persisted reverse index, and not parsed yet.
+			var err error
+			if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+				continue
+			}
+		}
+		references = append(references, ref)
+	}
+
+	sort.Sort(lexicalRefs(references))
+
+	return references
+}
+
+// ReferencesGrouped returns the references to the given ID grouped by
+// familiar repository name, such as "busybox" or "example.com/foo". The
+// references within each group are sorted lexically. The map will be empty
+// if there are no references to this ID.
+func (store *store) ReferencesGrouped(id digest.Digest) map[string][]reference.Named {
+	grouped := make(map[string][]reference.Named)
+	for _, ref := range store.References(id) {
+		name := reference.FamiliarName(ref)
+		grouped[name] = append(grouped[name], ref)
+	}
+	return grouped
+}
+
+// PrimaryReference returns the reference to display as the name of the given
+// ID: tags are preferred over digests, then shorter references over longer
+// ones, and references of the same length are ordered lexically. It returns
+// false if there are no references to the ID.
+func (store *store) PrimaryReference(id digest.Digest) (reference.Named, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var (
+		primary    reference.Named
+		primaryStr string
+	)
+	for refStr, ref := range store.referencesByIDCache[id] {
+		if primary != nil && !betterName(refStr, primaryStr) {
+			continue
+		}
+		if ref == nil {
+			var err error
+			if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+				continue
+			}
+		}
+		primary, primaryStr = ref, refStr
+	}
+	return primary, primary != nil
+}
+
+// betterName reports whether the reference key a names an image better than
+// b does.
+func betterName(a, b string) bool {
+	aDigest, bDigest := strings.Contains(a, "@"), strings.Contains(b, "@")
+	if aDigest != bDigest {
+		return bDigest
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// ReferencesByName returns the references for a given repository name,
+// sorted lexically. If there are no references known for this repository
+// name, ReferencesByName returns nil.
+func (store *store) ReferencesByName(ref reference.Named) []Association {
+	refName := reference.FamiliarName(ref)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	repository, exists := store.Repositories[refName]
+	if !exists {
+		return nil
+	}
+
+	var associations []Association
+	for refStr, refID := range repository {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		if err != nil {
+			// Should never happen
+			return nil
+		}
+		associations = append(associations,
+			Association{
+				Ref: ref,
+				ID:  refID,
+			})
+	}
+
+	sort.Sort(lexicalAssociations(associations))
+
+	return associations
+}
+
+// RefKind selects the kind of references returned by FilterByName.
+type RefKind int
+
+const (
+	// All selects both tag and digest references.
+	All RefKind = iota
+	// Tags selects tag references.
+	Tags
+	// Digests selects digest references.
+	Digests
+)
+
+// FilterByName returns the associations for the given repository name, like
+// ReferencesByName, keeping only the references of the given kind.
+func (store *store) FilterByName(ref reference.Named, kind RefKind) []Association {
+	associations := store.ReferencesByName(ref)
+	if kind == All {
+		return associations
+	}
+
+	filtered := associations[:0]
+	for _, a := range associations {
+		if _, isCanonical := a.Ref.(reference.Canonical); isCanonical == (kind == Digests) {
+			filtered = append(filtered, a)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return filtered
+}
+
+// DanglingByRepository returns the references whose target ID no longer
+// exists according to exists, indexed by the familiar name of their
+// repository, and sorted lexically. The store is not modified. exists is
+// called once per ID, with the read lock held, so it must not call back into
+// the store.
+func (store *store) DanglingByRepository(exists func(digest.Digest) bool) map[string][]reference.Named {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	dangling := make(map[string][]reference.Named)
+	for id, refs := range store.referencesByIDCache {
+		if exists(id) {
+			continue
+		}
+		for refStr, ref := range refs {
+			if ref == nil {
+				var err error
+				if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+					continue
+				}
+			}
+			name := reference.FamiliarName(ref)
+			dangling[name] = append(dangling[name], ref)
+		}
+	}
+	for _, refs := range dangling {
+		sort.Sort(lexicalRefs(refs))
+	}
+	return dangling
+}
+
+// registryTagsList is the response of the registry v2 tags list endpoint,
+// GET /v2/<name>/tags/list.
+type registryTagsList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ExportRegistryFormat returns the tags of the given repository, sorted
+// lexically, in the JSON format of the registry v2 tags list. Digest
+// references are not included. It returns ErrDoesNotExist if there are no
+// references to the repository.
+func (store *store) ExportRegistryFormat(repo reference.Named) ([]byte, error) {
+	refName := reference.FamiliarName(repo)
+
+	store.mu.RLock()
+	repository, exists := store.Repositories[refName]
+	if !exists {
+		store.mu.RUnlock()
+		return nil, ErrDoesNotExist
+	}
+	tags := []string{}
+	for refStr := range repository {
+		if tag, ok := refTag(refName, refStr); ok {
+			tags = append(tags, tag)
+		}
+	}
+	store.mu.RUnlock()
+
+	sort.Strings(tags)
+	return json.Marshal(registryTagsList{Name: reference.Path(repo), Tags: tags})
+}
+
+// ReferencesByRegistry returns the references for all repositories on the
+// given registry host, such as "registry.example.com:5000" or "docker.io",
+// sorted lexically. If there are no references known for this host,
+// ReferencesByRegistry returns nil.
+func (store *store) ReferencesByRegistry(host string) []Association {
+	if host == "index.docker.io" {
+		// The legacy name of the default registry.
+		host = "docker.io"
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var associations []Association
+	for refName, repository := range store.Repositories {
+		name, err := reference.ParseNormalizedNamed(refName)
+		if err != nil {
+			// Should never happen
+			continue
+		}
+		if reference.Domain(name) != host {
+			continue
+		}
+		for refStr, refID := range repository {
+			ref, err := reference.ParseNormalizedNamed(refStr)
+			if err != nil {
+				// Should never happen
+				continue
+			}
+			associations = append(associations, Association{Ref: ref, ID: refID})
+		}
+	}
+
+	sort.Sort(lexicalAssociations(associations))
+
+	return associations
+}
+
+// ReferencesByTag returns the tag references with the given tag, such as
+// "latest", in all repositories, sorted lexically. If the store was created
+// with WithTagIndex, the index is used rather than scanning every
+// repository. If there are no references with this tag, ReferencesByTag
+// returns nil.
+func (store *store) ReferencesByTag(tag string) []Association {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var refs map[string]digest.Digest
+	if store.tagIndex != nil {
+		refs = store.tagIndex[tag]
+	} else {
+		refs = make(map[string]digest.Digest)
+		for refName, repository := range store.Repositories {
+			for refStr, refID := range repository {
+				if t, ok := refTag(refName, refStr); ok && t == tag {
+					refs[refStr] = refID
+				}
+			}
+		}
+	}
+
+	var associations []Association
+	for refStr, refID := range refs {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		if err != nil {
+			// Should never happen
+			continue
+		}
+		associations = append(associations, Association{Ref: ref, ID: refID})
+	}
+
+	sort.Sort(lexicalAssociations(associations))
+
+	return associations
+}
+
+// AllReferences returns the associations for every reference in the store,
+// in all repositories, sorted lexically. The returned slice is a copy, which
+// the caller may modify. If the store is empty, AllReferences returns nil.
+func (store *store) AllReferences() []Association {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var associations []Association
+	for _, repository := range store.Repositories {
+		for refStr, refID := range repository {
+			ref, err := reference.ParseNormalizedNamed(refStr)
+			if err != nil {
+				// Should never happen
+				continue
+			}
+			associations = append(associations, Association{Ref: ref, ID: refID})
+		}
+	}
+
+	sort.Sort(lexicalAssociations(associations))
+
+	return associations
+}
+
+// ErrStopWalk can be returned by the function passed to Walk to stop
+// visiting references. Walk then returns nil.
+var ErrStopWalk = errors.New("stop walking references")
+
+// Walk calls fn for each reference in the store, in no particular order,
+// without building a list of them. If fn returns an error, Walk stops and
+// returns it, unless it is ErrStopWalk. fn is called with the read lock held,
+// so it must not modify the store.
+func (store *store) Walk(fn func(Association) error) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, repository := range store.Repositories {
+		for refStr, refID := range repository {
+			ref := store.referencesByIDCache[refID][refStr]
+			if ref == nil {
+				var err error
+				if ref, err = reference.ParseNormalizedNamed(refStr); err != nil {
+					// Should never happen
+					continue
+				}
+			}
+			if err := fn(Association{Ref: ref, ID: refID}); err != nil {
+				if err == ErrStopWalk {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnsavedReferences returns the references that were added to the store but
+// not persisted yet, because saving the store failed, sorted lexically.
+func (store *store) UnsavedReferences() []reference.Named {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var references []reference.Named
+	for _, ref := range store.unsaved {
+		references = append(references, ref)
+	}
+
+	sort.Sort(lexicalRefs(references))
+
+	return references
+}
+
+// lock locks the store for a change which is saved before it is unlocked.
+// store.saveMu is taken first, so that the save does not interleave with
+// that of a change to a single repository.
+func (store *store) lock() {
+	store.saveMu.Lock()
+	store.mu.Lock()
+}
+
+// unlock unlocks the store locked by lock.
+func (store *store) unlock() {
+	store.mu.Unlock()
+	store.saveMu.Unlock()
+}
+
+// save persists the store, or schedules it to be persisted if the store was
+// created with WithDeferredSave. store.saveMu and store.mu must be held, the
+// latter for writing.
+func (store *store) save() error {
+	if store.saveInterval > 0 {
+		store.scheduleSave()
+		return nil
+	}
+	return store.write()
+}
+
+// saveRepository saves the store after a change to a single repository,
+// made with store.mu released. Unlike save, it only holds store.mu to copy
+// the data to write, not while it is written, so that a slow disk or
+// backend does not block readers, nor the changes to other repositories.
+// Stores with a write-ahead log, or whose saves are deferred, are saved like
+// with save.
+func (store *store) saveRepository() error {
+	store.saveMu.Lock()
+	defer store.saveMu.Unlock()
+
+	store.mu.Lock()
+	if store.wal != nil || store.saveInterval > 0 {
+		defer store.mu.Unlock()
+		return store.save()
+	}
+	w, err := store.prepareWrite()
+	store.mu.Unlock()
+	if err == nil {
+		err = store.persist(w)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.finishWrite(w, err)
+}
+
+// write persists the store now. store.saveMu and store.mu must be held, the
+// latter for writing.
+func (store *store) write() error {
+	var (
+		logged  bool
+		walSize int64
+	)
+	if store.backend == nil && store.jsonPath != "" && store.wal != nil && len(store.wal.pending) > 0 {
+		size, err := store.wal.appendPending()
+		if err != nil {
+			return errors.Wrap(err, "failed to write the reference store write-ahead log")
+		}
+		logged, walSize = true, size
+	}
+	w, err := store.prepareWrite()
+	if err == nil {
+		err = store.persist(w)
+	}
+	if err != nil && logged {
+		store.wal.rollback(walSize)
+		store.Sequence = store.wal.seq
+	}
+	if err == nil && store.wal != nil {
+		store.wal.committed()
+	}
+	return store.finishWrite(w, err)
+}
+
+// pendingWrite is the data of a save of the store, which is persisted
+// without holding store.mu.
+type pendingWrite struct {
+	// data is the content of the file of the store, and changes those to
+	// pass to its backend, if it has one.
+	data    []byte
+	changes []Change
+	// events is the number of pending events, and unsaved the unsaved
+	// references, which the save covers.
+	events  int
+	unsaved map[string]reference.Named
+}
+
+// prepareWrite copies the data to persist. The changes to pass to the
+// backend are taken from the store, and given back by finishWrite if they
+// could not be persisted. store.mu must be held for writing.
+func (store *store) prepareWrite() (*pendingWrite, error) {
+	w := &pendingWrite{
+		events:  len(store.pendingEvents),
+		unsaved: make(map[string]reference.Named, len(store.unsaved)),
+	}
+	for key, ref := range store.unsaved {
+		w.unsaved[key] = ref
+	}
+	if store.backend != nil {
+		w.changes, store.changes = store.changes, nil
+		return w, nil
+	}
+	if store.jsonPath == "" {
+		return w, nil
+	}
+	if store.persistReverseIndex {
+		store.ReverseIndex = store.reverseIndex()
+	}
+	if store.wal != nil {
+		store.Sequence = store.wal.seq
+	}
+	// Store the json
+	jsonData, err := json.Marshal(store)
+	if err == nil && len(store.unknownFields) > 0 {
+		jsonData, err = withUnknownFields(jsonData, store.unknownFields)
+	}
+	w.data = jsonData
+	return w, err
+}
+
+// persist writes w to the file or the backend of the store. store.saveMu
+// must be held.
+func (store *store) persist(w *pendingWrite) error {
+	if store.backend != nil {
+		return store.backend.Persist(w.changes)
+	}
+	if store.jsonPath == "" {
+		return nil
+	}
+	data := w.data
+	if store.compress {
+		var err error
+		if data, err = compress(data); err != nil {
+			return err
+		}
+	}
+	return store.writeFile(data)
+}
+
+// finishWrite records the outcome err of persisting w: the references it
+// covers are no longer unsaved and their events are published, or the
+// changes it took are given back to the store. It returns err. store.mu
+// must be held for writing.
+func (store *store) finishWrite(w *pendingWrite, err error) error {
+	if err != nil {
+		if len(w.changes) > 0 {
+			store.changes = append(w.changes, store.changes...)
+		}
+		return err
+	}
+	for key, ref := range w.unsaved {
+		if current, ok := store.unsaved[key]; ok && current.String() == ref.String() {
+			delete(store.unsaved, key)
+		}
+	}
+	store.publishEvents(w.events)
+	return nil
+}
+
+// reloadFile loads the file of the store, if it has one, and replays its
+// write-ahead log.
+func (store *store) reloadFile() error {
+	if store.jsonPath == "" {
+		return nil
+	}
+	f, err := os.Open(store.jsonPath)
+	if err != nil {
+		return err
 	}
 	defer f.Close()
-	if err := json.NewDecoder(f).Decode(&store); err != nil {
+	r, err := decompressReader(f)
+	if err != nil {
+		return corruptFileError{err}
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return corruptFileError{err}
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return corruptFileError{err}
+	}
+	if store.unknownFields, err = unknownFields(data); err != nil {
+		return corruptFileError{err}
+	}
+	if store.wal != nil {
+		if err := store.wal.replay(store); err != nil {
+			return errors.Wrap(err, "failed to replay the reference store write-ahead log")
+		}
+	}
+	return nil
+}
+
+// storeFileFields are the names of the top-level fields of the file of the
+// store which are decoded into the store.
+var storeFileFields = []string{"Repositories", "ReverseIndex", "Sequence"}
+
+// unknownFields returns the top-level fields of data, the content of the file
+// of the store, which are not in storeFileFields.
+func unknownFields(data []byte) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key := range fields {
+		for _, known := range storeFileFields {
+			// encoding/json matches field names regardless of case.
+			if strings.EqualFold(key, known) {
+				delete(fields, key)
+				break
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// withUnknownFields returns jsonData, the encoded store, with the unknown
+// fields added.
+func withUnknownFields(jsonData []byte, unknown map[string]json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jsonData, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range unknown {
+		fields[key] = value
+	}
+	return json.Marshal(fields)
+}
+
+func (store *store) reload() error {
+	if store.backend != nil {
+		if err := store.loadBackend(); err != nil {
+			return err
+		}
+	} else if err := store.reloadFile(); err != nil {
 		return err
 	}
 
+	store.loadWarnings = nil
+	for refName, repository := range store.Repositories {
+		var ignored bool
+		for refStr, refID := range repository {
+			if err := refID.Validate(); err != nil {
+				warning := fmt.Sprintf("ignoring reference %s: invalid image ID %q: %v", refStr, refID, err)
+				logrus.Warn(warning)
+				store.loadWarnings = append(store.loadWarnings, warning)
+				delete(repository, refStr)
+				ignored = true
+			}
+		}
+		// Repositories which were already empty are left for
+		// PruneEmptyRepositories.
+		if ignored && len(repository) == 0 {
+			delete(store.Repositories, refName)
+		}
+	}
+	if store.strictLoad {
+		if err := store.checkNormalized(); err != nil {
+			return err
+		}
+	}
+	if store.caseInsensitiveTags {
+		store.loadWarnings = append(store.loadWarnings, store.caseCollisions()...)
+	}
+	sort.Strings(store.loadWarnings)
+	store.rebuildTagIndex()
+
+	reverseIndex := store.ReverseIndex
+	store.ReverseIndex = nil
+	if store.persistReverseIndex && store.loadReverseIndex(reverseIndex) {
+		return nil
+	}
+
 	for _, repository := range store.Repositories {
 		for refStr, refID := range repository {
 			ref, err := reference.ParseNormalizedNamed(refStr)
@@ -346,3 +1955,113 @@ func (store *store) reload() error {
 
 	return nil
 }
+
+// checkNormalized returns an error listing the references whose key does not
+// parse, or is not in the normalized form the store uses, such as keys whose
+// format changed between versions.
+func (store *store) checkNormalized() error {
+	var invalid []string
+	for refName, repository := range store.Repositories {
+		for refStr := range repository {
+			ref, err := reference.ParseNormalizedNamed(refStr)
+			if err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s: %v", refStr, err))
+				continue
+			}
+			if normalized := reference.FamiliarString(ref); normalized != refStr {
+				invalid = append(invalid, fmt.Sprintf("%s: normalizes to %s", refStr, normalized))
+			} else if name := reference.FamiliarName(ref); name != refName {
+				invalid = append(invalid, fmt.Sprintf("%s: stored in repository %s instead of %s", refStr, refName, name))
+			}
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	sort.Strings(invalid)
+	return errors.Errorf("invalid references in the reference store: %s", strings.Join(invalid, "; "))
+}
+
+// caseCollisions returns a warning for each tag which only differs by case
+// from another tag in the same repository, such as tags added before the
+// store had case-insensitive tags.
+func (store *store) caseCollisions() []string {
+	var warnings []string
+	for refName, repository := range store.Repositories {
+		folded := make(map[string][]string)
+		for refStr := range repository {
+			if tag, ok := refTag(refName, refStr); ok {
+				folded[strings.ToLower(tag)] = append(folded[strings.ToLower(tag)], refStr)
+			}
+		}
+		for _, refStrs := range folded {
+			if len(refStrs) < 2 {
+				continue
+			}
+			sort.Strings(refStrs)
+			warning := fmt.Sprintf("tags %s only differ by case", strings.Join(refStrs, ", "))
+			logrus.Warn(warning)
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// LoadWarnings returns the problems found when the store was loaded, sorted
+// lexically.
+func (store *store) LoadWarnings() []string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return append([]string(nil), store.loadWarnings...)
+}
+
+// reverseIndex returns referencesByIDCache in its persisted form.
+func (store *store) reverseIndex() map[digest.Digest][]string {
+	index := make(map[digest.Digest][]string, len(store.referencesByIDCache))
+	for id, refs := range store.referencesByIDCache {
+		refStrs := make([]string, 0, len(refs))
+		for refStr := range refs {
+			refStrs = append(refStrs, refStr)
+		}
+		sort.Strings(refStrs)
+		index[id] = refStrs
+	}
+	return index
+}
+
+// loadReverseIndex populates referencesByIDCache from a persisted reverse
+// index, leaving the references to be parsed when they are first needed.
+// It returns false, without modifying the cache, if the index does not match
+// the repositories exactly.
+func (store *store) loadReverseIndex(index map[digest.Digest][]string) bool {
+	if index == nil {
+		return false
+	}
+	ids := make(map[string]digest.Digest)
+	for _, repository := range store.Repositories {
+		for refStr, id := range repository {
+			ids[refStr] = id
+		}
+	}
+	for id, refStrs := range index {
+		for _, refStr := range refStrs {
+			if refID, ok := ids[refStr]; !ok || refID != id {
+				return false
+			}
+			delete(ids, refStr)
+		}
+	}
+	if len(ids) != 0 {
+		return false
+	}
+
+	for id, refStrs := range index {
+		refs := make(map[string]reference.Named, len(refStrs))
+		for _, refStr := range refStrs {
+			refs[refStr] = nil
+		}
+		store.referencesByIDCache[id] = refs
+	}
+	return true
+}
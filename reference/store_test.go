@@ -2,16 +2,23 @@ package reference // import "github.com/docker/docker/reference"
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/errdefs"
 	"github.com/opencontainers/go-digest"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	"gotest.tools/poll"
 )
 
 var (
@@ -28,6 +35,25 @@ var (
 	marshalledSaveLoadTestCases = []byte(`{"Repositories":{"busybox":{"busybox:latest":"sha256:91e54dfb11794fad694460162bf0cb0a4fa710cfa3f60979c177d920813e267c"},"jess/hollywood":{"jess/hollywood:latest":"sha256:ae7a5519a0a55a2d4ef20ddcbd5d0ca0888a1f7ab806acc8e2a27baf46f529fe"},"registry":{"registry@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6":"sha256:24126a56805beb9711be5f4590cc2eb55ab8d4a85ebd618eed72bb19fc50631c"},"registry:5000/foobar":{"registry:5000/foobar:HEAD":"sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6","registry:5000/foobar:alternate":"sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793","registry:5000/foobar:latest":"sha256:6153498b9ac00968d71b66cca4eac37e990b5f9eb50c26877eb8799c8847451b","registry:5000/foobar:master":"sha256:6c9917af4c4e05001b346421959d7ea81b6dc9d25718466a37a6add865dfd7fc"}}}`)
 )
 
+// fullStore is the set of interfaces implemented by the stores created by
+// this package.
+type fullStore interface {
+	Store
+	QueryStore
+	EditStore
+	StatusStore
+	PersistentStore
+}
+
+// full returns the store returned by one of the constructors of this package
+// as a fullStore, so that tests can use its optional interfaces.
+func full(s Store, err error) (fullStore, error) {
+	if err != nil {
+		return nil, err
+	}
+	return s.(fullStore), nil
+}
+
 func TestLoad(t *testing.T) {
 	jsonFile, err := ioutil.TempFile("", "tag-store-test")
 	if err != nil {
@@ -356,3 +382,1553 @@ func TestInvalidTags(t *testing.T) {
 	err = store.AddTag(ref, id, true)
 	assert.Check(t, is.ErrorContains(err, ""))
 }
+
+func TestReferencesOrdering(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewReferenceStore(filepath.Join(tmpDir, "repositories.json"))
+	assert.NilError(t, err)
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+
+	// Added in an order different from the expected one.
+	for _, refStr := range []string{
+		"registry:5000/busybox:latest",
+		"busybox@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6",
+		"localhost/busybox:latest",
+		"busybox:latest",
+		"busybox:1.0",
+		"example.com/busybox:latest",
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	var refs []string
+	for _, ref := range store.References(id) {
+		refs = append(refs, ref.String())
+	}
+	assert.Check(t, is.DeepEqual(refs, []string{
+		"docker.io/library/busybox:1.0",
+		"docker.io/library/busybox:latest",
+		"docker.io/library/busybox@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6",
+		"example.com/busybox:latest",
+		"localhost/busybox:latest",
+		"registry:5000/busybox:latest",
+	}))
+
+	repoName, err := reference.ParseNormalizedNamed("busybox")
+	assert.NilError(t, err)
+	refs = nil
+	for _, a := range store.ReferencesByName(repoName) {
+		refs = append(refs, a.Ref.String())
+	}
+	assert.Check(t, is.DeepEqual(refs, []string{
+		"docker.io/library/busybox:1.0",
+		"docker.io/library/busybox:latest",
+		"docker.io/library/busybox@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6",
+	}))
+}
+
+func TestUnsavedReferences(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.UnsavedReferences(), 0))
+
+	// Make saving fail by putting a non-empty directory in place of the file.
+	assert.NilError(t, os.Remove(jsonPath))
+	assert.NilError(t, os.MkdirAll(filepath.Join(jsonPath, "blocker"), 0700))
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref1, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	ref2, err := reference.ParseNormalizedNamed("username/repo:two")
+	assert.NilError(t, err)
+
+	assert.Check(t, store.AddTag(ref2, id, false) != nil)
+	assert.Check(t, store.AddTag(ref1, id, false) != nil)
+
+	unsaved := store.UnsavedReferences()
+	assert.Assert(t, is.Len(unsaved, 2))
+	assert.Check(t, is.Equal(unsaved[0].String(), ref1.String()))
+	assert.Check(t, is.Equal(unsaved[1].String(), ref2.String()))
+
+	// Deleting an unsaved reference removes it from the unsaved set.
+	_, err = store.Delete(ref2)
+	assert.Check(t, err != nil)
+	assert.Check(t, is.Len(store.UnsavedReferences(), 1))
+
+	// A successful save clears the unsaved set.
+	assert.NilError(t, os.RemoveAll(jsonPath))
+	assert.NilError(t, store.AddTag(ref2, id, false))
+	assert.Check(t, is.Len(store.UnsavedReferences(), 0))
+}
+
+func TestPersistedReverseIndex(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := NewReferenceStore(jsonPath, WithPersistedReverseIndex(true))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref1, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	ref2, err := reference.ParseNormalizedNamed("username/repo:two")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref1, id, false))
+	assert.NilError(t, store.AddTag(ref2, id, false))
+
+	var saved struct {
+		Repositories map[string]map[string]digest.Digest
+		ReverseIndex map[digest.Digest][]string
+	}
+	readJSON := func() {
+		data, err := ioutil.ReadFile(jsonPath)
+		assert.NilError(t, err)
+		assert.NilError(t, json.Unmarshal(data, &saved))
+	}
+	readJSON()
+	assert.Check(t, is.DeepEqual(saved.ReverseIndex, map[digest.Digest][]string{
+		id: {"username/repo:one", "username/repo:two"},
+	}))
+
+	checkRefs := func(s Store) {
+		refs := s.References(id)
+		assert.Assert(t, is.Len(refs, 2))
+		assert.Check(t, is.Equal(refs[0].String(), ref1.String()))
+		assert.Check(t, is.Equal(refs[1].String(), ref2.String()))
+	}
+	reloaded, err := NewReferenceStore(jsonPath, WithPersistedReverseIndex(true))
+	assert.NilError(t, err)
+	checkRefs(reloaded)
+
+	// A stale index is ignored, and the cache rebuilt from the repositories.
+	saved.ReverseIndex = map[digest.Digest][]string{id: {"username/repo:one"}}
+	data, err := json.Marshal(saved)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(jsonPath, data, 0600))
+	reloaded, err = full(NewReferenceStore(jsonPath, WithPersistedReverseIndex(true)))
+	assert.NilError(t, err)
+	checkRefs(reloaded)
+
+	// Without the option, the index is neither used nor written.
+	reloaded, err = full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	checkRefs(reloaded)
+	_, err = reloaded.Delete(ref2)
+	assert.NilError(t, err)
+	saved.ReverseIndex = nil
+	readJSON()
+	assert.Check(t, is.Nil(saved.ReverseIndex))
+}
+
+func TestLoadWarnings(t *testing.T) {
+	jsonFile, err := ioutil.TempFile("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(jsonFile.Name())
+
+	_, err = jsonFile.Write([]byte(`{"Repositories":{"username/repo":{
+		"username/repo:good":"sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6",
+		"username/repo:bad":"username/repo:latest"
+	},"username/broken":{"username/broken:latest":"sha256:1234"}}}`))
+	assert.NilError(t, err)
+	jsonFile.Close()
+
+	store, err := full(NewReferenceStore(jsonFile.Name()))
+	assert.NilError(t, err)
+
+	warnings := store.LoadWarnings()
+	assert.Assert(t, is.Len(warnings, 2))
+	assert.Check(t, is.Contains(warnings[0], "username/broken:latest"))
+	assert.Check(t, is.Contains(warnings[1], `invalid image ID "username/repo:latest"`))
+
+	// The references with a malformed ID are not loaded.
+	for _, refStr := range []string{"username/repo:bad", "username/broken:latest"} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		_, err = store.Get(ref)
+		assert.Check(t, is.Equal(err, ErrDoesNotExist), refStr)
+	}
+	ref, err := reference.ParseNormalizedNamed("username/repo:good")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.References(digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")), 1))
+	_, err = store.Get(ref)
+	assert.NilError(t, err)
+	broken, err := reference.ParseNormalizedNamed("username/broken")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.ReferencesByName(broken), 0))
+}
+
+func TestReferencesByRegistry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{
+		"registry.example.com/foo:latest",
+		"registry.example.com/bar/baz:1.0",
+		"registry.example.com:5000/foo:latest",
+		"busybox:latest",
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+	}
+
+	refStrs := func(associations []Association) []string {
+		var s []string
+		for _, a := range associations {
+			s = append(s, a.Ref.String())
+		}
+		return s
+	}
+	assert.Check(t, is.DeepEqual(refStrs(store.ReferencesByRegistry("registry.example.com")), []string{
+		"registry.example.com/bar/baz:1.0",
+		"registry.example.com/foo:latest",
+	}))
+	assert.Check(t, is.DeepEqual(refStrs(store.ReferencesByRegistry("registry.example.com:5000")), []string{
+		"registry.example.com:5000/foo:latest",
+	}))
+	assert.Check(t, is.DeepEqual(refStrs(store.ReferencesByRegistry("docker.io")), []string{
+		"docker.io/library/busybox:latest",
+	}))
+	assert.Check(t, is.DeepEqual(refStrs(store.ReferencesByRegistry("index.docker.io")), []string{
+		"docker.io/library/busybox:latest",
+	}))
+	assert.Check(t, is.Len(store.ReferencesByRegistry("example.com"), 0))
+}
+
+func TestRejectShadowingTags(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	digestRef, err := reference.ParseNormalizedNamed("username/repo@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	assert.NilError(t, err)
+
+	for _, strict := range []bool{false, true} {
+		store, err := NewReferenceStore(filepath.Join(tmpDir, fmt.Sprintf("repositories-%t.json", strict)), WithRejectShadowingTags(strict))
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddDigest(digestRef.(reference.Canonical), id, false))
+
+		for _, tc := range []struct {
+			ref       string
+			shadowing bool
+		}{
+			{ref: "username/repo:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793", shadowing: true},
+			{ref: "username/repo:ae300ebc4a4f", shadowing: true},
+			{ref: "username/repo:ae300ebc4a4"},
+			{ref: "username/repo:470022b8af68"},
+			{ref: "username/other:ae300ebc4a4f"},
+		} {
+			ref, err := reference.ParseNormalizedNamed(tc.ref)
+			assert.NilError(t, err)
+			err = store.AddTag(ref, id, false)
+			if strict && tc.shadowing {
+				assert.Check(t, errdefs.IsConflict(err), tc.ref)
+				assert.Check(t, is.ErrorContains(err, "shadows the digest reference"), tc.ref)
+				continue
+			}
+			assert.NilError(t, err, tc.ref)
+		}
+	}
+}
+
+func TestDeleteRepository(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{
+		"username/repo:latest",
+		"username/repo:1.0",
+		"username/repo@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+		"username/other:latest",
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	name, err := reference.ParseNormalizedNamed("username/repo")
+	assert.NilError(t, err)
+	deleted, err := store.DeleteRepository(name)
+	assert.NilError(t, err)
+	var deletedStrs []string
+	for _, ref := range deleted {
+		deletedStrs = append(deletedStrs, ref.String())
+	}
+	assert.Check(t, is.DeepEqual(deletedStrs, []string{
+		"docker.io/username/repo:1.0",
+		"docker.io/username/repo:latest",
+		"docker.io/username/repo@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+	}))
+	assert.Check(t, is.Len(store.ReferencesByName(name), 0))
+	refs := store.References(id)
+	assert.Assert(t, is.Len(refs, 1))
+	assert.Check(t, is.Equal(refs[0].String(), "docker.io/username/other:latest"))
+
+	reloaded, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(reloaded.ReferencesByName(name), 0))
+
+	deleted, err = store.DeleteRepository(name)
+	assert.NilError(t, err)
+	assert.Check(t, deleted != nil)
+	assert.Check(t, is.Len(deleted, 0))
+}
+
+func TestPrimaryReference(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	_, ok := store.PrimaryReference(id)
+	assert.Check(t, !ok)
+
+	for _, tc := range []struct {
+		add      string
+		expected string
+	}{
+		{add: "username/repo@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793", expected: "docker.io/username/repo@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793"},
+		{add: "a@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793", expected: "docker.io/library/a@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793"},
+		{add: "username/repo:a-long-tag", expected: "docker.io/username/repo:a-long-tag"},
+		{add: "username/repo:latest", expected: "docker.io/username/repo:latest"},
+		{add: "username/repo:stable", expected: "docker.io/username/repo:latest"},
+		{add: "busybox:1.0", expected: "docker.io/library/busybox:1.0"},
+	} {
+		ref, err := reference.ParseNormalizedNamed(tc.add)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+		primary, ok := store.PrimaryReference(id)
+		assert.Assert(t, ok)
+		assert.Check(t, is.Equal(primary.String(), tc.expected), tc.add)
+	}
+}
+
+func TestExportRegistryFormat(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{
+		"registry:5000/foo/bar:latest",
+		"registry:5000/foo/bar:1.0",
+		"registry:5000/foo/bar@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+		"registry:5000/foo/other:latest",
+		"busybox@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	for _, tc := range []struct {
+		repo     string
+		expected string
+	}{
+		{repo: "registry:5000/foo/bar", expected: `{"name":"foo/bar","tags":["1.0","latest"]}`},
+		{repo: "registry:5000/foo/bar:ignored", expected: `{"name":"foo/bar","tags":["1.0","latest"]}`},
+		{repo: "busybox", expected: `{"name":"library/busybox","tags":[]}`},
+	} {
+		repo, err := reference.ParseNormalizedNamed(tc.repo)
+		assert.NilError(t, err)
+		data, err := store.ExportRegistryFormat(repo)
+		assert.NilError(t, err, tc.repo)
+		assert.Check(t, is.Equal(string(data), tc.expected), tc.repo)
+	}
+
+	repo, err := reference.ParseNormalizedNamed("registry:5000/missing")
+	assert.NilError(t, err)
+	_, err = store.ExportRegistryFormat(repo)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+}
+
+func TestAddTagWithResolver(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+
+	keepExisting := func(existing, incoming digest.Digest) (digest.Digest, error) {
+		return existing, nil
+	}
+
+	// The resolver is not called when there is no conflict.
+	assert.NilError(t, store.AddTagWithResolver(ref, id1, func(existing, incoming digest.Digest) (digest.Digest, error) {
+		t.Fatal("unexpected call to the resolver")
+		return "", nil
+	}))
+
+	assert.NilError(t, store.AddTagWithResolver(ref, id2, keepExisting))
+	got, err := store.Get(ref)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id1))
+
+	assert.NilError(t, store.AddTagWithResolver(ref, id2, OverwriteOnConflict))
+	got, err = store.Get(ref)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id2))
+
+	err = store.AddTagWithResolver(ref, id1, func(existing, incoming digest.Digest) (digest.Digest, error) {
+		return "", errors.New("older image")
+	})
+	assert.Check(t, is.Error(err, "older image"))
+	err = store.AddTagWithResolver(ref, id1, func(existing, incoming digest.Digest) (digest.Digest, error) {
+		return "sha256:0000000000000000000000000000000000000000000000000000000000000000", nil
+	})
+	assert.Check(t, is.ErrorContains(err, "neither the existing image"))
+	assert.Check(t, is.ErrorContains(store.AddTagWithResolver(ref, id1, nil), "Conflict:"))
+
+	got, err = store.Get(ref)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id2))
+}
+
+func TestDanglingByRepository(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	live := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	gone := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:live":  live,
+		"username/repo:gone":  gone,
+		"username/repo:gone2": gone,
+		"busybox:latest":      gone,
+		"username/other:live": live,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+	}
+
+	dangling := store.DanglingByRepository(func(id digest.Digest) bool { return id == live })
+	refStrs := make(map[string][]string)
+	for name, refs := range dangling {
+		for _, ref := range refs {
+			refStrs[name] = append(refStrs[name], reference.FamiliarString(ref))
+		}
+	}
+	assert.Check(t, is.DeepEqual(refStrs, map[string][]string{
+		"busybox":       {"busybox:latest"},
+		"username/repo": {"username/repo:gone", "username/repo:gone2"},
+	}))
+
+	// Nothing was deleted.
+	assert.Check(t, is.Len(store.References(gone), 3))
+	assert.Check(t, is.Len(store.DanglingByRepository(func(digest.Digest) bool { return true }), 0))
+}
+
+func TestReferencesByTag(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	indexed, err := full(NewReferenceStore(jsonPath, WithTagIndex(true)))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"registry:5000/foo/bar:latest": id1,
+		"registry:5000/foo/bar:1.0":    id1,
+		"busybox:latest":               id2,
+		"busybox:nightly":              id2,
+		"busybox@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6": id2,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, indexed.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, indexed.AddTag(ref, id, false))
+		}
+	}
+	ref, err := reference.ParseNormalizedNamed("busybox:nightly")
+	assert.NilError(t, err)
+	_, err = indexed.Delete(ref)
+	assert.NilError(t, err)
+
+	check := func(store fullStore) {
+		latest := store.ReferencesByTag("latest")
+		assert.Assert(t, is.Len(latest, 2))
+		assert.Check(t, is.Equal(latest[0].Ref.String(), "docker.io/library/busybox:latest"))
+		assert.Check(t, is.Equal(latest[0].ID, id2))
+		assert.Check(t, is.Equal(latest[1].Ref.String(), "registry:5000/foo/bar:latest"))
+		assert.Check(t, is.Equal(latest[1].ID, id1))
+
+		assert.Check(t, is.Len(store.ReferencesByTag("1.0"), 1))
+		assert.Check(t, is.Len(store.ReferencesByTag("nightly"), 0))
+		assert.Check(t, is.Len(store.ReferencesByTag("sha256"), 0))
+	}
+	check(indexed)
+
+	// The index is rebuilt on load, and the store without an index gives
+	// the same results.
+	reloaded, err := full(NewReferenceStore(jsonPath, WithTagIndex(true)))
+	assert.NilError(t, err)
+	check(reloaded)
+	unindexed, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	check(unindexed)
+}
+
+func TestCaseInsensitiveTags(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := NewReferenceStore(jsonPath, WithCaseInsensitiveTags(true))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	upper, err := reference.ParseNormalizedNamed("myapp:LATEST")
+	assert.NilError(t, err)
+	lower, err := reference.ParseNormalizedNamed("myapp:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(upper, id, false))
+
+	got, err := store.Get(lower)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id))
+	refs := store.References(id)
+	assert.Assert(t, is.Len(refs, 1))
+	assert.Check(t, is.Equal(reference.FamiliarString(refs[0]), "myapp:LATEST"))
+
+	err = store.AddTag(lower, id, true)
+	assert.Check(t, is.ErrorContains(err, "tag myapp:latest only differs by case from the existing tag myapp:LATEST"))
+	assert.Check(t, errdefs.IsConflict(err))
+
+	// Tags are case-sensitive by default.
+	plain, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	_, err = plain.Get(lower)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+	assert.NilError(t, plain.AddTag(lower, id, false))
+
+	reloaded, err := full(NewReferenceStore(jsonPath, WithCaseInsensitiveTags(true)))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(reloaded.LoadWarnings(), []string{"tags myapp:LATEST, myapp:latest only differ by case"}))
+
+	deleted, err := store.Delete(lower)
+	assert.NilError(t, err)
+	assert.Check(t, deleted)
+	_, err = store.Get(upper)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+}
+
+func TestGetByString(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{
+		"busybox:latest",
+		"registry:5000/foo/bar@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793",
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+
+		got, err := store.GetByString(refStr)
+		assert.NilError(t, err, refStr)
+		assert.Check(t, is.Equal(got, id), refStr)
+	}
+
+	_, err = store.GetByString("busybox:missing")
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	for refStr, expected := range map[string]string{
+		"busybox":                          `reference "busybox" is not in the form used by the store, expected "busybox:latest"`,
+		"docker.io/library/busybox:latest": `expected "busybox:latest"`,
+		"busybox:latest@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793": `expected "busybox@sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793"`,
+		"Busybox:latest": `invalid reference "Busybox:latest"`,
+	} {
+		_, err := store.GetByString(refStr)
+		assert.Check(t, is.ErrorContains(err, expected), refStr)
+		assert.Check(t, errdefs.IsInvalidParameter(err), refStr)
+	}
+}
+
+func TestPruneEmptyRepositories(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	data := `{"Repositories":{"busybox":{"busybox:latest":"sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"},"empty":{},"null":null}}`
+	assert.NilError(t, ioutil.WriteFile(jsonPath, []byte(data), 0600))
+
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	pruned, err := store.PruneEmptyRepositories()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pruned, 2))
+
+	pruned, err = store.PruneEmptyRepositories()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pruned, 0))
+
+	saved, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(saved), `{"Repositories":{"busybox":{"busybox:latest":"sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"}}}`))
+}
+
+func TestDistinctImageCount(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(store.DistinctImageCount(), 0))
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:one": id1,
+		"username/repo:two": id1,
+		"busybox:latest":    id2,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+	}
+	assert.Check(t, is.Equal(store.DistinctImageCount(), 2))
+
+	ref, err := reference.ParseNormalizedNamed("busybox:latest")
+	assert.NilError(t, err)
+	_, err = store.Delete(ref)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(store.DistinctImageCount(), 1))
+}
+
+func TestCompression(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := NewReferenceStore(jsonPath, WithCompression(true))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/username/repo:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+
+	data, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(data[:2], gzipMagic))
+
+	// Compressed and plain files are both loaded, whatever the option.
+	for i, compressed := range []bool{false, true, false} {
+		reloaded, err := NewReferenceStore(jsonPath, WithCompression(compressed))
+		assert.NilError(t, err)
+		got, err := reloaded.Get(ref)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(got, id))
+
+		ref2, err := reference.ParseNormalizedNamed(fmt.Sprintf("username/repo:%d", i))
+		assert.NilError(t, err)
+		assert.NilError(t, reloaded.AddTag(ref2, id, true))
+		data, err := ioutil.ReadFile(jsonPath)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(bytes.HasPrefix(data, gzipMagic), compressed))
+	}
+}
+
+func TestGzip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+
+	for i, gzipped := range []bool{true, false} {
+		store, err := NewReferenceStore(jsonPath, WithGzip(gzipped))
+		assert.NilError(t, err)
+		ref, err := reference.ParseNormalizedNamed(fmt.Sprintf("username/repo:%d", i))
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+
+		data, err := ioutil.ReadFile(jsonPath)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(bytes.HasPrefix(data, gzipMagic), gzipped))
+	}
+}
+
+func TestAddTagIfUntagged(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	ref1, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	ref2, err := reference.ParseNormalizedNamed("username/repo:mine")
+	assert.NilError(t, err)
+
+	added, err := store.AddTagIfUntagged(ref1, id1)
+	assert.NilError(t, err)
+	assert.Check(t, added)
+
+	// The image is already tagged.
+	added, err = store.AddTagIfUntagged(ref2, id1)
+	assert.NilError(t, err)
+	assert.Check(t, !added)
+	_, err = store.Get(ref2)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	// The tag points to another image.
+	added, err = store.AddTagIfUntagged(ref1, id2)
+	assert.Check(t, is.ErrorContains(err, "Conflict:"))
+	assert.Check(t, !added)
+	got, err := store.Get(ref1)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id1))
+}
+
+func TestDebugResolve(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json"), WithCaseInsensitiveTags(true)))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("username/repo:Latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+
+	for input, expected := range map[string][2]string{
+		"ubuntu":                         {"ubuntu", "ubuntu:latest"},
+		"docker.io/library/ubuntu:18.04": {"ubuntu", "ubuntu:18.04"},
+		"username/repo":                  {"username/repo", "username/repo:Latest"},
+		"registry.example.com/repo:v1@" + id.String(): {"registry.example.com/repo", "registry.example.com/repo@" + id.String()},
+	} {
+		ref, err := reference.ParseNormalizedNamed(input)
+		assert.NilError(t, err)
+		name, key := store.DebugResolve(ref)
+		assert.Check(t, is.Equal(name, expected[0]), input)
+		assert.Check(t, is.Equal(key, expected[1]), input)
+	}
+}
+
+func TestBeforeDelete(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	var called []string
+	inUse := errors.New("image is in use")
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json"), WithBeforeDelete(func(ref reference.Named, id digest.Digest) error {
+		called = append(called, reference.FamiliarString(ref))
+		if id == id1 {
+			return inUse
+		}
+		return nil
+	})))
+	assert.NilError(t, err)
+
+	var refs []reference.Named
+	for i, s := range []string{"username/repo:one", "username/repo:two", "username/other:latest"} {
+		ref, err := reference.ParseNormalizedNamed(s)
+		assert.NilError(t, err)
+		id := id2
+		if i == 0 {
+			id = id1
+		}
+		assert.NilError(t, store.AddTag(ref, id, false))
+		refs = append(refs, ref)
+	}
+
+	_, err = store.Delete(refs[0])
+	assert.Check(t, is.Equal(err, inUse))
+	_, err = store.Get(refs[0])
+	assert.NilError(t, err)
+
+	_, err = store.DeleteRepository(refs[0])
+	assert.Check(t, is.Equal(err, inUse))
+	assert.Check(t, is.Len(store.References(id2), 2))
+
+	txn := store.Begin()
+	assert.NilError(t, txn.Delete(refs[2]))
+	assert.NilError(t, txn.Delete(refs[0]))
+	assert.Check(t, is.Equal(txn.Commit(), inUse))
+	assert.Check(t, is.Len(store.References(id2), 2))
+
+	deleted, err := store.Delete(refs[1])
+	assert.NilError(t, err)
+	assert.Check(t, deleted)
+	assert.Check(t, is.DeepEqual(called, []string{
+		"username/repo:one",
+		"username/repo:one",
+		"username/other:latest", "username/repo:one",
+		"username/repo:two",
+	}))
+}
+
+func TestAddTags(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	var associations []Association
+	for _, refStr := range []string{"username/repo:one", "username/repo:two", "username/other"} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		associations = append(associations, Association{Ref: ref, ID: id1})
+	}
+	assert.NilError(t, store.AddTags(associations, false))
+	assert.Check(t, is.Len(store.References(id1), 3))
+	_, err = store.Get(associations[2].Ref)
+	assert.NilError(t, err)
+
+	// A conflict fails the whole batch, without saving anything.
+	before, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	newRef, err := reference.ParseNormalizedNamed("username/repo:three")
+	assert.NilError(t, err)
+	batch := []Association{{Ref: newRef, ID: id2}, {Ref: associations[0].Ref, ID: id2}}
+	assert.Check(t, is.ErrorContains(store.AddTags(batch, false), "Conflict:"))
+	_, err = store.Get(newRef)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+	after, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(after), string(before)))
+
+	assert.NilError(t, store.AddTags(batch, true))
+	assert.Check(t, is.Len(store.References(id2), 2))
+	assert.Check(t, is.Len(store.References(id1), 2))
+
+	digested, err := reference.ParseNormalizedNamed("username/repo@" + id1.String())
+	assert.NilError(t, err)
+	assert.Check(t, is.ErrorContains(store.AddTags([]Association{{Ref: digested, ID: id1}}, false), "refusing to create a tag with a digest reference"))
+}
+
+func TestAllReferences(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.AllReferences(), 0))
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"registry:5000/foo/bar:latest": id1,
+		"busybox:latest":               id2,
+		"busybox@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6": id2,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	all := store.AllReferences()
+	assert.Assert(t, is.Len(all, 3))
+	assert.Check(t, is.Equal(all[0].Ref.String(), "docker.io/library/busybox:latest"))
+	assert.Check(t, is.Equal(all[0].ID, id2))
+	assert.Check(t, is.Equal(all[1].Ref.String(), "docker.io/library/busybox@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6"))
+	assert.Check(t, is.Equal(all[2].Ref.String(), "registry:5000/foo/bar:latest"))
+	assert.Check(t, is.Equal(all[2].ID, id1))
+
+	// The result is a copy.
+	all[0].ID = id1
+	assert.Check(t, is.Equal(store.AllReferences()[0].ID, id2))
+}
+
+func TestHas(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	tagged, err := reference.ParseNormalizedNamed("username/repo")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(tagged, id, false))
+	digested, err := reference.ParseNormalizedNamed("username/repo@" + id.String())
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddDigest(digested.(reference.Canonical), id, false))
+
+	for input, expected := range map[string]bool{
+		"username/repo":                      true,
+		"docker.io/username/repo:latest":     true,
+		"username/repo:other":                false,
+		"username/repo@" + id.String():       true,
+		"username/repo:other@" + id.String(): true,
+		"username/other@" + id.String():      false,
+		"registry.example.com/username/repo": false,
+	} {
+		ref, err := reference.ParseNormalizedNamed(input)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(store.Has(ref), expected), input)
+		_, err = store.Get(ref)
+		assert.Check(t, is.Equal(err == nil, expected), input)
+	}
+}
+
+func TestInMemoryStore(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+	assert.Check(t, is.Len(store.UnsavedReferences(), 0))
+
+	got, err := store.Get(ref)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id))
+	assert.Check(t, is.Len(store.References(id), 1))
+
+	deleted, err := store.Delete(ref)
+	assert.NilError(t, err)
+	assert.Check(t, deleted)
+	assert.Check(t, is.Len(store.References(id), 0))
+}
+
+func TestRename(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	parse := func(s string) reference.Named {
+		ref, err := reference.ParseNormalizedNamed(s)
+		assert.NilError(t, err)
+		return ref
+	}
+	assert.NilError(t, store.AddTag(parse("username/repo:old"), id1, false))
+	assert.NilError(t, store.AddTag(parse("username/other:taken"), id2, false))
+
+	assert.NilError(t, store.Rename(parse("username/repo:old"), parse("username/new"), false))
+	assert.Check(t, !store.Has(parse("username/repo:old")))
+	got, err := store.Get(parse("username/new:latest"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id1))
+	assert.Check(t, is.Len(store.References(id1), 1))
+
+	reloaded, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	assert.Check(t, reloaded.Has(parse("username/new:latest")))
+	assert.Check(t, !reloaded.Has(parse("username/repo:old")))
+
+	err = store.Rename(parse("username/repo:old"), parse("username/repo:other"), false)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	// A conflict leaves both references in place, unless forced.
+	err = store.Rename(parse("username/new"), parse("username/other:taken"), false)
+	assert.Check(t, is.ErrorContains(err, "Conflict:"))
+	assert.Check(t, store.Has(parse("username/new")))
+	got, err = store.Get(parse("username/other:taken"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id2))
+
+	assert.NilError(t, store.Rename(parse("username/new"), parse("username/other:taken"), true))
+	assert.Check(t, !store.Has(parse("username/new")))
+	got, err = store.Get(parse("username/other:taken"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id1))
+	assert.Check(t, is.Len(store.References(id2), 0))
+}
+
+func TestDeleteAllForID(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:one":             id1,
+		"username/repo:two":             id2,
+		"username/other:one":            id1,
+		"username/repo@" + id1.String(): id1,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	deleted, err := store.DeleteAllForID(id1)
+	assert.NilError(t, err)
+	var refStrs []string
+	for _, ref := range deleted {
+		refStrs = append(refStrs, reference.FamiliarString(ref))
+	}
+	assert.Check(t, is.DeepEqual(refStrs, []string{
+		"username/other:one",
+		"username/repo:one",
+		"username/repo@" + id1.String(),
+	}))
+	assert.Check(t, is.Len(store.References(id1), 0))
+	assert.Check(t, is.Len(store.References(id2), 1))
+	assert.Check(t, is.Len(store.AllReferences(), 1))
+
+	reloaded, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(reloaded.References(id1), 0))
+	assert.Check(t, is.Len(reloaded.References(id2), 1))
+
+	deleted, err = store.DeleteAllForID(id1)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(deleted, 0))
+}
+
+func TestRecoverOnCorruption(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	corrupt := []byte(`{"Repositories":{"username/repo":{"username/repo:latest":"sha256:4700`)
+	assert.NilError(t, ioutil.WriteFile(jsonPath, corrupt, 0600))
+
+	_, err = NewReferenceStore(jsonPath)
+	assert.Check(t, is.ErrorContains(err, "unexpected EOF"))
+
+	store, err := full(NewReferenceStore(jsonPath, WithRecoverOnCorruption(true)))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.AllReferences(), 0))
+	warnings := store.LoadWarnings()
+	assert.Assert(t, is.Len(warnings, 1))
+	assert.Check(t, is.Contains(warnings[0], "is corrupt"))
+
+	moved, err := ioutil.ReadFile(jsonPath + ".corrupt")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(moved), string(corrupt)))
+
+	// The empty store was saved.
+	_, err = NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+}
+
+func TestFilterByName(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{
+		"username/repo:one",
+		"username/repo:two",
+		"username/repo@" + id.String(),
+		"username/other:one",
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	repo, err := reference.ParseNormalizedNamed("username/repo")
+	assert.NilError(t, err)
+	familiar := func(associations []Association) []string {
+		var refStrs []string
+		for _, a := range associations {
+			refStrs = append(refStrs, reference.FamiliarString(a.Ref))
+		}
+		return refStrs
+	}
+	assert.Check(t, is.DeepEqual(familiar(store.FilterByName(repo, All)), []string{
+		"username/repo:one", "username/repo:two", "username/repo@" + id.String(),
+	}))
+	assert.Check(t, is.DeepEqual(familiar(store.FilterByName(repo, Tags)), []string{
+		"username/repo:one", "username/repo:two",
+	}))
+	assert.Check(t, is.DeepEqual(familiar(store.FilterByName(repo, Digests)), []string{
+		"username/repo@" + id.String(),
+	}))
+
+	other, err := reference.ParseNormalizedNamed("username/other")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.FilterByName(other, Digests), 0))
+}
+
+func TestFileMode(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	_, err = NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	fi, err := os.Stat(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(fi.Mode().Perm(), os.FileMode(0600)))
+
+	groupPath := filepath.Join(tmpDir, "group.json")
+	store, err := NewReferenceStore(groupPath, WithFileMode(0640))
+	assert.NilError(t, err)
+	fi, err = os.Stat(groupPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(fi.Mode().Perm(), os.FileMode(0640)))
+
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, "sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6", false))
+	fi, err = os.Stat(groupPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(fi.Mode().Perm(), os.FileMode(0640)))
+}
+
+func TestPrune(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:one":  id1,
+		"username/repo:two":  id2,
+		"username/other:one": id1,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+	}
+
+	calls := make(map[digest.Digest]int)
+	pruned, err := store.Prune(func(id digest.Digest) bool {
+		calls[id]++
+		return id == id2
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(calls, map[digest.Digest]int{id1: 1, id2: 1}))
+	assert.Assert(t, is.Len(pruned, 2))
+	assert.Check(t, is.Equal(reference.FamiliarString(pruned[0].Ref), "username/other:one"))
+	assert.Check(t, is.Equal(pruned[0].ID, id1))
+	assert.Check(t, is.Equal(reference.FamiliarString(pruned[1].Ref), "username/repo:one"))
+
+	reloaded, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(reloaded.References(id1), 0))
+	assert.Check(t, is.Len(reloaded.References(id2), 1))
+
+	pruned, err = store.Prune(func(digest.Digest) bool { return true })
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pruned, 0))
+}
+
+func TestAddReferenceDigestAlgorithmName(t *testing.T) {
+	store := NewInMemoryReferenceStore()
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, algorithm := range []string{"sha256", "sha384", "sha512"} {
+		ref, err := reference.ParseNormalizedNamed(algorithm + ":sometag")
+		assert.NilError(t, err)
+		err = store.AddTag(ref, id, false)
+		assert.Check(t, is.ErrorContains(err, "using digest algorithm "+algorithm+" as name"))
+		assert.Check(t, errdefs.IsInvalidParameter(err))
+	}
+
+	ref, err := reference.ParseNormalizedNamed("sha1:sometag")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id, false))
+}
+
+func TestUnknownFieldsPreserved(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	content := `{"Repositories":{"username/repo":{"username/repo:latest":"sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"}},"Labels":{"username/repo:latest":{"owner":"me"}},"FormatVersion":2}`
+	assert.NilError(t, ioutil.WriteFile(jsonPath, []byte(content), 0600))
+
+	store, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	ref, err := reference.ParseNormalizedNamed("username/repo:other")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, "sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793", false))
+
+	saved, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	var fields map[string]json.RawMessage
+	assert.NilError(t, json.Unmarshal(saved, &fields))
+	assert.Check(t, is.Equal(string(fields["Labels"]), `{"username/repo:latest":{"owner":"me"}}`))
+	assert.Check(t, is.Equal(string(fields["FormatVersion"]), `2`))
+
+	reloaded, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(reloaded.AllReferences(), 2))
+}
+
+func TestResolve(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	manifest := "sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6"
+	for refStr, id := range map[string]digest.Digest{
+		"username/repo:latest":           id1,
+		"username/repo:old":              id2,
+		"username/repo@" + manifest:      id1,
+		"username/other@" + id2.String(): id2,
+	} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id, false))
+		}
+	}
+
+	latest, err := reference.ParseNormalizedNamed("username/repo")
+	assert.NilError(t, err)
+	id, canonical, err := store.Resolve(latest)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(id, id1))
+	assert.Assert(t, canonical != nil)
+	assert.Check(t, is.Equal(reference.FamiliarString(canonical), "username/repo@"+manifest))
+
+	// The digest reference to id2 is in another repository.
+	old, err := reference.ParseNormalizedNamed("username/repo:old")
+	assert.NilError(t, err)
+	id, canonical, err = store.Resolve(old)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(id, id2))
+	assert.Check(t, canonical == nil)
+
+	missing, err := reference.ParseNormalizedNamed("username/repo:missing")
+	assert.NilError(t, err)
+	_, _, err = store.Resolve(missing)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+}
+
+func TestAddReferenceSameID(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	tagged, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+	digested, err := reference.ParseNormalizedNamed("username/repo@" + id.String())
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(tagged, id, false))
+	assert.NilError(t, store.AddDigest(digested.(reference.Canonical), id, false))
+
+	// Adding the same references again, without force, is a no-op rather
+	// than a conflict, and does not save the store.
+	events := store.Subscribe()
+	assert.NilError(t, store.AddTag(tagged, id, false))
+	assert.NilError(t, store.AddDigest(digested.(reference.Canonical), id, false))
+	assert.Check(t, is.Equal(store.Metrics().Adds, uint64(2)))
+	assert.Check(t, is.Len(events, 0))
+}
+
+func TestWalk(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	for _, refStr := range []string{"username/repo:one", "username/repo:two", "username/other:one"} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		assert.NilError(t, store.AddTag(ref, id, false))
+	}
+
+	var visited []string
+	assert.NilError(t, store.Walk(func(a Association) error {
+		assert.Check(t, is.Equal(a.ID, id))
+		visited = append(visited, reference.FamiliarString(a.Ref))
+		return nil
+	}))
+	sort.Strings(visited)
+	assert.Check(t, is.DeepEqual(visited, []string{"username/other:one", "username/repo:one", "username/repo:two"}))
+
+	var calls int
+	assert.NilError(t, store.Walk(func(Association) error {
+		calls++
+		return ErrStopWalk
+	}))
+	assert.Check(t, is.Equal(calls, 1))
+
+	failed := errors.New("failed")
+	assert.Check(t, is.Equal(store.Walk(func(Association) error { return failed }), failed))
+}
+
+func TestStrictLoad(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	id := "sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6"
+	content := `{"Repositories":{` +
+		`"username/repo":{"username/repo:latest":"` + id + `","docker.io/username/repo:full":"` + id + `","Invalid:tag":"` + id + `"},` +
+		`"username/other":{"username/misplaced:latest":"` + id + `"}}}`
+	assert.NilError(t, ioutil.WriteFile(jsonPath, []byte(content), 0600))
+
+	store, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.References(digest.Digest(id)), 3))
+
+	_, err = NewReferenceStore(jsonPath, WithStrictLoad(true))
+	assert.Check(t, is.ErrorContains(err, "Invalid:tag: invalid reference format"))
+	assert.Check(t, is.ErrorContains(err, "docker.io/username/repo:full: normalizes to username/repo:full"))
+	assert.Check(t, is.ErrorContains(err, "username/misplaced:latest: stored in repository username/other instead of username/misplaced"))
+	assert.Check(t, !strings.Contains(err.Error(), "username/repo:latest"))
+}
+
+// blockingBackend is a backend whose Persist blocks until release is closed.
+// It sends on persisting each time Persist is called.
+type blockingBackend struct {
+	testBackend
+	persisting chan struct{}
+	release    chan struct{}
+}
+
+func (b *blockingBackend) Persist(changes []Change) error {
+	b.persisting <- struct{}{}
+	<-b.release
+	return b.testBackend.Persist(changes)
+}
+
+func TestSaveDoesNotBlockOtherRepositories(t *testing.T) {
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	backend := &blockingBackend{
+		testBackend: testBackend{repositories: map[string]map[string]digest.Digest{
+			"repob": {"repob:latest": id1},
+		}},
+		persisting: make(chan struct{}, 2),
+		release:    make(chan struct{}),
+	}
+	s, err := NewReferenceStoreWithBackend(backend)
+	assert.NilError(t, err)
+
+	repoA, err := reference.ParseNormalizedNamed("repoa:latest")
+	assert.NilError(t, err)
+	repoB, err := reference.ParseNormalizedNamed("repob:latest")
+	assert.NilError(t, err)
+	repoC, err := reference.ParseNormalizedNamed("repoc:latest")
+	assert.NilError(t, err)
+
+	errA := make(chan error, 1)
+	go func() {
+		errA <- s.AddTag(repoA, id2, false)
+	}()
+	<-backend.persisting
+
+	// While repoA is being saved, repoB can still be read.
+	got := make(chan digest.Digest, 1)
+	go func() {
+		id, _ := s.Get(repoB)
+		got <- id
+	}()
+	select {
+	case id := <-got:
+		assert.Check(t, is.Equal(id, id1))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get on repoB was blocked by the save of repoA")
+	}
+
+	// repoC can be changed as well, and is saved once repoA is.
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.AddTag(repoC, id2, false)
+	}()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if id, err := s.Get(repoC); err == nil && id == id2 {
+			return poll.Success()
+		}
+		return poll.Continue("repoC was not changed")
+	}, poll.WithDelay(time.Millisecond), poll.WithTimeout(5*time.Second))
+
+	close(backend.release)
+	assert.NilError(t, <-errA)
+	assert.NilError(t, <-errC)
+	assert.Check(t, is.DeepEqual(backend.repositories["repoa"], map[string]digest.Digest{"repoa:latest": id2}))
+	assert.Check(t, is.DeepEqual(backend.repositories["repoc"], map[string]digest.Digest{"repoc:latest": id2}))
+}
+
+func TestIsReferenced(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	ref, err := reference.ParseNormalizedNamed("busybox:latest")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref, id1, false))
+	assert.Check(t, store.IsReferenced(id1))
+	assert.Check(t, !store.IsReferenced(id2))
+
+	_, err = store.Delete(ref)
+	assert.NilError(t, err)
+	assert.Check(t, !store.IsReferenced(id1))
+}
+
+func TestReferencesGrouped(t *testing.T) {
+	store := NewInMemoryReferenceStore().(fullStore)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	for _, refStr := range []string{"busybox:latest", "busybox:1.0", "example.com/foo:bar", "username/repo@" + id1.String()} {
+		ref, err := reference.ParseNormalizedNamed(refStr)
+		assert.NilError(t, err)
+		if canonical, ok := ref.(reference.Canonical); ok {
+			assert.NilError(t, store.AddDigest(canonical, id1, false))
+		} else {
+			assert.NilError(t, store.AddTag(ref, id1, false))
+		}
+	}
+
+	grouped := store.ReferencesGrouped(id1)
+	got := make(map[string][]string)
+	for name, refs := range grouped {
+		for _, ref := range refs {
+			got[name] = append(got[name], reference.FamiliarString(ref))
+		}
+	}
+	assert.Check(t, is.DeepEqual(got, map[string][]string{
+		"busybox":         {"busybox:1.0", "busybox:latest"},
+		"example.com/foo": {"example.com/foo:bar"},
+		"username/repo":   {"username/repo@" + id1.String()},
+	}))
+
+	assert.Check(t, is.Len(store.ReferencesGrouped(id2), 0))
+}
+
+func TestAddValidator(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	errLatest := errors.New("tagging latest is forbidden")
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json"), WithAddValidator(func(ref reference.Named, id digest.Digest) error {
+		if tagged, ok := ref.(reference.Tagged); ok && tagged.Tag() == "latest" {
+			return errLatest
+		}
+		return nil
+	})))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	latest, err := reference.ParseNormalizedNamed("username/repo")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(store.AddTag(latest, id, false), errLatest))
+	assert.Check(t, !store.Has(latest))
+
+	// Transactions are validated too, and fail as a whole.
+	v1, err := reference.ParseNormalizedNamed("username/repo:v1")
+	assert.NilError(t, err)
+	txn := store.Begin()
+	assert.NilError(t, txn.AddTag(v1, id, false))
+	assert.NilError(t, txn.AddTag(latest, id, false))
+	assert.Check(t, is.Equal(txn.Commit(), errLatest))
+	assert.Check(t, !store.Has(v1))
+
+	assert.NilError(t, store.AddTag(v1, id, false))
+	assert.Check(t, is.Equal(store.Rename(v1, latest, false), errLatest))
+	assert.Check(t, store.Has(v1))
+}
@@ -0,0 +1,216 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"sync/atomic"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+var errTxnDone = errors.New("transaction has already been committed or rolled back")
+
+// Txn buffers a set of mutations to a reference store so that they can be
+// applied atomically. A Txn is not safe for concurrent use.
+type Txn struct {
+	store *store
+	ops   []txnOp
+	done  bool
+}
+
+type txnOp struct {
+	ref     reference.Named
+	refName string
+	refStr  string
+	id      digest.Digest
+	resolve ConflictResolver
+	delete  bool
+}
+
+// txnUndo records the state of a reference before a transaction modified it.
+type txnUndo struct {
+	refName string
+	refStr  string
+	ref     reference.Named
+	id      digest.Digest
+	existed bool
+	unsaved bool
+}
+
+// Begin starts a new transaction on the store. Nothing is applied until the
+// transaction is committed.
+func (store *store) Begin() *Txn {
+	return &Txn{store: store}
+}
+
+// AddTag buffers the addition of a tag reference. If force is set to true,
+// an existing tag can be overwritten. This only works for tags, not digests.
+func (txn *Txn) AddTag(ref reference.Named, id digest.Digest, force bool) error {
+	if txn.done {
+		return errors.WithStack(errTxnDone)
+	}
+	if _, isCanonical := ref.(reference.Canonical); isCanonical {
+		return errors.WithStack(invalidTagError("refusing to create a tag with a digest reference"))
+	}
+	ref, refName, refStr, err := prepareAddReference(reference.TagNameOnly(ref))
+	if err != nil {
+		return err
+	}
+	txn.ops = append(txn.ops, txnOp{ref: ref, refName: refName, refStr: refStr, id: id, resolve: forceResolver(force)})
+	return nil
+}
+
+// AddDigest buffers the addition of a digest reference. Digest references
+// cannot be overwritten, whether or not force is set.
+func (txn *Txn) AddDigest(ref reference.Canonical, id digest.Digest, force bool) error {
+	if txn.done {
+		return errors.WithStack(errTxnDone)
+	}
+	named, refName, refStr, err := prepareAddReference(ref)
+	if err != nil {
+		return err
+	}
+	txn.ops = append(txn.ops, txnOp{ref: named, refName: refName, refStr: refStr, id: id, resolve: forceResolver(force)})
+	return nil
+}
+
+// Delete buffers the deletion of a reference. Committing the transaction
+// fails with ErrDoesNotExist if the reference is not present at that time.
+func (txn *Txn) Delete(ref reference.Named) error {
+	if txn.done {
+		return errors.WithStack(errTxnDone)
+	}
+	refName, refStr, err := prepareDeleteReference(ref)
+	if err != nil {
+		return err
+	}
+	txn.ops = append(txn.ops, txnOp{refName: refName, refStr: refStr, delete: true})
+	return nil
+}
+
+// Commit applies all buffered operations under a single write lock, and
+// saves the store once. Either all operations are applied, or none are.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return errors.WithStack(errTxnDone)
+	}
+	txn.done = true
+	if txn.store.readOnly {
+		return ErrReadOnly
+	}
+
+	store := txn.store
+	store.lock()
+	defer store.unlock()
+
+	var (
+		undo          []txnUndo
+		mark          = store.markPending()
+		adds, deletes uint64
+	)
+	for _, op := range txn.ops {
+		if op.delete {
+			op.refStr = store.lookupRefStr(op.refName, op.refStr)
+		}
+		u := store.undoRecord(op.refName, op.refStr)
+
+		if op.delete {
+			if u.existed {
+				if err := store.checkBeforeDelete(op.refStr, u.id); err != nil {
+					store.undo(undo, mark)
+					return err
+				}
+			}
+			if _, exists := store.removeReference(op.refName, op.refStr); !exists {
+				store.undo(undo, mark)
+				return ErrDoesNotExist
+			}
+			deletes++
+		} else {
+			changed, err := store.addReferenceLocked(op.ref, op.refName, op.refStr, op.id, op.resolve)
+			if err != nil {
+				store.undo(undo, mark)
+				return err
+			}
+			if !changed {
+				continue
+			}
+			adds++
+		}
+		undo = append(undo, u)
+	}
+
+	if len(undo) == 0 {
+		return nil
+	}
+	if err := store.save(); err != nil {
+		store.undo(undo, mark)
+		return err
+	}
+	atomic.AddUint64(&store.counters.adds, adds)
+	atomic.AddUint64(&store.counters.deletes, deletes)
+	return nil
+}
+
+// Rollback discards all buffered operations.
+func (txn *Txn) Rollback() {
+	txn.ops = nil
+	txn.done = true
+}
+
+// undoRecord records the current state of the reference with the given
+// repository name and key. store.mu must be held.
+func (store *store) undoRecord(refName, refStr string) txnUndo {
+	id, existed := store.Repositories[refName][refStr]
+	u := txnUndo{
+		refName: refName,
+		refStr:  refStr,
+		ref:     store.referencesByIDCache[id][refStr],
+		id:      id,
+		existed: existed,
+	}
+	_, u.unsaved = store.unsaved[refStr]
+	return u
+}
+
+// pendingMark records how many events, backend changes and write-ahead log
+// records were buffered for the next save, so that those of changes which are
+// undone can be discarded.
+type pendingMark struct {
+	events, changes, wal int
+}
+
+// markPending returns the current pendingMark of the store. store.mu must be
+// held for writing.
+func (store *store) markPending() pendingMark {
+	m := pendingMark{events: len(store.pendingEvents), changes: len(store.changes)}
+	if store.wal != nil {
+		m.wal = len(store.wal.pending)
+	}
+	return m
+}
+
+// undo reverts the changes recorded in undo, most recent first, and discards
+// what they and their reversal buffered for the next save since mark, so that
+// subscribers, the backend and the write-ahead log never see them. store.mu
+// must be held for writing.
+func (store *store) undo(undo []txnUndo, mark pendingMark) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		if u.existed {
+			store.setReference(u.ref, u.refName, u.refStr, u.id)
+		} else {
+			store.removeReference(u.refName, u.refStr)
+		}
+		if u.unsaved {
+			store.unsaved[u.refStr] = u.ref
+		} else {
+			delete(store.unsaved, u.refStr)
+		}
+	}
+	store.pendingEvents = store.pendingEvents[:mark.events]
+	store.changes = store.changes[:mark.changes]
+	if store.wal != nil {
+		store.wal.pending = store.wal.pending[:mark.wal]
+	}
+}
@@ -0,0 +1,205 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestTxnCommit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	oldRef, err := reference.ParseNormalizedNamed("username/repo:old")
+	assert.NilError(t, err)
+	newRef, err := reference.ParseNormalizedNamed("username/repo:new")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(oldRef, id, false))
+
+	txn := store.Begin()
+	assert.NilError(t, txn.Delete(oldRef))
+	assert.NilError(t, txn.AddTag(newRef, id, false))
+
+	// Nothing is applied before commit
+	_, err = store.Get(newRef)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	assert.NilError(t, txn.Commit())
+
+	_, err = store.Get(oldRef)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+	got, err := store.Get(newRef)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id))
+
+	refs := store.References(id)
+	assert.Assert(t, is.Len(refs, 1))
+	assert.Check(t, is.Equal(refs[0].String(), newRef.String()))
+
+	// The committed state was persisted.
+	reloaded, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	got, err = reloaded.Get(newRef)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id))
+
+	assert.Check(t, is.ErrorContains(txn.Commit(), "already been committed"))
+}
+
+func TestTxnCommitIsAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := full(NewReferenceStore(jsonPath))
+	assert.NilError(t, err)
+
+	id1 := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	id2 := digest.Digest("sha256:ae300ebc4a4f00693702cfb0a5e0b7bc527b353828dc86ad09fb95c8a681b793")
+	ref1, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	ref2, err := reference.ParseNormalizedNamed("username/repo:two")
+	assert.NilError(t, err)
+	missing, err := reference.ParseNormalizedNamed("username/repo:missing")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref1, id1, false))
+
+	before, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+
+	// A failing delete rolls back the earlier operations.
+	txn := store.Begin()
+	assert.NilError(t, txn.AddTag(ref1, id2, true))
+	assert.NilError(t, txn.AddTag(ref2, id2, false))
+	assert.NilError(t, txn.Delete(missing))
+	assert.Check(t, is.Equal(txn.Commit(), ErrDoesNotExist))
+
+	// A conflicting add rolls back the earlier operations.
+	txn = store.Begin()
+	assert.NilError(t, txn.AddTag(ref2, id2, false))
+	assert.NilError(t, txn.AddTag(ref1, id2, false))
+	assert.Check(t, is.ErrorContains(txn.Commit(), "Conflict:"))
+
+	got, err := store.Get(ref1)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got, id1))
+	_, err = store.Get(ref2)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+	assert.Check(t, is.Len(store.References(id2), 0))
+	assert.Check(t, is.Len(store.References(id1), 1))
+
+	after, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(before), string(after)))
+}
+
+func TestTxnRollback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	store, err := full(NewReferenceStore(filepath.Join(tmpDir, "repositories.json")))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref, err := reference.ParseNormalizedNamed("username/repo:latest")
+	assert.NilError(t, err)
+
+	txn := store.Begin()
+	assert.NilError(t, txn.AddTag(ref, id, false))
+	txn.Rollback()
+
+	assert.Check(t, is.ErrorContains(txn.Commit(), "already been committed or rolled back"))
+	_, err = store.Get(ref)
+	assert.Check(t, is.Equal(err, ErrDoesNotExist))
+
+	// Invalid references are rejected when buffered.
+	digested, err := reference.ParseNormalizedNamed("registry@sha256:367eb40fd0330a7e464777121e39d2f5b3e8e23a1e159342e53ab05c9e4d94e6")
+	assert.NilError(t, err)
+	assert.Check(t, is.ErrorContains(store.Begin().AddTag(digested, id, false), "refusing to create a tag with a digest reference"))
+}
+
+func TestUndoDiscardsPending(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	s, err := full(NewReferenceStore(jsonPath, WithWriteAheadLog(true)))
+	assert.NilError(t, err)
+	store := s.(*store)
+	events := store.Subscribe()
+	defer store.Unsubscribe(events)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	oldRef, err := reference.ParseNormalizedNamed("username/repo:old")
+	assert.NilError(t, err)
+	newRef, err := reference.ParseNormalizedNamed("username/repo:new")
+	assert.NilError(t, err)
+	otherRef, err := reference.ParseNormalizedNamed("username/repo:other")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(oldRef, id, false))
+	<-events
+
+	// Replacing the file of the store with a directory makes writeFile fail.
+	assert.NilError(t, os.Remove(jsonPath))
+	assert.NilError(t, os.MkdirAll(filepath.Join(jsonPath, "dir"), 0755))
+	assert.Check(t, store.Rename(oldRef, newRef, false) != nil)
+	txn := store.Begin()
+	assert.NilError(t, txn.AddTag(otherRef, id, false))
+	assert.NilError(t, txn.Delete(oldRef))
+	assert.Check(t, txn.Commit() != nil)
+	assert.Check(t, is.Len(store.pendingEvents, 0))
+	assert.Check(t, is.Len(store.wal.pending, 0))
+
+	// The next successful save only reports its own change.
+	assert.NilError(t, os.RemoveAll(jsonPath))
+	assert.NilError(t, store.AddTag(otherRef, id, false))
+	ev := <-events
+	assert.Check(t, is.Equal(ev.Action, ReferenceAdded))
+	assert.Check(t, is.Equal(ev.Ref.String(), otherRef.String()))
+	assert.Check(t, is.Len(events, 0))
+
+	s, err = full(NewReferenceStore(jsonPath, WithWriteAheadLog(true)))
+	assert.NilError(t, err)
+	assert.Check(t, s.Has(oldRef))
+	assert.Check(t, s.Has(otherRef))
+	assert.Check(t, !s.Has(newRef))
+}
+
+func TestUndoDiscardsBackendChanges(t *testing.T) {
+	backend := &testBackend{repositories: map[string]map[string]digest.Digest{}}
+	s, err := full(NewReferenceStoreWithBackend(backend))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	oldRef, err := reference.ParseNormalizedNamed("username/repo:old")
+	assert.NilError(t, err)
+	newRef, err := reference.ParseNormalizedNamed("username/repo:new")
+	assert.NilError(t, err)
+	assert.NilError(t, s.AddTag(oldRef, id, false))
+
+	backend.err = errors.New("persist failed")
+	assert.Check(t, s.Rename(oldRef, newRef, false) != nil)
+	backend.err = nil
+
+	otherRef, err := reference.ParseNormalizedNamed("username/repo:other")
+	assert.NilError(t, err)
+	assert.NilError(t, s.AddTag(otherRef, id, false))
+	assert.Assert(t, is.Len(backend.persisted, 2))
+	assert.Check(t, is.DeepEqual(backend.persisted[1], []Change{{Name: "username/repo", Ref: "username/repo:other", ID: id}}))
+}
@@ -0,0 +1,185 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// walCompactRecords is the number of records after which the write-ahead log
+// is compacted into the file of the store.
+const walCompactRecords = 1000
+
+// WithWriteAheadLog makes the store append each change to a write-ahead log,
+// <file>.wal, before the file of the store is rewritten. Changes which are in
+// the log but did not make it to the file, because the daemon crashed while
+// saving the store, are replayed when the store is loaded.
+func WithWriteAheadLog(enabled bool) StoreOption {
+	return func(store *store) {
+		if enabled {
+			store.wal = &writeAheadLog{path: store.jsonPath + ".wal"}
+		} else {
+			store.wal = nil
+		}
+	}
+}
+
+// walRecord is a change to a single reference, as stored in the write-ahead
+// log.
+type walRecord struct {
+	Seq    uint64        `json:"seq"`
+	Name   string        `json:"name"`
+	Ref    string        `json:"ref"`
+	ID     digest.Digest `json:"id,omitempty"`
+	Delete bool          `json:"delete,omitempty"`
+}
+
+// writeAheadLog holds the changes which are not in the log yet, and the
+// state of the log file. It is protected by the mutex of the store.
+type writeAheadLog struct {
+	path string
+	// seq is the sequence number of the last record in the log.
+	seq uint64
+	// records is the number of records in the log file.
+	records int
+	pending []walRecord
+}
+
+// record buffers a change to be appended to the log by the next save.
+func (wal *writeAheadLog) record(r walRecord) {
+	wal.pending = append(wal.pending, r)
+}
+
+// appendPending appends the buffered changes to the log file, and syncs it.
+// It returns the size of the file beforehand, for rollback.
+func (wal *writeAheadLog) appendPending() (int64, error) {
+	f, err := os.OpenFile(wal.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	seq := wal.seq
+	for _, r := range wal.pending {
+		seq++
+		r.Seq = seq
+		if err := enc.Encode(r); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		os.Truncate(wal.path, fi.Size())
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		os.Truncate(wal.path, fi.Size())
+		return 0, err
+	}
+	wal.seq = seq
+	wal.records += len(wal.pending)
+	return fi.Size(), nil
+}
+
+// rollback removes the records appended since the log file had the given
+// size, so that they are not replayed, and keeps them buffered.
+func (wal *writeAheadLog) rollback(size int64) {
+	if err := os.Truncate(wal.path, size); err != nil {
+		logrus.WithError(err).Warn("failed to roll back the reference store write-ahead log")
+	}
+	wal.seq -= uint64(len(wal.pending))
+	wal.records -= len(wal.pending)
+}
+
+// committed is called once the file of the store includes the appended
+// records. The log is truncated once it holds enough of them.
+func (wal *writeAheadLog) committed() {
+	wal.pending = nil
+	if wal.records < walCompactRecords {
+		return
+	}
+	if err := os.Truncate(wal.path, 0); err != nil {
+		logrus.WithError(err).Warn("failed to compact the reference store write-ahead log")
+		return
+	}
+	wal.records = 0
+}
+
+// replay applies the records of the log newer than the file of the store to
+// its repositories.
+func (wal *writeAheadLog) replay(store *store) error {
+	wal.seq, wal.records, wal.pending = store.Sequence, 0, nil
+
+	f, err := os.Open(wal.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var size int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var r walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// The daemon crashed while appending this record, so it was
+			// never saved to the file either. Drop it so that the next
+			// records are appended after a complete line.
+			logrus.WithError(err).Warn("ignoring truncated reference store write-ahead log record")
+			if err := os.Truncate(wal.path, size); err != nil {
+				return err
+			}
+			break
+		}
+		size += int64(len(scanner.Bytes())) + 1
+		wal.records++
+		if r.Seq <= store.Sequence {
+			continue
+		}
+		wal.seq = r.Seq
+		repository := store.Repositories[r.Name]
+		if r.Delete {
+			delete(repository, r.Ref)
+			if len(repository) == 0 {
+				delete(store.Repositories, r.Name)
+			}
+			continue
+		}
+		if repository == nil {
+			repository = make(map[string]digest.Digest)
+			store.Repositories[r.Name] = repository
+		}
+		repository[r.Ref] = r.ID
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if size > fi.Size() {
+		// The last record is complete, but not its line.
+		af, err := os.OpenFile(wal.path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer af.Close()
+		_, err = af.Write([]byte("\n"))
+		return err
+	}
+	return nil
+}
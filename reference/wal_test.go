@@ -0,0 +1,81 @@
+package reference // import "github.com/docker/docker/reference"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tag-store-test")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	jsonPath := filepath.Join(tmpDir, "repositories.json")
+	store, err := NewReferenceStore(jsonPath, WithWriteAheadLog(true))
+	assert.NilError(t, err)
+
+	id := digest.Digest("sha256:470022b8af682154f57a2163d030eb369549549cba00edc69e1b99b46bb924d6")
+	ref1, err := reference.ParseNormalizedNamed("username/repo:one")
+	assert.NilError(t, err)
+	ref2, err := reference.ParseNormalizedNamed("username/repo:two")
+	assert.NilError(t, err)
+	ref3, err := reference.ParseNormalizedNamed("username/repo:three")
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref1, id, false))
+	assert.NilError(t, store.AddTag(ref2, id, false))
+
+	// Simulate a crash after the log was written, but before the file of
+	// the store was replaced.
+	before, err := ioutil.ReadFile(jsonPath)
+	assert.NilError(t, err)
+	assert.NilError(t, store.AddTag(ref3, id, false))
+	_, err = store.Delete(ref1)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(jsonPath, before, 0600))
+
+	// The daemon also crashed while appending a record.
+	f, err := os.OpenFile(jsonPath+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NilError(t, err)
+	_, err = f.Write([]byte(`{"seq":5,"name":"user`))
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+
+	check := func(store Store, expected ...string) {
+		refs := store.References(id)
+		var got []string
+		for _, ref := range refs {
+			got = append(got, reference.FamiliarString(ref))
+		}
+		assert.Check(t, is.DeepEqual(got, expected))
+	}
+
+	store, err = full(NewReferenceStore(jsonPath, WithWriteAheadLog(true)))
+	assert.NilError(t, err)
+	check(store, "username/repo:three", "username/repo:two")
+
+	// Without the log, only the file of the store is loaded.
+	plain, err := NewReferenceStore(jsonPath)
+	assert.NilError(t, err)
+	check(plain, "username/repo:one", "username/repo:two")
+
+	// New records are appended after the last complete one.
+	_, err = store.Delete(ref2)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(jsonPath, before, 0600))
+	store, err = full(NewReferenceStore(jsonPath, WithWriteAheadLog(true)))
+	assert.NilError(t, err)
+	check(store, "username/repo:three")
+
+	// Once saved, records which are in the file are not replayed again.
+	assert.NilError(t, store.AddTag(ref1, id, false))
+	store, err = full(NewReferenceStore(jsonPath, WithWriteAheadLog(true)))
+	assert.NilError(t, err)
+	check(store, "username/repo:one", "username/repo:three")
+}
@@ -256,6 +256,9 @@ type APIEndpoint struct {
 	Official                       bool
 	TrimHostname                   bool
 	TLSConfig                      *tls.Config
+	// Proxy, if set, is used to select the proxy for requests to the
+	// endpoint instead of the proxy configured in the environment.
+	Proxy func(*http.Request) (*url.URL, error)
 }
 
 // ToV1Endpoint returns a V1 API endpoint based on the APIEndpoint